@@ -44,6 +44,24 @@ func AddCommands(rootCmd *cobra.Command) {
 	}
 	rootCmd.AddCommand(stopCmd)
 
+	useCmd := &cobra.Command{
+		Use:     `use <name>`,
+		Short:   `切换出口（只重启代理进程，规则、DNS缓存等保持不变）。`,
+		GroupID: `daily`,
+		Args:    cobra.ExactArgs(1),
+		Run:     cmdUse,
+	}
+	rootCmd.AddCommand(useCmd)
+
+	reloadCmd := &cobra.Command{
+		Use:     `reload`,
+		Short:   `重新加载配置文件和规则文件（不中断网络）。`,
+		GroupID: `daily`,
+		Args:    cobra.NoArgs,
+		Run:     cmdReload,
+	}
+	rootCmd.AddCommand(reloadCmd)
+
 	speedCmd := &cobra.Command{
 		Use:     `speed`,
 		Short:   `测试常用网站的打开速度(基于TLS拨号)。`,
@@ -83,6 +101,14 @@ func AddCommands(rootCmd *cobra.Command) {
 	}
 	rootCmd.AddCommand(updateCmd)
 
+	subscribeCmd := &cobra.Command{
+		Use:     `subscribe`,
+		Short:   `更新全部的订阅，节点可以用“订阅名/节点名”引用。`,
+		GroupID: `manage`,
+		Run:     cmdSubscribe,
+	}
+	rootCmd.AddCommand(subscribeCmd)
+
 	directCmd := &cobra.Command{
 		Use:                `direct <command> [args]...`,
 		Short:              `直接运行命令，不进行代理。`,
@@ -3,31 +3,212 @@ package configs
 import (
 	"log"
 	"os"
+	"time"
 
 	"github.com/goccy/go-yaml"
+	"github.com/movsb/gun/pkg/utils"
 )
 
 const DefaultConfigFileName = `gun.yaml`
 
 type Config struct {
+	// 防火墙后端：iptables 或 nftables。
+	// 可以为空。如果为空，根据系统自动选择。
+	Firewall string `yaml:"firewall"`
+
 	DNS     DNSConfig     `yaml:"dns"`
 	Outputs OutputsConfig `yaml:"outputs"`
+
+	// 按顺序匹配的路由规则，第一条匹配的规则决定使用哪个出口。
+	// 没有匹配的规则时使用当前出口。
+	Rules []RuleConfig `yaml:"rules"`
+
+	// 局域网客户端（按来源IP或MAC地址）的策略，先于黑白名单和路由规则。
+	Clients []ClientConfig `yaml:"clients"`
+
+	// GeoIP/GeoSite 数据库。
+	Geo GeoConfig `yaml:"geo"`
+
+	// `gun update` 下载规则文件的配置。
+	Update UpdateConfig `yaml:"update"`
+}
+
+type UpdateConfig struct {
+	// 经由哪个出口下载：为空表示直接下载；current 表示配置文件中的当前出口；或者库存中的出口名。
+	// 只支持内部实现的协议（与出口组成员相同），不需要守护进程在运行。
+	Via string `yaml:"via"`
+
+	// 规则文件的来源。map的key是：china_domains、banned_domains、china_routes。
+	// 没有配置的使用默认的来源。
+	Sources map[string]RuleSourceConfig `yaml:"sources"`
+
+	// 广告、跟踪器等屏蔽列表。map的key是列表名，保存为 blocked.<列表名>.ro.txt。
+	// 格式是 hosts、adblock 或者 plain，必须指定。
+	// 从配置中删除的列表在下次更新时被删除。
+	BlockLists map[string]RuleSourceConfig `yaml:"block_lists"`
+}
+
+// 规则文件的来源。
+type RuleSourceConfig struct {
+	// 按顺序尝试的镜像URL。可以是单个值，也可以是列表。
+	URLs YamlStringList `yaml:"urls"`
+	// 格式：dnsmasq、plain、gfwlist-base64、apnic、cidr。
+	// 为空时与默认的来源相同。
+	Format string `yaml:"format"`
+	// 可选的 SHA256 校验和：十六进制的值，或者校验和文件的URL。
+	SHA256 string `yaml:"sha256"`
+	// 可选的 minisign 公钥（.pub 文件的第二行），签名从 URL + .minisig 下载。
+	Minisign string `yaml:"minisign"`
+}
+
+// GeoIP/GeoSite 数据库，以及通过它们添加到黑白名单中的国家和类别。
+type GeoConfig struct {
+	// GeoIP 数据库：v2ray 的 geoip.dat，或者 MaxMind 的 .mmdb 文件。
+	// 相对路径相对于配置目录。为空表示没有。
+	GeoIP string `yaml:"geoip"`
+	// GeoSite 数据库：v2ray 的 geosite.dat。
+	// 相对路径相对于配置目录。为空表示没有。
+	GeoSite string `yaml:"geosite"`
+
+	// 直连：IP添加到白名单集，域名添加到中国域名列表。
+	// 形如：geoip:hk、geosite:apple-cn。
+	Direct YamlStringList `yaml:"direct"`
+	// 代理：IP添加到黑名单集，域名添加到被墙域名列表。
+	// 形如：geoip:us、geosite:google。
+	Proxy YamlStringList `yaml:"proxy"`
+}
+
+// 局域网客户端策略。
+type ClientConfig struct {
+	// 客户端：IP、IP段或者MAC地址。可以是单个值，也可以是列表。
+	Source YamlStringList `yaml:"source"`
+
+	// 策略：
+	//   - direct：不接管，全部直连；
+	//   - proxy：全部交给当前出口，不管是不是中国的IP；
+	//   - block：禁止访问本机以外的地址（本机的DNS等服务仍然可用）；
+	//   - 库存中的出口名：全部交给此出口（与规则中的出口相同）。
+	//     按MAC地址指定时只对IPv4有效。
+	Policy string `yaml:"policy"`
+}
+
+// 路由规则。
+//
+// 只作用于经过代理的TCP连接（不在白名单集、或者在黑名单集中的），
+// 在出口进程中，根据嗅探到的或者通过虚假IP找回的域名、目的IP、端口等匹配。
+//
+// 每个条件既可以写成单个值，也可以写成列表。
+// 同一条件的多个值之间是“或”的关系，不同条件之间是“与”的关系。
+type RuleConfig struct {
+	// 域名后缀。
+	Domain YamlStringList `yaml:"domain,omitempty"`
+	// 域名包含的关键字。
+	Keyword YamlStringList `yaml:"keyword,omitempty"`
+	// 匹配域名的正则表达式。
+	Regexp YamlStringList `yaml:"regexp,omitempty"`
+	// 目的IP或者IP段。
+	CIDR YamlStringList `yaml:"cidr,omitempty"`
+	// 目的IP所属的国家代码。
+	// 没有配置 GeoIP 数据库时只支持 CN（即中国路由段）。
+	GeoIP YamlStringList `yaml:"geoip,omitempty"`
+	// 域名属于 GeoSite 数据库中的类别，比如：google、geolocation-!cn@cn。
+	GeoSite YamlStringList `yaml:"geosite,omitempty"`
+	// 目的端口或者端口范围，比如：443、8000-9000。
+	Port YamlStringList `yaml:"port,omitempty"`
+	// 来源IP或者IP段（局域网内的主机）。
+	Source YamlStringList `yaml:"source,omitempty"`
+
+	// 使用的出口：
+	//   - direct：直接连接；
+	//   - reject：拒绝连接；
+	//   - current：当前出口；
+	//   - 库存中的出口名（只支持内部实现的协议，与出口组成员相同）。
+	Output string `yaml:"output"`
 }
 
 type DNSConfig struct {
 	Upstreams DNSUpstreamsConfig `yaml:"upstreams"`
+
+	// 是否保留IPv6（AAAA）查询结果。
+	// 默认为否：总是丢弃，局域网主机只会通过IPv4访问外部。
+	// 如果局域网是双栈网络，并且希望IPv6流量也被代理，则设置为是。
+	IPv6 bool `yaml:"ipv6"`
+
+	// DNS学习到的IP在黑白名单集中的最短保留时间。形如：30m、2h。
+	// 实际的过期时间由应答的TTL决定，但不会短于此值。
+	// 默认为：1h。
+	MinSetTTL time.Duration `yaml:"min_set_ttl"`
+
+	// 缓存的最大条目数。默认为：1024。
+	// 停止时缓存（包括每个域名被判断为中国还是外国）会被保存到配置目录，下次启动时恢复。
+	CacheSize int `yaml:"cache_size"`
+
+	// 虚假IP模式：国外域名应答此IPv4地址段内的虚假IP（比如 198.18.0.0/15，不能小于 /20），
+	// 出口通过虚假IP找回域名，按域名连接，而不是把真实IP添加到黑名单集。
+	// direct、block 策略的客户端仍然得到真实IP（不能按MAC地址指定）。
+	// 为空表示不开启（默认）。
+	FakeIP string `yaml:"fake_ip"`
+
+	// 被屏蔽的域名的应答方式：nxdomain（域名不存在）、zero（0.0.0.0 或者 ::）、refused（拒绝）。
+	// 默认为：nxdomain。
+	BlockMode string `yaml:"block_mode"`
+
+	// 附加在发往国内上游的查询中的 EDNS Client Subnet，让国内 CDN 返回就近的节点：
+	// client 表示客户端地址所在的 /24（IPv6 为 /56），或者一个公网子网（比如 1.2.3.0/24）。
+	// client 模式下局域网客户端使用 client,子网 中指定的子网，没有指定时使用本机的公网IPv4地址所在的 /24。
+	// 为空表示不附加（默认）。发往国外上游的查询总是会去掉 ECS。
+	ECS string `yaml:"ecs"`
+
+	// 本地域名记录，优先于屏蔽和分流，不经过上游。
+	Hosts DNSHostsConfig `yaml:"hosts"`
 }
 
+// 本地域名记录。
+type DNSHostsConfig struct {
+	// 域名 -> IP（可以是列表），或者另一个域名（别名，应答 CNAME 及其目标的记录）。
+	// 同名时覆盖文件中的记录。
+	Records map[string]YamlStringList `yaml:"records"`
+	// hosts 格式的文件，比如 /etc/hosts。
+	Files YamlStringList `yaml:"files"`
+	// DHCP 租约文件：dnsmasq（/tmp/dhcp.leases）或者 odhcpd 的租约文件。
+	// 文件有变化时自动重新读取。
+	Leases YamlStringList `yaml:"leases"`
+	// 租约中的主机名还会加上此域名后缀，比如 lan。
+	LeaseDomain string `yaml:"lease_domain"`
+}
+
+func (c DNSHostsConfig) Empty() bool {
+	return len(c.Records)+len(c.Files)+len(c.Leases) == 0
+}
+
+// 上游格式：
+//   - a.b.c.d 或 a.b.c.d:53：普通DNS，国内走UDP，国外走TCP；
+//   - udp://a.b.c.d:53、tcp://a.b.c.d:53：指定协议的普通DNS；
+//   - tls://dns.google：DNS-over-TLS；
+//   - https://dns.google/dns-query：DNS-over-HTTPS；
+//   - quic://dns.adguard-dns.com：DNS-over-QUIC。
+//
+// 主机是域名时，需要在 # 后面指定引导IP，多个以逗号分隔。
+// 比如：https://dns.google/dns-query#8.8.8.8,8.8.4.4。
+//
+// 每个类别可以是一个上游，也可以是上游列表。
 type DNSUpstreamsConfig struct {
 	// 中国域名解析上游。
-	// 格式：a.b.c.d 或 a.b.c.d:53
 	// 可以为空。如果为空：如果有进程监听53号端口，则使用此上游。
 	// 否则使用 223.5.5.5。
-	China string `yaml:"china"`
+	China YamlStringList `yaml:"china"`
 	// 国外域名解析上游。
-	// 格式：8.8.8.8 或 8.8.8.8:53
 	// 可以为空。如果为空，使用 8.8.8.8。
-	Banned string `yaml:"banned"`
+	Banned YamlStringList `yaml:"banned"`
+	// 同一类别有多个上游时的选择策略。
+	//   - fallback：按顺序使用第一个可用的上游，失败时尝试下一个（默认）；
+	//   - race：同时向所有可用的上游查询，使用最先成功的响应；
+	//   - round_robin：轮流使用可用的上游，失败时尝试下一个。
+	Strategy string `yaml:"strategy"`
+	// 单独设置中国/国外上游的选择策略，为空时使用 strategy。
+	// 比如国内上游用 race 以降低延迟，国外上游用 fallback 以减少经过代理的请求。
+	ChinaStrategy  string `yaml:"china_strategy"`
+	BannedStrategy string `yaml:"banned_strategy"`
 }
 
 type OutputsConfig struct {
@@ -36,12 +217,21 @@ type OutputsConfig struct {
 	Stocks YamlMapSlice[string, OutputConfig] `yaml:"stocks"`
 
 	// 订阅的配置(URL）。
+	// map的key表示此订阅的名字。
+	//
+	// 由 `gun subscribe` 更新，订阅中的节点以“订阅名/节点名”的名字合并到库存中。
 	Subscriptions YamlMapSlice[string, string] `yaml:"subscriptions"`
 
 	// 当前使用哪个配置名？
 	//
 	// 特殊名字：direct - 直接连接。
+	// 也可以是订阅中的节点：订阅名/节点名。
 	Current string `yaml:"current"`
+
+	// 是否嗅探 TLS ClientHello 的 SNI 或者 HTTP 请求的 Host，
+	// 把域名（而不是IP）交给出口，由代理服务器解析。
+	// 直连时仍然使用原来的IP。
+	Sniff bool `yaml:"sniff"`
 }
 
 // 单个的配置。
@@ -53,6 +243,10 @@ type OutputConfig struct {
 	Trojan     *TrojanOutputConfig     `yaml:"trojan,omitempty"`
 	NaiveProxy *NaiveProxyOutputConfig `yaml:"naive_proxy,omitempty"`
 	Hysteria   *HysteriaOutputConfig   `yaml:"hysteria,omitempty"`
+
+	Shadowsocks *ShadowsocksOutputConfig `yaml:"shadowsocks,omitempty"`
+
+	Group *GroupOutputConfig `yaml:"group,omitempty"`
 }
 
 type HTTP2SocksOutputConfig struct {
@@ -126,6 +320,37 @@ type HysteriaOutputConfig struct {
 	Bin string `yaml:"bin"`
 }
 
+// Shadowsocks
+type ShadowsocksOutputConfig struct {
+	// 服务器地址。
+	// 形如：example.com:8388
+	Server string `yaml:"server"`
+	// 加密方式。
+	// 形如：aes-128-gcm、chacha20-ietf-poly1305、2022-blake3-aes-128-gcm。
+	Method string `yaml:"method"`
+	// 密码。2022 系列加密方式为 base64 编码的密钥。
+	Password string `yaml:"password"`
+}
+
+// 出口组。
+//
+// 由多个库存出口组成，定期经由每个成员探测，新连接交给选中的成员。
+// 暂时只支持TCP，并且成员只能是内部实现的出口协议。
+type GroupOutputConfig struct {
+	// 成员：库存中的出口名（包括 direct 和“订阅名/节点名”）。
+	Members []string `yaml:"members"`
+	// 选择策略。
+	//   - fallback：按顺序选择第一个可用的成员（默认）；
+	//   - latency：选择延迟最低的可用成员。
+	Strategy string `yaml:"strategy"`
+	// 探测地址，经由成员与其建立TLS连接。
+	// 默认为：www.google.com:443。
+	Probe string `yaml:"probe"`
+	// 探测间隔。形如：30s、1m。
+	// 默认为：1m。
+	Interval time.Duration `yaml:"interval"`
+}
+
 type SubscriptionOutputConfig struct {
 	URL string `yaml:"url"`
 }
@@ -150,6 +375,23 @@ func LoadConfigFromFile(path string) *Config {
 	return &config
 }
 
+// 既可以写成单个字符串，也可以写成字符串列表。
+type YamlStringList []string
+
+func (l *YamlStringList) UnmarshalYAML(data []byte) error {
+	var list []string
+	if err := yaml.Unmarshal(data, &list); err == nil {
+		*l = list
+		return nil
+	}
+	var s string
+	if err := yaml.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	*l = utils.IIF(s == ``, nil, []string{s})
+	return nil
+}
+
 type YamlMapSlice[Key comparable, Value any] []YamlMapItem[Key, Value]
 
 type YamlMapItem[Key comparable, Value any] struct {
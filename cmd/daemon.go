@@ -8,12 +8,16 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/goccy/go-yaml"
+	"github.com/movsb/gun/dns"
+	"github.com/movsb/gun/outputs/group"
 	"github.com/movsb/gun/pkg/speed"
 	"github.com/movsb/gun/pkg/utils"
 	"github.com/spf13/cobra"
@@ -28,7 +32,26 @@ func cmdDaemon(cmd *cobra.Command, args []string) {
 	utils.Must(logger.CaptureStdoutStderr())
 	logger.Serve(mux)
 
-	mux.HandleFunc(`/v1/status`, serveStatus)
+	running := &running{}
+
+	mux.HandleFunc(`/v1/status`, func(w http.ResponseWriter, r *http.Request) {
+		serveStatus(w, r, running)
+	})
+	mux.HandleFunc(`POST /v1/outputs`, running.serveUse)
+	mux.HandleFunc(`POST /v1/reload`, running.serveReload)
+
+	// kill -HUP 与 `gun reload` 等价。
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if msg, err := running.reload(); err != nil {
+				log.Println(err)
+			} else {
+				log.Println(msg)
+			}
+		}
+	}()
 
 	var state atomic.Value
 	mux.HandleFunc(`/v1/ready`, func(w http.ResponseWriter, r *http.Request) {
@@ -40,7 +63,7 @@ func cmdDaemon(cmd *cobra.Command, args []string) {
 	configDir := utils.MustGetEnvString(`CONFIG_DIR`)
 
 	for {
-		start(context.Background(), configDir, &state)
+		start(context.Background(), configDir, &state, running)
 		time.Sleep(time.Second * 3)
 	}
 }
@@ -73,34 +96,76 @@ func cmdStatus(cmd *cobra.Command, args []string) {
 	utils.Must1(io.Copy(os.Stdout, rsp.Body))
 }
 
-func serveStatus(w http.ResponseWriter, r *http.Request) {
+func serveStatus(w http.ResponseWriter, r *http.Request, running *running) {
 	status := struct {
 		Processes struct {
 			Daemon bool `yaml:"daemon"`
 		} `yaml:"processes"`
+		// 当前使用的出口。
+		Output    string `yaml:"output,omitempty"`
 		Latencies struct {
 			Google string `yaml:"google"`
 			Baidu  string `yaml:"baidu"`
 		} `yaml:"latencies"`
+		Group *group.Status `yaml:"group,omitempty"`
+		// DNS上游的统计信息。
+		DNS *dns.Status `yaml:"dns,omitempty"`
 	}{}
 
 	// 此响应是由 daemon 提供的，肯定在运行。
 	status.Processes.Daemon = true
+	status.Output = running.name()
 
 	speedResults := speed.Test(r.Context())
 	status.Latencies.Google = speedResults.Google.String()
 	status.Latencies.Baidu = speedResults.Baidu.String()
 
+	status.Group = taskStatus[group.Status](r.Context(), outputsHTTPClient())
+	status.DNS = taskStatus[dns.Status](r.Context(), dnsHTTPClient())
+
 	yaml.NewEncoder(w).Encode(status)
 }
 
+// 从子进程获取状态。
+//
+// 子进程没有提供状态（比如当前出口不是出口组）时返回 nil。
+func taskStatus[T any](ctx context.Context, client *http.Client) *T {
+	req := utils.Must1(http.NewRequestWithContext(ctx, http.MethodGet, `http://gun/v1/status`, nil))
+	rsp, err := client.Do(req)
+	if err != nil {
+		return nil
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil
+	}
+	var status T
+	if err := yaml.NewDecoder(rsp.Body).Decode(&status); err != nil {
+		log.Println(`获取状态失败：`, err)
+		return nil
+	}
+	return &status
+}
+
 var httpClient = sync.OnceValue(func() *http.Client {
+	return unixHTTPClient(logSocketPath)
+})
+
+var outputsHTTPClient = sync.OnceValue(func() *http.Client {
+	return unixHTTPClient(outputsSocketPath)
+})
+
+var dnsHTTPClient = sync.OnceValue(func() *http.Client {
+	return unixHTTPClient(dnsSocketPath)
+})
+
+func unixHTTPClient(path string) *http.Client {
 	return &http.Client{
 		Transport: &http.Transport{
 			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
 				var dialer net.Dialer
-				return dialer.DialContext(ctx, `unix`, logSocketPath)
+				return dialer.DialContext(ctx, `unix`, path)
 			},
 		},
 	}
-})
+}
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// 切换到指定的出口，返回给用户看的提示信息。
+//
+// 新出口启动失败时会恢复原来的出口。
+func (s *running) use(name string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.isRunning() {
+		return ``, errors.New(`服务未运行。`)
+	}
+	if name != `direct` && findStock(&s.config.Outputs, name) == nil {
+		return ``, fmt.Errorf(`出口在库存中找不到：%s`, name)
+	}
+	if name == s.output.name {
+		return fmt.Sprintf(`已经在使用：%s。`, name), nil
+	}
+
+	old := s.output
+	if err := s.restartOutput(name); err != nil {
+		return ``, err
+	}
+	s.override = name
+	log.Println(`已切换出口：`, old.name, `->`, name)
+
+	msg := fmt.Sprintf(`已切换到：%s。`, name)
+	return msg + s.udpNote(), nil
+}
+
+// 出口的UDP支持情况与创建规则时不一致时的提示。
+//
+// 需要持有锁。
+func (s *running) udpNote() string {
+	switch {
+	case s.output.udp && !s.rulesUDP:
+		return "\n注意：规则是按不支持UDP创建的，QUIC仍会被丢弃，重启后才能代理UDP。"
+	case !s.output.udp && s.rulesUDP:
+		return "\n注意：新出口不支持UDP，UDP流量将无法被代理，重启后才会丢弃QUIC。"
+	}
+	return ``
+}
+
+// 停止当前的出口进程，并启动指定的出口。
+// 启动失败时会恢复原来的出口。
+//
+// 需要持有锁。
+func (s *running) restartOutput(name string) error {
+	old := s.output
+	old.stop()
+
+	output, err := s.tryStart(name)
+	if err != nil {
+		log.Println(`启动出口失败，恢复原来的出口：`, err)
+		if output, err2 := s.tryStart(old.name); err2 != nil {
+			log.Println(`恢复原来的出口失败：`, err2)
+		} else {
+			s.output = output
+		}
+		return fmt.Errorf(`启动出口失败：%s`, err)
+	}
+	s.output = output
+	return nil
+}
+
+func (s *running) tryStart(name string) (task *outputTask, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			task, err = nil, fmt.Errorf(`%v`, e)
+		}
+	}()
+	return startOutput(s.ctx, s.states, s.config, s.configDir, name), nil
+}
+
+func (s *running) serveUse(w http.ResponseWriter, r *http.Request) {
+	msg, err := s.use(r.FormValue(`name`))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(w, msg)
+}
+
+func cmdUse(cmd *cobra.Command, args []string) {
+	postAndPrint(`http://gun/v1/outputs`, url.Values{`name`: {args[0]}})
+}
+
+// 向 daemon 发送控制命令，并输出其响应。
+func postAndPrint(u string, values url.Values) {
+	rsp, err := httpClient().PostForm(u, values)
+	if err != nil {
+		if strings.Contains(err.Error(), `connection refused`) || strings.Contains(err.Error(), `no such file`) {
+			log.Fatalln(`未运行。`)
+		}
+		log.Fatalln(err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(rsp.Body)
+		log.Fatalln(strings.TrimSpace(string(body)))
+	}
+	io.Copy(os.Stdout, rsp.Body)
+}
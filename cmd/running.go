@@ -0,0 +1,241 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/movsb/gun/cmd/configs"
+	"github.com/movsb/gun/dns"
+	"github.com/movsb/gun/pkg/tables"
+	"github.com/movsb/gun/pkg/utils"
+	"github.com/movsb/gun/targets"
+	"github.com/spf13/cobra"
+)
+
+// 正在运行的各个部分，用于运行时修改（切换出口、重新加载）。
+//
+// 规则、IP集等系统状态只在启动时创建，运行时只做增量更新。
+type running struct {
+	lock sync.Mutex
+
+	// 通过 `gun use` 指定的出口，优先于配置文件中的 current。
+	// 在 daemon 退出前一直有效。
+	override string
+
+	ctx       context.Context
+	configDir string
+	states    *targets.State
+	config    *configs.Config
+
+	// 创建规则时出口是否支持UDP。
+	rulesUDP bool
+
+	dns    *task
+	output *outputTask
+}
+
+// 本次启动应该使用的出口名。
+func (s *running) current(config *configs.Config) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.currentLocked(config)
+}
+
+func (s *running) currentLocked(config *configs.Config) string {
+	if s.override != `` {
+		if s.override == `direct` || findStock(&config.Outputs, s.override) != nil {
+			return s.override
+		}
+		log.Println(`指定的出口已不在库存中，使用配置文件中的出口：`, s.override)
+		s.override = ``
+	}
+	return config.Outputs.Current
+}
+
+// 记录启动时创建的进程及其依赖。
+func (s *running) set(ctx context.Context, configDir string, states *targets.State, config *configs.Config, dns *task, output *outputTask) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ctx, s.configDir, s.states, s.config = ctx, configDir, states, config
+	s.rulesUDP = output.udp
+	s.dns, s.output = dns, output
+}
+
+// 需要持有锁。
+func (s *running) isRunning() bool {
+	return s.output != nil && s.ctx.Err() == nil
+}
+
+// 当前正在使用的出口名，未运行时为空。
+func (s *running) name() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.isRunning() {
+		return ``
+	}
+	return s.output.name
+}
+
+// 重新加载配置文件和规则文件，返回给用户看的提示信息。
+//
+//   - 规则文件：按差异更新黑白名单集，DNS进程原子地替换域名和路由列表；
+//   - 配置文件：DNS配置有变化时重启DNS进程，当前出口的配置有变化时重启出口进程。
+//
+// 防火墙规则本身保持不变，所以不会丢包。
+func (s *running) reload() (_ string, outErr error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.isRunning() {
+		return ``, errors.New(`服务未运行。`)
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			outErr = fmt.Errorf(`重新加载失败：%v`, e)
+		}
+	}()
+
+	var notes []string
+
+	config := loadConfig(s.configDir)
+	utils.Must(clientsOf(config).Check())
+	if targets.ResolveBackend(config.Firewall) != s.states.Backend {
+		notes = append(notes, `防火墙后端有变化，需要重启才能生效。`)
+	}
+
+	log.Println(`重新加载规则文件...`)
+	states := s.states.ReloadRules(s.configDir)
+	states.SetDNSUpstreams(config.DNS.Upstreams.China, config.DNS.Upstreams.Banned)
+	states.SetFakeIP(config.DNS.FakeIP)
+	setGeo(states, s.configDir, config)
+	setRuleTargets(states, s.configDir, config)
+
+	// 先更新名单集，再让DNS进程使用新的列表。
+	oldStates, oldConfig := s.states, s.config
+	updateSets(oldStates, states)
+	s.states, s.config = states, config
+
+	if clients := clientsOf(config); !reflect.DeepEqual(clientsOf(oldConfig), clients) {
+		log.Println(`客户端策略有变化，更新客户端名单集...`)
+		if states.Backend == tables.BackendNFTables {
+			tables.UpdateNFTClientSets(clients)
+		} else {
+			tables.UpdateClientSets(clients)
+		}
+		notes = append(notes, `已更新客户端策略。`)
+	}
+
+	if !reflect.DeepEqual(oldConfig.DNS, config.DNS) ||
+		!slices.Equal(oldStates.ChinaDNS, states.ChinaDNS) || !slices.Equal(oldStates.BannedDNS, states.BannedDNS) ||
+		!slices.Equal(realIPClients(oldConfig), realIPClients(config)) {
+		log.Println(`DNS配置有变化，重启域名进程...`)
+		s.dns.stop()
+		// 列表也可能有变化，不恢复保存的缓存。
+		os.Remove(filepath.Join(s.configDir, dns.CacheFileName))
+		s.dns = startDNS(s.ctx, states, config, s.configDir)
+		notes = append(notes, `已重启域名进程。`)
+	} else {
+		// 重新生成列表文件后通知DNS进程重新读取。
+		states.ChinaDomainsFile()
+		states.BannedDomainsFile()
+		states.BlockedDomainsFile()
+		states.ChinaRoutesFile()
+		if err := reloadDNS(s.ctx); err != nil {
+			return ``, fmt.Errorf(`通知域名进程重新加载失败：%w`, err)
+		}
+	}
+
+	name := s.currentLocked(config)
+	if name != s.output.name || outputChanged(oldConfig, s.output.name, config, name) {
+		log.Println(`出口配置有变化，重启代理进程...`)
+		if err := s.restartOutput(name); err != nil {
+			return ``, err
+		}
+		notes = append(notes, fmt.Sprintf(`已重启代理进程：%s。`, name)+s.udpNote())
+	}
+
+	log.Println(`重新加载完成。`)
+	return strings.Join(append([]string{`已重新加载。`}, notes...), "\n"), nil
+}
+
+// 按差异更新黑白名单集。
+func updateSets(old, new *targets.State) {
+	if new.Backend == tables.BackendNFTables {
+		tables.UpdateNFTSet(tables.WHITE_SET_NAME_4, old.White4(), new.White4())
+		tables.UpdateNFTSet(tables.WHITE_SET_NAME_6, old.White6(), new.White6())
+		tables.UpdateNFTSet(tables.BLACK_SET_NAME_4, old.Black4(), new.Black4())
+		tables.UpdateNFTSet(tables.BLACK_SET_NAME_6, old.Black6(), new.Black6())
+		return
+	}
+	tables.UpdateIPSet(tables.WHITE_SET_NAME_4, tables.IPv4, old.White4(), new.White4())
+	tables.UpdateIPSet(tables.WHITE_SET_NAME_6, tables.IPv6, old.White6(), new.White6())
+	tables.UpdateIPSet(tables.BLACK_SET_NAME_4, tables.IPv4, old.Black4(), new.Black4())
+	tables.UpdateIPSet(tables.BLACK_SET_NAME_6, tables.IPv6, old.Black6(), new.Black6())
+}
+
+// 出口进程用到的配置是否有变化。
+func outputChanged(oldConfig *configs.Config, oldName string, config *configs.Config, name string) bool {
+	return !reflect.DeepEqual(resolveOutput(oldConfig, oldName), resolveOutput(config, name)) ||
+		oldConfig.DNS.FakeIP != config.DNS.FakeIP ||
+		oldConfig.Outputs.Sniff != config.Outputs.Sniff ||
+		oldConfig.Geo.GeoIP != config.Geo.GeoIP ||
+		oldConfig.Geo.GeoSite != config.Geo.GeoSite ||
+		!reflect.DeepEqual(rulesOf(oldConfig), rulesOf(config)) ||
+		!reflect.DeepEqual(ruleOutputs(oldConfig), ruleOutputs(config))
+}
+
+// 出口及其依赖的全部配置（出口组的成员），用于判断是否有变化。
+func resolveOutput(config *configs.Config, name string) []*configs.OutputConfig {
+	if name == `direct` {
+		return nil
+	}
+	output := findStock(&config.Outputs, name)
+	resolved := []*configs.OutputConfig{output}
+	if output != nil && output.Group != nil {
+		for _, member := range output.Group.Members {
+			resolved = append(resolved, findStock(&config.Outputs, member))
+		}
+	}
+	return resolved
+}
+
+// 通知DNS进程重新读取列表文件。
+func reloadDNS(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, `http://gun/v1/reload`, nil)
+	if err != nil {
+		return err
+	}
+	rsp, err := dnsHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf(`域名进程返回错误：%s`, rsp.Status)
+	}
+	return nil
+}
+
+func (s *running) serveReload(w http.ResponseWriter, r *http.Request) {
+	msg, err := s.reload()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(w, msg)
+}
+
+func cmdReload(cmd *cobra.Command, args []string) {
+	postAndPrint(`http://gun/v1/reload`, nil)
+}
@@ -1,13 +1,21 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"maps"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"slices"
 	"time"
 
+	"github.com/movsb/gun/cmd/configs"
+	"github.com/movsb/gun/outputs/subscriptions"
 	"github.com/movsb/gun/pkg/rules"
 	"github.com/movsb/gun/pkg/utils"
 	"github.com/movsb/gun/targets"
@@ -56,16 +64,21 @@ func cmdUpdate(cmd *cobra.Command, args []string) {
 
 	configDir := getConfigDir(cmd)
 
-	defer rules.ClearTempFiles(configDir)
-
-	fmt.Println(`正在更新中国域名列表...`)
-	rules.UpdateChinaDomains(ctx, configDir)
+	// 第一次更新时可能还没有配置文件。
+	config := &configs.Config{}
+	if utils.FileExists(filepath.Join(configDir, configs.DefaultConfigFileName)) {
+		config = loadConfig(configDir)
+	}
+	sources := ruleSources(config)
+	client := updateHTTPClient(config)
 
-	fmt.Println(`正在更新被墙域名列表...`)
-	rules.UpdateGFWDomains(ctx, configDir)
+	defer rules.ClearTempFiles(configDir)
 
-	fmt.Println(`正在更新中国路由列表...`)
-	rules.UpdateChinaRoutes(ctx, configDir)
+	for _, s := range ruleSourceNames {
+		fmt.Printf("正在更新%s...\n", s.desc)
+		utils.Must(rules.Update(ctx, client, configDir, s.file, sources[s.file]))
+	}
+	updateBlockLists(ctx, client, configDir, config)
 
 	if f := filepath.Join(configDir, rules.BannedUserTxt); !utils.FileExists(f) {
 		fmt.Println(`写入被墙的额外列表...`)
@@ -82,3 +95,129 @@ func cmdUpdate(cmd *cobra.Command, args []string) {
 
 	fmt.Println(`全部更新成功（重启服务后生效）。`)
 }
+
+type ruleSourceName struct {
+	key, file, desc string
+}
+
+// 配置中的来源名 -> 规则文件名。
+var ruleSourceNames = []ruleSourceName{
+	{`china_domains`, rules.ChinaDomainsName, `中国域名列表`},
+	{`banned_domains`, rules.GfwDomainsName, `被墙域名列表`},
+	{`china_routes`, rules.ChinaRoutesName, `中国路由列表`},
+}
+
+// 规则文件名 -> 来源。没有配置的使用默认的来源。
+func ruleSources(config *configs.Config) map[string]rules.Source {
+	sources := maps.Clone(rules.DefaultSources)
+	for key, c := range config.Update.Sources {
+		i := slices.IndexFunc(ruleSourceNames, func(s ruleSourceName) bool { return s.key == key })
+		if i < 0 {
+			log.Panicf(`未知的规则文件来源：%s`, key)
+		}
+		file := ruleSourceNames[i].file
+		src := rules.Source{
+			URLs:     c.URLs,
+			Format:   c.Format,
+			SHA256:   c.SHA256,
+			Minisign: c.Minisign,
+		}
+		if src.Format == `` {
+			src.Format = sources[file].Format
+		}
+		if err := src.Check(); err != nil {
+			log.Panicf(`规则文件来源不正确：%s: %v`, key, err)
+		}
+		sources[file] = src
+	}
+	return sources
+}
+
+var blockListNameRegexp = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// 下载配置的屏蔽列表，并删除已经不在配置中的。
+func updateBlockLists(ctx context.Context, client *http.Client, configDir string, config *configs.Config) {
+	files := map[string]rules.Source{}
+	for name, c := range config.Update.BlockLists {
+		if !blockListNameRegexp.MatchString(name) {
+			log.Panicf(`屏蔽列表名只能包含小写字母、数字、下划线和减号：%s`, name)
+		}
+		src := rules.Source{
+			URLs:     c.URLs,
+			Format:   c.Format,
+			SHA256:   c.SHA256,
+			Minisign: c.Minisign,
+		}
+		if err := src.Check(); err != nil {
+			log.Panicf(`屏蔽列表来源不正确：%s: %v`, name, err)
+		}
+		files[rules.BlockedListName(name)] = src
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		fmt.Printf("正在更新屏蔽列表：%s...\n", name)
+		// 屏蔽列表不是必须的，失败时保留原来的文件，继续更新其它的。
+		if err := rules.Update(ctx, client, configDir, name, files[name]); err != nil {
+			log.Println(`更新屏蔽列表失败：`, err)
+		}
+	}
+
+	for _, path := range utils.Must1(filepath.Glob(filepath.Join(configDir, rules.BlockedListPattern))) {
+		if _, ok := files[filepath.Base(path)]; !ok {
+			fmt.Println(`删除不再使用的屏蔽列表：`, filepath.Base(path))
+			utils.Must(os.Remove(path))
+		}
+	}
+}
+
+// 经由出口下载时使用的客户端，直接下载时返回空。
+//
+// 由出口（代理服务器）解析域名，所以被污染的域名也可以下载。
+func updateHTTPClient(config *configs.Config) *http.Client {
+	via := config.Update.Via
+	if via == `current` {
+		via = config.Outputs.Current
+	}
+	if via == `` || via == `direct` {
+		return nil
+	}
+	output := innerOutputs(config, []string{via}, `下载规则文件的出口`)[0]
+	dialer := newDialer(&output.Value)
+	fmt.Println(`经由出口下载：`, via)
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialer.DialTCP(addr)
+			},
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: time.Second * 10,
+		},
+	}
+}
+
+func cmdSubscribe(cmd *cobra.Command, args []string) {
+	configDir := getConfigDir(cmd)
+	config := configs.LoadConfigFromFile(filepath.Join(configDir, configs.DefaultConfigFileName))
+
+	if len(config.Outputs.Subscriptions) == 0 {
+		fmt.Println(`没有配置任何订阅(config.outputs.subscriptions)。`)
+		return
+	}
+
+	defer rules.ClearTempFiles(configDir)
+
+	fmt.Println(`正在更新所有的订阅...`)
+	if err := subscriptions.Update(cmd.Context(), configDir, config.Outputs.Subscriptions); err != nil {
+		log.Println(err)
+	}
+
+	cache := subscriptions.LoadCache(configDir)
+	for _, sub := range cache {
+		fmt.Printf("%s:\n", sub.Key)
+		for _, node := range sub.Value {
+			fmt.Printf("  %s/%s\n", sub.Key, node.Key)
+		}
+	}
+
+	fmt.Println(`订阅已更新（重启服务后生效）。`)
+}
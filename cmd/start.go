@@ -1,21 +1,31 @@
 package cmd
 
 import (
+	"cmp"
 	"context"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/goccy/go-yaml"
 	"github.com/movsb/gun/cmd/configs"
+	"github.com/movsb/gun/dns"
+	"github.com/movsb/gun/outputs/router"
+	"github.com/movsb/gun/outputs/subscriptions"
+	"github.com/movsb/gun/pkg/rules"
 	"github.com/movsb/gun/pkg/shell"
 	"github.com/movsb/gun/pkg/tables"
 	"github.com/movsb/gun/pkg/utils"
@@ -25,6 +35,12 @@ import (
 
 const logSocketPath = `/tmp/gun.sock`
 
+// 出口进程（目前只有出口组）提供状态的地方。
+const outputsSocketPath = `/tmp/gun.outputs.sock`
+
+// DNS进程接受控制命令（比如重新加载）的地方。
+const dnsSocketPath = `/tmp/gun.dns.sock`
+
 func cmdLogs(cmd *cobra.Command, args []string, tail int, follow bool) {
 	printLogs(cmd.Context(), tail, follow)
 }
@@ -46,12 +62,13 @@ func printLogs(_ context.Context, tail int, follow bool) {
 
 func cmdStart(cmd *cobra.Command, _ []string, showLogs bool) {
 	mustBeRoot()
-	targets.CheckCommands()
 
 	configDir := getConfigDir(cmd)
+	config := loadConfig(configDir)
+	targets.CheckCommands(targets.ResolveBackend(config.Firewall))
 
 	// 启动之前总是清理一遍，防止上次启动的时候可能的没清理干净。
-	stop()
+	stop(configDir)
 
 	// Detach会启动但不等待。
 	// 但是如果进程启动后就退出了，仍然会进行错误处理。
@@ -87,6 +104,13 @@ func cmdStart(cmd *cobra.Command, _ []string, showLogs bool) {
 	}
 }
 
+// 加载配置文件，并把已缓存的订阅节点合并到库存列表。
+func loadConfig(configDir string) *configs.Config {
+	config := configs.LoadConfigFromFile(filepath.Join(configDir, configs.DefaultConfigFileName))
+	subscriptions.MergeStocks(&config.Outputs, subscriptions.LoadCache(configDir))
+	return config
+}
+
 const (
 	stateRunning = `运行中。`
 	stateStopped = `未成功运行。`
@@ -97,7 +121,7 @@ const (
 // 结束条件：ctx结束、ctrl-c。
 //
 // 不会 panic。
-func start(ctx context.Context, configDir string, state *atomic.Value) {
+func start(ctx context.Context, configDir string, state *atomic.Value, running *running) {
 	needsStopIfErr := false
 
 	defer func() {
@@ -107,7 +131,7 @@ func start(ctx context.Context, configDir string, state *atomic.Value) {
 		}
 		if needsStopIfErr {
 			log.Println(`还原系统状态...`)
-			stop()
+			stop(configDir)
 			log.Println(`已还原系统状态。`)
 		}
 	}()
@@ -118,19 +142,26 @@ func start(ctx context.Context, configDir string, state *atomic.Value) {
 	ctx, cancel := signal.NotifyContext(ctx, syscall.SIGTERM)
 	defer cancel()
 
-	config := configs.LoadConfigFromFile(filepath.Join(configDir, configs.DefaultConfigFileName))
+	config := loadConfig(configDir)
 
 	func() {
 		log.Println(`加载数据、检查系统状态...`)
-		states := targets.LoadStates(configDir)
+		states := targets.LoadStates(configDir, targets.ResolveBackend(config.Firewall))
 
 		states.SetDNSUpstreams(config.DNS.Upstreams.China, config.DNS.Upstreams.Banned)
+		states.SetFakeIP(config.DNS.FakeIP)
+		setGeo(states, configDir, config)
+		setRuleTargets(states, configDir, config)
+		utils.Must(clientsOf(config).Check())
 
 		// 从这里才开始需要还原系统。
 		needsStopIfErr = true
 
-		hasUDP := startProcesses(ctx, states, config, configDir)
-		startRules(states, hasUDP)
+		dns := startDNS(ctx, states, config, configDir)
+		output := startOutput(ctx, states, config, configDir, running.current(config))
+		learned := tables.LoadLearned(filepath.Join(configDir, tables.LearnedFileName))
+		startRules(states, output.udp, learned, clientsOf(config))
+		running.set(ctx, configDir, states, config, dns, output)
 	}()
 	runtime.GC()
 
@@ -141,20 +172,48 @@ func start(ctx context.Context, configDir string, state *atomic.Value) {
 	<-ctx.Done()
 }
 
-func startRules(states *targets.State, hasUDP bool) {
+// learned 是上次停止时保存的DNS学习到的IP。
+func startRules(states *targets.State, hasUDP bool, learned []tables.LearnedIP, clients tables.Clients) {
 	log.Println(`设置内核参数...`)
 	tables.SetKernelParams()
 
+	if states.Backend == tables.BackendNFTables {
+		log.Println(`创建 nftables 规则集...`)
+		nft := tables.NFTables{
+			OutputsGroupID:           states.OutputsGroupID,
+			DNSGroupID:               states.DNSGroupID,
+			OriginalDNSServerGroupID: states.OriginalDNSServerGroupID,
+			White4:                   states.White4(),
+			Black4:                   states.Black4(),
+			White6:                   states.White6(),
+			Black6:                   states.Black6(),
+			Learned:                  learned,
+			DropQUIC:                 !hasUDP,
+			Clients:                  clients,
+		}
+		nft.Apply()
+	} else {
+		startIPTablesRules(states, hasUDP, learned, clients)
+	}
+
+	log.Println(`添加系统路由...`)
+	tables.CreateIPRoute(tables.IPv4)
+	tables.CreateIPRoute(tables.IPv6)
+}
+
+func startIPTablesRules(states *targets.State, hasUDP bool, learned []tables.LearnedIP, clients tables.Clients) {
 	log.Println(`创建表和链...`)
 	tables.CreateChains(states.Ip4tables)
 	tables.CreateChains(states.Ip6tables)
 
 	log.Println(`创建黑白IP列表集...`)
-	tables.CreateIPSet(states.White4(), states.Black4(), states.White6(), states.Black6())
+	tables.CreateIPSet(states.White4(), states.Black4(), states.White6(), states.Black6(), learned)
 
-	log.Println(`添加系统路由...`)
-	tables.CreateIPRoute(tables.IPv4)
-	tables.CreateIPRoute(tables.IPv6)
+	// 先于其它规则匹配。
+	log.Println(`应用客户端策略...`)
+	tables.CreateClientSets(clients)
+	tables.ClientRules(states.Ip4tables, tables.IPv4)
+	tables.ClientRules(states.Ip6tables, tables.IPv6)
 
 	// 没有UDP代理的情况下……
 	//
@@ -180,89 +239,204 @@ func startRules(states *targets.State, hasUDP bool) {
 	tables.TProxy(states.Ip6tables, tables.IPv6)
 }
 
-func startProcesses(ctx context.Context, states *targets.State, config *configs.Config, configDir string) (outputSupportsUDP bool) {
-	sh := shell.Bind(
+func tasksShell(ctx context.Context) shell.Bound {
+	return shell.Bind(
 		shell.WithContext(ctx), shell.WithCmdSelf(),
 		shell.WithStdout(os.Stdout), shell.WithStderr(os.Stderr),
 		shell.WithIgnoreErrors(`signal: interrupt`, `context canceled`, `signal: killed`),
 		shell.WithEnv(`GUN_CHILD`, 1),
 	)
+}
+
+// 可以单独停止的子进程。
+type task struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newTask(ctx context.Context) (context.Context, *task) {
+	ctx, cancel := context.WithCancel(ctx)
+	return ctx, &task{cancel: cancel}
+}
+
+// 结束进程，并等待其退出（以释放端口）。
+func (t *task) stop() {
+	t.cancel()
+	t.wg.Wait()
+}
+
+// 本地域名记录，没有配置时返回空。
+func newHosts(c configs.DNSHostsConfig) (*dns.Hosts, error) {
+	if c.Empty() {
+		return nil, nil
+	}
+	records := map[string][]string{}
+	for name, values := range c.Records {
+		records[name] = values
+	}
+	return dns.NewHosts(records, c.Files, c.Leases, c.LeaseDomain)
+}
+
+func startDNS(ctx context.Context, states *targets.State, config *configs.Config, configDir string) *task {
+	utils.Must(dns.Strategy(config.DNS.Upstreams.Strategy).Check())
+	utils.Must(dns.Strategy(config.DNS.Upstreams.ChinaStrategy).Check())
+	utils.Must(dns.Strategy(config.DNS.Upstreams.BannedStrategy).Check())
+	utils.Must(dns.BlockMode(config.DNS.BlockMode).Check())
+	utils.Must1(newHosts(config.DNS.Hosts))
+	if config.DNS.ECS != `` {
+		utils.Must1(dns.ParseECS(config.DNS.ECS))
+	}
+	if config.DNS.FakeIP != `` {
+		utils.Must1(dns.ParseFakeIPRange(config.DNS.FakeIP))
+	}
+
+	ctx, t := newTask(ctx)
+	sh := tasksShell(ctx)
 
 	log.Println(`启动域名进程...`)
 	// 启动DNS进程。
 	// 需要在域名进程组。
-	go sh.Run(`${self} tasks dns`,
-		shell.WithAutoRestart(),
-		shell.WithGID(states.DNSGroupID),
-		shell.WithEnv(`PORT`, tables.DNSPort),
-		shell.WithEnv(`CHINA_UPSTREAM`, states.ChinaDNS),
-		shell.WithEnv(`BANNED_UPSTREAM`, states.BannedDNS),
-		shell.WithEnv(`CHINA_DOMAINS_FILE`, states.ChinaDomainsFile()),
-		shell.WithEnv(`BANNED_DOMAINS_FILE`, states.BannedDomainsFile()),
-		shell.WithEnv(`BLOCKED_DOMAINS_FILE`, states.BlockedDomainsFile()),
-		shell.WithEnv(`CHINA_ROUTES_FILE`, states.ChinaRoutesFile()),
-	)
+	t.wg.Go(func() {
+		sh.Run(`${self} tasks dns`,
+			shell.WithAutoRestart(),
+			// 退出前需要保存缓存。
+			shell.WithStopSignal(syscall.SIGTERM, time.Second*5),
+			shell.WithGID(states.DNSGroupID),
+			shell.WithEnv(`PORT`, tables.DNSPort),
+			shell.WithEnv(`CHINA_UPSTREAMS`, string(utils.Must1(yaml.Marshal(states.ChinaDNS)))),
+			shell.WithEnv(`BANNED_UPSTREAMS`, string(utils.Must1(yaml.Marshal(states.BannedDNS)))),
+			shell.WithEnv(`CHINA_UPSTREAM_STRATEGY`, cmp.Or(config.DNS.Upstreams.ChinaStrategy, config.DNS.Upstreams.Strategy)),
+			shell.WithEnv(`BANNED_UPSTREAM_STRATEGY`, cmp.Or(config.DNS.Upstreams.BannedStrategy, config.DNS.Upstreams.Strategy)),
+			shell.WithEnv(`CHINA_DOMAINS_FILE`, states.ChinaDomainsFile()),
+			shell.WithEnv(`BANNED_DOMAINS_FILE`, states.BannedDomainsFile()),
+			shell.WithEnv(`BLOCKED_DOMAINS_FILE`, states.BlockedDomainsFile()),
+			shell.WithEnv(`CHINA_ROUTES_FILE`, states.ChinaRoutesFile()),
+			shell.WithEnv(`IPV6`, config.DNS.IPv6),
+			shell.WithEnv(`MIN_SET_TTL`, config.DNS.MinSetTTL),
+			shell.WithEnv(`CACHE_SIZE`, config.DNS.CacheSize),
+			shell.WithEnv(`CACHE_FILE`, filepath.Join(configDir, dns.CacheFileName)),
+			shell.WithEnv(`FAKE_IP_FILE`, filepath.Join(configDir, dns.FakeIPFileName)),
+			shell.WithEnv(`FAKE_IP`, config.DNS.FakeIP),
+			shell.WithEnv(`REAL_IP_CLIENTS`, string(utils.Must1(yaml.Marshal(realIPClients(config))))),
+			shell.WithEnv(`BLOCK_MODE`, config.DNS.BlockMode),
+			shell.WithEnv(`ECS`, config.DNS.ECS),
+			shell.WithEnv(`HOSTS`, string(utils.Must1(yaml.Marshal(config.DNS.Hosts)))),
+			shell.WithEnv(`NFTABLES`, states.Backend == tables.BackendNFTables),
+		)
+	})
+	return t
+}
 
-	log.Println(`启动代理进程...`)
-	current := config.Outputs.Current
+// 正在运行的出口进程。
+type outputTask struct {
+	*task
+
+	// 出口名。
+	name string
+	// 是否支持UDP。
+	udp bool
+}
+
+// 启动指定名字的出口进程。
+//
+// 出口进程的生命周期独立于其它进程，可以单独停止并更换。
+func startOutput(ctx context.Context, states *targets.State, config *configs.Config, configDir string, current string) *outputTask {
+	log.Println(`启动代理进程：`, current)
 	if current == `` {
 		panic(`没有指定使用哪个输出(config.outputs.current)。`)
 	}
 
+	ctx, t := newTask(ctx)
+	task := &outputTask{task: t, name: current}
+	defer func() {
+		if e := recover(); e != nil {
+			task.stop()
+			panic(e)
+		}
+	}()
+
 	// 当前选择的输出端，如果为空，为直连。
 	var output *configs.OutputConfig
 
 	if current != `direct` {
-		for _, item := range config.Outputs.Stocks {
-			if item.Key == current {
-				copy := item.Value
-				output = &copy
-				break
-			}
-		}
+		output = findStock(&config.Outputs, current)
 		if output == nil {
 			panic(`指定的输出在库存中找不到。`)
 		}
 	}
 
+	allRules := rulesOf(config)
+	geo := geoOf(configDir, config)
+
 	// 需要在直连/输出进程组。
-	psh := sh.Bind(
+	psh := tasksShell(ctx).Bind(
 		shell.WithAutoRestart(),
 		shell.WithGID(states.OutputsGroupID),
+		// 目的地址是虚假IP时，通过DNS进程找回域名。
+		shell.WithEnv(`FAKE_IP`, config.DNS.FakeIP),
+		shell.WithEnv(`SNIFF`, config.Outputs.Sniff),
+		shell.WithIf(len(allRules) > 0, shell.WithEnv(`RULES`, string(utils.Must1(yaml.Marshal(allRules))))),
+		shell.WithIf(len(allRules) > 0, shell.WithEnv(`RULE_OUTPUTS`, string(utils.Must1(yaml.Marshal(ruleOutputs(config)))))),
+		shell.WithIf(len(allRules) > 0, shell.WithEnv(`CHINA_ROUTES_FILE`, states.ChinaRoutesFile())),
+		shell.WithIf(len(allRules) > 0, shell.WithEnv(`GEOIP_FILE`, geo.GeoIP)),
+		shell.WithIf(len(allRules) > 0, shell.WithEnv(`GEOSITE_FILE`, geo.GeoSite)),
 	)
+	utils.Must(router.Check(routerRules(allRules)))
+	for _, r := range config.Rules {
+		for _, g := range r.GeoIP {
+			if geo.GeoIP == `` && !strings.EqualFold(g, `CN`) {
+				log.Panicf(`没有配置 GeoIP 数据库时 GeoIP 条件只支持 CN：%s`, g)
+			}
+		}
+		if len(r.GeoSite) > 0 && geo.GeoSite == `` {
+			log.Panicf(`没有配置 GeoSite 数据库：%v`, r.GeoSite)
+		}
+	}
+	if len(allRules) > 0 && output != nil && output.Hysteria != nil {
+		log.Println(`警告：hysteria 出口不支持路由规则。`)
+	}
 
 	switch {
 	case output == nil:
-		// 暂时不支持，还没实现。
-		// outputSupportsUDP = true
-		go psh.Run(`${self} tasks outputs direct`)
+		task.wg.Go(func() { psh.Run(`${self} tasks outputs direct`) })
+		task.udp = true
 	case output.HTTP2Socks != nil:
 		c := output.HTTP2Socks
-		go psh.Run(`${self} tasks outputs http2socks`,
-			shell.WithEnv(`SERVER`, c.Server),
-			shell.WithEnv(`TOKEN`, c.Token),
-		)
+		task.wg.Go(func() {
+			psh.Run(`${self} tasks outputs http2socks`,
+				shell.WithEnv(`SERVER`, c.Server),
+				shell.WithEnv(`TOKEN`, c.Token),
+			)
+		})
 	case output.Trojan != nil:
 		c := output.Trojan
-		go psh.Run(`${self} tasks outputs trojan`,
-			shell.WithEnv(`TROJAN_SERVER`, c.Server),
-			shell.WithEnv(`TROJAN_PASSWORD`, c.Password),
-			shell.WithEnv(`TROJAN_INSECURE`, c.Insecure),
-			shell.WithEnv(`TROJAN_SNI`, c.SNI),
-		)
+		task.wg.Go(func() {
+			psh.Run(`${self} tasks outputs trojan`,
+				shell.WithEnv(`TROJAN_SERVER`, c.Server),
+				shell.WithEnv(`TROJAN_PASSWORD`, c.Password),
+				shell.WithEnv(`TROJAN_INSECURE`, c.Insecure),
+				shell.WithEnv(`TROJAN_SNI`, c.SNI),
+			)
+		})
+		task.udp = true
 	case output.SSH != nil:
 		c := output.SSH
-		go psh.Run(`${self} tasks outputs ssh`,
-			shell.WithEnv(`SSH_USERNAME`, c.Username),
-			shell.WithEnv(`SSH_PASSWORD`, c.Password),
-			shell.WithEnv(`SSH_SERVER`, c.Server),
-			shell.WithEnv(`SSH_FINGERPRINT`, c.Fingerprint),
-		)
+		task.wg.Go(func() {
+			psh.Run(`${self} tasks outputs ssh`,
+				shell.WithEnv(`SSH_USERNAME`, c.Username),
+				shell.WithEnv(`SSH_PASSWORD`, c.Password),
+				shell.WithEnv(`SSH_SERVER`, c.Server),
+				shell.WithEnv(`SSH_FINGERPRINT`, c.Fingerprint),
+			)
+		})
 	case output.Socks5 != nil:
 		c := output.Socks5
-		go psh.Run(`${self} tasks outputs socks5`,
-			shell.WithEnv(`SOCKS5_SERVER`, c.Server),
-		)
+		task.wg.Go(func() {
+			psh.Run(`${self} tasks outputs socks5`,
+				shell.WithEnv(`SOCKS5_SERVER`, c.Server),
+			)
+		})
+		task.udp = true
 	case output.NaiveProxy != nil:
 		c := output.NaiveProxy
 
@@ -271,15 +445,17 @@ func startProcesses(ctx context.Context, states *targets.State, config *configs.
 			bin = filepath.Join(configDir, `naive`)
 		}
 
-		go psh.Run(`${self} tasks outputs naive_proxy`,
-			shell.WithEnv(`GUN_CHILD`, 1),
-			shell.WithEnv(`UID`, states.NobodyID),
-			shell.WithEnv(`GID`, states.OutputsGroupID),
-			shell.WithEnv(`NAIVE_BIN`, bin),
-			shell.WithEnv(`NAIVE_SERVER`, c.Server),
-			shell.WithEnv(`NAIVE_USERNAME`, c.Username),
-			shell.WithEnv(`NAIVE_PASSWORD`, c.Password),
-		)
+		task.wg.Go(func() {
+			psh.Run(`${self} tasks outputs naive_proxy`,
+				shell.WithEnv(`GUN_CHILD`, 1),
+				shell.WithEnv(`UID`, states.NobodyID),
+				shell.WithEnv(`GID`, states.OutputsGroupID),
+				shell.WithEnv(`NAIVE_BIN`, bin),
+				shell.WithEnv(`NAIVE_SERVER`, c.Server),
+				shell.WithEnv(`NAIVE_USERNAME`, c.Username),
+				shell.WithEnv(`NAIVE_PASSWORD`, c.Password),
+			)
+		})
 	case output.Hysteria != nil:
 		c := output.Hysteria
 		bin := c.Bin
@@ -287,26 +463,270 @@ func startProcesses(ctx context.Context, states *targets.State, config *configs.
 			bin = filepath.Join(configDir, `hysteria`)
 		}
 		nobody := psh.Bind(shell.WithUID(states.NobodyID))
-		runHysteria(nobody, bin, c.Server, c.Password, tables.TPROXY_SERVER_PORT)
-		outputSupportsUDP = true
+		runHysteria(&task.wg, nobody, bin, c.Server, c.Password, tables.TPROXY_SERVER_PORT)
+		task.udp = true
+	case output.Shadowsocks != nil:
+		c := output.Shadowsocks
+		task.wg.Go(func() {
+			psh.Run(`${self} tasks outputs shadowsocks`,
+				shell.WithEnv(`SS_SERVER`, c.Server),
+				shell.WithEnv(`SS_METHOD`, c.Method),
+				shell.WithEnv(`SS_PASSWORD`, c.Password),
+			)
+		})
+	case output.Group != nil:
+		c := output.Group
+		members := innerOutputs(config, c.Members, `出口组成员`)
+		task.wg.Go(func() {
+			psh.Run(`${self} tasks outputs group`,
+				shell.WithEnv(`GROUP_STRATEGY`, c.Strategy),
+				shell.WithEnv(`GROUP_PROBE`, c.Probe),
+				shell.WithEnv(`GROUP_INTERVAL`, c.Interval),
+				shell.WithEnv(`GROUP_MEMBERS`, string(utils.Must1(yaml.Marshal(members)))),
+			)
+		})
 	default:
 		panic(`未指定具体的输出配置项。`)
 	}
 
-	return
+	return task
+}
+
+// 在出口进程内部实现的出口（出口组成员、规则中的出口）。
+//
+// 只支持内部实现的协议，direct 表示直连。what 用于错误提示。
+func innerOutputs(config *configs.Config, names []string, what string) configs.YamlMapSlice[string, configs.OutputConfig] {
+	outputs := configs.YamlMapSlice[string, configs.OutputConfig]{}
+	for _, name := range names {
+		m := &configs.OutputConfig{}
+		if name != `direct` {
+			m = findStock(&config.Outputs, name)
+		}
+		switch {
+		case m == nil:
+			log.Panicf(`%s在库存中找不到：%s`, what, name)
+		case m.NaiveProxy != nil || m.Hysteria != nil || m.Group != nil:
+			log.Panicf(`%s不支持此协议：%s`, what, name)
+		}
+		outputs = append(outputs, configs.YamlMapItem[string, configs.OutputConfig]{Key: name, Value: *m})
+	}
+	return outputs
+}
+
+func routerRules(ruleConfigs []configs.RuleConfig) []router.Rule {
+	var list []router.Rule
+	for _, r := range ruleConfigs {
+		list = append(list, router.Rule{
+			Domains:  r.Domain,
+			Keywords: r.Keyword,
+			Regexps:  r.Regexp,
+			CIDRs:    r.CIDR,
+			GeoIPs:   r.GeoIP,
+			GeoSites: r.GeoSite,
+			Ports:    r.Port,
+			Sources:  r.Source,
+			Output:   r.Output,
+		})
+	}
+	return list
+}
+
+// GeoIP/GeoSite 数据库，相对路径相对于配置目录。
+func geoOf(configDir string, config *configs.Config) rules.Geo {
+	abs := func(path string) string {
+		if path == `` || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(configDir, path)
+	}
+	return rules.Geo{GeoIP: abs(config.Geo.GeoIP), GeoSite: abs(config.Geo.GeoSite)}
+}
+
+// 通过 GeoIP/GeoSite 数据库添加直连和代理的IP、域名。
+func setGeo(states *targets.State, configDir string, config *configs.Config) {
+	geo := geoOf(configDir, config)
+	states.SetGeo(
+		utils.Must1(geo.File(config.Geo.Direct)),
+		utils.Must1(geo.File(config.Geo.Proxy)),
+	)
+}
+
+// 路由规则只能看到被接管的流量，直连（白名单集中）的流量不经过规则。
+// 所以不直连的规则中的域名当作国外的、IP段添加到黑名单集，以便被接管后再交给规则。
+//
+// 只有端口、来源、GeoIP 条件的规则仍然只作用于本来就被接管的流量。
+func setRuleTargets(states *targets.State, configDir string, config *configs.Config) {
+	f := &rules.File{}
+	var categories []string
+	for _, r := range rulesOf(config) {
+		if r.Output == router.Direct {
+			continue
+		}
+		for _, list := range []struct {
+			typ    string
+			values []string
+		}{
+			{rules.DomainSuffix, r.Domain},
+			{rules.DomainKeyword, r.Keyword},
+			{rules.DomainRegexp, r.Regexp},
+		} {
+			for _, v := range list.values {
+				f.Domains = append(f.Domains, utils.Must1(rules.ParseDomain(list.typ+`:`+v)))
+			}
+		}
+		for _, ip := range r.CIDR {
+			if strings.Contains(ip, `:`) {
+				f.IPv6 = append(f.IPv6, ip)
+			} else {
+				f.IPv4 = append(f.IPv4, ip)
+			}
+		}
+		for _, c := range r.GeoSite {
+			categories = append(categories, `geosite:`+c)
+		}
+	}
+	if len(categories) > 0 {
+		sites := utils.Must1(geoOf(configDir, config).File(categories))
+		f.Domains = append(f.Domains, sites.Domains...)
+	}
+	states.SetRuleTargets(f)
+}
+
+// 防火墙中的客户端策略：指定了出口的客户端和 proxy 一样全部接管，再由规则交给此出口。
+func clientsOf(config *configs.Config) tables.Clients {
+	clients := tables.Clients{}
+	for _, c := range config.Clients {
+		policy := c.Policy
+		switch policy {
+		case tables.CLIENT_DIRECT, tables.CLIENT_PROXY, tables.CLIENT_BLOCK:
+		case ``:
+			log.Panicf(`客户端没有指定策略：%v`, c.Source)
+		default:
+			policy = tables.CLIENT_PROXY
+		}
+		clients[policy] = append(clients[policy], c.Source...)
+	}
+	return clients
+}
+
+// 虚假IP模式下应答真实IP的客户端：direct 和 block 的客户端不经过代理，访问虚假IP不会被转换。
+//
+// DNS进程只能看到客户端的IP，所以这些客户端不能按MAC地址指定。
+func realIPClients(config *configs.Config) []string {
+	if config.DNS.FakeIP == `` {
+		return nil
+	}
+	var list []string
+	for _, c := range config.Clients {
+		switch c.Policy {
+		case tables.CLIENT_DIRECT, tables.CLIENT_BLOCK:
+		default:
+			continue
+		}
+		for _, src := range c.Source {
+			if _, err := net.ParseMAC(src); err == nil {
+				log.Panicf(`虚假IP模式下 %s 策略的客户端不能按MAC地址指定：%s`, c.Policy, src)
+			}
+			prefix, err := netip.ParsePrefix(src)
+			if err != nil {
+				ip, err := netip.ParseAddr(src)
+				if err != nil {
+					log.Panicf(`客户端地址不正确：%s`, src)
+				}
+				prefix = netip.PrefixFrom(ip, ip.BitLen())
+			}
+			list = append(list, prefix.Masked().String())
+		}
+	}
+	return list
+}
+
+// 出口进程中的全部规则：指定了出口的客户端在前，然后是配置中的规则。
+func rulesOf(config *configs.Config) []configs.RuleConfig {
+	var list []configs.RuleConfig
+	for _, c := range config.Clients {
+		switch c.Policy {
+		case tables.CLIENT_DIRECT, tables.CLIENT_PROXY, tables.CLIENT_BLOCK:
+			continue
+		}
+		list = append(list, configs.RuleConfig{Source: c.Source, Output: c.Policy})
+	}
+	return append(list, config.Rules...)
+}
+
+// 规则中用到的库存中的出口。
+func ruleOutputs(config *configs.Config) configs.YamlMapSlice[string, configs.OutputConfig] {
+	var names []string
+	for _, r := range rulesOf(config) {
+		switch r.Output {
+		case router.Direct, router.Reject, router.Current:
+		default:
+			if !slices.Contains(names, r.Output) {
+				names = append(names, r.Output)
+			}
+		}
+	}
+	return innerOutputs(config, names, `规则中的出口`)
+}
+
+// 在库存中查找出口，找不到返回 nil。
+func findStock(outputs *configs.OutputsConfig, name string) *configs.OutputConfig {
+	for _, item := range outputs.Stocks {
+		if item.Key == name {
+			copy := item.Value
+			return &copy
+		}
+	}
+	return nil
 }
 
 func cmdStop(cmd *cobra.Command, args []string) {
 	mustBeRoot()
-	stop()
+	stop(getConfigDir(cmd))
 }
 
-func stop() {
+// 不管使用的是哪个后端，都全部清理一遍，避免配置修改后残留。
+//
+// 删除名单集之前先保存DNS学习到的IP，下次启动时恢复。
+func stop(configDir string) {
 	utils.KillChildren()
-	ip4, ip6 := targets.FindIPTablesCommands()
-	tables.DeleteChains(ip4)
-	tables.DeleteChains(ip6)
+	saveLearned(configDir)
+	if ip4, ip6 := targets.FindIPTablesCommands(); ip4 != `` {
+		tables.DeleteChains(ip4)
+		tables.DeleteChains(ip6)
+	}
 	tables.DeleteIPRoute(tables.IPv4)
 	tables.DeleteIPRoute(tables.IPv6)
-	tables.DeleteIPSet()
+	if targets.HasCommand(`ipset`) {
+		tables.DeleteIPSet()
+	}
+	if targets.HasCommand(`nft`) {
+		tables.DeleteNFTables()
+	}
+}
+
+// 保存名单集中DNS学习到的IP。
+//
+// 名单集不存在（比如没有在运行）时保留上次保存的。
+func saveLearned(configDir string) {
+	var (
+		learned []tables.LearnedIP
+		found   bool
+	)
+	if targets.HasCommand(`ipset`) {
+		l, ok := tables.ListLearnedIPSet()
+		learned, found = append(learned, l...), found || ok
+	}
+	if targets.HasCommand(`nft`) {
+		l, ok := tables.ListLearnedNFTSet()
+		learned, found = append(learned, l...), found || ok
+	}
+	if !found {
+		return
+	}
+	if err := tables.SaveLearned(filepath.Join(configDir, tables.LearnedFileName), learned); err != nil {
+		log.Println(`保存学习到的IP失败：`, err)
+		return
+	}
+	log.Println(`已保存学习到的IP：`, len(learned))
 }
@@ -2,26 +2,40 @@ package cmd
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"math/rand/v2"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"net/netip"
 	"net/url"
 	"os"
+	"os/signal"
 	"runtime"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/goccy/go-yaml"
+	"github.com/movsb/gun/cmd/configs"
 	"github.com/movsb/gun/dns"
 	"github.com/movsb/gun/outputs/direct"
+	"github.com/movsb/gun/outputs/group"
 	"github.com/movsb/gun/outputs/http2socks"
+	"github.com/movsb/gun/outputs/router"
+	"github.com/movsb/gun/outputs/shadowsocks"
 	"github.com/movsb/gun/outputs/socks5"
 	"github.com/movsb/gun/outputs/ssh"
 	"github.com/movsb/gun/outputs/trojan"
 	"github.com/movsb/gun/pkg/rules"
 	"github.com/movsb/gun/pkg/shell"
 	"github.com/movsb/gun/pkg/tables"
+	"github.com/movsb/gun/pkg/tproxy"
 	"github.com/movsb/gun/pkg/utils"
 	"github.com/spf13/cobra"
+	"go4.org/netipx"
 )
 
 func cmdTasks(cmd *cobra.Command, args []string) {
@@ -34,6 +48,15 @@ func cmdTasks(cmd *cobra.Command, args []string) {
 
 	if args[0] == `outputs` {
 		setLimit()
+		if fakeIP := utils.MustGetEnvString(`FAKE_IP`); fakeIP != `` {
+			tproxy.SetFakeIP(utils.Must1(dns.ParseFakeIPRange(fakeIP)), lookupFakeIP, lookupRealIP)
+		}
+		if utils.MustGetEnvBool(`SNIFF`) {
+			tproxy.EnableSniffing()
+		}
+		if rules := os.Getenv(`RULES`); rules != `` {
+			tproxy.SetRouter(newRouter(rules).Serve)
+		}
 		switch args[1] {
 		case `direct`:
 			direct.ListenAndServeTProxy(tables.TPROXY_SERVER_PORT)
@@ -51,6 +74,13 @@ func cmdTasks(cmd *cobra.Command, args []string) {
 				utils.MustGetEnvBool(`TROJAN_INSECURE`),
 				utils.MustGetEnvString(`TROJAN_SNI`),
 			)
+		case `shadowsocks`:
+			shadowsocks.ListenAndServeTProxy(
+				tables.TPROXY_SERVER_PORT,
+				utils.MustGetEnvString(`SS_SERVER`),
+				utils.MustGetEnvString(`SS_METHOD`),
+				utils.MustGetEnvString(`SS_PASSWORD`),
+			)
 		case `ssh`:
 			client := ssh.New(
 				utils.MustGetEnvString(`SSH_USERNAME`),
@@ -63,7 +93,27 @@ func cmdTasks(cmd *cobra.Command, args []string) {
 			socks5.ListenAndServeTProxy(
 				tables.TPROXY_SERVER_PORT,
 				utils.MustGetEnvString(`SOCKS5_SERVER`),
+				true,
 			)
+		case `group`:
+			members := configs.YamlMapSlice[string, configs.OutputConfig]{}
+			utils.Must(yaml.Unmarshal([]byte(utils.MustGetEnvString(`GROUP_MEMBERS`)), &members))
+			var dialers []group.Member
+			for _, m := range members {
+				dialers = append(dialers, group.Member{Name: m.Key, Dialer: newDialer(&m.Value)})
+			}
+			g := utils.Must1(group.New(
+				group.Strategy(utils.MustGetEnvString(`GROUP_STRATEGY`)),
+				utils.MustGetEnvString(`GROUP_PROBE`),
+				utils.Must1(time.ParseDuration(utils.MustGetEnvString(`GROUP_INTERVAL`))),
+				dialers,
+			))
+			mux := http.NewServeMux()
+			mux.HandleFunc(`/v1/status`, func(w http.ResponseWriter, r *http.Request) {
+				yaml.NewEncoder(w).Encode(g.Status())
+			})
+			go httpServe(outputsSocketPath, mux)
+			g.ListenAndServeTProxy(tables.TPROXY_SERVER_PORT)
 		case `naive_proxy`:
 			port := runNaiveProxy(
 				utils.MustGetEnvInt(`GID`),
@@ -76,6 +126,8 @@ func cmdTasks(cmd *cobra.Command, args []string) {
 			socks5.ListenAndServeTProxy(
 				tables.TPROXY_SERVER_PORT,
 				fmt.Sprintf(`127.0.0.1:%d`, port),
+				// naive 的 SOCKS5 入口不支持UDP。
+				false,
 			)
 		}
 		return
@@ -84,39 +136,294 @@ func cmdTasks(cmd *cobra.Command, args []string) {
 	if args[0] == `dns` {
 		setLimit()
 
+		var (
+			chinaDomainsFile   = utils.MustGetEnvString(`CHINA_DOMAINS_FILE`)
+			bannedDomainsFile  = utils.MustGetEnvString(`BANNED_DOMAINS_FILE`)
+			chinaRoutesFile    = utils.MustGetEnvString(`CHINA_ROUTES_FILE`)
+			blockedDomainsFile = utils.MustGetEnvString(`BLOCKED_DOMAINS_FILE`)
+		)
+
+		// 读取域名和路由列表，重新加载时文件由 daemon 重新生成。
+		read := func() (chinaDomains, bannedDomains, chinaRoutes, blockedDomains []string) {
+			return rules.ReadGenerated(chinaDomainsFile),
+				rules.ReadGenerated(bannedDomainsFile),
+				rules.ReadGenerated(chinaRoutesFile),
+				rules.ReadGenerated(blockedDomainsFile)
+		}
+
 		// 包装在函数中以回收不必须的局部变量内存。
 		create := func() *dns.Server {
 			var (
-				port               = utils.MustGetEnvInt(`PORT`)
-				chinaUpstream      = utils.MustGetEnvString(`CHINA_UPSTREAM`)
-				bannedUpstream     = utils.MustGetEnvString(`BANNED_UPSTREAM`)
-				chinaDomainsFile   = utils.MustGetEnvString(`CHINA_DOMAINS_FILE`)
-				bannedDomainsFile  = utils.MustGetEnvString(`BANNED_DOMAINS_FILE`)
-				chinaRoutesFile    = utils.MustGetEnvString(`CHINA_ROUTES_FILE`)
-				blockedDomainsFile = utils.MustGetEnvString(`BLOCKED_DOMAINS_FILE`)
-
-				chinaDomains   = rules.ReadGenerated(chinaDomainsFile)
-				bannedDomains  = rules.ReadGenerated(bannedDomainsFile)
-				blockedDomains = rules.ReadGenerated(blockedDomainsFile)
-				chinaRoutes    = rules.ReadGenerated(chinaRoutesFile)
+				port           = utils.MustGetEnvInt(`PORT`)
+				chinaStrategy  = dns.Strategy(utils.MustGetEnvString(`CHINA_UPSTREAM_STRATEGY`))
+				bannedStrategy = dns.Strategy(utils.MustGetEnvString(`BANNED_UPSTREAM_STRATEGY`))
+				ipv6           = utils.MustGetEnvBool(`IPV6`)
+				nftables       = utils.MustGetEnvBool(`NFTABLES`)
+				minSetTTL      = utils.Must1(time.ParseDuration(utils.MustGetEnvString(`MIN_SET_TTL`)))
+				cacheSize      = utils.MustGetEnvInt(`CACHE_SIZE`)
+				fakeIP         = utils.MustGetEnvString(`FAKE_IP`)
+				blockMode      = dns.BlockMode(utils.MustGetEnvString(`BLOCK_MODE`))
+				ecs            = utils.MustGetEnvString(`ECS`)
 			)
 
+			var fakeIPRange netip.Prefix
+			if fakeIP != `` {
+				fakeIPRange = utils.Must1(dns.ParseFakeIPRange(fakeIP))
+			}
+
+			var realClients []netip.Prefix
+			var realClientsText []string
+			utils.Must(yaml.Unmarshal([]byte(utils.MustGetEnvString(`REAL_IP_CLIENTS`)), &realClientsText))
+			for _, c := range realClientsText {
+				realClients = append(realClients, netip.MustParsePrefix(c))
+			}
+
+			var ecsConfig *dns.ECS
+			if ecs != `` {
+				ecsConfig = utils.Must1(dns.ParseECS(ecs))
+			}
+
+			var hostsConfig configs.DNSHostsConfig
+			utils.Must(yaml.Unmarshal([]byte(utils.MustGetEnvString(`HOSTS`)), &hostsConfig))
+			hosts := utils.Must1(newHosts(hostsConfig))
+
+			var chinaUpstreams, bannedUpstreams []string
+			utils.Must(yaml.Unmarshal([]byte(utils.MustGetEnvString(`CHINA_UPSTREAMS`)), &chinaUpstreams))
+			utils.Must(yaml.Unmarshal([]byte(utils.MustGetEnvString(`BANNED_UPSTREAMS`)), &bannedUpstreams))
+
+			chinaDomains, bannedDomains, chinaRoutes, blockedDomains := read()
+
 			return dns.NewServer(int(port),
-				chinaUpstream, bannedUpstream,
+				chinaUpstreams, bannedUpstreams,
 				chinaDomains, bannedDomains,
 				chinaRoutes, blockedDomains,
 				tables.WHITE_SET_NAME_4, tables.BLACK_SET_NAME_4,
 				tables.WHITE_SET_NAME_6, tables.BLACK_SET_NAME_6,
+				dns.WithIf(ipv6, dns.WithIPv6Records()),
+				dns.WithIf(nftables, dns.WithNFTSets(tables.NFT_TABLE)),
+				dns.WithMinSetTTL(minSetTTL),
+				dns.WithUpstreamStrategy(chinaStrategy, bannedStrategy),
+				dns.WithCacheSize(cacheSize),
+				dns.WithIf(fakeIP != ``, dns.WithFakeIP(fakeIPRange)),
+				dns.WithIf(len(realClients) > 0, dns.WithRealIPClients(realClients)),
+				dns.WithBlockMode(blockMode),
+				dns.WithIf(hosts != nil, dns.WithHosts(hosts)),
+				dns.WithECS(ecsConfig),
 			)
 		}
 
 		s := create()
 		runtime.GC()
+
+		// 恢复上次退出时保存的虚假IP池和缓存，退出（被 daemon 停止）时再保存。
+		// 虚假IP池需要先恢复，缓存中已经被回收的虚假IP会被丢弃。
+		cacheFile := utils.MustGetEnvString(`CACHE_FILE`)
+		fakeIPFile := utils.MustGetEnvString(`FAKE_IP_FILE`)
+		if n, err := s.LoadFakeIPs(fakeIPFile); err != nil {
+			log.Println(`恢复虚假IP池失败：`, err)
+		} else if n > 0 {
+			log.Println(`已恢复虚假IP池：`, n)
+		}
+		if n, err := s.LoadCache(cacheFile); err != nil {
+			log.Println(`恢复DNS缓存失败：`, err)
+		} else if n > 0 {
+			log.Println(`已恢复DNS缓存：`, n)
+		}
+		go func() {
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+			<-sig
+			if n, err := s.SaveCache(cacheFile); err != nil {
+				log.Println(`保存DNS缓存失败：`, err)
+			} else {
+				log.Println(`已保存DNS缓存：`, n)
+			}
+			if n, err := s.SaveFakeIPs(fakeIPFile); err != nil {
+				log.Println(`保存虚假IP池失败：`, err)
+			} else if n > 0 {
+				log.Println(`已保存虚假IP池：`, n)
+			}
+			os.Exit(0)
+		}()
+
+		mux := http.NewServeMux()
+		mux.HandleFunc(`POST /v1/reload`, func(w http.ResponseWriter, r *http.Request) {
+			s.Reload(read())
+			runtime.GC()
+		})
+		mux.HandleFunc(`GET /v1/status`, func(w http.ResponseWriter, r *http.Request) {
+			yaml.NewEncoder(w).Encode(s.Status())
+		})
+		mux.HandleFunc(`GET /v1/realip/{name}`, func(w http.ResponseWriter, r *http.Request) {
+			ips, err := s.LookupRealIP(r.PathValue(`name`))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			for _, ip := range ips {
+				fmt.Fprintln(w, ip)
+			}
+		})
+		mux.HandleFunc(`GET /v1/fakeip/{ip}`, func(w http.ResponseWriter, r *http.Request) {
+			ip, err := netip.ParseAddr(r.PathValue(`ip`))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			name, ok := s.LookupFakeIP(ip)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			io.WriteString(w, name)
+		})
+		go httpServe(dnsSocketPath, mux)
+
 		utils.Must(s.ListenAndServe())
 		return
 	}
 }
 
+// 向DNS进程找回虚假IP对应的域名。
+//
+// 不缓存：虚假IP会被回收分配给别的域名，只有DNS进程知道当前的映射。
+func lookupFakeIP(ip netip.Addr) (string, error) {
+	rsp, err := dnsHTTPClient().Get(`http://gun/v1/fakeip/` + ip.String())
+	if err != nil {
+		return ``, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return ``, fmt.Errorf(`域名进程返回错误：%s`, rsp.Status)
+	}
+	name, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return ``, err
+	}
+	return string(name), nil
+}
+
+// 向DNS进程查询域名的真实IP，用于直连虚假IP对应的域名。
+func lookupRealIP(name string) ([]netip.Addr, error) {
+	rsp, err := dnsHTTPClient().Get(`http://gun/v1/realip/` + name)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(`域名进程返回错误：%s`, rsp.Status)
+	}
+	body, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var ips []netip.Addr
+	for line := range strings.FieldsSeq(string(body)) {
+		ip, err := netip.ParseAddr(line)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// 由环境变量中的规则及其出口创建路由器。
+func newRouter(ruleConfigsYAML string) *router.Router {
+	var ruleConfigs []configs.RuleConfig
+	utils.Must(yaml.Unmarshal([]byte(ruleConfigsYAML), &ruleConfigs))
+
+	outputs := configs.YamlMapSlice[string, configs.OutputConfig]{}
+	utils.Must(yaml.Unmarshal([]byte(utils.MustGetEnvString(`RULE_OUTPUTS`)), &outputs))
+	dialers := map[string]group.Dialer{}
+	for _, o := range outputs {
+		dialers[o.Key] = newDialer(&o.Value)
+	}
+
+	geo := rules.Geo{
+		GeoIP:   utils.MustGetEnvString(`GEOIP_FILE`),
+		GeoSite: utils.MustGetEnvString(`GEOSITE_FILE`),
+	}
+	var codes, categories []string
+	for _, r := range ruleConfigs {
+		codes = append(codes, r.GeoIP...)
+		categories = append(categories, r.GeoSite...)
+	}
+
+	// 国家代码 -> IP段。
+	// 没有 GeoIP 数据库时只有中国路由段。
+	countries := map[string]*netipx.IPSet{}
+	if geo.GeoIP != `` && len(codes) > 0 {
+		for code, prefixes := range utils.Must1(geo.IPs(codes)) {
+			var b netipx.IPSetBuilder
+			for _, p := range prefixes {
+				b.AddPrefix(p)
+			}
+			countries[code] = utils.Must1(b.IPSet())
+		}
+	} else {
+		var b netipx.IPSetBuilder
+		for _, r := range rules.ReadGenerated(utils.MustGetEnvString(`CHINA_ROUTES_FILE`)) {
+			if prefix, err := netip.ParsePrefix(r); err == nil {
+				b.AddPrefix(prefix)
+			} else {
+				b.Add(netip.MustParseAddr(r))
+			}
+		}
+		countries[`CN`] = utils.Must1(b.IPSet())
+	}
+	geoIP := func(ip netip.Addr) string {
+		for code, set := range countries {
+			if set.Contains(ip) {
+				return code
+			}
+		}
+		return ``
+	}
+
+	var geoSite router.GeoSite
+	if len(categories) > 0 {
+		sites := utils.Must1(geo.Sites(categories))
+		geoSite = func(category string) *rules.GeoSite {
+			return sites[strings.ToUpper(category)]
+		}
+	}
+
+	return utils.Must1(router.New(routerRules(ruleConfigs), dialers, geoIP, geoSite))
+}
+
+// 出口组成员。
+//
+// 只支持内部实现的出口协议，空的配置表示直连。
+func newDialer(c *configs.OutputConfig) group.Dialer {
+	switch {
+	case c.HTTP2Socks != nil:
+		return group.DialerFunc(http2socks.NewDialer(c.HTTP2Socks.Server, c.HTTP2Socks.Token))
+	case c.Trojan != nil:
+		return &trojan.Trojan{
+			ServerAddrPort:     c.Trojan.Server,
+			Password:           c.Trojan.Password,
+			InsecureSkipVerify: c.Trojan.Insecure,
+			ServerName:         c.Trojan.SNI,
+		}
+	case c.SSH != nil:
+		return ssh.New(c.SSH.Username, c.SSH.Password, c.SSH.Server, c.SSH.Fingerprint)
+	case c.Socks5 != nil:
+		server := c.Socks5.Server
+		return group.DialerFunc(func(addr string) (net.Conn, error) {
+			return socks5.DialTCP(server, addr)
+		})
+	case c.Shadowsocks != nil:
+		return utils.Must1(shadowsocks.New(c.Shadowsocks.Server, c.Shadowsocks.Method, c.Shadowsocks.Password))
+	case c.NaiveProxy != nil, c.Hysteria != nil, c.Group != nil:
+		panic(`出口组成员不支持此协议。`)
+	default:
+		return group.DialerFunc(func(addr string) (net.Conn, error) {
+			return net.Dial(`tcp`, addr)
+		})
+	}
+}
+
 func runNaiveProxy(gid, uid int, bin string, server, username, password string) uint16 {
 	if !utils.FileExists(bin) {
 		log.Panicf(`二进制文件未找到：%s`, bin)
@@ -149,7 +456,7 @@ func runNaiveProxy(gid, uid int, bin string, server, username, password string)
 }
 
 // 因为其本身支持tproxy作为入口，所以不需要以task进程的方式额外启动。
-func runHysteria(psh shell.Bound, bin string, server, password string, port uint16) {
+func runHysteria(wg *sync.WaitGroup, psh shell.Bound, bin string, server, password string, port uint16) {
 	if !utils.FileExists(bin) {
 		log.Panicf(`二进制文件未找到：%s`, bin)
 	}
@@ -174,10 +481,12 @@ udpTProxy:
 	utils.Must1(tmpFile.WriteString(rawConfigYaml))
 	tmpFile.Close()
 
-	go psh.Run(`${bin} client -c ${config}`,
-		shell.WithAutoRestart(),
-		shell.WithEnv(`GUN_CHILD`, 1),
-		shell.WithValues(`bin`, bin),
-		shell.WithValues(`config`, tmpFile.Name()),
-	)
+	wg.Go(func() {
+		psh.Run(`${bin} client -c ${config}`,
+			shell.WithAutoRestart(),
+			shell.WithEnv(`GUN_CHILD`, 1),
+			shell.WithValues(`bin`, bin),
+			shell.WithValues(`config`, tmpFile.Name()),
+		)
+	})
 }
@@ -0,0 +1,107 @@
+package dns
+
+import (
+	"cmp"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// 被屏蔽的域名的应答方式。
+type BlockMode string
+
+const (
+	// 应答域名不存在（默认）。
+	BlockNXDomain BlockMode = `nxdomain`
+	// 应答 0.0.0.0 或者 ::。
+	BlockZero BlockMode = `zero`
+	// 拒绝查询。
+	BlockRefused BlockMode = `refused`
+)
+
+// 空表示默认（nxdomain）。
+func (m BlockMode) Check() error {
+	switch m {
+	case ``, BlockNXDomain, BlockZero, BlockRefused:
+		return nil
+	}
+	return fmt.Errorf(`未知的域名屏蔽方式：%s`, m)
+}
+
+// 按屏蔽方式生成应答。
+func (m BlockMode) reply(r *dns.Msg) *dns.Msg {
+	msg := &dns.Msg{}
+	switch m {
+	case BlockRefused:
+		msg.SetRcode(r, dns.RcodeRefused)
+	case BlockZero:
+		msg.SetReply(r)
+		q := r.Question[0]
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+		switch q.Qtype {
+		case dns.TypeA:
+			msg.Answer = append(msg.Answer, &dns.A{Hdr: hdr, A: net.IPv4zero})
+		case dns.TypeAAAA:
+			msg.Answer = append(msg.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero})
+		}
+	default:
+		msg.SetRcode(r, dns.RcodeNameError)
+	}
+	return msg
+}
+
+const (
+	// 最多统计这么多个不同域名的命中次数，之后只增加总数。
+	maxBlockedDomains = 4096
+	// 状态中显示命中次数最多的域名数。
+	topBlockedDomains = 10
+)
+
+// 屏蔽的命中次数。
+type blockStats struct {
+	lock    sync.Mutex
+	total   uint64
+	domains map[string]uint64
+}
+
+func (b *blockStats) hit(domain string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.total++
+	if b.domains == nil {
+		b.domains = map[string]uint64{}
+	}
+	if _, ok := b.domains[domain]; ok || len(b.domains) < maxBlockedDomains {
+		b.domains[domain]++
+	}
+}
+
+type BlockStatus struct {
+	Mode BlockMode `yaml:"mode"`
+	// 屏蔽的总次数。
+	Hits uint64 `yaml:"hits"`
+	// 命中次数最多的域名。
+	Top []BlockedDomain `yaml:"top,omitempty"`
+}
+
+type BlockedDomain struct {
+	Domain string `yaml:"domain"`
+	Hits   uint64 `yaml:"hits"`
+}
+
+func (b *blockStats) status(mode BlockMode) BlockStatus {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	s := BlockStatus{Mode: mode, Hits: b.total}
+	for d, n := range b.domains {
+		s.Top = append(s.Top, BlockedDomain{Domain: d, Hits: n})
+	}
+	slices.SortFunc(s.Top, func(a, b BlockedDomain) int {
+		return cmp.Or(cmp.Compare(b.Hits, a.Hits), cmp.Compare(a.Domain, b.Domain))
+	})
+	s.Top = s.Top[:min(len(s.Top), topBlockedDomains)]
+	return s
+}
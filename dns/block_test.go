@@ -0,0 +1,46 @@
+package dns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestBlocked(t *testing.T) {
+	s := NewServer(0,
+		[]string{`127.0.0.1`}, []string{`127.0.0.1`},
+		nil, nil, nil, []string{`ads.com`, `@@full:good.ads.com`},
+		`w4`, `b4`, `w6`, `b6`,
+	)
+
+	query := func(name string, typ uint16) *dns.Msg {
+		w := &fakeWriter{}
+		m := new(dns.Msg)
+		m.SetQuestion(name, typ)
+		if !s.handleBlocked(w, m) {
+			return nil
+		}
+		return w.msg
+	}
+
+	if rsp := query(`x.ads.com.`, dns.TypeA); rsp == nil || rsp.Rcode != dns.RcodeNameError {
+		t.Fatalf(`应该被屏蔽：%v`, rsp)
+	}
+	if rsp := query(`good.ads.com.`, dns.TypeA); rsp != nil {
+		t.Fatalf(`不应该被屏蔽：%v`, rsp)
+	}
+
+	s.blockMode = BlockZero
+	if rsp := query(`ads.com.`, dns.TypeA); rsp == nil || len(rsp.Answer) != 1 || !rsp.Answer[0].(*dns.A).A.IsUnspecified() {
+		t.Fatalf(`应该应答 0.0.0.0：%v`, rsp)
+	}
+	s.blockMode = BlockRefused
+	if rsp := query(`ads.com.`, dns.TypeA); rsp == nil || rsp.Rcode != dns.RcodeRefused {
+		t.Fatalf(`应该拒绝：%v`, rsp)
+	}
+
+	status := s.Status().Blocked
+	if status.Hits != 3 || len(status.Top) != 2 || status.Top[0] != (BlockedDomain{Domain: `ads.com`, Hits: 2}) {
+		t.Fatalf(`统计不正确：%+v`, status)
+	}
+}
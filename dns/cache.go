@@ -0,0 +1,158 @@
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/movsb/gun/pkg/utils"
+)
+
+// 缓存文件名（位于配置目录）。
+const CacheFileName = `dns.cache.ro.bin`
+
+// 默认的缓存条目数。
+const DefaultCacheSize = 1024
+
+// 缓存文件头，格式变化时修改版本号，旧文件会被忽略。
+const cacheFileMagic = "GUNDNS\x00\x02"
+
+// 缓存文件中保存的判断结果。
+const (
+	verdictBanned byte = 0
+	verdictChina  byte = 1
+	// 虚假IP（也是国外）。
+	verdictFake byte = 2
+)
+
+// 把缓存保存到文件，在进程退出前调用。
+//
+// 文件格式：文件头，然后是若干条目，每个条目依次是：
+// 过期时间（Unix秒，uvarint）、判断结果（1字节）、ECS 子网长度（uvarint）、ECS 子网（文本，可以为空）、
+// 应答长度（uvarint）、应答（DNS报文格式）。
+//
+// 返回保存的条目数。
+func (s *Server) SaveCache(path string) (int, error) {
+	buf := bytes.NewBufferString(cacheFileMagic)
+	n := 0
+	for _, key := range s.cache.AppendKeys(nil) {
+		val, expires, found := s.cache.Peek(key)
+		// 给不经过代理的客户端的真实应答不保存，恢复后会被当成普通的应答。
+		if !found || key.real {
+			continue
+		}
+		packed, err := val.msg.Pack()
+		if err != nil {
+			continue
+		}
+		buf.Write(binary.AppendUvarint(nil, uint64(time.Unix(0, expires).Unix())))
+		verdict := utils.IIF(val.white, verdictChina, verdictBanned)
+		if _, fake := s.fakeIPOf(val.msg); fake {
+			verdict = verdictFake
+		}
+		buf.WriteByte(verdict)
+		var subnet string
+		if key.subnet.IsValid() {
+			subnet = key.subnet.String()
+		}
+		buf.Write(binary.AppendUvarint(nil, uint64(len(subnet))))
+		buf.WriteString(subnet)
+		buf.Write(binary.AppendUvarint(nil, uint64(len(packed))))
+		buf.Write(packed)
+		n++
+	}
+
+	return n, utils.WriteFileAtomic(path, func(w io.Writer) error {
+		_, err := buf.WriteTo(w)
+		return err
+	})
+}
+
+// 从文件恢复缓存，已经过期的条目会被忽略，其余的按剩余时间缓存。
+//
+// 恢复的条目在第一次命中时会把其IP重新添加到名单集中，
+// 因为启动时名单集可能还没有创建。
+//
+// 文件不存在时什么也不做。返回恢复的条目数。
+func (s *Server) LoadCache(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if !bytes.HasPrefix(data, []byte(cacheFileMagic)) {
+		return 0, errors.New(`缓存文件格式不正确`)
+	}
+
+	r := bufio.NewReader(bytes.NewReader(data[len(cacheFileMagic):]))
+	now := time.Now()
+	n := 0
+	for {
+		expires, err := binary.ReadUvarint(r)
+		if err != nil {
+			if err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+		verdict, err := r.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		subnetSize, err := binary.ReadUvarint(r)
+		if err != nil {
+			return n, err
+		}
+		subnetText := make([]byte, subnetSize)
+		if _, err := io.ReadFull(r, subnetText); err != nil {
+			return n, err
+		}
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return n, err
+		}
+		packed := make([]byte, size)
+		if _, err := io.ReadFull(r, packed); err != nil {
+			return n, err
+		}
+
+		ttl := time.Unix(int64(expires), 0).Sub(now)
+		if ttl <= 0 {
+			continue
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(packed); err != nil || len(msg.Question) != 1 {
+			continue
+		}
+		q := msg.Question[0]
+		// 虚假IP模式或者虚假IP段有变化、或者虚假IP已经被回收时，不再有效。
+		if verdict == verdictFake {
+			ip, ok := s.fakeIPOf(msg)
+			if !ok || !s.fakeIPs.restore(strings.ToLower(strings.TrimSuffix(q.Name, `.`)), ip) {
+				continue
+			}
+		}
+		key := cacheKey{
+			name:  q.Name,
+			typ:   dns.Type(q.Qtype),
+			class: dns.Class(q.Qclass),
+		}
+		if len(subnetText) > 0 {
+			// ECS 配置有变化时不会再命中，等待过期。
+			key.subnet, _ = netip.ParsePrefix(string(subnetText))
+		}
+		stats := &cacheStats{}
+		stats.restored.Store(true)
+		s.cache.Set(key, cacheValue{msg: msg, white: verdict == verdictChina, stats: stats}, ttl)
+		n++
+	}
+}
@@ -2,144 +2,300 @@ package dns
 
 import (
 	"fmt"
-	"iter"
 	"log"
 	"net"
 	"net/netip"
 	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/movsb/gun/pkg/rules"
 	"github.com/movsb/gun/pkg/utils"
 	"github.com/phuslu/lru"
 	"go4.org/netipx"
+	"golang.org/x/sync/singleflight"
 )
 
 // 考虑用 https://github.com/phuslu/fastdns 代替 miekg/dns。
 
 // 一个基于内存的DNS服务器。
 //
-// 这里面的大部分数据库结构都没有加锁，
-// 所以只能一次性初始化完成，不能运行时修改。
+// 域名和路由列表整体存放在 lists 中，运行时可以通过 Reload 原子地替换。
+// 其它字段只能一次性初始化完成，不能运行时修改。
 type Server struct {
 	srv *dns.Server
 	mux *dns.ServeMux
 
-	// 国外走TCP。
-	tcp *dns.Client
-	// 国内走UDP。
-	udp *dns.Client
-
 	// 国内上游与国外上游。
-	chinaUpstream  string
-	bannedUpstream string
-
-	// 没有加最后的 . 的域名后缀列表。
-	chinaDomainsSuffixes map[string]struct{}
-	bannedDomainSuffixes map[string]struct{}
-
-	// 中国路由段（IPv4 & IPv6）
-	chinaRoutes *netipx.IPSet
+	// 普通DNS国内走UDP、国外走TCP。
+	chinaUpstreams  *upstreams
+	bannedUpstreams *upstreams
+	chinaStrategy   Strategy
+	bannedStrategy  Strategy
 
-	// 被屏蔽的完整域名。
-	blockedDomains map[string]struct{}
+	lists atomic.Pointer[lists]
 
 	whiteSet4, blackSet4 string
 	whiteSet6, blackSet6 string
 
+	// 把IP添加到名单集的方法，默认为 ipset。
+	addIPSet func(name string, ips []netip.Addr, timeout time.Duration)
+
+	// 学习到的IP在名单集中的最短保留时间。
+	minSetTTL time.Duration
+
 	// 基于内存的缓存。
-	cache *lru.TTLCache[cacheKey, cacheValue]
+	cache     *lru.TTLCache[cacheKey, cacheValue]
+	cacheSize int
+
+	// 正在向上游查询的请求，相同的请求只查询一次。
+	inflight singleflight.Group
 
 	// 是否丢弃IPv6查询结果。
 	dropIPv6Records bool
+
+	// 虚假IP池，为空表示没有开启虚假IP模式。
+	fakeIPs *fakeIPPool
+	// 虚假IP模式下应答真实IP的客户端。
+	realIPClients *netipx.IPSet
+
+	// 本地域名记录，为空表示没有。
+	hosts *Hosts
+
+	// 附加在国内查询中的 ECS，为空表示不附加。
+	ecs *ECS
+
+	// 被屏蔽的域名的应答方式及命中次数。
+	blockMode BlockMode
+	blocks    blockStats
+}
+
+// 域名和路由列表。
+//
+// 创建后只读，更新时整体替换。
+type lists struct {
+	// 国内、国外的域名规则。
+	china  *rules.DomainSet
+	banned *rules.DomainSet
+
+	// 中国路由段（IPv4 & IPv6）
+	chinaRoutes *netipx.IPSet
+
+	// 被屏蔽的域名规则，以及其中的例外规则（不屏蔽）。
+	blocked *rules.DomainSet
+	allowed *rules.DomainSet
+}
+
+// 把规则文件语法的域名规则编译成集合，无效的规则被忽略。
+func newDomainSet(lines []string) *rules.DomainSet {
+	set := &rules.DomainSet{}
+	for _, line := range lines {
+		d, err := rules.ParseDomain(line)
+		if err == nil {
+			err = set.Add(d)
+		}
+		if err != nil {
+			log.Println(`忽略无效的域名规则：`, line, err)
+		}
+	}
+	return set
+}
+
+// 域名匹配的结果。
+type matchResult int
+
+const (
+	matchNone matchResult = iota
+	matchChina
+	matchBanned
+)
+
+// 域名是否被屏蔽：都匹配时更具体的规则优先，相同时例外规则优先。
+func (l *lists) isBlocked(name string) bool {
+	blocked := l.blocked.Match(name)
+	return blocked > 0 && blocked > l.allowed.Match(name)
+}
+
+// 判断域名属于国内还是国外：都匹配时更具体的规则优先，相同时国内的优先。
+// 所以被墙列表中的例外规则（写入了国内列表）可以覆盖同一个域名。
+func (l *lists) match(name string) matchResult {
+	china, banned := l.china.Match(name), l.banned.Match(name)
+	switch {
+	case china == 0 && banned == 0:
+		return matchNone
+	case china >= banned:
+		return matchChina
+	default:
+		return matchBanned
+	}
+}
+
+func newLists(chinaDomains, bannedDomains []string, chinaRoutes []string, blockedDomains []string) *lists {
+	var blocked, allowed []string
+	for _, line := range blockedDomains {
+		if rest, ok := strings.CutPrefix(line, `@@`); ok {
+			allowed = append(allowed, rest)
+		} else {
+			blocked = append(blocked, line)
+		}
+	}
+
+	l := &lists{
+		china:   newDomainSet(chinaDomains),
+		banned:  newDomainSet(bannedDomains),
+		blocked: newDomainSet(blocked),
+		allowed: newDomainSet(allowed),
+	}
+
+	ipSetBuilder := netipx.IPSetBuilder{}
+	for _, r := range chinaRoutes {
+		if strings.IndexByte(r, '/') < 0 {
+			ip := netip.MustParseAddr(r)
+			ipSetBuilder.Add(ip)
+		} else {
+			prefix := netip.MustParsePrefix(r)
+			ipSetBuilder.AddPrefix(prefix)
+		}
+	}
+	l.chinaRoutes = utils.Must1(ipSetBuilder.IPSet())
+
+	return l
 }
 
 type cacheKey struct {
 	name  string
 	typ   dns.Type
 	class dns.Class
+	// 请求中的 ECS 子网，不同子网的应答可能不同。
+	subnet netip.Prefix
+	// 虚假IP模式下应答真实IP（给不经过代理的客户端）。
+	real bool
+}
+
+func keyOf(r *dns.Msg) cacheKey {
+	q := r.Question[0]
+	return cacheKey{
+		name:   q.Name,
+		typ:    dns.Type(q.Qtype),
+		class:  dns.Class(q.Qclass),
+		subnet: ecsOf(r),
+	}
+}
+
+// 请求的缓存键：经由 resolve 处理的请求使用其已经算好的键。
+func cacheKeyOf(w dns.ResponseWriter, r *dns.Msg) cacheKey {
+	if rec, ok := w.(*recorder); ok {
+		return rec.key
+	}
+	return keyOf(r)
+}
+
+func (k cacheKey) String() string {
+	s := k.name + ` ` + k.class.String() + ` ` + k.typ.String()
+	if k.subnet.IsValid() {
+		s += ` ` + k.subnet.String()
+	}
+	if k.real {
+		s += ` real`
+	}
+	return s
 }
 
 type cacheValue struct {
 	msg *dns.Msg
+	// 应答被判断为中国（白名单）还是外国（黑名单）。
+	white bool
+	// 用于预取热门的缓存。
+	stats *cacheStats
 }
 
+type cacheStats struct {
+	hits       atomic.Uint32
+	prefetched atomic.Bool
+	// 从文件恢复的、还没有重新添加到名单集的缓存。
+	restored atomic.Bool
+}
+
+const (
+	// 命中这么多次的缓存在快要过期时会被预取。
+	prefetchMinHits = 3
+	// 距离过期还有这么长时间时开始预取。
+	prefetchWindow = cacheTTL * time.Second / 10
+)
+
 func NewServer(port int,
-	chinaUpstream, bannedUpstream string,
+	chinaUpstreams, bannedUpstreams []string,
 	chinaDomains, bannedDomains []string,
 	chinaRoutes []string, blockedDomains []string,
 	whiteSet4, blackSet4, whiteSet6, blackSet6 string,
+	options ..._Option,
 ) *Server {
-	addPort := func(s string, port uint16) string {
-		_, _, err := net.SplitHostPort(s)
-		if err == nil {
-			return s
-		}
-		return net.JoinHostPort(s, fmt.Sprint(port))
-	}
-
 	s := &Server{
-		mux:   dns.NewServeMux(),
-		cache: lru.NewTTLCache[cacheKey, cacheValue](1024),
-
-		chinaUpstream:  addPort(chinaUpstream, 53),
-		bannedUpstream: addPort(bannedUpstream, 53),
-
-		chinaDomainsSuffixes: map[string]struct{}{},
-		bannedDomainSuffixes: map[string]struct{}{},
-		blockedDomains:       map[string]struct{}{},
-		chinaRoutes:          &netipx.IPSet{},
+		mux:       dns.NewServeMux(),
+		cacheSize: DefaultCacheSize,
 
 		whiteSet4: whiteSet4,
 		blackSet4: blackSet4,
 		whiteSet6: whiteSet6,
 		blackSet6: blackSet6,
 
-		// IPv6 测试不完整，先全部丢了。
+		addIPSet:  AddIPSet,
+		minSetTTL: DefaultMinSetTTL,
+		blockMode: BlockNXDomain,
+
+		// 默认丢弃，除非明确开启。
 		dropIPv6Records: true,
 	}
 
+	for _, opt := range options {
+		opt(s)
+	}
+
+	s.cache = lru.NewTTLCache[cacheKey, cacheValue](s.cacheSize)
+	s.chinaUpstreams = utils.Must1(newUpstreams(chinaUpstreams, `udp`, s.chinaStrategy))
+	s.bannedUpstreams = utils.Must1(newUpstreams(bannedUpstreams, `tcp`, s.bannedStrategy))
+	s.bannedUpstreams.stripECS = true
+
 	// 需要绑定到所有接口才能接受来自 --redirect --to-ports 的请求。
 	// 否则可能表现为：能收到路由器本身的DNS请求、收不到局域网其它主机的请求。
+	// 同时监听IPv4和IPv6，以便接受 ip6tables 重定向过来的请求。
 	s.srv = &dns.Server{
-		Net:     `udp4`,
-		Addr:    fmt.Sprintf(`0.0.0.0:%d`, port),
+		Net:     `udp`,
+		Addr:    fmt.Sprintf(`:%d`, port),
 		Handler: s.mux,
 	}
-	s.tcp = &dns.Client{
-		Net: `tcp`,
-	}
-	s.udp = &dns.Client{
-		Net: `udp`,
-	}
 	s.mux.HandleFunc(`.`, s.handleCached)
 
-	for _, d := range chinaDomains {
-		s.chinaDomainsSuffixes[d] = struct{}{}
-	}
-	for _, d := range bannedDomains {
-		s.bannedDomainSuffixes[d] = struct{}{}
-	}
-	for _, d := range blockedDomains {
-		s.blockedDomains[d] = struct{}{}
-	}
-
-	ipSetBuilder := netipx.IPSetBuilder{}
-	for _, r := range chinaRoutes {
-		if strings.IndexByte(r, '/') < 0 {
-			ip := netip.MustParseAddr(r)
-			ipSetBuilder.Add(ip)
-		} else {
-			prefix := netip.MustParsePrefix(r)
-			ipSetBuilder.AddPrefix(prefix)
-		}
-	}
-	s.chinaRoutes = utils.Must1(ipSetBuilder.IPSet())
+	s.lists.Store(newLists(chinaDomains, bannedDomains, chinaRoutes, blockedDomains))
 
 	return s
 }
 
+// 原子地替换域名和路由列表。
+//
+// 正在处理的请求仍然使用旧的列表。
+// 因为判断结果可能发生变化，缓存会被清空。
+func (s *Server) Reload(chinaDomains, bannedDomains []string, chinaRoutes []string, blockedDomains []string) {
+	s.lists.Store(newLists(chinaDomains, bannedDomains, chinaRoutes, blockedDomains))
+	for _, key := range s.cache.AppendKeys(nil) {
+		s.cache.Delete(key)
+	}
+	log.Println(`已重新加载域名和路由列表。`)
+}
+
+// 上游及屏蔽的统计信息。
+func (s *Server) Status() Status {
+	return Status{
+		ChinaStrategy:  s.chinaUpstreams.strategy,
+		BannedStrategy: s.bannedUpstreams.strategy,
+		China:          s.chinaUpstreams.status(),
+		Banned:         s.bannedUpstreams.status(),
+		Blocked:        s.blocks.status(s.blockMode),
+	}
+}
+
 func (s *Server) ListenAndServe() error {
 	return s.srv.ListenAndServe()
 }
@@ -150,23 +306,102 @@ func (s *Server) handleCached(w dns.ResponseWriter, r *dns.Msg) {
 		s.handleFallback(w, r)
 		return
 	}
-	q := r.Question[0]
-	key := cacheKey{
-		name:  q.Name,
-		typ:   dns.Type(q.Qtype),
-		class: dns.Class(q.Qclass),
+	// 本地记录不缓存，优先于屏蔽和分流。
+	if s.handleLocal(w, r) {
+		return
+	}
+	if s.ecs != nil {
+		if subnet := s.ecs.subnet(w.RemoteAddr()); subnet.IsValid() {
+			if r.IsEdns0() == nil {
+				w = &noEDNSWriter{ResponseWriter: w}
+			}
+			setECS(r, subnet)
+		}
+	}
+	key := keyOf(r)
+	key.real = s.wantsRealIP(w.RemoteAddr())
+	val, expires, found := s.cache.Peek(key)
+	// 虚假IP被回收后，缓存的应答不再有效。
+	if found && s.fakeIPRecycled(val.msg) {
+		s.cache.Delete(key)
+		found = false
 	}
-	val, _, found := s.cache.Peek(key)
 	if found {
 		rsp := val.msg.Copy()
 		rsp.Id = r.Id
 		s.writeMessage(w, rsp)
 		log.Println(`使用缓存：`, key.typ.String(), key.name)
+		if val.stats.restored.CompareAndSwap(true, false) {
+			s.saveIPSet(val.msg, val.white)
+		}
+		s.prefetch(key, r, val, time.Unix(0, expires))
 		return
 	}
 
-	// 优化：这里尚没有加锁，可能重复查询一个域名多次，然后缓存。
-	s.handle(w, r)
+	rsp, shared := s.resolve(key, w, r)
+	if shared {
+		rsp = rsp.Copy()
+		rsp.Id = r.Id
+		log.Println(`合并了相同的请求：`, key)
+	}
+	w.WriteMsg(rsp)
+}
+
+// 向上游查询，同时进行的相同请求只查询一次，返回的响应是共享的。
+//
+// w 只用于获取地址，可以为空（预取时）。
+func (s *Server) resolve(key cacheKey, w dns.ResponseWriter, r *dns.Msg) (_ *dns.Msg, shared bool) {
+	v, _, shared := s.inflight.Do(key.String(), func() (any, error) {
+		rec := &recorder{ResponseWriter: w, key: key}
+		s.handle(rec, r)
+		return rec.msg, nil
+	})
+	return v.(*dns.Msg), shared
+}
+
+// 热门的缓存在快要过期时在后台重新查询，以免之后的请求都需要等待上游。
+func (s *Server) prefetch(key cacheKey, r *dns.Msg, val cacheValue, expires time.Time) {
+	if val.stats.hits.Add(1) < prefetchMinHits || time.Until(expires) > prefetchWindow {
+		return
+	}
+	if !val.stats.prefetched.CompareAndSwap(false, true) {
+		return
+	}
+	log.Println(`预取缓存：`, key)
+	go s.resolve(key, nil, r.Copy())
+}
+
+// 记录下响应而不是发送，用于合并相同的请求。
+type recorder struct {
+	// 只用于获取地址，可能为空。
+	dns.ResponseWriter
+	// 请求的缓存键（预取时客户端地址未知，由此决定是否应答虚假IP）。
+	key cacheKey
+	msg *dns.Msg
+}
+
+func (r *recorder) WriteMsg(m *dns.Msg) error {
+	r.msg = m
+	return nil
+}
+
+// 客户端的IP，未知时无效。
+func addrOf(client net.Addr) netip.Addr {
+	var ip netip.Addr
+	switch a := client.(type) {
+	case *net.UDPAddr:
+		ip, _ = netip.AddrFromSlice(a.IP)
+	case *net.TCPAddr:
+		ip, _ = netip.AddrFromSlice(a.IP)
+	}
+	return ip.Unmap()
+}
+
+func (r *recorder) RemoteAddr() net.Addr {
+	if r.ResponseWriter == nil {
+		return &net.UDPAddr{}
+	}
+	return r.ResponseWriter.RemoteAddr()
 }
 
 func (s *Server) handle(w dns.ResponseWriter, r *dns.Msg) {
@@ -178,18 +413,17 @@ func (s *Server) handle(w dns.ResponseWriter, r *dns.Msg) {
 	q := r.Question[0]
 	if q.Qclass == dns.ClassINET {
 		if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
-			// 被查询的域名被会拆成后缀依次检测。
-			for suffix := range split(q.Name) {
-				_, inChina := s.chinaDomainsSuffixes[suffix]
-				if inChina {
-					s.handleChina(w, r)
-					return
-				}
-				_, banned := s.bannedDomainSuffixes[suffix]
-				if banned {
-					s.handleBanned(w, r)
+			switch s.lists.Load().match(q.Name) {
+			case matchChina:
+				s.handleChina(w, r)
+				return
+			case matchBanned:
+				if s.useFakeIP(w) {
+					s.handleFake(w, r)
 					return
 				}
+				s.handleBanned(w, r)
+				return
 			}
 			// 查询了一个既不在国内也不在国外列表内的域名。
 			// 分别向两个服务器查询，如果中国服务器返回的IP在路由范围内，
@@ -205,19 +439,18 @@ func (s *Server) handle(w dns.ResponseWriter, r *dns.Msg) {
 func (s *Server) handleBlocked(w dns.ResponseWriter, r *dns.Msg) bool {
 	q := r.Question[0]
 	d := strings.TrimSuffix(q.Name, `.`)
-	if _, ok := s.blockedDomains[d]; !ok {
+	if !s.lists.Load().isBlocked(d) {
 		return false
 	}
-	msg := dns.Msg{}
-	msg.SetRcode(r, dns.RcodeNameError)
-	s.writeMessage(w, &msg)
+	s.blocks.hit(strings.ToLower(d))
+	s.writeMessage(w, s.blockMode.reply(r))
 	log.Println(`屏蔽了域名访问：`, d)
 	return true
 }
 
 func (s *Server) handleChina(w dns.ResponseWriter, r *dns.Msg) {
 	log.Println(`处理中国请求：`, questionStrings(r.Question))
-	rsp, err := s.doExchange(s.udp, r, s.chinaUpstream)
+	rsp, err := s.chinaUpstreams.exchange(r)
 	if err != nil {
 		log.Println(err, questionStrings(r.Question))
 		dns.HandleFailed(w, r)
@@ -228,13 +461,13 @@ func (s *Server) handleChina(w dns.ResponseWriter, r *dns.Msg) {
 		return
 	}
 	s.saveIPSet(rsp, true)
-	s.saveCache(r.Question[0], rsp)
+	s.saveCache(w, r, rsp, true)
 	s.writeMessage(w, rsp)
 }
 
 func (s *Server) handleBanned(w dns.ResponseWriter, r *dns.Msg) {
 	log.Println(`处理外国请求：`, questionStrings(r.Question))
-	rsp, err := s.doExchange(s.tcp, r, s.bannedUpstream)
+	rsp, err := s.bannedUpstreams.exchange(r)
 	if err != nil {
 		log.Println(err, r)
 		dns.HandleFailed(w, r)
@@ -245,7 +478,7 @@ func (s *Server) handleBanned(w dns.ResponseWriter, r *dns.Msg) {
 		return
 	}
 	s.saveIPSet(rsp, false)
-	s.saveCache(r.Question[0], rsp)
+	s.saveCache(w, r, rsp, false)
 	s.writeMessage(w, rsp)
 }
 
@@ -257,13 +490,13 @@ func (s *Server) handleDetect(w dns.ResponseWriter, r *dns.Msg) {
 	var chinaRsp *dns.Msg
 	var chinaErr error
 	go func() {
-		chinaRsp, chinaErr = s.doExchange(s.udp, r.Copy(), s.chinaUpstream)
+		chinaRsp, chinaErr = s.chinaUpstreams.exchange(r.Copy())
 		ch <- `china`
 	}()
 	var bannedRsp *dns.Msg
 	var bannedErr error
 	go func() {
-		bannedRsp, bannedErr = s.doExchange(s.tcp, r.Copy(), s.bannedUpstream)
+		bannedRsp, bannedErr = s.bannedUpstreams.exchange(r.Copy())
 		ch <- `banned`
 	}()
 
@@ -277,19 +510,25 @@ func (s *Server) handleDetect(w dns.ResponseWriter, r *dns.Msg) {
 
 	// 中国的服务器响应了处于中国路由范围内的IP地址，被简单认为是中国IP。
 	if chinaErr == nil && chinaRsp.Rcode == dns.RcodeSuccess && len(chinaRsp.Answer) > 0 {
+		chinaRoutes := s.lists.Load().chinaRoutes
 		allInChina := true
 		for _, ans := range chinaRsp.Answer {
 			switch ans.Header().Rrtype {
 			case dns.TypeA:
 				a := ans.(*dns.A)
 				ip, _ := netip.AddrFromSlice(a.A)
-				white := s.chinaRoutes.Contains(ip)
+				white := chinaRoutes.Contains(ip)
+				allInChina = allInChina && white
+			case dns.TypeAAAA:
+				a := ans.(*dns.AAAA)
+				ip, _ := netip.AddrFromSlice(a.AAAA)
+				white := chinaRoutes.Contains(ip)
 				allInChina = allInChina && white
 			}
 		}
 		if allInChina {
 			s.saveIPSet(chinaRsp, true)
-			s.saveCache(r.Question[0], chinaRsp)
+			s.saveCache(w, r, chinaRsp, true)
 			s.writeMessage(w, chinaRsp)
 			log.Printf("检测为中国地址：%s\n%s", questionStrings(r.Question), answerStrings(chinaRsp.Answer))
 			return
@@ -303,8 +542,12 @@ func (s *Server) handleDetect(w dns.ResponseWriter, r *dns.Msg) {
 	}
 
 	if bannedErr == nil && bannedRsp.Rcode == dns.RcodeSuccess && len(bannedRsp.Answer) > 0 {
+		if s.useFakeIP(w) {
+			s.handleFake(w, r)
+			return
+		}
 		s.saveIPSet(bannedRsp, false)
-		s.saveCache(r.Question[0], bannedRsp)
+		s.saveCache(w, r, bannedRsp, false)
 		s.writeMessage(w, bannedRsp)
 		log.Printf("检测为外国地址：%s\n%s", questionStrings(r.Question), answerStrings(bannedRsp.Answer))
 		return
@@ -319,37 +562,65 @@ func (s *Server) handleDetect(w dns.ResponseWriter, r *dns.Msg) {
 	}
 }
 
-// 注意：没有设置过期时间。
 // TODO 不要把已经在路由列表里面的ip/net重复添加进去。
 func (s *Server) saveIPSet(rsp *dns.Msg, white bool) {
+	chinaRoutes := s.lists.Load().chinaRoutes
+	var ips4, ips6 []netip.Addr
 	for _, ans := range rsp.Answer {
 		switch ans.Header().Rrtype {
 		case dns.TypeA:
 			a := ans.(*dns.A)
 			ip, _ := netip.AddrFromSlice(a.A)
 			// 如果是白名单，且已存在，就不添加
-			if white && s.chinaRoutes.Contains(ip) {
+			if white && chinaRoutes.Contains(ip) {
 				// log.Println(`已存在于白名单中，不重复添加`)
 				continue
 			}
-			set := utils.IIF(white, s.whiteSet4, s.blackSet4)
-			AddIPSet(set, ip)
+			// 虚假IP段整体在黑名单集中。
+			if s.fakeIPs != nil && s.fakeIPs.contains(ip) {
+				continue
+			}
+			ips4 = append(ips4, ip)
 		case dns.TypeAAAA:
 			a := ans.(*dns.AAAA)
 			ip, _ := netip.AddrFromSlice(a.AAAA)
 			// 如果是白名单，且已存在，就不添加
-			if white && s.chinaRoutes.Contains(ip) {
+			if white && chinaRoutes.Contains(ip) {
 				// log.Println(`已存在于白名单中，不重复添加`)
 				continue
 			}
-			set := utils.IIF(white, s.whiteSet6, s.blackSet6)
-			AddIPSet(set, ip)
+			ips6 = append(ips6, ip)
+		}
+	}
+	timeout := s.setTimeout(rsp)
+	if len(ips4) > 0 {
+		s.addIPSet(utils.IIF(white, s.whiteSet4, s.blackSet4), ips4, timeout)
+	}
+	if len(ips6) > 0 {
+		s.addIPSet(utils.IIF(white, s.whiteSet6, s.blackSet6), ips6, timeout)
+	}
+}
+
+// 学习到的IP在名单集中的过期时间。
+//
+// 应答会被缓存 cacheTTL，客户端拿到之后还可能再缓存一个 TTL，
+// 在此期间访问的IP都应该仍然在名单集中，并且不短于 minSetTTL。
+func (s *Server) setTimeout(rsp *dns.Msg) time.Duration {
+	var maxTTL uint32
+	for _, rr := range rsp.Answer {
+		switch rr.Header().Rrtype {
+		case dns.TypeA, dns.TypeAAAA:
+			maxTTL = max(maxTTL, rr.Header().Ttl)
 		}
 	}
+	return max(s.minSetTTL, cacheTTL*time.Second+time.Duration(maxTTL)*time.Second)
 }
 
-func (s *Server) saveCache(q dns.Question, rsp *dns.Msg) {
-	minTTL := uint32(300)
+// 缓存时间（秒）。
+const cacheTTL = 300
+
+func (s *Server) saveCache(w dns.ResponseWriter, r *dns.Msg, rsp *dns.Msg, white bool) {
+	minTTL := uint32(cacheTTL)
 	for _, rr := range rsp.Answer {
 		ttl := rr.Header().Ttl
 		if ttl < minTTL {
@@ -357,23 +628,21 @@ func (s *Server) saveCache(q dns.Question, rsp *dns.Msg) {
 		}
 	}
 	if minTTL <= 0 {
-		log.Printf(`没有缓存：%v`, questionStrings([]dns.Question{q}))
+		log.Printf(`没有缓存：%v`, questionStrings(r.Question))
 		return
 	}
-	if minTTL < 300 {
-		minTTL = 300
+	if minTTL < cacheTTL {
+		minTTL = cacheTTL
 	}
 
-	key := cacheKey{
-		name:  q.Name,
-		typ:   dns.Type(q.Qtype),
-		class: dns.Class(q.Qclass),
-	}
+	key := cacheKeyOf(w, r)
 	s.cache.Set(key, cacheValue{
 		// 好像可以不用复制。
-		rsp.Copy(),
+		msg:   rsp.Copy(),
+		white: white,
+		stats: &cacheStats{},
 	}, time.Duration(time.Duration(minTTL)*time.Second))
-	log.Printf("写入缓存：%v %s\n%s", key.name, key.typ.String(), answerStrings(rsp.Answer))
+	log.Printf("写入缓存：%v\n%s", key, answerStrings(rsp.Answer))
 }
 
 func answerStrings(ans []dns.RR) string {
@@ -392,35 +661,8 @@ func questionStrings(qs []dns.Question) string {
 	return strings.Join(s, "\n")
 }
 
-// 把域名拆成后缀用于依次匹配。
-// abc.example.com. -> [abc.example.com, example.com, com]
-func split(domain string) iter.Seq[string] {
-	if domain[len(domain)-1] == '.' {
-		domain = domain[0 : len(domain)-1]
-	}
-	return func(yield func(string) bool) {
-		if !yield(domain) {
-			return
-		}
-		for {
-			dot := strings.IndexByte(domain, '.')
-			if dot < 0 {
-				return
-			}
-			remain := domain[dot+1:]
-			if len(remain) <= 0 {
-				return
-			}
-			if !yield(remain) {
-				return
-			}
-			domain = remain
-		}
-	}
-}
-
 func (s *Server) handleFallback(w dns.ResponseWriter, r *dns.Msg) {
-	rsp, err := s.doExchange(s.udp, r, s.chinaUpstream)
+	rsp, err := s.chinaUpstreams.exchange(r)
 	if err != nil {
 		log.Printf("dns forward error: %v\n%s", err, questionStrings(r.Question))
 		dns.HandleFailed(w, r)
@@ -449,27 +691,3 @@ func (s *Server) writeMessage(w dns.ResponseWriter, m *dns.Msg) {
 	}
 	w.WriteMsg(m)
 }
-
-// 有时会遇到服务器超时响应（非我方错误）的情况下是应该重试的。
-func (s *Server) doExchange(client *dns.Client, m *dns.Msg, server string) (rsp *dns.Msg, err error) {
-	exchange := func() {
-		rsp, _, err = client.Exchange(m, server)
-	}
-
-	for range 3 {
-		exchange()
-		if err == nil {
-			break
-		}
-		if strings.Contains(err.Error(), `i/o timeout`) {
-			time.Sleep(time.Second)
-			continue
-		}
-		if strings.Contains(err.Error(), `connect: network is unreachable`) {
-			break
-		}
-		log.Println(`其它未处理的DNS请求错误：`, err)
-	}
-
-	return
-}
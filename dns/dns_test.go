@@ -1,18 +1,155 @@
 package dns
 
 import (
+	"net"
+	"net/netip"
 	"slices"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/miekg/dns"
 )
 
-func TestSplit(t *testing.T) {
-	want := []string{`xxx.yyy.example.com`, `yyy.example.com`, `example.com`, `com`}
-	got := []string{}
+func TestListsMatch(t *testing.T) {
+	l := newLists(
+		[]string{`cn.google.com`, `full:www.baidu.com`, `regexp:^cdn\d+\.`},
+		[]string{`google.com`, `baidu.com`, `full:example.com`, `regexp:^g\d+\.`, `*.example.net`, `keyword:twitter`},
+		nil, []string{`*.ads.com`, `bad:rule`},
+	)
+	for name, want := range map[string]matchResult{
+		`www.google.com.`:   matchBanned,
+		`a.cn.Google.com.`:  matchChina,
+		`www.baidu.com.`:    matchChina,
+		`map.baidu.com.`:    matchBanned,
+		`example.com.`:      matchBanned,
+		`www.example.com.`:  matchNone,
+		`cdn1.example.org.`: matchChina,
+		`g2.example.org.`:   matchBanned,
+		`cdn1.google.com.`:  matchBanned,
+		`example.net.`:      matchNone,
+		`a.b.example.net.`:  matchBanned,
+		`twitter.cn.`:       matchBanned,
+	} {
+		if got := l.match(name); got != want {
+			t.Errorf(`%s: want %d, got %d`, name, want, got)
+		}
+	}
+	if l.blocked.Match(`a.b.ads.com`) == 0 || l.blocked.Match(`ads.com`) != 0 {
+		t.Error(`屏蔽列表不正确`)
+	}
+}
+
+type fakeWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *fakeWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *fakeWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{}
+}
+
+func TestInflightAndPrefetch(t *testing.T) {
+	s := NewServer(0,
+		[]string{`127.0.0.1`}, []string{`127.0.0.1`},
+		[]string{`example.com`}, nil, nil, nil,
+		`w4`, `b4`, `w6`, `b6`,
+	)
+	china := &fakeUpstream{name: `china`, delay: time.Millisecond * 100}
+	s.chinaUpstreams = &upstreams{strategy: StrategyFallback, list: []*upstream{{Upstream: china}}}
+
+	query := func() {
+		w := &fakeWriter{}
+		m := new(dns.Msg)
+		m.SetQuestion(`www.example.com.`, dns.TypeA)
+		s.handleCached(w, m)
+		if w.msg == nil || w.msg.Id != m.Id {
+			t.Errorf(`响应不正确：%v`, w.msg)
+		}
+	}
+
+	// 同时进行的相同请求只查询一次。
+	wg := sync.WaitGroup{}
+	for range 10 {
+		wg.Go(query)
+	}
+	wg.Wait()
+	if n := china.count.Load(); n != 1 {
+		t.Fatalf(`上游被查询了 %d 次`, n)
+	}
+
+	// 快要过期的热门缓存会被预取。
+	key := cacheKey{name: `www.example.com.`, typ: dns.Type(dns.TypeA), class: dns.Class(dns.ClassINET)}
+	val, _, _ := s.cache.Peek(key)
+	s.cache.Set(key, cacheValue{msg: val.msg, stats: &cacheStats{}}, prefetchWindow/2)
+	for range prefetchMinHits + 2 {
+		query()
+	}
+	for i := 0; china.count.Load() != 2; i++ {
+		if i > 20 {
+			t.Fatalf(`没有预取：%d`, china.count.Load())
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+func TestSaveAndLoadCache(t *testing.T) {
+	newServer := func() *Server {
+		return NewServer(0,
+			[]string{`127.0.0.1`}, []string{`127.0.0.1`},
+			nil, nil, nil, nil,
+			`w4`, `b4`, `w6`, `b6`,
+		)
+	}
+	set := func(s *Server, name string, white bool, ttl time.Duration) {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 600},
+			A:   net.IPv4(1, 2, 3, 4),
+		})
+		key := cacheKey{name: name, typ: dns.Type(dns.TypeA), class: dns.Class(dns.ClassINET)}
+		s.cache.Set(key, cacheValue{msg: m, white: white, stats: &cacheStats{}}, ttl)
+	}
+
+	s := newServer()
+	set(s, `china.example.`, true, time.Minute)
+	set(s, `banned.example.`, false, time.Minute)
+	set(s, `expired.example.`, false, time.Second)
+
+	path := t.TempDir() + `/` + CacheFileName
+	if n, err := s.SaveCache(path); err != nil || n != 3 {
+		t.Fatal(n, err)
+	}
+
+	// 即将过期的条目恢复时会被忽略。
+	time.Sleep(time.Second)
+
+	s = newServer()
+	var sets []string
+	s.addIPSet = func(name string, ips []netip.Addr, timeout time.Duration) {
+		sets = append(sets, name)
+	}
+	if n, err := s.LoadCache(path); err != nil || n != 2 {
+		t.Fatal(n, err)
+	}
 
-	for d := range split(`xxx.yyy.example.com.`) {
-		got = append(got, d)
+	// 第一次命中时把IP添加到对应的名单集。
+	for _, name := range []string{`china.example.`, `banned.example.`, `china.example.`} {
+		w := &fakeWriter{}
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		s.handleCached(w, m)
+		if w.msg == nil || len(w.msg.Answer) != 1 {
+			t.Fatalf(`没有使用缓存：%v`, w.msg)
+		}
 	}
-	if !slices.Equal(want, got) {
-		t.Fatal(`不相等：`, want, got)
+	if !slices.Equal(sets, []string{`w4`, `b4`}) {
+		t.Fatalf(`名单集不正确：%v`, sets)
 	}
 }
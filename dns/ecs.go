@@ -0,0 +1,182 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// EDNS Client Subnet（RFC 7871）：附加在发往国内上游的查询中，
+// 让国内的 CDN 按客户端（而不是路由器或者出口）所在的位置返回就近的节点。
+type ECS struct {
+	// 使用客户端地址所在的子网（IPv4 为 /24，IPv6 为 /56）。
+	// 局域网地址没有意义，使用 Subnet，没有时使用本机的公网地址所在的子网。
+	Client bool
+	// 固定的子网。
+	Subnet netip.Prefix
+
+	// 本机的公网地址所在的子网，无效表示没有。
+	wan func() netip.Prefix
+}
+
+const (
+	ecsClientBits4 = 24
+	ecsClientBits6 = 56
+)
+
+// 解析 ECS 配置：client、client,子网（局域网客户端使用此子网），或者子网（比如 1.2.3.0/24）。
+func ParseECS(s string) (*ECS, error) {
+	if rest, ok := strings.CutPrefix(s, `client`); ok {
+		e := &ECS{Client: true, wan: wanSubnet}
+		if rest == `` {
+			return e, nil
+		}
+		if rest, ok = strings.CutPrefix(rest, `,`); ok {
+			subnet, err := parseECSSubnet(rest)
+			e.Subnet = subnet
+			return e, err
+		}
+	}
+	subnet, err := parseECSSubnet(s)
+	if err != nil {
+		return nil, err
+	}
+	return &ECS{Subnet: subnet}, nil
+}
+
+func parseECSSubnet(s string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf(`ECS 不是 client 或者子网：%s`, s)
+	}
+	if !isPublic(prefix.Addr()) {
+		return netip.Prefix{}, errors.New(`ECS 子网应该是公网地址`)
+	}
+	return prefix.Masked(), nil
+}
+
+// 运营商级 NAT 的地址段，也不是公网地址。
+var cgnat = netip.MustParsePrefix(`100.64.0.0/10`)
+
+func isPublic(ip netip.Addr) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !cgnat.Contains(ip)
+}
+
+// 本机的公网IPv4地址所在的 /24，没有时（比如在光猫或者运营商的NAT后面）无效。
+//
+// 拨号上网时地址会变，所以结果只缓存一分钟。
+func wanSubnet() netip.Prefix {
+	wan.lock.Lock()
+	defer wan.lock.Unlock()
+	if time.Now().Before(wan.expires) {
+		return wan.prefix
+	}
+	wan.prefix, wan.expires = netip.Prefix{}, time.Now().Add(time.Minute)
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok {
+			ip, _ := netip.AddrFromSlice(n.IP)
+			if ip = ip.Unmap(); ip.Is4() && isPublic(ip) {
+				wan.prefix = netip.PrefixFrom(ip, ecsClientBits4).Masked()
+				break
+			}
+		}
+	}
+	return wan.prefix
+}
+
+var wan struct {
+	lock    sync.Mutex
+	prefix  netip.Prefix
+	expires time.Time
+}
+
+// 请求应该附加的子网，无效表示不附加。
+func (e *ECS) subnet(client net.Addr) netip.Prefix {
+	if !e.Client {
+		return e.Subnet
+	}
+	ip := addrOf(client)
+	if !isPublic(ip) {
+		if e.Subnet.IsValid() || e.wan == nil {
+			return e.Subnet
+		}
+		return e.wan()
+	}
+	bits := ecsClientBits4
+	if ip.Is6() {
+		bits = ecsClientBits6
+	}
+	return netip.PrefixFrom(ip, bits).Masked()
+}
+
+// 设置请求中的 ECS 选项，替换客户端自带的。
+func setECS(m *dns.Msg, subnet netip.Prefix) {
+	removeECS(m)
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		opt = m.IsEdns0()
+	}
+	family := uint16(1)
+	if subnet.Addr().Is6() {
+		family = 2
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: uint8(subnet.Bits()),
+		Address:       subnet.Addr().AsSlice(),
+	})
+}
+
+// 请求本来没有 EDNS 时，附加 ECS 的同时也附加了 OPT 记录。
+// 客户端不支持 EDNS，应答需要去掉 OPT 记录，UDP 应答还要截断到 512 字节（RFC 6891）。
+type noEDNSWriter struct {
+	dns.ResponseWriter
+}
+
+func (w *noEDNSWriter) WriteMsg(m *dns.Msg) error {
+	// 应答可能是共享的（缓存、合并的请求），不能直接修改。
+	m = m.Copy()
+	m.Extra = slices.DeleteFunc(m.Extra, func(rr dns.RR) bool {
+		return rr.Header().Rrtype == dns.TypeOPT
+	})
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		m.Truncate(dns.MinMsgSize)
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// 去掉 ECS 选项。
+func removeECS(m *dns.Msg) {
+	if opt := m.IsEdns0(); opt != nil {
+		opt.Option = slices.DeleteFunc(opt.Option, func(o dns.EDNS0) bool {
+			return o.Option() == dns.EDNS0SUBNET
+		})
+	}
+}
+
+// 请求中的 ECS 子网，没有时无效。
+func ecsOf(m *dns.Msg) netip.Prefix {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return netip.Prefix{}
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			ip, _ := netip.AddrFromSlice(e.Address)
+			if p, err := ip.Unmap().Prefix(int(e.SourceNetmask)); err == nil {
+				return p
+			}
+		}
+	}
+	return netip.Prefix{}
+}
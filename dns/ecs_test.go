@@ -0,0 +1,142 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// 记录收到的请求中的 ECS 子网。
+type ecsUpstream struct {
+	fakeUpstream
+	subnets []netip.Prefix
+}
+
+func (u *ecsUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	u.subnets = append(u.subnets, ecsOf(m))
+	rsp, err := u.fakeUpstream.Exchange(ctx, m)
+	if err == nil {
+		rsp.SetEdns0(dns.DefaultMsgSize, false)
+		setECS(rsp, ecsOf(m).Masked())
+	}
+	return rsp, err
+}
+
+type addrWriter struct {
+	fakeWriter
+	addr net.Addr
+}
+
+func (w *addrWriter) RemoteAddr() net.Addr { return w.addr }
+
+func TestECS(t *testing.T) {
+	ecs, err := ParseECS(`client`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecs.wan = func() netip.Prefix { return netip.MustParsePrefix(`9.9.9.0/24`) }
+	s := NewServer(0,
+		[]string{`127.0.0.1`}, []string{`127.0.0.1`},
+		[]string{`china.com`}, []string{`banned.com`}, nil, nil,
+		`w4`, `b4`, `w6`, `b6`,
+		WithECS(ecs),
+	)
+	s.addIPSet = func(name string, ips []netip.Addr, timeout time.Duration) {}
+	china, banned := &ecsUpstream{fakeUpstream: fakeUpstream{name: `china`}}, &ecsUpstream{fakeUpstream: fakeUpstream{name: `banned`}}
+	s.chinaUpstreams.list = []*upstream{{Upstream: china}}
+	s.bannedUpstreams.list = []*upstream{{Upstream: banned}}
+
+	query := func(client, name string) *dns.Msg {
+		w := &addrWriter{addr: &net.UDPAddr{IP: net.ParseIP(client), Port: 5353}}
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		setECS(m, netip.MustParsePrefix(`8.8.8.0/24`))
+		s.handleCached(w, m)
+		return w.msg
+	}
+
+	rsp := query(`1.2.3.4`, `www.china.com.`)
+	query(`1.2.3.5`, `www.china.com.`)
+	query(`5.6.7.8`, `www.china.com.`)
+	query(`192.168.1.2`, `www.china.com.`)
+	query(`1.2.3.4`, `www.banned.com.`)
+
+	// 同一个 /24 的客户端共用缓存，局域网客户端使用本机的公网地址所在的子网。
+	want := []netip.Prefix{
+		netip.MustParsePrefix(`1.2.3.0/24`),
+		netip.MustParsePrefix(`5.6.7.0/24`),
+		netip.MustParsePrefix(`9.9.9.0/24`),
+	}
+	if !slices.Equal(china.subnets, want) {
+		t.Fatalf(`国内上游收到的 ECS 不正确：%v`, china.subnets)
+	}
+	if len(banned.subnets) != 1 || banned.subnets[0].IsValid() {
+		t.Fatalf(`国外上游不应该收到 ECS：%v`, banned.subnets)
+	}
+	if rsp == nil || ecsOf(rsp).IsValid() {
+		t.Fatalf(`应答中不应该有 ECS：%v`, rsp)
+	}
+
+	// 请求没有 EDNS 时，应答中也不应该有。
+	w := &addrWriter{addr: &net.UDPAddr{IP: net.ParseIP(`1.2.3.4`), Port: 5353}}
+	m := new(dns.Msg)
+	m.SetQuestion(`www2.china.com.`, dns.TypeA)
+	s.handleCached(w, m)
+	if w.msg == nil || w.msg.IsEdns0() != nil {
+		t.Fatalf(`应答中不应该有 OPT 记录：%v`, w.msg)
+	}
+	if got := china.subnets[len(china.subnets)-1]; got != netip.MustParsePrefix(`1.2.3.0/24`) {
+		t.Fatalf(`国内上游收到的 ECS 不正确：%v`, got)
+	}
+
+	// 配置了子网时，局域网客户端使用配置的子网。
+	ecs, err = ParseECS(`client,4.3.2.0/24`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for client, want := range map[string]string{
+		`192.168.1.2`: `4.3.2.0/24`,
+		`100.64.1.2`:  `4.3.2.0/24`,
+		`1.2.3.4`:     `1.2.3.0/24`,
+	} {
+		if got := ecs.subnet(&net.UDPAddr{IP: net.ParseIP(client)}); got != netip.MustParsePrefix(want) {
+			t.Errorf(`%s: 子网不正确：%v`, client, got)
+		}
+	}
+
+	for _, s := range []string{`192.168.1.0/24`, `x`, `client,192.168.1.0/24`, `client,x`, `clientx`} {
+		if _, err := ParseECS(s); err == nil {
+			t.Errorf(`应该报错：%s`, s)
+		}
+	}
+}
+
+func TestNoEDNSWriter(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion(`example.com.`, dns.TypeA)
+	rsp := new(dns.Msg)
+	rsp.SetReply(m)
+	for i := range 100 {
+		rsp.Answer = append(rsp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: `example.com.`, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(1, 2, 3, byte(i)),
+		})
+	}
+	rsp.SetEdns0(dns.DefaultMsgSize, false)
+
+	fw := &fakeWriter{}
+	w := &noEDNSWriter{ResponseWriter: fw}
+	w.WriteMsg(rsp)
+	if fw.msg.IsEdns0() != nil || !fw.msg.Truncated || fw.msg.Len() > dns.MinMsgSize {
+		t.Fatalf(`应答没有去掉 OPT 或者没有截断：%d`, fw.msg.Len())
+	}
+	if rsp.IsEdns0() == nil || len(rsp.Answer) != 100 {
+		t.Fatal(`修改了原来的应答`)
+	}
+}
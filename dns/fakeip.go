@@ -0,0 +1,300 @@
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/movsb/gun/pkg/utils"
+)
+
+// 虚假IP应答的TTL（秒）。
+const fakeIPTTL = 60
+
+// 虚假IP段的最大前缀长度（/20 有 4094 个可用地址）。
+//
+// 地址太少时很快就会被回收，客户端（不遵守TTL的应用）还在使用的虚假IP会指向别的域名。
+const maxFakeIPBits = 20
+
+// 虚假IP池文件名（位于配置目录）。
+//
+// 与缓存文件分开保存：DNS配置变化时缓存文件会被删除，
+// 但是客户端可能还在使用之前分配的虚假IP，重启后不能分配给别的域名。
+const FakeIPFileName = `dns.fakeip.ro.txt`
+
+// 虚假IP池。
+//
+// 给国外域名分配虚假IP，出口通过虚假IP找回域名，按域名连接，
+// 这样与国内网站共用的CDN的IP就不会因为被添加到黑名单集而被错误地代理。
+//
+// 按顺序循环分配，用完后回收最早分配的IP。
+type fakeIPPool struct {
+	prefix netip.Prefix
+
+	lock   sync.Mutex
+	next   netip.Addr
+	byName map[string]netip.Addr
+	byIP   map[netip.Addr]string
+}
+
+func newFakeIPPool(prefix netip.Prefix) *fakeIPPool {
+	prefix = prefix.Masked()
+	return &fakeIPPool{
+		prefix: prefix,
+		next:   prefix.Addr().Next(),
+		byName: map[string]netip.Addr{},
+		byIP:   map[netip.Addr]string{},
+	}
+}
+
+func (p *fakeIPPool) contains(ip netip.Addr) bool {
+	return p.prefix.Contains(ip.Unmap())
+}
+
+// 取得域名的虚假IP，没有的话分配一个。
+//
+// name 是不带最后的 . 的小写域名。
+func (p *fakeIPPool) get(name string) netip.Addr {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if ip, ok := p.byName[name]; ok {
+		return ip
+	}
+
+	ip := p.next
+	p.next = ip.Next()
+	// 跳过网络地址和广播地址。
+	if !p.prefix.Contains(p.next.Next()) {
+		p.next = p.prefix.Addr().Next()
+	}
+	if old, ok := p.byIP[ip]; ok {
+		delete(p.byName, old)
+	}
+	p.set(name, ip)
+	return ip
+}
+
+// 从缓存恢复时重新建立映射。
+//
+// 虚假IP已经分配给了别的域名、或者域名已经有别的虚假IP时（池文件比缓存新）返回假。
+func (p *fakeIPPool) restore(name string, ip netip.Addr) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if old, ok := p.byIP[ip]; ok {
+		return old == name
+	}
+	if _, ok := p.byName[name]; ok {
+		return false
+	}
+	p.set(name, ip)
+	if ip.Compare(p.next) >= 0 && p.prefix.Contains(ip.Next().Next()) {
+		p.next = ip.Next()
+	}
+	return true
+}
+
+func (p *fakeIPPool) set(name string, ip netip.Addr) {
+	p.byName[name] = ip
+	p.byIP[ip] = name
+}
+
+func (p *fakeIPPool) lookup(ip netip.Addr) (string, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	name, ok := p.byIP[ip.Unmap()]
+	return name, ok
+}
+
+// 缓存的应答中的虚假IP是否已经被回收（分配给了别的域名）。
+func (s *Server) fakeIPRecycled(rsp *dns.Msg) bool {
+	ip, ok := s.fakeIPOf(rsp)
+	if !ok || len(rsp.Question) != 1 {
+		return false
+	}
+	name, _ := s.fakeIPs.lookup(ip)
+	return name != strings.ToLower(strings.TrimSuffix(rsp.Question[0].Name, `.`))
+}
+
+// 保存虚假IP池，在进程退出前调用。
+//
+// 文件格式：第一行是虚假IP段和下一个要分配的IP，之后每行是一个分配的IP和域名。
+//
+// 没有开启虚假IP模式时什么也不做。返回保存的条目数。
+func (s *Server) SaveFakeIPs(path string) (int, error) {
+	if s.fakeIPs == nil {
+		return 0, nil
+	}
+	p := s.fakeIPs
+	p.lock.Lock()
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintln(buf, p.prefix, p.next)
+	for ip, name := range p.byIP {
+		fmt.Fprintln(buf, ip, name)
+	}
+	n := len(p.byIP)
+	p.lock.Unlock()
+	return n, utils.WriteFileAtomic(path, func(w io.Writer) error {
+		_, err := buf.WriteTo(w)
+		return err
+	})
+}
+
+// 恢复虚假IP池，应该在恢复缓存之前调用。
+//
+// 文件不存在、没有开启虚假IP模式、或者虚假IP段有变化时什么也不做。返回恢复的条目数。
+func (s *Server) LoadFakeIPs(path string) (int, error) {
+	if s.fakeIPs == nil {
+		return 0, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	p := s.fakeIPs
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if !scanner.Scan() {
+		return 0, nil
+	}
+	header := strings.Fields(scanner.Text())
+	if len(header) != 2 {
+		return 0, fmt.Errorf(`虚假IP池文件格式不正确：%s`, scanner.Text())
+	}
+	prefix, err1 := netip.ParsePrefix(header[0])
+	next, err2 := netip.ParseAddr(header[1])
+	if err1 != nil || err2 != nil || prefix != p.prefix || !prefix.Contains(next) {
+		return 0, nil
+	}
+	p.next = next
+	n := 0
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		ip, err := netip.ParseAddr(fields[0])
+		if err != nil || !prefix.Contains(ip) {
+			continue
+		}
+		p.set(fields[1], ip)
+		n++
+	}
+	return n, scanner.Err()
+}
+
+// 通过虚假IP找回域名。
+//
+// 没有开启虚假IP模式、或者不是分配过的虚假IP时返回假。
+func (s *Server) LookupFakeIP(ip netip.Addr) (string, bool) {
+	if s.fakeIPs == nil {
+		return ``, false
+	}
+	return s.fakeIPs.lookup(ip)
+}
+
+// 客户端是否应该得到真实IP：不经过代理的客户端（direct、block）用不了虚假IP。
+func (s *Server) wantsRealIP(client net.Addr) bool {
+	if s.fakeIPs == nil || s.realIPClients == nil {
+		return false
+	}
+	return s.realIPClients.Contains(addrOf(client))
+}
+
+// 国外域名是否应答虚假IP。
+func (s *Server) useFakeIP(w dns.ResponseWriter) bool {
+	if s.fakeIPs == nil {
+		return false
+	}
+	rec, ok := w.(*recorder)
+	return !ok || !rec.key.real
+}
+
+// 查询域名的真实IPv4地址（不使用虚假IP），用于出口直连虚假IP对应的域名。
+//
+// 与不经过代理的客户端共用缓存。
+func (s *Server) LookupRealIP(name string) ([]netip.Addr, error) {
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	key := keyOf(r)
+	key.real = true
+
+	var rsp *dns.Msg
+	if val, _, found := s.cache.Peek(key); found {
+		rsp = val.msg
+	} else {
+		rsp, _ = s.resolve(key, nil, r)
+	}
+	if rsp == nil || rsp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf(`查询真实IP失败：%s`, name)
+	}
+	var ips []netip.Addr
+	for _, rr := range rsp.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			ip, _ := netip.AddrFromSlice(a.A)
+			ips = append(ips, ip.Unmap())
+		}
+	}
+	return ips, nil
+}
+
+// 国外域名应答虚假IP，不向上游查询、也不添加到名单集。
+//
+// 虚假IP只有IPv4的，AAAA查询应答为空。
+func (s *Server) handleFake(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	rsp := new(dns.Msg)
+	rsp.SetReply(r)
+	rsp.RecursionAvailable = true
+	if q.Qtype == dns.TypeA {
+		ip := s.fakeIPs.get(strings.ToLower(strings.TrimSuffix(q.Name, `.`)))
+		rsp.Answer = append(rsp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: fakeIPTTL},
+			A:   ip.AsSlice(),
+		})
+	}
+	s.saveCache(w, r, rsp, false)
+	s.writeMessage(w, rsp)
+	log.Printf("虚假IP：%s\n%s", questionStrings(r.Question), answerStrings(rsp.Answer))
+}
+
+// 应答中的虚假IP。
+func (s *Server) fakeIPOf(rsp *dns.Msg) (netip.Addr, bool) {
+	if s.fakeIPs == nil {
+		return netip.Addr{}, false
+	}
+	for _, rr := range rsp.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			ip, _ := netip.AddrFromSlice(a.A)
+			if s.fakeIPs.contains(ip) {
+				return ip.Unmap(), true
+			}
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// 解析虚假IP段：只能是IPv4地址段，并且不能小于 /20。
+func ParseFakeIPRange(s string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf(`虚假IP段不正确：%w`, err)
+	}
+	if !prefix.Addr().Is4() || prefix.Bits() > maxFakeIPBits {
+		return netip.Prefix{}, fmt.Errorf(`虚假IP段只能是不小于 /%d 的IPv4地址段：%s`, maxFakeIPBits, s)
+	}
+	return prefix.Masked(), nil
+}
@@ -0,0 +1,208 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestFakeIPPool(t *testing.T) {
+	p := newFakeIPPool(netip.MustParsePrefix(`10.0.0.0/30`))
+	a, b := p.get(`a.com`), p.get(`b.com`)
+	if a.String() != `10.0.0.1` || b.String() != `10.0.0.2` || p.get(`a.com`) != a {
+		t.Fatal(`分配不正确：`, a, b)
+	}
+	// 用完后回收最早分配的。
+	if c := p.get(`c.com`); c != a {
+		t.Fatal(`没有回收：`, c)
+	}
+	if name, ok := p.lookup(a); !ok || name != `c.com` {
+		t.Fatal(`反查不正确：`, name)
+	}
+	if _, ok := p.byName[`a.com`]; ok {
+		t.Fatal(`被回收的域名还在`)
+	}
+
+	for _, s := range []string{`10.0.0.0/31`, `10.0.0.0/24`, `fd00::/64`, `x`} {
+		if _, err := ParseFakeIPRange(s); err == nil {
+			t.Fatal(`应该报错：`, s)
+		}
+	}
+}
+
+func TestHandleFake(t *testing.T) {
+	s := NewServer(0,
+		[]string{`127.0.0.1`}, []string{`127.0.0.1`},
+		nil, []string{`example.com`}, nil, nil,
+		`w4`, `b4`, `w6`, `b6`,
+		WithFakeIP(netip.MustParsePrefix(`198.18.0.0/15`)),
+	)
+	s.addIPSet = func(name string, ips []netip.Addr, timeout time.Duration) {
+		t.Fatal(`虚假IP不应该添加到名单集：`, name, ips)
+	}
+
+	query := func(name string, typ uint16) *dns.Msg {
+		w := &fakeWriter{}
+		m := new(dns.Msg)
+		m.SetQuestion(name, typ)
+		s.handleCached(w, m)
+		return w.msg
+	}
+
+	rsp := query(`www.example.com.`, dns.TypeA)
+	if len(rsp.Answer) != 1 {
+		t.Fatal(`没有应答虚假IP：`, rsp)
+	}
+	ip, _ := netip.AddrFromSlice(rsp.Answer[0].(*dns.A).A)
+	if name, ok := s.LookupFakeIP(ip); !ok || name != `www.example.com` {
+		t.Fatal(`反查不正确：`, ip, name)
+	}
+	if rsp := query(`www.example.com.`, dns.TypeAAAA); rsp.Rcode != dns.RcodeSuccess || len(rsp.Answer) != 0 {
+		t.Fatal(`AAAA应答应该为空：`, rsp)
+	}
+
+	// 保存的缓存恢复后虚假IP仍然有效。
+	path := t.TempDir() + `/` + CacheFileName
+	if _, err := s.SaveCache(path); err != nil {
+		t.Fatal(err)
+	}
+	s2 := NewServer(0,
+		[]string{`127.0.0.1`}, []string{`127.0.0.1`},
+		nil, nil, nil, nil,
+		`w4`, `b4`, `w6`, `b6`,
+		WithFakeIP(netip.MustParsePrefix(`198.18.0.0/15`)),
+	)
+	if _, err := s2.LoadCache(path); err != nil {
+		t.Fatal(err)
+	}
+	if name, ok := s2.LookupFakeIP(ip); !ok || name != `www.example.com` {
+		t.Fatal(`恢复后反查不正确：`, ip, name)
+	}
+	if next := s2.fakeIPs.get(`other.com`); next == ip {
+		t.Fatal(`恢复后重复分配了：`, next)
+	}
+
+	// 缓存文件被删除后，虚假IP池仍然可以从单独的文件恢复。
+	poolPath := t.TempDir() + `/` + FakeIPFileName
+	if n, err := s2.SaveFakeIPs(poolPath); err != nil || n != 2 {
+		t.Fatal(`保存虚假IP池失败：`, n, err)
+	}
+	s3 := NewServer(0,
+		[]string{`127.0.0.1`}, []string{`127.0.0.1`},
+		nil, nil, nil, nil,
+		`w4`, `b4`, `w6`, `b6`,
+		WithFakeIP(netip.MustParsePrefix(`198.18.0.0/15`)),
+	)
+	if n, err := s3.LoadFakeIPs(poolPath); err != nil || n != 2 {
+		t.Fatal(`恢复虚假IP池失败：`, n, err)
+	}
+	if name, ok := s3.LookupFakeIP(ip); !ok || name != `www.example.com` {
+		t.Fatal(`恢复虚假IP池后反查不正确：`, ip, name)
+	}
+	if next := s3.fakeIPs.get(`third.com`); next == ip || next == s2.fakeIPs.byName[`other.com`] {
+		t.Fatal(`恢复虚假IP池后重复分配了：`, next)
+	}
+}
+
+func TestFakeIPRecycled(t *testing.T) {
+	s := NewServer(0,
+		[]string{`127.0.0.1`}, []string{`127.0.0.1`},
+		nil, []string{`com`}, nil, nil,
+		`w4`, `b4`, `w6`, `b6`,
+		WithFakeIP(netip.MustParsePrefix(`198.18.0.0/15`)),
+	)
+	s.fakeIPs = newFakeIPPool(netip.MustParsePrefix(`10.0.0.0/30`))
+	s.addIPSet = func(name string, ips []netip.Addr, timeout time.Duration) {}
+
+	query := func(name string) netip.Addr {
+		w := &fakeWriter{}
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		s.handleCached(w, m)
+		ip, _ := netip.AddrFromSlice(w.msg.Answer[0].(*dns.A).A)
+		return ip
+	}
+
+	a := query(`a.com.`)
+	query(`b.com.`)
+	// 回收了 a.com 的虚假IP。
+	if c := query(`c.com.`); c != a {
+		t.Fatal(`没有回收：`, c)
+	}
+	// 缓存中 a.com 的应答不应该再被使用。
+	if ip := query(`a.com.`); ip == a {
+		t.Fatal(`使用了被回收的虚假IP：`, ip)
+	} else if name, _ := s.LookupFakeIP(ip); name != `a.com` {
+		t.Fatal(`反查不正确：`, ip, name)
+	}
+}
+
+func TestRealIPClients(t *testing.T) {
+	s := NewServer(0,
+		[]string{`127.0.0.1`}, []string{`127.0.0.1`},
+		nil, []string{`example.com`}, nil, nil,
+		`w4`, `b4`, `w6`, `b6`,
+		WithFakeIP(netip.MustParsePrefix(`198.18.0.0/15`)),
+		WithRealIPClients([]netip.Prefix{netip.MustParsePrefix(`192.168.1.100/32`)}),
+	)
+	s.bannedUpstreams = &upstreams{strategy: StrategyFallback, list: []*upstream{{Upstream: &fakeUpstream{name: `banned`}}}}
+	s.addIPSet = func(name string, ips []netip.Addr, timeout time.Duration) {}
+
+	query := func(client string) *dns.Msg {
+		w := &addrWriter{addr: &net.UDPAddr{IP: net.ParseIP(client), Port: 53}}
+		m := new(dns.Msg)
+		m.SetQuestion(`www.example.com.`, dns.TypeA)
+		s.handleCached(w, m)
+		return w.msg
+	}
+
+	for range 2 {
+		if rsp := query(`192.168.1.2`); len(rsp.Answer) != 1 {
+			t.Fatal(`普通客户端没有得到虚假IP：`, rsp)
+		}
+		// 不能使用缓存中的虚假IP。
+		if rsp := query(`192.168.1.100`); len(rsp.Answer) != 0 || len(rsp.Ns) != 1 {
+			t.Fatal(`不经过代理的客户端没有得到真实应答：`, rsp)
+		}
+	}
+}
+
+// 总是应答一个A记录的上游。
+type answerUpstream struct{ ip string }
+
+func (u *answerUpstream) String() string { return u.ip }
+
+func (u *answerUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	rsp := new(dns.Msg)
+	rsp.SetReply(m)
+	rsp.Answer = append(rsp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 600},
+		A:   net.ParseIP(u.ip),
+	})
+	return rsp, nil
+}
+
+func TestLookupRealIP(t *testing.T) {
+	s := NewServer(0,
+		[]string{`127.0.0.1`}, []string{`127.0.0.1`},
+		nil, []string{`example.com`}, nil, nil,
+		`w4`, `b4`, `w6`, `b6`,
+		WithFakeIP(netip.MustParsePrefix(`198.18.0.0/15`)),
+	)
+	s.bannedUpstreams = &upstreams{strategy: StrategyFallback, list: []*upstream{{Upstream: &answerUpstream{ip: `1.2.3.4`}}}}
+	s.addIPSet = func(name string, ips []netip.Addr, timeout time.Duration) {}
+
+	w := &fakeWriter{}
+	m := new(dns.Msg)
+	m.SetQuestion(`www.example.com.`, dns.TypeA)
+	s.handleCached(w, m)
+
+	ips, err := s.LookupRealIP(`www.example.com`)
+	if err != nil || len(ips) != 1 || ips[0].String() != `1.2.3.4` {
+		t.Fatal(`真实IP不正确：`, ips, err)
+	}
+}
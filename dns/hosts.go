@@ -0,0 +1,326 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// 本地记录的应答的TTL。
+	hostsTTL = 60
+	// 至少间隔这么长时间才检查一次文件是否有变化。
+	hostsCheckInterval = time.Second * 10
+	// 别名最多的跳转次数。
+	maxAliasDepth = 8
+)
+
+// 本地域名记录：配置中的记录、hosts 文件、DHCP 租约文件。
+//
+// 文件有变化时会自动重新读取（DHCP 租约会随时变化）。
+type Hosts struct {
+	records     map[string][]string
+	files       []string
+	leases      []string
+	leaseDomain string
+
+	table atomic.Pointer[hostsTable]
+
+	lock    sync.Mutex
+	checked time.Time
+	mtimes  map[string]time.Time
+}
+
+type hostsTable struct {
+	// 没有加最后的 . 的小写域名。
+	addrs   map[string][]netip.Addr
+	aliases map[string]string
+	// 反向域名（x.x.x.x.in-addr.arpa.）-> 域名。
+	ptrs map[string]string
+}
+
+// 创建本地域名记录。
+//
+// records：域名 -> IP列表，或者另一个域名（别名，只能有一个）；
+// files：hosts 格式的文件；
+// leases：dnsmasq 或者 odhcpd 的租约文件，其中的主机名在 leaseDomain 不为空时还会加上此后缀。
+func NewHosts(records map[string][]string, files, leases []string, leaseDomain string) (*Hosts, error) {
+	for name, values := range records {
+		if len(values) == 0 {
+			return nil, fmt.Errorf(`本地域名没有记录：%s`, name)
+		}
+		for _, v := range values {
+			if _, err := netip.ParseAddr(v); err != nil && len(values) > 1 {
+				return nil, fmt.Errorf(`本地域名的别名只能有一个：%s`, name)
+			}
+		}
+	}
+	h := &Hosts{
+		records:     records,
+		files:       files,
+		leases:      leases,
+		leaseDomain: strings.Trim(leaseDomain, `.`),
+		mtimes:      map[string]time.Time{},
+	}
+	h.load()
+	return h, nil
+}
+
+// 返回最新的记录，文件有变化时重新读取。
+func (h *Hosts) get() *hostsTable {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if time.Since(h.checked) >= hostsCheckInterval {
+		h.checked = time.Now()
+		for _, path := range slices.Concat(h.files, h.leases) {
+			var mtime time.Time
+			if info, err := os.Stat(path); err == nil {
+				mtime = info.ModTime()
+			}
+			if !mtime.Equal(h.mtimes[path]) {
+				h.load()
+				break
+			}
+		}
+	}
+	return h.table.Load()
+}
+
+func (h *Hosts) load() {
+	t := &hostsTable{
+		addrs:   map[string][]netip.Addr{},
+		aliases: map[string]string{},
+		ptrs:    map[string]string{},
+	}
+	add := func(name string, ip netip.Addr) {
+		name = strings.ToLower(strings.TrimSuffix(name, `.`))
+		ip = ip.Unmap()
+		for _, a := range t.addrs[name] {
+			if a == ip {
+				return
+			}
+		}
+		t.addrs[name] = append(t.addrs[name], ip)
+		if rev, err := dns.ReverseAddr(ip.String()); err == nil {
+			if _, ok := t.ptrs[rev]; !ok {
+				t.ptrs[rev] = name
+			}
+		}
+	}
+
+	// 文件中的记录先添加，配置中的记录覆盖文件中的同名记录。
+	for _, path := range h.files {
+		h.readFile(path, false, func(fields []string) {
+			ip, err := netip.ParseAddr(fields[0])
+			if err != nil {
+				return
+			}
+			for _, name := range fields[1:] {
+				add(name, ip)
+			}
+		})
+	}
+	for _, path := range h.leases {
+		h.readFile(path, true, func(fields []string) {
+			ip, host, ok := parseLease(fields)
+			if !ok {
+				return
+			}
+			add(host, ip)
+			if h.leaseDomain != `` {
+				add(host+`.`+h.leaseDomain, ip)
+			}
+		})
+	}
+	for name, values := range h.records {
+		name = strings.ToLower(strings.TrimSuffix(name, `.`))
+		delete(t.addrs, name)
+		if _, err := netip.ParseAddr(values[0]); err != nil {
+			t.aliases[name] = strings.ToLower(strings.TrimSuffix(values[0], `.`))
+			continue
+		}
+		for _, v := range values {
+			add(name, netip.MustParseAddr(v))
+		}
+	}
+
+	h.table.Store(t)
+}
+
+// 逐行读取文件（去掉 hosts 格式的注释），文件不存在时忽略。
+func (h *Hosts) readFile(path string, lease bool, line func(fields []string)) {
+	fp, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println(`读取本地域名文件失败：`, err)
+		}
+		h.mtimes[path] = time.Time{}
+		return
+	}
+	defer fp.Close()
+	if info, err := fp.Stat(); err == nil {
+		h.mtimes[path] = info.ModTime()
+	}
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		text := scanner.Text()
+		// odhcpd 的租约以 # 开头，不能当作注释去掉。
+		if !lease || !strings.HasPrefix(text, `# `) {
+			if i := strings.IndexByte(text, '#'); i >= 0 {
+				text = text[:i]
+			}
+		}
+		if fields := strings.Fields(text); len(fields) >= 2 {
+			line(fields)
+		}
+	}
+}
+
+// 解析一行租约：
+//
+//	dnsmasq: <过期时间> <MAC> <IP> <主机名> <客户端编号>
+//	odhcpd:  # <接口> <DUID> <IAID> <主机名> <有效期> <编号> <前缀长度> <IP/长度>...
+//
+// 没有主机名（* 或者 -）的租约被忽略。
+func parseLease(fields []string) (netip.Addr, string, bool) {
+	var ipField, host string
+	switch {
+	case fields[0] == `#` && len(fields) >= 9:
+		host, ipField = fields[4], fields[8]
+	case len(fields) >= 4:
+		if _, err := strconv.ParseInt(fields[0], 10, 64); err != nil {
+			return netip.Addr{}, ``, false
+		}
+		host, ipField = fields[3], fields[2]
+	default:
+		return netip.Addr{}, ``, false
+	}
+	if host == `*` || host == `-` || host == `` {
+		return netip.Addr{}, ``, false
+	}
+	ipField, _, _ = strings.Cut(ipField, `/`)
+	ip, err := netip.ParseAddr(ipField)
+	if err != nil {
+		return netip.Addr{}, ``, false
+	}
+	return ip, host, true
+}
+
+// 用本地记录应答，不在本地记录中时返回 false。
+func (s *Server) handleLocal(w dns.ResponseWriter, r *dns.Msg) bool {
+	q := r.Question[0]
+	if s.hosts == nil || q.Qclass != dns.ClassINET {
+		return false
+	}
+	t := s.hosts.get()
+
+	if q.Qtype == dns.TypePTR {
+		name, ok := t.ptrs[strings.ToLower(q.Name)]
+		if !ok {
+			return false
+		}
+		msg := &dns.Msg{}
+		msg.SetReply(r)
+		msg.Authoritative = true
+		msg.Answer = append(msg.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: hostsTTL},
+			Ptr: dns.Fqdn(name),
+		})
+		s.writeMessage(w, msg)
+		return true
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(q.Name, `.`))
+	if _, ok := t.aliases[name]; ok {
+		s.handleAlias(w, r, t)
+		return true
+	}
+	addrs, ok := t.addrs[name]
+	if !ok {
+		return false
+	}
+	msg := &dns.Msg{}
+	msg.SetReply(r)
+	msg.Authoritative = true
+	msg.Answer = localAnswers(q.Name, q.Qtype, addrs)
+	// 本地记录总是直连。
+	s.saveIPSet(msg, true)
+	s.writeMessage(w, msg)
+	log.Println(`本地记录应答：`, questionStrings(r.Question))
+	return true
+}
+
+// 别名：应答 CNAME 记录，以及目标域名的记录（本地的，或者按正常的流程查询）。
+func (s *Server) handleAlias(w dns.ResponseWriter, r *dns.Msg, t *hostsTable) {
+	q := r.Question[0]
+	var cnames []dns.RR
+	current := q.Name
+	target := t.aliases[strings.ToLower(strings.TrimSuffix(current, `.`))]
+	for range maxAliasDepth {
+		cnames = append(cnames, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: current, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: hostsTTL},
+			Target: dns.Fqdn(target),
+		})
+		current = dns.Fqdn(target)
+		next, ok := t.aliases[target]
+		if !ok {
+			break
+		}
+		target = next
+	}
+
+	msg := &dns.Msg{}
+	target = strings.TrimSuffix(current, `.`)
+	if addrs, ok := t.addrs[target]; ok {
+		msg.SetReply(r)
+		msg.Authoritative = true
+		msg.Answer = localAnswers(current, q.Qtype, addrs)
+		s.saveIPSet(msg, true)
+	} else if _, ok := t.aliases[target]; ok {
+		// 别名的跳转次数太多。
+		msg.SetRcode(r, dns.RcodeServerFailure)
+		s.writeMessage(w, msg)
+		return
+	} else {
+		m := r.Copy()
+		m.Question[0].Name = current
+		rec := &recorder{ResponseWriter: w}
+		s.handleCached(rec, m)
+		if rec.msg == nil {
+			dns.HandleFailed(w, r)
+			return
+		}
+		msg = rec.msg.Copy()
+		msg.Id = r.Id
+		msg.Question = r.Question
+	}
+	msg.Answer = append(cnames, msg.Answer...)
+	s.writeMessage(w, msg)
+	log.Println(`本地别名应答：`, questionStrings(r.Question), `->`, current)
+}
+
+// 只应答与查询类型相同的记录，其它类型的查询应答为空。
+func localAnswers(name string, qtype uint16, addrs []netip.Addr) (answers []dns.RR) {
+	for _, ip := range addrs {
+		hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: hostsTTL}
+		switch {
+		case qtype == dns.TypeA && ip.Is4():
+			hdr.Rrtype = dns.TypeA
+			answers = append(answers, &dns.A{Hdr: hdr, A: ip.AsSlice()})
+		case qtype == dns.TypeAAAA && ip.Is6():
+			hdr.Rrtype = dns.TypeAAAA
+			answers = append(answers, &dns.AAAA{Hdr: hdr, AAAA: ip.AsSlice()})
+		}
+	}
+	return
+}
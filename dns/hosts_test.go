@@ -0,0 +1,93 @@
+package dns
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestHosts(t *testing.T) {
+	dir := t.TempDir()
+	hostsFile := filepath.Join(dir, `hosts`)
+	os.WriteFile(hostsFile, []byte("127.0.0.1 localhost\n192.168.1.2 router router.lan # comment\n"), 0644)
+	dnsmasq := filepath.Join(dir, `dhcp.leases`)
+	os.WriteFile(dnsmasq, []byte("1700000000 aa:bb:cc:dd:ee:ff 192.168.1.20 laptop 01:aa:bb\n1700000000 aa:bb:cc:dd:ee:00 192.168.1.21 * *\n"), 0644)
+	odhcpd := filepath.Join(dir, `odhcpd`)
+	os.WriteFile(odhcpd, []byte("# br-lan 000100 1 phone 3600 a 128 fd00::20/128\n"), 0644)
+
+	h, err := NewHosts(map[string][]string{
+		`nas.lan`:    {`192.168.1.10`, `fd00::10`},
+		`router`:     {`192.168.1.1`},
+		`git.lan`:    {`nas.lan`},
+		`search.lan`: {`www.example.com`},
+	}, []string{hostsFile}, []string{dnsmasq, odhcpd}, `lan`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(0,
+		[]string{`127.0.0.1`}, []string{`127.0.0.1`},
+		nil, []string{`example.com`}, nil, nil,
+		`w4`, `b4`, `w6`, `b6`,
+		WithIPv6Records(), WithHosts(h),
+	)
+	s.addIPSet = func(name string, ips []netip.Addr, timeout time.Duration) {}
+	s.bannedUpstreams = &upstreams{strategy: StrategyFallback, list: []*upstream{{Upstream: &fakeUpstream{name: `banned`}}}}
+
+	query := func(name string, typ uint16) *dns.Msg {
+		w := &fakeWriter{}
+		m := new(dns.Msg)
+		m.SetQuestion(name, typ)
+		s.handleCached(w, m)
+		return w.msg
+	}
+	answers := func(m *dns.Msg) (list []string) {
+		for _, rr := range m.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				list = append(list, rr.A.String())
+			case *dns.AAAA:
+				list = append(list, rr.AAAA.String())
+			case *dns.CNAME:
+				list = append(list, rr.Target)
+			case *dns.PTR:
+				list = append(list, rr.Ptr)
+			}
+		}
+		return
+	}
+
+	for _, tc := range []struct {
+		name string
+		typ  uint16
+		want []string
+	}{
+		{`NAS.lan.`, dns.TypeA, []string{`192.168.1.10`}},
+		{`nas.lan.`, dns.TypeAAAA, []string{`fd00::10`}},
+		{`nas.lan.`, dns.TypeMX, nil},
+		{`router.`, dns.TypeA, []string{`192.168.1.1`}},
+		{`router.lan.`, dns.TypeA, []string{`192.168.1.2`}},
+		{`laptop.`, dns.TypeA, []string{`192.168.1.20`}},
+		{`laptop.lan.`, dns.TypeA, []string{`192.168.1.20`}},
+		{`phone.lan.`, dns.TypeAAAA, []string{`fd00::20`}},
+		{`git.lan.`, dns.TypeA, []string{`nas.lan.`, `192.168.1.10`}},
+		{`10.1.168.192.in-addr.arpa.`, dns.TypePTR, []string{`nas.lan.`}},
+	} {
+		rsp := query(tc.name, tc.typ)
+		if rsp == nil || rsp.Rcode != dns.RcodeSuccess || !slices.Equal(answers(rsp), tc.want) {
+			t.Errorf(`%s: 应答不正确：%v`, tc.name, rsp)
+		}
+	}
+
+	// 别名的目标不在本地时按正常的流程查询。
+	rsp := query(`search.lan.`, dns.TypeA)
+	if rsp == nil || rsp.Question[0].Name != `search.lan.` || !slices.Equal(answers(rsp), []string{`www.example.com.`}) ||
+		len(rsp.Ns) != 1 || rsp.Ns[0].(*dns.TXT).Txt[0] != `banned` {
+		t.Fatalf(`别名应答不正确：%v`, rsp)
+	}
+}
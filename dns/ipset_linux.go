@@ -3,25 +3,131 @@
 package dns
 
 import (
+	"fmt"
 	"log"
 	"net/netip"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/movsb/gun/pkg/shell"
 	"github.com/movsb/gun/pkg/utils"
 	"github.com/nadoo/ipset"
 )
 
-func init() {
+// 只有使用 ipset 的时候才需要初始化（nftables 下可能没有 ipset 模块）。
+var initIPSet = sync.OnceFunc(func() {
 	utils.Must(ipset.Init())
+})
+
+// 已经存在的IP会更新过期时间。
+func AddIPSet(name string, ips []netip.Addr, timeout time.Duration) {
+	initIPSet()
+	for _, ip := range ips {
+		opts := []ipset.Option{ipset.OptTimeout(uint32(timeout.Seconds()))}
+		if ip.Is6() {
+			opts = append(opts, ipset.OptIPv6())
+		}
+		if err := ipset.AddAddr(name, ip, opts...); err != nil {
+			log.Println(`未能将IP添加到名单：`, name, err)
+		} else {
+			log.Println(`已将IP添加到名单：`, name, ip)
+		}
+	}
+}
+
+// 添加到 nftables 的命名集合中。
+//
+// 在后台执行，不等待完成，见 addNFTBatched。
+//
+// add 不会更新已经存在的元素的过期时间，所以在同一个事务中先确保存在、再删除、再添加，
+// 任何时刻都不会缺少元素。如果失败（比如与文件中的网段重叠），退回到只添加。
+func AddNFTSet(table string, name string, ips []netip.Addr, timeout time.Duration) {
+	var elements, timed []string
+	for _, ip := range ips {
+		elements = append(elements, ip.String())
+		timed = append(timed, fmt.Sprintf(`%s timeout %ds`, ip, int(timeout.Seconds())))
+	}
+	element := func(op string, elements []string) string {
+		return fmt.Sprintf("%s element inet %s %s { %s }\n", op, table, name, strings.Join(elements, `, `))
+	}
+
+	addNFTBatched(&nftAdd{
+		name:     name,
+		ips:      ips,
+		script:   element(`add`, timed) + element(`delete`, elements) + element(`add`, timed),
+		fallback: element(`add`, timed),
+	})
+}
+
+// 一次 AddNFTSet 调用要执行的脚本。
+type nftAdd struct {
+	name     string
+	ips      []netip.Addr
+	script   string
+	fallback string
+}
+
+// 等待执行的 nftAdd。
+var nftBatch struct {
+	lock    sync.Mutex
+	running bool
+	pending []*nftAdd
+}
+
+// 执行 nft 脚本，测试时替换。
+var runNFT = func(script string) (err error) {
+	defer utils.CatchAsError(&err)
+	shell.Run(`nft -f -`, shell.WithStdin(strings.NewReader(script)))
+	return nil
 }
 
-func AddIPSet(name string, ip netip.Addr) {
-	opts := []ipset.Option{}
-	if ip.Is6() {
-		opts = append(opts, ipset.OptIPv6())
+// 每个DNS应答都启动一个 nft 进程太慢了，也不能让应答等待 nft 执行完成，
+// 所以添加只是排队，由后台合并到一个事务中执行：
+// 没有正在执行的 nft 时立即执行，否则等当前的执行结束后，与其它排队的一起执行。
+//
+// 客户端可能在IP被添加之前就开始连接，这时的连接会走错路径，之后的连接正常。
+func addNFTBatched(a *nftAdd) {
+	nftBatch.lock.Lock()
+	defer nftBatch.lock.Unlock()
+	nftBatch.pending = append(nftBatch.pending, a)
+	if !nftBatch.running {
+		nftBatch.running = true
+		go flushNFT()
 	}
-	if err := ipset.AddAddr(name, ip, opts...); err != nil {
-		log.Println(`未能将IP添加到名单：`, name, err)
-	} else {
-		log.Println(`已将IP添加到名单：`, name, ip)
+}
+
+func flushNFT() {
+	for {
+		nftBatch.lock.Lock()
+		batch := nftBatch.pending
+		nftBatch.pending = nil
+		if len(batch) == 0 {
+			nftBatch.running = false
+			nftBatch.lock.Unlock()
+			return
+		}
+		nftBatch.lock.Unlock()
+
+		var script strings.Builder
+		for _, a := range batch {
+			script.WriteString(a.script)
+		}
+		errs := make([]error, len(batch))
+		if err := runNFT(script.String()); err != nil {
+			// 整个事务都失败了，逐个执行，以免影响其它的。
+			for i, a := range batch {
+				if len(batch) == 1 || runNFT(a.script) != nil {
+					errs[i] = runNFT(a.fallback)
+				}
+			}
+		}
+		for i, a := range batch {
+			if errs[i] != nil {
+				log.Println(`未能将IP添加到名单：`, a.name, errs[i])
+			} else {
+				log.Println(`已将IP添加到名单：`, a.name, a.ips)
+			}
+		}
 	}
 }
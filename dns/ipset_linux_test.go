@@ -0,0 +1,77 @@
+//go:build linux
+
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAddNFTSetBatched(t *testing.T) {
+	old := runNFT
+	defer func() { runNFT = old }()
+
+	var (
+		lock    sync.Mutex
+		scripts []string
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+	runNFT = func(script string) error {
+		lock.Lock()
+		scripts = append(scripts, script)
+		first := len(scripts) == 1
+		lock.Unlock()
+		if first {
+			close(started)
+			<-release
+		}
+		if strings.Contains(script, `1.1.1.3 `) {
+			return errors.New(`overlaps`)
+		}
+		return nil
+	}
+
+	add := func(ip string) {
+		AddNFTSet(`gun`, `set`, []netip.Addr{netip.MustParseAddr(ip)}, time.Minute)
+	}
+	// 等待后台执行完成。
+	wait := func() {
+		for {
+			nftBatch.lock.Lock()
+			running := nftBatch.running
+			nftBatch.lock.Unlock()
+			if !running {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// 不等待执行完成：第一个立即执行，执行期间的添加合并到下一次执行中。
+	add(`1.1.1.1`)
+	<-started
+	for i := range 3 {
+		add(fmt.Sprintf(`2.2.2.%d`, i))
+	}
+	close(release)
+	wait()
+
+	if len(scripts) != 2 || strings.Count(scripts[1], `delete element`) != 3 {
+		t.Fatalf("没有合并执行：%q", scripts)
+	}
+
+	// 合并的事务失败时，逐个执行，失败的退回到只添加。
+	scripts = nil
+	started = make(chan struct{})
+	add(`1.1.1.3`)
+	wait()
+	if len(scripts) != 2 || strings.Contains(scripts[1], `delete`) {
+		t.Fatalf("没有退回到只添加：%q", scripts)
+	}
+}
@@ -2,6 +2,11 @@
 
 package dns
 
-import "net/netip"
+import (
+	"net/netip"
+	"time"
+)
 
-func AddIPSet(name string, ip netip.Addr) {}
+func AddIPSet(name string, ips []netip.Addr, timeout time.Duration) {}
+
+func AddNFTSet(table string, name string, ips []netip.Addr, timeout time.Duration) {}
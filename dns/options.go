@@ -0,0 +1,114 @@
+package dns
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/movsb/gun/pkg/utils"
+	"go4.org/netipx"
+)
+
+type _Option func(s *Server)
+
+// 如果 cond 为 true，则 opt 会被应用，否则 opt 会被忽略。
+func WithIf(cond bool, opt _Option) _Option {
+	return func(s *Server) {
+		if cond {
+			opt(s)
+		}
+	}
+}
+
+// 保留IPv6查询结果（AAAA记录）。
+//
+// 默认会丢弃，仅当局域网内的IPv6流量也被代理时才应该保留。
+func WithIPv6Records() _Option {
+	return func(s *Server) {
+		s.dropIPv6Records = false
+	}
+}
+
+// 使用 nftables 的命名集合（位于 table 表中）代替 ipset。
+func WithNFTSets(table string) _Option {
+	return func(s *Server) {
+		s.addIPSet = func(name string, ips []netip.Addr, timeout time.Duration) {
+			AddNFTSet(table, name, ips, timeout)
+		}
+	}
+}
+
+// 默认的学习到的IP在名单集中的最短保留时间。
+const DefaultMinSetTTL = time.Hour
+
+// 学习到的IP在名单集中的最短保留时间。
+//
+// 实际的过期时间由应答的TTL决定，但不会短于此值。为 0 时使用默认值。
+func WithMinSetTTL(ttl time.Duration) _Option {
+	return func(s *Server) {
+		if ttl > 0 {
+			s.minSetTTL = ttl
+		}
+	}
+}
+
+// 中国、国外上游各有多个上游时的选择策略。默认为 fallback。
+func WithUpstreamStrategy(china, banned Strategy) _Option {
+	return func(s *Server) {
+		s.chinaStrategy = china
+		s.bannedStrategy = banned
+	}
+}
+
+// 缓存的最大条目数。为 0 时使用默认值。
+func WithCacheSize(size int) _Option {
+	return func(s *Server) {
+		if size > 0 {
+			s.cacheSize = size
+		}
+	}
+}
+
+// 开启虚假IP模式：国外域名应答 prefix 内的虚假IP，出口通过 LookupFakeIP 找回域名。
+//
+// prefix 只能是IPv4地址段，并且需要整体被添加到黑名单集中。
+func WithFakeIP(prefix netip.Prefix) _Option {
+	return func(s *Server) {
+		s.fakeIPs = newFakeIPPool(prefix)
+	}
+}
+
+// 虚假IP模式下应答真实IP的客户端。
+//
+// 不经过代理的客户端（direct、block）访问虚假IP不会被转换，需要真实的IP。
+func WithRealIPClients(clients []netip.Prefix) _Option {
+	return func(s *Server) {
+		var b netipx.IPSetBuilder
+		for _, p := range clients {
+			b.AddPrefix(p)
+		}
+		s.realIPClients = utils.Must1(b.IPSet())
+	}
+}
+
+// 被屏蔽的域名的应答方式。为空时使用默认值（nxdomain）。
+func WithBlockMode(mode BlockMode) _Option {
+	return func(s *Server) {
+		if mode != `` {
+			s.blockMode = mode
+		}
+	}
+}
+
+// 用本地记录应答（优先于屏蔽和分流）。
+func WithHosts(h *Hosts) _Option {
+	return func(s *Server) {
+		s.hosts = h
+	}
+}
+
+// 在发往国内上游的查询中附加 ECS（替换客户端自带的），国外上游的查询总是会去掉 ECS。
+func WithECS(ecs *ECS) _Option {
+	return func(s *Server) {
+		s.ecs = ecs
+	}
+}
@@ -0,0 +1,483 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/sync/singleflight"
+)
+
+// 上游服务器。
+//
+// 支持的地址格式：
+//   - a.b.c.d、a.b.c.d:53：普通DNS，协议由使用者决定（国内UDP、国外TCP）；
+//   - udp://a.b.c.d、tcp://a.b.c.d:53：指定协议的普通DNS；
+//   - tls://dns.google：DNS-over-TLS，默认端口 853；
+//   - https://dns.google/dns-query：DNS-over-HTTPS，默认端口 443；
+//   - quic://dns.adguard-dns.com：DNS-over-QUIC，默认端口 853。
+//
+// 主机是域名时，需要在 # 后面指定引导IP（多个以逗号分隔），
+// 比如：https://dns.google/dns-query#8.8.8.8,8.8.4.4，以免解析上游自己的域名时依赖自己。
+type Upstream interface {
+	Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+	// 原始地址，用于日志。
+	String() string
+}
+
+// 解析后的上游地址。
+type upstreamAddr struct {
+	raw    string
+	scheme string
+	// 主机名，也用于 TLS 的 ServerName。
+	host string
+	port string
+	// 仅 https。
+	path string
+	// 主机是IP时就是它，否则是引导IP。
+	ips []netip.Addr
+}
+
+func parseUpstreamAddr(s string, network string) (*upstreamAddr, error) {
+	raw := s
+	if !strings.Contains(s, `://`) {
+		s = network + `://` + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf(`无效的DNS上游：%s: %w`, raw, err)
+	}
+
+	a := &upstreamAddr{
+		raw:    raw,
+		scheme: u.Scheme,
+		host:   u.Hostname(),
+		port:   u.Port(),
+		path:   u.EscapedPath(),
+	}
+
+	var defaultPort string
+	switch a.scheme {
+	case `udp`, `tcp`:
+		defaultPort = `53`
+	case `tls`, `quic`:
+		defaultPort = `853`
+	case `https`:
+		defaultPort = `443`
+		if a.path == `` {
+			a.path = `/dns-query`
+		}
+	default:
+		return nil, fmt.Errorf(`不支持的DNS上游协议：%s`, raw)
+	}
+	if a.port == `` {
+		a.port = defaultPort
+	}
+	if a.host == `` {
+		return nil, fmt.Errorf(`DNS上游没有主机：%s`, raw)
+	}
+
+	if ip, err := netip.ParseAddr(a.host); err == nil {
+		a.ips = append(a.ips, ip.Unmap())
+	} else {
+		for p := range strings.SplitSeq(u.Fragment, `,`) {
+			if p = strings.TrimSpace(p); p == `` {
+				continue
+			}
+			ip, err := netip.ParseAddr(p)
+			if err != nil {
+				return nil, fmt.Errorf(`无效的DNS上游引导IP：%s: %w`, raw, err)
+			}
+			a.ips = append(a.ips, ip.Unmap())
+		}
+		if len(a.ips) == 0 {
+			return nil, fmt.Errorf(`DNS上游的主机是域名，需要在 # 后面指定引导IP：%s`, raw)
+		}
+		if a.scheme == `udp` || a.scheme == `tcp` {
+			return nil, fmt.Errorf(`普通DNS上游只能是IP：%s`, raw)
+		}
+	}
+
+	return a, nil
+}
+
+// 依次尝试每一个IP，返回第一个连接成功的。
+func (a *upstreamAddr) dial(ctx context.Context, network string) (net.Conn, error) {
+	var d net.Dialer
+	var errs []error
+	for _, ip := range a.ips {
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), a.port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// 解析上游地址。network 是普通DNS默认使用的协议：udp 或 tcp。
+func ParseUpstream(s string, network string) (Upstream, error) {
+	a, err := parseUpstreamAddr(s, network)
+	if err != nil {
+		return nil, err
+	}
+	switch a.scheme {
+	case `udp`, `tcp`:
+		return &plainUpstream{
+			addr:   a,
+			client: &dns.Client{Net: a.scheme},
+		}, nil
+	case `tls`:
+		return &tlsUpstream{
+			addr:   a,
+			config: &tls.Config{ServerName: a.host},
+			idle:   make(chan *dns.Conn, maxIdleConns),
+		}, nil
+	case `https`:
+		return newHTTPSUpstream(a), nil
+	case `quic`:
+		return &quicUpstream{
+			addr:   a,
+			config: &tls.Config{ServerName: a.host, NextProtos: []string{`doq`}},
+		}, nil
+	}
+	panic(`unreachable`)
+}
+
+// 上游（或者其引导）的所有IP。
+//
+// 防火墙需要据此决定到上游的流量是否经过代理。
+func UpstreamIPs(s string) ([]string, error) {
+	a, err := parseUpstreamAddr(s, `udp`)
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	for _, ip := range a.ips {
+		ips = append(ips, ip.String())
+	}
+	return ips, nil
+}
+
+// 每个上游最多保持的空闲连接数。
+const maxIdleConns = 4
+
+// 普通DNS，每次请求一个新连接。
+type plainUpstream struct {
+	addr   *upstreamAddr
+	client *dns.Client
+}
+
+func (u *plainUpstream) String() string { return u.addr.raw }
+
+func (u *plainUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	rsp, _, err := u.client.ExchangeContext(ctx, m, net.JoinHostPort(u.addr.ips[0].String(), u.addr.port))
+	return rsp, err
+}
+
+// DNS-over-TLS（RFC 7858）。
+//
+// 用完的连接放回空闲池复用，不使用流水线。
+type tlsUpstream struct {
+	addr   *upstreamAddr
+	config *tls.Config
+	idle   chan *dns.Conn
+}
+
+func (u *tlsUpstream) String() string { return u.addr.raw }
+
+func (u *tlsUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	for {
+		conn, reused, err := u.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		rsp, err := exchangeConn(ctx, conn, m)
+		if err == nil {
+			u.put(conn)
+			return rsp, nil
+		}
+		conn.Close()
+		// 复用的连接可能已经被服务器关闭，用新连接再试一次。
+		if !reused || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+func (u *tlsUpstream) get(ctx context.Context) (_ *dns.Conn, reused bool, _ error) {
+	select {
+	case conn := <-u.idle:
+		return conn, true, nil
+	default:
+	}
+	conn, err := u.addr.dial(ctx, `tcp`)
+	if err != nil {
+		return nil, false, err
+	}
+	tlsConn := tls.Client(conn, u.config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, false, err
+	}
+	return &dns.Conn{Conn: tlsConn}, false, nil
+}
+
+func (u *tlsUpstream) put(conn *dns.Conn) {
+	select {
+	case u.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// 在流式连接上发送请求并读取响应。
+func exchangeConn(ctx context.Context, conn *dns.Conn, m *dns.Msg) (*dns.Msg, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := conn.WriteMsg(m); err != nil {
+		return nil, err
+	}
+	rsp, err := conn.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if rsp.Id != m.Id {
+		return nil, dns.ErrId
+	}
+	return rsp, nil
+}
+
+// DNS-over-HTTPS（RFC 8484）。
+//
+// 由 http.Transport 复用连接（HTTP/2）。
+type httpsUpstream struct {
+	addr   *upstreamAddr
+	url    string
+	client *http.Client
+}
+
+func newHTTPSUpstream(a *upstreamAddr) *httpsUpstream {
+	return &httpsUpstream{
+		addr: a,
+		url:  (&url.URL{Scheme: `https`, Host: net.JoinHostPort(a.host, a.port), Path: a.path}).String(),
+		client: &http.Client{
+			Transport: &http.Transport{
+				// 总是连接到引导IP，TLS 仍然使用 URL 中的主机名。
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					return a.dial(ctx, network)
+				},
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: maxIdleConns,
+				IdleConnTimeout:     time.Minute,
+			},
+		},
+	}
+}
+
+func (u *httpsUpstream) String() string { return u.addr.raw }
+
+func (u *httpsUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	// 按标准，ID 应该为 0，以便于 HTTP 缓存。
+	q := m.Copy()
+	q.Id = 0
+	packed, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(`Content-Type`, `application/dns-message`)
+	req.Header.Set(`Accept`, `application/dns-message`)
+
+	rsp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(`DoH 上游返回错误：%s`, rsp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(rsp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	var r dns.Msg
+	if err := r.Unpack(body); err != nil {
+		return nil, err
+	}
+	r.Id = m.Id
+	return &r, nil
+}
+
+// DNS-over-QUIC（RFC 9250）。
+//
+// 所有请求共用一个连接，每个请求一个流。
+type quicUpstream struct {
+	addr   *upstreamAddr
+	config *tls.Config
+
+	lock sync.Mutex
+	conn *quic.Conn
+	// 同时进行的拨号只拨一次。
+	dialing singleflight.Group
+}
+
+func (u *quicUpstream) String() string { return u.addr.raw }
+
+func (u *quicUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	for {
+		conn, reused, err := u.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		rsp, err := exchangeQUIC(ctx, conn, m)
+		if err == nil {
+			return rsp, nil
+		}
+		// 单个流的失败（比如超时）不影响其它请求，只有连接本身失效时才丢弃，
+		// 并用新连接再试一次。
+		if !quicConnError(conn, err) {
+			return nil, err
+		}
+		u.drop(conn)
+		if !reused || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+func (u *quicUpstream) get(ctx context.Context) (_ *quic.Conn, reused bool, _ error) {
+	u.lock.Lock()
+	conn := u.conn
+	u.lock.Unlock()
+	if conn != nil && conn.Context().Err() == nil {
+		return conn, true, nil
+	}
+
+	// 握手可能很慢，不能持有锁，否则其它请求都要等待。
+	ch := u.dialing.DoChan(``, func() (any, error) {
+		conn, err := u.dial()
+		if err != nil {
+			return nil, err
+		}
+		u.lock.Lock()
+		u.conn = conn
+		u.lock.Unlock()
+		return conn, nil
+	})
+	select {
+	case r := <-ch:
+		if r.Err != nil {
+			return nil, false, r.Err
+		}
+		return r.Val.(*quic.Conn), false, nil
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+}
+
+// 连接是共用的，不能因为某个请求被取消而失败。
+func (u *quicUpstream) dial() (*quic.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), exchangeTimeout)
+	defer cancel()
+
+	var errs []error
+	for _, ip := range u.addr.ips {
+		conn, err := quic.DialAddr(ctx, net.JoinHostPort(ip.String(), u.addr.port), u.config, &quic.Config{
+			MaxIdleTimeout: time.Minute,
+		})
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (u *quicUpstream) drop(conn *quic.Conn) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.conn == conn {
+		u.conn = nil
+	}
+	conn.CloseWithError(0, ``)
+}
+
+// 是否是连接级别的错误（连接不能再用）。
+func quicConnError(conn *quic.Conn, err error) bool {
+	var (
+		transport *quic.TransportError
+		app       *quic.ApplicationError
+		idle      *quic.IdleTimeoutError
+		reset     *quic.StatelessResetError
+	)
+	return conn.Context().Err() != nil ||
+		errors.As(err, &transport) || errors.As(err, &app) ||
+		errors.As(err, &idle) || errors.As(err, &reset)
+}
+
+func exchangeQUIC(ctx context.Context, conn *quic.Conn, m *dns.Msg) (*dns.Msg, error) {
+	// 按标准，ID 必须为 0。
+	q := m.Copy()
+	q.Id = 0
+	packed, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.CancelRead(0)
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+
+	// 与 TCP 一样，有两个字节的长度前缀。
+	if _, err := stream.Write(binary.BigEndian.AppendUint16(nil, uint16(len(packed)))); err != nil {
+		return nil, err
+	}
+	if _, err := stream.Write(packed); err != nil {
+		return nil, err
+	}
+	// 请求发送完毕。
+	if err := stream.Close(); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(stream, body); err != nil {
+		return nil, err
+	}
+
+	var r dns.Msg
+	if err := r.Unpack(body); err != nil {
+		return nil, err
+	}
+	r.Id = m.Id
+	return &r, nil
+}
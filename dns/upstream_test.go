@@ -0,0 +1,90 @@
+package dns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseUpstreamAddr(t *testing.T) {
+	for _, tc := range []struct {
+		s      string
+		scheme string
+		port   string
+		ips    []string
+	}{
+		{`8.8.8.8`, `tcp`, `53`, []string{`8.8.8.8`}},
+		{`udp://223.5.5.5:5353`, `udp`, `5353`, []string{`223.5.5.5`}},
+		{`tls://[2001:4860:4860::8888]`, `tls`, `853`, []string{`2001:4860:4860::8888`}},
+		{`https://dns.google/dns-query#8.8.8.8,8.8.4.4`, `https`, `443`, []string{`8.8.8.8`, `8.8.4.4`}},
+		{`quic://dns.adguard-dns.com:8853#94.140.14.14`, `quic`, `8853`, []string{`94.140.14.14`}},
+	} {
+		a, err := parseUpstreamAddr(tc.s, `tcp`)
+		if err != nil {
+			t.Fatal(tc.s, err)
+		}
+		var ips []string
+		for _, ip := range a.ips {
+			ips = append(ips, ip.String())
+		}
+		if a.scheme != tc.scheme || a.port != tc.port || !slices.Equal(ips, tc.ips) {
+			t.Fatalf(`解析不正确：%s: %+v`, tc.s, a)
+		}
+	}
+
+	for _, s := range []string{`https://dns.google/dns-query`, `dns.google`, `ftp://8.8.8.8`, `tls://dns.google#x`} {
+		if _, err := parseUpstreamAddr(s, `udp`); err == nil {
+			t.Fatalf(`应该报错：%s`, s)
+		}
+	}
+}
+
+func TestHTTPSUpstream(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var q dns.Msg
+		if err := q.Unpack(body); err != nil || q.Id != 0 {
+			http.Error(w, `bad request`, http.StatusBadRequest)
+			return
+		}
+		rsp := new(dns.Msg)
+		rsp.SetReply(&q)
+		rsp.Answer = append(rsp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   []byte{1, 2, 3, 4},
+		})
+		packed, _ := rsp.Pack()
+		w.Header().Set(`Content-Type`, `application/dns-message`)
+		w.Write(packed)
+	}))
+	defer server.Close()
+
+	// 测试证书对 example.com 有效，通过引导IP连接到测试服务器。
+	u, _ := url.Parse(server.URL)
+	upstream, err := ParseUpstream(`https://example.com:`+u.Port()+`/dns-query#127.0.0.1`, `udp`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	upstream.(*httpsUpstream).client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: pool}
+
+	for range 2 {
+		m := new(dns.Msg)
+		m.SetQuestion(`example.com.`, dns.TypeA)
+		rsp, err := upstream.Exchange(t.Context(), m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rsp.Id != m.Id || len(rsp.Answer) != 1 || rsp.Answer[0].(*dns.A).A.String() != `1.2.3.4` {
+			t.Fatalf(`响应不正确：%v`, rsp)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// 同一类别有多个上游时的选择策略。
+type Strategy string
+
+const (
+	// 按顺序使用第一个可用的上游，失败时依次尝试下一个。
+	StrategyFallback Strategy = `fallback`
+	// 同时向所有可用的上游查询，使用最先成功的响应。
+	StrategyRace Strategy = `race`
+	// 轮流使用可用的上游，失败时依次尝试下一个。
+	StrategyRoundRobin Strategy = `round_robin`
+)
+
+// 空表示默认（fallback）。
+func (s Strategy) Check() error {
+	switch s {
+	case ``, StrategyFallback, StrategyRace, StrategyRoundRobin:
+		return nil
+	}
+	return fmt.Errorf(`未知的DNS上游策略：%s`, s)
+}
+
+const (
+	// 连续失败这么多次后认为上游不可用。
+	maxConsecutiveFailures = 3
+	// 不可用的上游在这段时间内只作为最后的选择。
+	downDuration = time.Second * 30
+	// 按顺序尝试时最少的尝试次数（上游不够时轮流重试）。
+	minAttempts = 3
+	// 单次请求的超时时间。
+	exchangeTimeout = time.Second * 5
+)
+
+// 带统计信息的上游。
+type upstream struct {
+	Upstream
+
+	lock        sync.Mutex
+	requests    uint64
+	failures    uint64
+	consecutive int
+	downUntil   time.Time
+	// 成功请求的平滑延迟。
+	latency   time.Duration
+	lastError string
+}
+
+func (u *upstream) healthy(now time.Time) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return !now.Before(u.downUntil)
+}
+
+func (u *upstream) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	rsp, err := u.Exchange(ctx, m)
+	latency := time.Since(start)
+
+	// 被取消的（比如竞速输了）不算失败。
+	if errors.Is(err, context.Canceled) {
+		return nil, err
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.requests++
+	if err != nil {
+		u.failures++
+		u.consecutive++
+		u.lastError = err.Error()
+		if u.consecutive >= maxConsecutiveFailures {
+			if u.downUntil.Before(start) {
+				log.Println(`DNS上游不可用：`, u, err)
+			}
+			u.downUntil = time.Now().Add(downDuration)
+		}
+		return nil, err
+	}
+	u.consecutive = 0
+	u.downUntil = time.Time{}
+	if u.latency == 0 {
+		u.latency = latency
+	} else {
+		u.latency = (u.latency*7 + latency) / 8
+	}
+	return rsp, nil
+}
+
+// 同一类别（国内或国外）的一组上游。
+type upstreams struct {
+	strategy Strategy
+	list     []*upstream
+	next     atomic.Uint32
+
+	// 是否去掉请求中的 ECS 选项（国外上游，为了隐私）。
+	stripECS bool
+}
+
+// network 是普通DNS默认使用的协议。
+func newUpstreams(addrs []string, network string, strategy Strategy) (*upstreams, error) {
+	if err := strategy.Check(); err != nil {
+		return nil, err
+	}
+	if strategy == `` {
+		strategy = StrategyFallback
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New(`没有DNS上游`)
+	}
+	g := &upstreams{strategy: strategy}
+	for _, addr := range addrs {
+		u, err := ParseUpstream(addr, network)
+		if err != nil {
+			return nil, err
+		}
+		g.list = append(g.list, &upstream{Upstream: u})
+	}
+	return g, nil
+}
+
+// 按策略排列的候选上游：可用的在前，不可用的作为最后的选择。
+func (g *upstreams) candidates() []*upstream {
+	ordered := g.list
+	if g.strategy == StrategyRoundRobin {
+		i := int(g.next.Add(1)-1) % len(g.list)
+		ordered = append(g.list[i:len(g.list):len(g.list)], g.list[:i]...)
+	}
+
+	now := time.Now()
+	var healthy, down []*upstream
+	for _, u := range ordered {
+		if u.healthy(now) {
+			healthy = append(healthy, u)
+		} else {
+			down = append(down, u)
+		}
+	}
+	return append(healthy, down...)
+}
+
+// 应答中的 ECS 选项总是被去掉：应答会被缓存并共享给其它客户端。
+func (g *upstreams) exchange(m *dns.Msg) (rsp *dns.Msg, err error) {
+	if g.stripECS && ecsOf(m).IsValid() {
+		m = m.Copy()
+		removeECS(m)
+	}
+	if g.strategy == StrategyRace {
+		rsp, err = g.race(m)
+	} else {
+		rsp, err = g.fallback(m)
+	}
+	if err == nil {
+		removeECS(rsp)
+	}
+	return rsp, err
+}
+
+// 按顺序尝试候选上游。
+func (g *upstreams) fallback(m *dns.Msg) (*dns.Msg, error) {
+	var err error
+	candidates := g.candidates()
+	for i := range max(len(candidates), minAttempts) {
+		u := candidates[i%len(candidates)]
+		var rsp *dns.Msg
+		func() {
+			ctx, cancel := context.WithTimeout(context.Background(), exchangeTimeout)
+			defer cancel()
+			rsp, err = u.exchange(ctx, m)
+		}()
+		if err == nil {
+			return rsp, nil
+		}
+		// 没有别的上游可以尝试时，才重试同一个。
+		retrySame := i+1 >= len(candidates)
+		switch {
+		case isTimeout(err):
+			if retrySame {
+				time.Sleep(time.Second)
+			}
+		case strings.Contains(err.Error(), `connect: network is unreachable`):
+			if retrySame {
+				return nil, err
+			}
+		default:
+			log.Println(`其它未处理的DNS请求错误：`, u, err)
+		}
+	}
+	return nil, err
+}
+
+// 同时向可用的上游查询（都不可用时向全部查询），返回最先成功的响应。
+func (g *upstreams) race(m *dns.Msg) (*dns.Msg, error) {
+	candidates := g.candidates()
+	now := time.Now()
+	if n := len(candidates); candidates[0].healthy(now) {
+		for n > 0 && !candidates[n-1].healthy(now) {
+			n--
+		}
+		candidates = candidates[:n]
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), exchangeTimeout)
+	defer cancel()
+
+	type result struct {
+		rsp *dns.Msg
+		err error
+	}
+	results := make(chan result, len(candidates))
+	for _, u := range candidates {
+		go func() {
+			rsp, err := u.exchange(ctx, m.Copy())
+			results <- result{rsp, err}
+		}()
+	}
+
+	var errs []error
+	for range candidates {
+		r := <-results
+		if r.err == nil {
+			return r.rsp, nil
+		}
+		errs = append(errs, r.err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+func isTimeout(err error) bool {
+	return strings.Contains(err.Error(), `i/o timeout`) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// 上游的统计信息。
+type UpstreamStatus struct {
+	Address  string `yaml:"address"`
+	Healthy  bool   `yaml:"healthy"`
+	Requests uint64 `yaml:"requests"`
+	Failures uint64 `yaml:"failures"`
+	// 成功请求的平滑延迟。
+	Latency   string `yaml:"latency,omitempty"`
+	LastError string `yaml:"last_error,omitempty"`
+}
+
+type Status struct {
+	ChinaStrategy  Strategy         `yaml:"china_strategy"`
+	BannedStrategy Strategy         `yaml:"banned_strategy"`
+	China          []UpstreamStatus `yaml:"china"`
+	Banned         []UpstreamStatus `yaml:"banned"`
+	Blocked        BlockStatus      `yaml:"blocked"`
+}
+
+func (g *upstreams) status() []UpstreamStatus {
+	now := time.Now()
+	var list []UpstreamStatus
+	for _, u := range g.list {
+		healthy := u.healthy(now)
+		u.lock.Lock()
+		s := UpstreamStatus{
+			Address:   u.String(),
+			Healthy:   healthy,
+			Requests:  u.requests,
+			Failures:  u.failures,
+			LastError: u.lastError,
+		}
+		if u.latency > 0 {
+			s.Latency = u.latency.Truncate(time.Millisecond).String()
+		}
+		u.lock.Unlock()
+		list = append(list, s)
+	}
+	return list
+}
@@ -0,0 +1,95 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type fakeUpstream struct {
+	name  string
+	delay time.Duration
+	down  bool
+	count atomic.Int32
+}
+
+func (u *fakeUpstream) String() string { return u.name }
+
+func (u *fakeUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	u.count.Add(1)
+	select {
+	case <-time.After(u.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if u.down {
+		return nil, errors.New(`down`)
+	}
+	rsp := new(dns.Msg)
+	rsp.SetReply(m)
+	rsp.Ns = append(rsp.Ns, &dns.TXT{Hdr: dns.RR_Header{Name: `.`, Rrtype: dns.TypeTXT}, Txt: []string{u.name}})
+	return rsp, nil
+}
+
+func TestUpstreams(t *testing.T) {
+	newGroup := func(strategy Strategy, fakes ...*fakeUpstream) *upstreams {
+		g := &upstreams{strategy: strategy}
+		for _, f := range fakes {
+			g.list = append(g.list, &upstream{Upstream: f})
+		}
+		return g
+	}
+	expect := func(g *upstreams, want string) {
+		t.Helper()
+		m := new(dns.Msg)
+		m.SetQuestion(`example.com.`, dns.TypeA)
+		rsp, err := g.exchange(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rsp.Ns[0].(*dns.TXT).Txt[0]; got != want {
+			t.Fatalf(`上游不正确：want %s, got %s`, want, got)
+		}
+	}
+
+	t.Run(`fallback`, func(t *testing.T) {
+		a, b := &fakeUpstream{name: `a`, down: true}, &fakeUpstream{name: `b`}
+		g := newGroup(StrategyFallback, a, b)
+		for range maxConsecutiveFailures {
+			expect(g, `b`)
+		}
+		// 连续失败后不再优先尝试。
+		expect(g, `b`)
+		if n := a.count.Load(); n != maxConsecutiveFailures {
+			t.Fatalf(`不可用的上游不应该再被尝试：%d`, n)
+		}
+		status := g.status()
+		if status[0].Healthy || status[0].Failures != maxConsecutiveFailures || !status[1].Healthy {
+			t.Fatalf(`状态不正确：%+v`, status)
+		}
+	})
+
+	t.Run(`round_robin`, func(t *testing.T) {
+		g := newGroup(StrategyRoundRobin, &fakeUpstream{name: `a`}, &fakeUpstream{name: `b`})
+		expect(g, `a`)
+		expect(g, `b`)
+		expect(g, `a`)
+	})
+
+	t.Run(`race`, func(t *testing.T) {
+		g := newGroup(StrategyRace,
+			&fakeUpstream{name: `a`, delay: time.Millisecond * 200},
+			&fakeUpstream{name: `b`, delay: time.Millisecond * 10},
+			&fakeUpstream{name: `c`, down: true},
+		)
+		expect(g, `b`)
+	})
+
+	if err := Strategy(`unknown`).Check(); err == nil {
+		t.Fatal(`未知策略应该报错`)
+	}
+}
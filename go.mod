@@ -8,21 +8,24 @@ require (
 	github.com/movsb/http2socks v1.0.2
 	github.com/nadoo/ipset v0.5.0
 	github.com/phuslu/lru v1.0.18
+	github.com/quic-go/quic-go v0.59.1
 	github.com/spf13/cobra v1.10.2
 	go4.org/netipx v0.0.0-20231129151722-fdeea329fbba
 	golang.org/x/crypto v0.47.0
+	golang.org/x/sync v0.19.0
 	golang.org/x/sys v0.40.0
+	lukechampine.com/blake3 v1.4.1
 	mvdan.cc/sh/v3 v3.12.0
 )
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
 	github.com/movsb/http2tcp v0.0.0-20260106083714-4b0578c57feb // indirect
 	github.com/spf13/pflag v1.0.9 // indirect
 	github.com/things-go/go-socks5 v0.1.0 // indirect
 	github.com/xtaci/smux v1.5.55 // indirect
 	golang.org/x/mod v0.31.0 // indirect
 	golang.org/x/net v0.48.0 // indirect
-	golang.org/x/sync v0.19.0 // indirect
 	golang.org/x/tools v0.40.0 // indirect
 )
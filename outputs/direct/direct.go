@@ -3,15 +3,19 @@ package direct
 import (
 	"log"
 	"net"
+	"net/netip"
 
 	"github.com/movsb/gun/pkg/tproxy"
 	"github.com/movsb/gun/pkg/utils"
 )
 
 func ListenAndServeTProxy(port uint16) {
-	tproxy.ListenAndServeTCP(port, func(conn net.Conn, addr string) {
+	go tproxy.ListenAndServeUDP(port, func(src netip.AddrPort) (tproxy.PacketConn, error) {
+		return net.ListenUDP(`udp`, nil)
+	})
+	tproxy.ListenAndServeTCP(port, func(conn net.Conn, dst tproxy.Destination) {
 		defer conn.Close()
-		remote, err := net.Dial(`tcp`, addr)
+		remote, err := dst.DialDirect()
 		if err != nil {
 			log.Println(err)
 			return
@@ -0,0 +1,285 @@
+package group
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/movsb/gun/pkg/tproxy"
+	"github.com/movsb/gun/pkg/utils"
+)
+
+// 组成员需要实现的接口。
+type Dialer interface {
+	// 经由此出口连接目的地址。
+	// addr 形如 host:port，host 可以是域名。
+	DialTCP(addr string) (net.Conn, error)
+}
+
+type DialerFunc func(addr string) (net.Conn, error)
+
+func (f DialerFunc) DialTCP(addr string) (net.Conn, error) {
+	return f(addr)
+}
+
+// 选择策略。
+type Strategy string
+
+const (
+	// 按顺序选择第一个健康的成员。
+	StrategyFallback Strategy = `fallback`
+	// 选择延迟最低的健康成员。
+	StrategyLatency Strategy = `latency`
+)
+
+const (
+	DefaultProbe    = `www.google.com:443`
+	DefaultInterval = time.Minute
+
+	// 单次探测的超时时间。
+	probeTimeout = time.Second * 5
+	// 延迟优先时，当前成员的延迟没有比最优的差这么多就不切换，防止来回切换。
+	latencyTolerance = time.Millisecond * 50
+)
+
+type Member struct {
+	Name   string
+	Dialer Dialer
+}
+
+type member struct {
+	Member
+
+	// 以下由 Group.lock 保护。
+	latency time.Duration
+	err     error
+	checked time.Time
+}
+
+func (m *member) healthy() bool {
+	return !m.checked.IsZero() && m.err == nil
+}
+
+// 出口组。
+//
+// 定期经由每个成员与探测地址建立TLS连接，新连接总是交给选中的成员。
+type Group struct {
+	strategy Strategy
+	probe    string
+	interval time.Duration
+	members  []*member
+
+	current atomic.Pointer[member]
+
+	lock     sync.Mutex
+	switched time.Time
+
+	// 测试时可替换。
+	probeFunc func(ctx context.Context, d Dialer, addr string) error
+}
+
+// probe、interval 为空时使用默认值。
+func New(strategy Strategy, probe string, interval time.Duration, members []Member) (*Group, error) {
+	switch strategy {
+	case ``:
+		strategy = StrategyFallback
+	case StrategyFallback, StrategyLatency:
+	default:
+		return nil, fmt.Errorf(`未知的出口组策略：%s`, strategy)
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf(`出口组没有成员`)
+	}
+	if probe == `` {
+		probe = DefaultProbe
+	}
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+
+	g := &Group{
+		strategy:  strategy,
+		probe:     probe,
+		interval:  interval,
+		probeFunc: probeTLS,
+	}
+	for _, m := range members {
+		g.members = append(g.members, &member{Member: m})
+	}
+	// 第一次探测完成之前先用第一个。
+	g.current.Store(g.members[0])
+	return g, nil
+}
+
+// 当前选中的成员名。
+func (g *Group) Current() string {
+	return g.current.Load().Name
+}
+
+// 定期探测，直到 ctx 结束。
+func (g *Group) Run(ctx context.Context) {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+
+	for {
+		g.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// 并发探测所有成员，然后重新选择。
+func (g *Group) check(ctx context.Context) {
+	wg := sync.WaitGroup{}
+	for _, m := range g.members {
+		wg.Go(func() {
+			ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+			defer cancel()
+			now := time.Now()
+			// 成员的 DialTCP 不支持 ctx，可能卡住很久，不能让它阻塞整个探测。
+			errc := make(chan error, 1)
+			go func() { errc <- g.probeFunc(ctx, m.Dialer, g.probe) }()
+			var err error
+			select {
+			case err = <-errc:
+			case <-ctx.Done():
+				err = fmt.Errorf(`探测超时：%w`, ctx.Err())
+			}
+			latency := time.Since(now).Truncate(time.Millisecond)
+
+			g.lock.Lock()
+			defer g.lock.Unlock()
+			m.latency, m.err, m.checked = latency, err, time.Now()
+		})
+	}
+	wg.Wait()
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	old := g.current.Load()
+	next := g.choose(old)
+	if next == nil {
+		log.Printf(`出口组：所有成员都不可用，继续使用：%s`, old.Name)
+		return
+	}
+	if next != old {
+		g.current.Store(next)
+		g.switched = time.Now()
+		reason := `不可用`
+		if old.healthy() {
+			reason = fmt.Sprintf(`延迟 %v`, old.latency)
+		}
+		log.Printf(`出口组：从 %s（%s）切换到 %s（延迟 %v）`, old.Name, reason, next.Name, next.latency)
+	}
+}
+
+// 根据策略选择成员，没有健康的成员时返回 nil。
+//
+// 需要持有锁。
+func (g *Group) choose(current *member) *member {
+	var best *member
+	for _, m := range g.members {
+		if !m.healthy() {
+			continue
+		}
+		if g.strategy == StrategyFallback {
+			return m
+		}
+		if best == nil || m.latency < best.latency {
+			best = m
+		}
+	}
+	if best != nil && current.healthy() && current.latency <= best.latency+latencyTolerance {
+		return current
+	}
+	return best
+}
+
+func (g *Group) DialTCP(addr string) (net.Conn, error) {
+	m := g.current.Load()
+	conn, err := m.Dialer.DialTCP(addr)
+	if err != nil {
+		return nil, fmt.Errorf(`出口组：%s: %w`, m.Name, err)
+	}
+	return conn, nil
+}
+
+// 仅支持TCP。
+func (g *Group) ListenAndServeTProxy(port uint16) {
+	go g.Run(context.Background())
+	tproxy.ListenAndServeTCP(port, func(conn net.Conn, dst tproxy.Destination) {
+		defer conn.Close()
+		remote, err := g.DialTCP(dst.String())
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer remote.Close()
+		utils.Stream(conn, remote)
+	})
+}
+
+// 经由成员与探测地址完成TLS握手。
+func probeTLS(ctx context.Context, d Dialer, addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	conn, err := d.DialTCP(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return tls.Client(conn, &tls.Config{ServerName: host}).HandshakeContext(ctx)
+}
+
+type Status struct {
+	Strategy Strategy       `yaml:"strategy"`
+	Current  string         `yaml:"current"`
+	Switched string         `yaml:"switched,omitempty"`
+	Members  []MemberStatus `yaml:"members"`
+}
+
+type MemberStatus struct {
+	Name string `yaml:"name"`
+	// 延迟或者错误。
+	Latency string `yaml:"latency"`
+}
+
+func (g *Group) Status() Status {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	s := Status{
+		Strategy: g.strategy,
+		Current:  g.current.Load().Name,
+	}
+	if !g.switched.IsZero() {
+		s.Switched = g.switched.Format(time.DateTime)
+	}
+	for _, m := range g.members {
+		ms := MemberStatus{Name: m.Name}
+		switch {
+		case m.checked.IsZero():
+			ms.Latency = `未探测`
+		case m.err != nil:
+			ms.Latency = m.err.Error()
+		default:
+			ms.Latency = m.latency.String()
+		}
+		s.Members = append(s.Members, ms)
+	}
+	return s
+}
@@ -0,0 +1,112 @@
+package group
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type fakeDialer struct {
+	name string
+}
+
+func (d *fakeDialer) DialTCP(addr string) (net.Conn, error) {
+	return nil, errors.New(`not implemented`)
+}
+
+func TestGroup(t *testing.T) {
+	results := map[string]time.Duration{}
+	down := map[string]bool{}
+
+	newGroup := func(strategy Strategy) *Group {
+		var members []Member
+		for _, name := range []string{`a`, `b`, `c`} {
+			members = append(members, Member{Name: name, Dialer: &fakeDialer{name: name}})
+		}
+		g, err := New(strategy, ``, 0, members)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.probeFunc = func(ctx context.Context, d Dialer, addr string) error {
+			name := d.(*fakeDialer).name
+			time.Sleep(results[name])
+			if down[name] {
+				return errors.New(`down`)
+			}
+			return nil
+		}
+		return g
+	}
+
+	expect := func(g *Group, want string) {
+		t.Helper()
+		g.check(t.Context())
+		if got := g.Current(); got != want {
+			t.Fatalf(`当前成员不正确：want %s, got %s`, want, got)
+		}
+	}
+
+	t.Run(`fallback`, func(t *testing.T) {
+		clear(results)
+		clear(down)
+		g := newGroup(StrategyFallback)
+		expect(g, `a`)
+		down[`a`] = true
+		expect(g, `b`)
+		down[`b`] = true
+		expect(g, `c`)
+		// 全部不可用时保持不变。
+		down[`c`] = true
+		expect(g, `c`)
+		// 恢复后回到第一个。
+		clear(down)
+		expect(g, `a`)
+	})
+
+	t.Run(`latency`, func(t *testing.T) {
+		clear(results)
+		clear(down)
+		results[`a`] = time.Millisecond * 200
+		results[`b`] = time.Millisecond * 10
+		results[`c`] = time.Millisecond * 100
+		g := newGroup(StrategyLatency)
+		expect(g, `b`)
+		// 差别不大时不切换。
+		results[`c`] = time.Millisecond * 1
+		expect(g, `b`)
+		down[`b`] = true
+		expect(g, `c`)
+	})
+
+	if _, err := New(`unknown`, ``, 0, []Member{{Name: `a`}}); err == nil {
+		t.Fatal(`未知策略应该报错`)
+	}
+}
+
+func TestCheckHang(t *testing.T) {
+	g, err := New(StrategyFallback, ``, 0, []Member{
+		{Name: `a`, Dialer: &fakeDialer{name: `a`}},
+		{Name: `b`, Dialer: &fakeDialer{name: `b`}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hang := make(chan struct{})
+	defer close(hang)
+	g.probeFunc = func(ctx context.Context, d Dialer, addr string) error {
+		// 不理会 ctx，一直卡住。
+		if d.(*fakeDialer).name == `a` {
+			<-hang
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Millisecond*100)
+	defer cancel()
+	g.check(ctx)
+	if got := g.Current(); got != `b` {
+		t.Fatalf(`卡住的成员应该被认为不可用：%s`, got)
+	}
+}
@@ -11,12 +11,28 @@ import (
 
 func ListenAndServeTProxy(port uint16, server, token string) {
 	client := http2socks.NewClient(server, token)
-	tproxy.ListenAndServeTCP(port, func(conn net.Conn, addr string) {
+	tproxy.ListenAndServeTCP(port, func(conn net.Conn, dst tproxy.Destination) {
 		socksConn, err := client.OpenConn()
 		if err != nil {
 			log.Println(err)
 			return
 		}
-		socks5.ProxyTCP4Conn(conn, socksConn, addr)
+		socks5.ProxyTCPConn(conn, socksConn, dst.String())
 	})
 }
+
+// 返回一个经由服务器连接目的地址的函数。
+func NewDialer(server, token string) func(addr string) (net.Conn, error) {
+	client := http2socks.NewClient(server, token)
+	return func(addr string) (net.Conn, error) {
+		conn, err := client.OpenConn()
+		if err != nil {
+			return nil, err
+		}
+		if err := socks5.Connect(conn, addr); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,41 @@
+package router
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// 通过ARP表查询局域网主机的MAC地址，查不到时返回空。
+var neighbor = func(ip netip.Addr) string {
+	if !ip.Is4() {
+		return ``
+	}
+	fp, err := os.Open(`/proc/net/arp`)
+	if err != nil {
+		return ``
+	}
+	defer fp.Close()
+	return parseARP(bufio.NewScanner(fp), ip)
+}
+
+// IP address       HW type     Flags       HW address            Mask     Device
+// 192.168.1.10     0x1         0x2         aa:bb:cc:dd:ee:ff     *        br-lan
+func parseARP(s *bufio.Scanner, ip netip.Addr) string {
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 4 || fields[0] != ip.String() {
+			continue
+		}
+		// 0x0：不完整的条目。
+		if fields[2] == `0x0` {
+			return ``
+		}
+		if mac, err := net.ParseMAC(fields[3]); err == nil {
+			return mac.String()
+		}
+	}
+	return ``
+}
@@ -0,0 +1,24 @@
+package router
+
+import (
+	"bufio"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestParseARP(t *testing.T) {
+	table := `IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.10     0x1         0x2         aa:bb:cc:dd:ee:ff     *        br-lan
+192.168.1.11     0x1         0x0         00:00:00:00:00:00     *        br-lan
+`
+	s := bufio.NewScanner(strings.NewReader(table))
+	if got := parseARP(s, netip.MustParseAddr(`192.168.1.10`)); got != `aa:bb:cc:dd:ee:ff` {
+		t.Fatalf(`MAC不正确：%s`, got)
+	}
+	// 不完整的条目。
+	s = bufio.NewScanner(strings.NewReader(table))
+	if got := parseARP(s, netip.MustParseAddr(`192.168.1.11`)); got != `` {
+		t.Fatalf(`MAC不正确：%s`, got)
+	}
+}
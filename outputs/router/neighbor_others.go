@@ -0,0 +1,9 @@
+//go:build !linux
+
+package router
+
+import "net/netip"
+
+var neighbor = func(ip netip.Addr) string {
+	return ``
+}
@@ -0,0 +1,371 @@
+package router
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/movsb/gun/outputs/group"
+	"github.com/movsb/gun/pkg/rules"
+	"github.com/movsb/gun/pkg/tproxy"
+	"github.com/movsb/gun/pkg/utils"
+	"go4.org/netipx"
+)
+
+// 特殊的出口名。
+const (
+	// 直接连接（使用原来的IP）。
+	Direct = `direct`
+	// 拒绝连接。
+	Reject = `reject`
+	// 交给当前出口。
+	Current = `current`
+)
+
+// 一条规则。
+//
+// 同一类条件之间是“或”的关系，不同类条件之间是“与”的关系，没有条件的规则总是匹配。
+type Rule struct {
+	// 域名后缀。
+	Domains []string
+	// 域名包含的关键字。
+	Keywords []string
+	// 匹配域名的正则表达式。
+	Regexps []string
+	// 目的IP段。
+	CIDRs []string
+	// 目的IP所属的国家（两个字母的代码）。
+	GeoIPs []string
+	// 域名所属的 geosite 类别。
+	GeoSites []string
+	// 目的端口或者端口范围，比如：443、8000-9000。
+	Ports []string
+	// 来源IP段或者MAC地址（局域网内的主机）。
+	// MAC地址通过本机的ARP表查询，所以只对IPv4有效。
+	Sources []string
+
+	// 匹配后使用的出口：direct、reject、current 或者库存中的出口名。
+	Output string
+}
+
+// 根据IP查询国家代码（大写），查不到时返回空。
+type GeoIP func(ip netip.Addr) string
+
+// 根据类别名查询 geosite，查不到时返回空。
+type GeoSite func(category string) *rules.GeoSite
+
+type rule struct {
+	domains  []string
+	keywords []string
+	regexps  []*regexp.Regexp
+	cidrs    *netipx.IPSet
+	geoIPs   []string
+	geoSites []string
+	sites    []*site
+	ports    [][2]uint16
+	sources  *netipx.IPSet
+	macs     []string
+	output   string
+}
+
+// 按顺序匹配规则的路由器。
+type Router struct {
+	rules   []*rule
+	dialers map[string]group.Dialer
+	geoIP   GeoIP
+}
+
+// dialers 是规则中用到的库存中的出口；
+// geoIP、geoSite 可以为空（此时不能使用 GeoIPs、GeoSites 条件）。
+func New(list []Rule, dialers map[string]group.Dialer, geoIP GeoIP, geoSite GeoSite) (*Router, error) {
+	r := &Router{dialers: dialers, geoIP: geoIP}
+	for i, c := range list {
+		compiled, err := compile(c)
+		if err != nil {
+			return nil, fmt.Errorf(`第 %d 条规则不正确：%w`, i+1, err)
+		}
+		switch compiled.output {
+		case Direct, Reject, Current:
+		default:
+			if _, ok := dialers[compiled.output]; !ok {
+				return nil, fmt.Errorf(`第 %d 条规则的出口找不到：%s`, i+1, compiled.output)
+			}
+		}
+		if len(compiled.geoIPs) > 0 && geoIP == nil {
+			return nil, fmt.Errorf(`第 %d 条规则不正确：不支持 GeoIP 条件`, i+1)
+		}
+		for _, category := range compiled.geoSites {
+			var gs *rules.GeoSite
+			if geoSite != nil {
+				gs = geoSite(category)
+			}
+			if gs == nil {
+				return nil, fmt.Errorf(`第 %d 条规则不正确：找不到 GeoSite 类别：%s`, i+1, category)
+			}
+			s, err := newSite(gs)
+			if err != nil {
+				return nil, fmt.Errorf(`第 %d 条规则不正确：%w`, i+1, err)
+			}
+			compiled.sites = append(compiled.sites, s)
+		}
+		r.rules = append(r.rules, compiled)
+	}
+	return r, nil
+}
+
+// 只检查规则本身是否正确，不检查出口和 GeoIP。
+func Check(rules []Rule) error {
+	for i, c := range rules {
+		if _, err := compile(c); err != nil {
+			return fmt.Errorf(`第 %d 条规则不正确：%w`, i+1, err)
+		}
+	}
+	return nil
+}
+
+func compile(c Rule) (*rule, error) {
+	r := &rule{output: c.Output}
+	if r.output == `` {
+		return nil, fmt.Errorf(`没有指定出口`)
+	}
+
+	for _, d := range c.Domains {
+		r.domains = append(r.domains, strings.ToLower(strings.Trim(d, `.`)))
+	}
+	for _, k := range c.Keywords {
+		r.keywords = append(r.keywords, strings.ToLower(k))
+	}
+	for _, s := range c.Regexps {
+		// 待匹配的域名是小写的。
+		re, err := regexp.Compile(`(?i)` + s)
+		if err != nil {
+			return nil, err
+		}
+		r.regexps = append(r.regexps, re)
+	}
+	for _, g := range c.GeoIPs {
+		r.geoIPs = append(r.geoIPs, strings.ToUpper(g))
+	}
+	r.geoSites = c.GeoSites
+	for _, p := range c.Ports {
+		from, to, isRange := strings.Cut(p, `-`)
+		if !isRange {
+			to = from
+		}
+		a, err1 := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+		b, err2 := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+		if err1 != nil || err2 != nil || a > b {
+			return nil, fmt.Errorf(`端口不正确：%s`, p)
+		}
+		r.ports = append(r.ports, [2]uint16{uint16(a), uint16(b)})
+	}
+
+	var sources []string
+	for _, s := range c.Sources {
+		if mac, err := net.ParseMAC(s); err == nil {
+			r.macs = append(r.macs, mac.String())
+		} else {
+			sources = append(sources, s)
+		}
+	}
+
+	var err error
+	if r.cidrs, err = ipSet(c.CIDRs); err != nil {
+		return nil, err
+	}
+	if r.sources, err = ipSet(sources); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// 为空时返回 nil。
+func ipSet(list []string) (*netipx.IPSet, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	var b netipx.IPSetBuilder
+	for _, s := range list {
+		if strings.Contains(s, `/`) {
+			prefix, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, err
+			}
+			b.AddPrefix(prefix.Masked())
+		} else {
+			ip, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			b.Add(ip)
+		}
+	}
+	return b.IPSet()
+}
+
+// 虚假IP没有对应的真实IP，不会匹配IP相关的条件。
+func (r *rule) match(src netip.AddrPort, dst tproxy.Destination, geoIP GeoIP) bool {
+	domain := strings.ToLower(dst.Domain)
+	ip := dst.Addr.Addr()
+
+	if len(r.domains) > 0 && !anyOf(r.domains, func(d string) bool {
+		return domain == d || strings.HasSuffix(domain, `.`+d)
+	}) {
+		return false
+	}
+	if len(r.keywords) > 0 && !anyOf(r.keywords, func(k string) bool {
+		return domain != `` && strings.Contains(domain, k)
+	}) {
+		return false
+	}
+	if len(r.regexps) > 0 && !anyOf(r.regexps, func(re *regexp.Regexp) bool {
+		return domain != `` && re.MatchString(domain)
+	}) {
+		return false
+	}
+	if len(r.sites) > 0 && !anyOf(r.sites, func(s *site) bool {
+		return domain != `` && s.match(domain)
+	}) {
+		return false
+	}
+	if r.cidrs != nil && (dst.Fake || !r.cidrs.Contains(ip)) {
+		return false
+	}
+	if len(r.geoIPs) > 0 && (dst.Fake || !anyOf(r.geoIPs, func(g string) bool {
+		return geoIP(ip) == g
+	})) {
+		return false
+	}
+	if len(r.ports) > 0 && !anyOf(r.ports, func(p [2]uint16) bool {
+		return p[0] <= dst.Addr.Port() && dst.Addr.Port() <= p[1]
+	}) {
+		return false
+	}
+	if (r.sources != nil || len(r.macs) > 0) && !r.matchSource(src.Addr().Unmap()) {
+		return false
+	}
+	return true
+}
+
+func (r *rule) matchSource(ip netip.Addr) bool {
+	if r.sources != nil && r.sources.Contains(ip) {
+		return true
+	}
+	if len(r.macs) > 0 {
+		if mac := neighbor(ip); mac != `` && slices.Contains(r.macs, mac) {
+			return true
+		}
+	}
+	return false
+}
+
+// geosite 中的一个类别。
+type site struct {
+	domains  map[string]struct{}
+	fulls    map[string]struct{}
+	keywords []string
+	regexps  []*regexp.Regexp
+}
+
+func newSite(gs *rules.GeoSite) (*site, error) {
+	s := &site{
+		domains:  map[string]struct{}{},
+		fulls:    map[string]struct{}{},
+		keywords: gs.Keywords,
+	}
+	for _, d := range gs.Domains {
+		s.domains[d] = struct{}{}
+	}
+	for _, d := range gs.Fulls {
+		s.fulls[d] = struct{}{}
+	}
+	for _, e := range gs.Regexps {
+		re, err := regexp.Compile(`(?i)` + e)
+		if err != nil {
+			return nil, err
+		}
+		s.regexps = append(s.regexps, re)
+	}
+	return s, nil
+}
+
+// domain 是小写的。
+func (s *site) match(domain string) bool {
+	if _, ok := s.fulls[domain]; ok {
+		return true
+	}
+	for d := domain; ; {
+		if _, ok := s.domains[d]; ok {
+			return true
+		}
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+	return anyOf(s.keywords, func(k string) bool { return strings.Contains(domain, k) }) ||
+		anyOf(s.regexps, func(re *regexp.Regexp) bool { return re.MatchString(domain) })
+}
+
+func anyOf[T any](list []T, f func(T) bool) bool {
+	for _, v := range list {
+		if f(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// 返回第一条匹配的规则的出口，没有匹配的规则时返回 current。
+func (r *Router) Match(src netip.AddrPort, dst tproxy.Destination) string {
+	for _, rule := range r.rules {
+		if rule.match(src, dst, r.geoIP) {
+			return rule.output
+		}
+	}
+	return Current
+}
+
+// 按规则处理连接，返回假表示应该交给当前出口处理。
+//
+// 用于 tproxy.SetRouter。
+func (r *Router) Serve(conn net.Conn, dst tproxy.Destination) bool {
+	src, _ := netip.ParseAddrPort(conn.RemoteAddr().String())
+	src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+
+	output := r.Match(src, dst)
+	if output == Current {
+		return false
+	}
+
+	defer conn.Close()
+
+	var (
+		remote net.Conn
+		err    error
+	)
+	switch output {
+	case Reject:
+		log.Println(`规则拒绝了连接：`, src, dst)
+		return true
+	case Direct:
+		remote, err = dst.DialDirect()
+	default:
+		remote, err = r.dialers[output].DialTCP(dst.String())
+	}
+	if err != nil {
+		log.Println(`规则出口连接失败：`, output, dst, err)
+		return true
+	}
+	defer remote.Close()
+
+	utils.Stream(conn, remote)
+	return true
+}
@@ -0,0 +1,90 @@
+package router
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/movsb/gun/outputs/group"
+	"github.com/movsb/gun/pkg/rules"
+	"github.com/movsb/gun/pkg/tproxy"
+)
+
+func TestMatch(t *testing.T) {
+	neighbor = func(ip netip.Addr) string {
+		if ip == netip.MustParseAddr(`192.168.1.11`) {
+			return `aa:bb:cc:dd:ee:ff`
+		}
+		return ``
+	}
+	dialers := map[string]group.Dialer{
+		`us`: group.DialerFunc(func(addr string) (net.Conn, error) { return nil, nil }),
+	}
+	geoIP := func(ip netip.Addr) string {
+		if netip.MustParsePrefix(`1.0.0.0/8`).Contains(ip) {
+			return `CN`
+		}
+		return ``
+	}
+	geoSite := func(category string) *rules.GeoSite {
+		if category != `google` {
+			return nil
+		}
+		return &rules.GeoSite{Domains: []string{`google.com`}, Fulls: []string{`google.cn`}, Regexps: []string{`^g\d+\.net$`}}
+	}
+	r, err := New([]Rule{
+		{Domains: []string{`openai.com`}, Output: `us`},
+		{Keywords: []string{`ads`}, Output: Reject},
+		{Regexps: []string{`^cdn\d+\.`}, Ports: []string{`80`, `8000-9000`}, Output: Direct},
+		{CIDRs: []string{`8.8.8.0/24`}, Output: `us`},
+		{GeoIPs: []string{`cn`}, Output: Direct},
+		{Sources: []string{`192.168.1.10`, `AA:BB:CC:DD:EE:FF`}, Output: Reject},
+		{GeoSites: []string{`google`}, Output: `us`},
+	}, dialers, geoIP, geoSite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := netip.MustParseAddrPort(`192.168.1.2:5000`)
+	dst := func(addr, domain string, fake bool) tproxy.Destination {
+		return tproxy.Destination{Addr: netip.MustParseAddrPort(addr), Domain: domain, Fake: fake}
+	}
+	for _, tc := range []struct {
+		src  netip.AddrPort
+		dst  tproxy.Destination
+		want string
+	}{
+		{src, dst(`9.9.9.9:443`, `chat.OpenAI.com`, false), `us`},
+		{src, dst(`9.9.9.9:443`, `notopenai.com`, false), Current},
+		{src, dst(`9.9.9.9:443`, `myads.example.com`, false), Reject},
+		{src, dst(`9.9.9.9:8080`, `cdn1.example.com`, false), Direct},
+		{src, dst(`9.9.9.9:443`, `cdn1.example.com`, false), Current},
+		{src, dst(`8.8.8.8:53`, ``, false), `us`},
+		{src, dst(`1.2.3.4:443`, ``, false), Direct},
+		// 虚假IP不匹配IP相关的条件。
+		{src, dst(`1.2.3.4:443`, `example.com`, true), Current},
+		{netip.MustParseAddrPort(`192.168.1.10:5000`), dst(`9.9.9.9:443`, ``, false), Reject},
+		{netip.MustParseAddrPort(`192.168.1.11:5000`), dst(`9.9.9.9:443`, ``, false), Reject},
+		{src, dst(`9.9.9.9:443`, `www.google.com`, false), `us`},
+		{src, dst(`9.9.9.9:443`, `google.cn`, false), `us`},
+		{src, dst(`9.9.9.9:443`, `www.google.cn`, false), Current},
+		{src, dst(`9.9.9.9:443`, `g1.net`, false), `us`},
+	} {
+		if got := r.Match(tc.src, tc.dst); got != tc.want {
+			t.Errorf(`匹配不正确：%v %v: want %s, got %s`, tc.src, tc.dst, tc.want, got)
+		}
+	}
+
+	for _, list := range [][]Rule{
+		{{Output: `unknown`}},
+		{{Ports: []string{`9000-8000`}, Output: Direct}},
+		{{Regexps: []string{`(`}, Output: Direct}},
+		{{CIDRs: []string{`x`}, Output: Direct}},
+		{{GeoSites: []string{`unknown`}, Output: Direct}},
+		{{}},
+	} {
+		if _, err := New(list, dialers, geoIP, geoSite); err == nil {
+			t.Errorf(`应该报错：%+v`, list)
+		}
+	}
+}
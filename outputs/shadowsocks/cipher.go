@@ -0,0 +1,87 @@
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"lukechampine.com/blake3"
+)
+
+// [AEAD Ciphers | Shadowsocks](https://shadowsocks.org/doc/aead.html)
+// [SIP022 AEAD-2022 Ciphers](https://github.com/Shadowsocks-NET/shadowsocks-specs/blob/main/2022-1-shadowsocks-2022-edition.md)
+
+type method struct {
+	// 密钥长度，同时也是盐的长度。
+	keySize int
+	// 是否是 2022 版本（SIP022）。
+	is2022 bool
+	// 根据会话子密钥创建加密器。
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+var methods = map[string]method{
+	`aes-128-gcm`:            {keySize: 16, newAEAD: newGCM},
+	`aes-256-gcm`:            {keySize: 32, newAEAD: newGCM},
+	`chacha20-ietf-poly1305`: {keySize: 32, newAEAD: chacha20poly1305.New},
+
+	`2022-blake3-aes-128-gcm`:       {keySize: 16, is2022: true, newAEAD: newGCM},
+	`2022-blake3-aes-256-gcm`:       {keySize: 32, is2022: true, newAEAD: newGCM},
+	`2022-blake3-chacha20-poly1305`: {keySize: 32, is2022: true, newAEAD: chacha20poly1305.New},
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 由配置的密码得到主密钥。
+//
+//   - 旧版本：OpenSSL 的 EVP_BytesToKey；
+//   - 2022 版本：密码即是 base64 编码的密钥，长度必须刚好。
+func (m method) masterKey(password string) ([]byte, error) {
+	if m.is2022 {
+		key, err := base64.StdEncoding.DecodeString(password)
+		if err != nil {
+			return nil, fmt.Errorf(`密钥不是有效的 base64 编码：%w`, err)
+		}
+		if len(key) != m.keySize {
+			return nil, fmt.Errorf(`密钥长度不正确：需要 %d 字节，实际 %d 字节`, m.keySize, len(key))
+		}
+		return key, nil
+	}
+	return evpBytesToKey(password, m.keySize), nil
+}
+
+// 由主密钥和盐得到会话子密钥。
+func (m method) sessionKey(key []byte, salt []byte) ([]byte, error) {
+	if m.is2022 {
+		material := make([]byte, 0, len(key)+len(salt))
+		material = append(material, key...)
+		material = append(material, salt...)
+		subKey := make([]byte, m.keySize)
+		blake3.DeriveKey(subKey, `shadowsocks 2022 session subkey`, material)
+		return subKey, nil
+	}
+	return hkdf.Key(sha1.New, key, salt, `ss-subkey`, m.keySize)
+}
+
+func evpBytesToKey(password string, keySize int) []byte {
+	var key, prev []byte
+	for len(key) < keySize {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:keySize]
+}
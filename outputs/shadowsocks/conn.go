@@ -0,0 +1,156 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	mrand "math/rand/v2"
+	"net"
+	"time"
+)
+
+const (
+	// 旧版本每个块的最大数据长度。
+	maxPayloadSize = 0x3FFF
+	// 2022 版本每个块的最大数据长度。
+	maxPayloadSize2022 = 0xFFFF
+
+	// 2022 版本的头部类型。
+	headerTypeClient = 0
+	headerTypeServer = 1
+
+	// 2022 版本允许的最大时间差。
+	maxTimeDiff = 30 * time.Second
+	// 2022 版本没有首包数据时的最大填充长度。
+	maxPaddingLength = 900
+)
+
+// 客户端连接。
+//
+// 写入的数据会被加密后发往服务器，读出的是解密后的数据。
+type Conn struct {
+	net.Conn
+
+	m   method
+	key []byte
+
+	w       *aeadStream
+	reqSalt []byte
+
+	r *aeadStream
+	// 已解密但是还没有被读走的数据。
+	pending []byte
+}
+
+func (c *Conn) maxPayload() int {
+	if c.m.is2022 {
+		return maxPayloadSize2022
+	}
+	return maxPayloadSize
+}
+
+// 写盐、目标地址和首包数据。
+//
+// dst 是已经编码好的 SOCKS5 格式的地址。
+func (c *Conn) writeRequest(dst []byte, payload []byte) error {
+	salt := make([]byte, c.m.keySize)
+	rand.Read(salt)
+	w, err := newAEADStream(c.m, c.key, salt)
+	if err != nil {
+		return err
+	}
+	c.w, c.reqSalt = w, salt
+
+	buf := bytes.NewBuffer(nil)
+	buf.Write(salt)
+
+	if !c.m.is2022 {
+		header := append(dst, payload...)
+		buf.Write(w.sealChunks(nil, header, maxPayloadSize))
+	} else {
+		// 可变长度头部：地址、填充长度、填充、首包数据。
+		header := dst
+		padding := 0
+		if len(payload) == 0 {
+			padding = 1 + mrand.IntN(maxPaddingLength)
+		}
+		header = binary.BigEndian.AppendUint16(header, uint16(padding))
+		header = append(header, make([]byte, padding)...)
+		header = append(header, payload...)
+
+		// 固定长度头部：类型、时间戳、可变长度头部的长度。
+		fixed := []byte{headerTypeClient}
+		fixed = binary.BigEndian.AppendUint64(fixed, uint64(time.Now().Unix()))
+		fixed = binary.BigEndian.AppendUint16(fixed, uint16(len(header)))
+
+		buf.Write(w.seal(nil, fixed))
+		buf.Write(w.seal(nil, header))
+	}
+
+	_, err = c.Conn.Write(buf.Bytes())
+	return err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	if _, err := c.Conn.Write(c.w.sealChunks(nil, p, c.maxPayload())); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// 读服务器的盐（和 2022 版本的响应头部）。
+func (c *Conn) readResponse() error {
+	salt := make([]byte, c.m.keySize)
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return err
+	}
+	r, err := newAEADStream(c.m, c.key, salt)
+	if err != nil {
+		return err
+	}
+	c.r = r
+
+	if !c.m.is2022 {
+		return nil
+	}
+
+	// 类型、时间戳、请求的盐、首块数据的长度。
+	fixed, err := r.readOpen(c.Conn, 1+8+c.m.keySize+2)
+	if err != nil {
+		return err
+	}
+	if fixed[0] != headerTypeServer {
+		return fmt.Errorf(`shadowsocks: 响应头部类型不正确：%d`, fixed[0])
+	}
+	ts := time.Unix(int64(binary.BigEndian.Uint64(fixed[1:9])), 0)
+	if diff := time.Since(ts).Abs(); diff > maxTimeDiff {
+		return fmt.Errorf(`shadowsocks: 服务器时间相差太多：%v`, diff)
+	}
+	if subtle.ConstantTimeCompare(fixed[9:9+c.m.keySize], c.reqSalt) != 1 {
+		return fmt.Errorf(`shadowsocks: 响应中的请求盐不匹配`)
+	}
+	length := binary.BigEndian.Uint16(fixed[9+c.m.keySize:])
+	c.pending, err = r.readOpen(c.Conn, int(length))
+	return err
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if c.r == nil {
+		if err := c.readResponse(); err != nil {
+			return 0, err
+		}
+	}
+	for len(c.pending) == 0 {
+		chunk, err := c.r.readChunk(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		c.pending = chunk
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
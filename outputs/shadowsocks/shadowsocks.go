@@ -0,0 +1,105 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/movsb/gun/outputs/socks5"
+	"github.com/movsb/gun/pkg/tproxy"
+	"github.com/movsb/gun/pkg/utils"
+)
+
+// Shadowsocks 客户端，支持 AEAD 和 AEAD-2022 加密方式。
+//
+// 仅支持 TCP。
+type Shadowsocks struct {
+	server string
+	m      method
+	key    []byte
+}
+
+func New(server string, methodName string, password string) (*Shadowsocks, error) {
+	m, ok := methods[methodName]
+	if !ok {
+		return nil, fmt.Errorf(`shadowsocks: 不支持的加密方式：%s`, methodName)
+	}
+	key, err := m.masterKey(password)
+	if err != nil {
+		return nil, fmt.Errorf(`shadowsocks: %w`, err)
+	}
+	return &Shadowsocks{
+		server: server,
+		m:      m,
+		key:    key,
+	}, nil
+}
+
+func ListenAndServeTProxy(port uint16, server string, method string, password string) {
+	s := utils.Must1(New(server, method, password))
+	s.ListenAndServeTProxy(port)
+}
+
+func (s *Shadowsocks) ListenAndServeTProxy(port uint16) {
+	tproxy.ListenAndServeTCP(port, func(conn net.Conn, dst tproxy.Destination) {
+		if err := s.ProxyTCP(conn, dst.String()); err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+// 连接服务器并发送请求。
+//
+// addr 形如 host:port，host 可以是域名，由服务器解析。
+// 首包数据会和请求一起发送，以减少特征。
+func (s *Shadowsocks) Dial(addr string, payload []byte) (*Conn, error) {
+	dst, err := socks5.AppendHostPort(nil, addr)
+	if err != nil {
+		return nil, fmt.Errorf(`shadowsocks: %w`, err)
+	}
+	raw, err := net.Dial(`tcp`, s.server)
+	if err != nil {
+		return nil, fmt.Errorf(`shadowsocks: %w`, err)
+	}
+	conn := &Conn{Conn: raw, m: s.m, key: s.key}
+	if err := conn.writeRequest(dst, payload); err != nil {
+		raw.Close()
+		return nil, fmt.Errorf(`shadowsocks: 写请求时失败：%w`, err)
+	}
+	return conn, nil
+}
+
+// remote 形如 host:port，host 可以是域名，由服务器解析。
+func (s *Shadowsocks) ProxyTCP(local net.Conn, remote string) error {
+	defer local.Close()
+
+	// 读首包数据。
+	initial := [512]byte{}
+	local.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	n, err := local.Read(initial[:])
+	local.SetReadDeadline(time.Time{})
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			err = nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf(`读首包数据时错误：%w`, err)
+	}
+
+	remoteConn, err := s.Dial(remote, initial[:n])
+	if err != nil {
+		return err
+	}
+	defer remoteConn.Close()
+
+	utils.Stream(local, remoteConn)
+
+	return nil
+}
+
+// 经由服务器连接目的地址。
+func (s *Shadowsocks) DialTCP(addr string) (net.Conn, error) {
+	return s.Dial(addr, nil)
+}
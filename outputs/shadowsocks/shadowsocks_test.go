@@ -0,0 +1,256 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/movsb/gun/outputs/socks5"
+)
+
+// 一个最简单的服务端：解析请求后把数据原样返回。
+func echoServer(t *testing.T, l net.Listener, m method, key []byte, dst netip.AddrPort) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	fail := func(err error) {
+		t.Error(err)
+	}
+
+	reqSalt := make([]byte, m.keySize)
+	if _, err := io.ReadFull(conn, reqSalt); err != nil {
+		fail(err)
+		return
+	}
+	r, _ := newAEADStream(m, key, reqSalt)
+
+	var header []byte
+	if m.is2022 {
+		fixed, err := r.readOpen(conn, 1+8+2)
+		if err != nil {
+			fail(err)
+			return
+		}
+		if fixed[0] != headerTypeClient {
+			t.Errorf(`请求头部类型不正确：%d`, fixed[0])
+			return
+		}
+		header, err = r.readOpen(conn, int(binary.BigEndian.Uint16(fixed[9:])))
+		if err != nil {
+			fail(err)
+			return
+		}
+	} else {
+		if header, err = r.readChunk(conn); err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	hr := bytes.NewReader(header)
+	addr, err := socks5.ReadAddr(hr)
+	if err != nil || addr != dst {
+		t.Errorf(`目标地址不正确：%v, %v`, addr, err)
+		return
+	}
+	if m.is2022 {
+		var padding uint16
+		binary.Read(hr, binary.BigEndian, &padding)
+		hr.Seek(int64(padding), io.SeekCurrent)
+	}
+	initial, _ := io.ReadAll(hr)
+
+	salt := make([]byte, m.keySize)
+	rand.Read(salt)
+	w, _ := newAEADStream(m, key, salt)
+	out := append([]byte(nil), salt...)
+	if m.is2022 {
+		fixed := []byte{headerTypeServer}
+		fixed = binary.BigEndian.AppendUint64(fixed, uint64(time.Now().Unix()))
+		fixed = append(fixed, reqSalt...)
+		fixed = binary.BigEndian.AppendUint16(fixed, uint16(len(initial)))
+		out = w.seal(out, fixed)
+		out = w.seal(out, initial)
+	} else {
+		out = w.sealChunks(out, initial, maxPayloadSize)
+	}
+	conn.Write(out)
+
+	for {
+		chunk, err := r.readChunk(conn)
+		if err != nil {
+			return
+		}
+		conn.Write(w.sealChunks(nil, chunk, maxPayloadSize))
+	}
+}
+
+func TestShadowsocks(t *testing.T) {
+	key16 := base64.StdEncoding.EncodeToString(make([]byte, 16))
+	key32 := base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	tests := []struct {
+		method   string
+		password string
+	}{
+		{`aes-128-gcm`, `password`},
+		{`chacha20-ietf-poly1305`, `password`},
+		{`2022-blake3-aes-128-gcm`, key16},
+		{`2022-blake3-chacha20-poly1305`, key32},
+	}
+
+	dst := netip.MustParseAddrPort(`1.2.3.4:443`)
+
+	for _, tc := range tests {
+		t.Run(tc.method, func(t *testing.T) {
+			l, err := net.Listen(`tcp`, `127.0.0.1:0`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			s, err := New(l.Addr().String(), tc.method, tc.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go echoServer(t, l, s.m, s.key, dst)
+
+			conn, err := s.Dial(dst.String(), []byte(`hello`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			large := bytes.Repeat([]byte{'x'}, maxPayloadSize+100)
+			if _, err := conn.Write(large); err != nil {
+				t.Fatal(err)
+			}
+
+			want := append([]byte(`hello`), large...)
+			got := make([]byte, len(want))
+			conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatal(`数据不一致`)
+			}
+		})
+	}
+
+	if _, err := New(`:0`, `2022-blake3-aes-256-gcm`, key16); err == nil {
+		t.Fatal(`密钥长度不正确时应该报错`)
+	}
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// 已知答案测试：期望值由独立的实现（openssl kdf HKDF、BLAKE3 参考实现）算出。
+func TestKeyDerivation(t *testing.T) {
+	tests := []struct {
+		method   string
+		password string
+		master   string
+		salt     string
+		subKey   string
+	}{
+		{
+			`aes-128-gcm`, `password`,
+			`5f4dcc3b5aa765d61d8327deb882cf99`,
+			`000102030405060708090a0b0c0d0e0f`,
+			`ed2a618d9490d1701de885d82aa80616`,
+		},
+		{
+			`aes-256-gcm`, `password`,
+			`5f4dcc3b5aa765d61d8327deb882cf992b95990a9151374abd8ff8c5a7a0fe08`,
+			`000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f`,
+			`ee187aed3f87574907a39db98606f60a526114831288097cac66054b33a9464f`,
+		},
+		{
+			`2022-blake3-aes-128-gcm`, base64.StdEncoding.EncodeToString(mustHex(`808182838485868788898a8b8c8d8e8f`)),
+			`808182838485868788898a8b8c8d8e8f`,
+			`000102030405060708090a0b0c0d0e0f`,
+			`4747e887ff3a8e63d79c47d791a4097d`,
+		},
+		{
+			`2022-blake3-aes-256-gcm`, base64.StdEncoding.EncodeToString(mustHex(`808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f`)),
+			`808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f`,
+			`000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f`,
+			`189055769e6e33dd4aff43aa002e4b9346ba5a8b02272705936a99699ee30e32`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.method, func(t *testing.T) {
+			m := methods[tc.method]
+			master, err := m.masterKey(tc.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(master, mustHex(tc.master)) {
+				t.Fatalf(`主密钥不正确：%x`, master)
+			}
+			subKey, err := m.sessionKey(master, mustHex(tc.salt))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(subKey, mustHex(tc.subKey)) {
+				t.Fatalf(`子密钥不正确：%x`, subKey)
+			}
+		})
+	}
+}
+
+// 已知答案测试：首个数据块（请求头部 + 首包数据）的密文。
+//
+// 期望值直接由 AES-GCM 对子密钥加密得到。
+func TestFirstChunk(t *testing.T) {
+	salt := mustHex(`000102030405060708090a0b0c0d0e0f`)
+	addr := socks5.AppendAddr(nil, netip.MustParseAddrPort(`1.2.3.4:443`))
+
+	t.Run(`aes-128-gcm`, func(t *testing.T) {
+		w, err := newAEADStream(methods[`aes-128-gcm`], mustHex(`5f4dcc3b5aa765d61d8327deb882cf99`), salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := w.sealChunks(nil, append(addr, `hello`...), maxPayloadSize)
+		want := mustHex(`5c227bd3a2125e25aef80d12c6e4431ac737fd1019dae13a254505489df76d6d386e1f0405f248e7e439f711bfbe`)
+		if !bytes.Equal(got, want) {
+			t.Fatalf(`密文不正确：%x`, got)
+		}
+	})
+
+	t.Run(`2022-blake3-aes-128-gcm`, func(t *testing.T) {
+		w, err := newAEADStream(methods[`2022-blake3-aes-128-gcm`], mustHex(`808182838485868788898a8b8c8d8e8f`), salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := binary.BigEndian.AppendUint16(append([]byte(nil), addr...), 0)
+		header = append(header, `hello`...)
+		fixed := []byte{headerTypeClient}
+		fixed = binary.BigEndian.AppendUint64(fixed, 1700000000)
+		fixed = binary.BigEndian.AppendUint16(fixed, uint16(len(header)))
+		got := w.seal(nil, fixed)
+		got = w.seal(got, header)
+		want := mustHex(`6c0980110d7060cdc5ac77ef273c39dac6f0de02a372de00763073c282feda1aae1004ecca1ec1dac956066b323441c534dfb5dfed0942ab10`)
+		if !bytes.Equal(got, want) {
+			t.Fatalf(`密文不正确：%x`, got)
+		}
+	})
+}
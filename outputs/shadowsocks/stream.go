@@ -0,0 +1,86 @@
+package shadowsocks
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// 单个方向的加密流。
+//
+// 每次加/解密后，nonce（小端）加一。
+type aeadStream struct {
+	aead  cipher.AEAD
+	nonce []byte
+}
+
+func newAEADStream(m method, key []byte, salt []byte) (*aeadStream, error) {
+	subKey, err := m.sessionKey(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := m.newAEAD(subKey)
+	if err != nil {
+		return nil, err
+	}
+	return &aeadStream{
+		aead:  aead,
+		nonce: make([]byte, aead.NonceSize()),
+	}, nil
+}
+
+func (s *aeadStream) increment() {
+	for i := range s.nonce {
+		s.nonce[i]++
+		if s.nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func (s *aeadStream) seal(dst, plaintext []byte) []byte {
+	out := s.aead.Seal(dst, s.nonce, plaintext, nil)
+	s.increment()
+	return out
+}
+
+func (s *aeadStream) open(dst, ciphertext []byte) ([]byte, error) {
+	out, err := s.aead.Open(dst, s.nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf(`shadowsocks: 解密失败：%w`, err)
+	}
+	s.increment()
+	return out, nil
+}
+
+// 从 r 中读取 n 字节的密文并解密。
+func (s *aeadStream) readOpen(r io.Reader, n int) ([]byte, error) {
+	buf := make([]byte, n+s.aead.Overhead())
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return s.open(buf[:0], buf)
+}
+
+// 把数据按块加密：
+//
+//	[加密的长度][长度的TAG][加密的数据][数据的TAG]
+func (s *aeadStream) sealChunks(dst []byte, p []byte, maxPayload int) []byte {
+	for len(p) > 0 {
+		n := min(len(p), maxPayload)
+		dst = s.seal(dst, binary.BigEndian.AppendUint16(nil, uint16(n)))
+		dst = s.seal(dst, p[:n])
+		p = p[n:]
+	}
+	return dst
+}
+
+// 读取一个数据块。
+func (s *aeadStream) readChunk(r io.Reader) ([]byte, error) {
+	length, err := s.readOpen(r, 2)
+	if err != nil {
+		return nil, err
+	}
+	return s.readOpen(r, int(binary.BigEndian.Uint16(length)))
+}
@@ -1,7 +1,6 @@
 package socks5
 
 import (
-	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
@@ -13,21 +12,46 @@ import (
 
 // [SOCKS - Wikipedia](https://en.wikipedia.org/wiki/SOCKS#SOCKS5)
 
-func ProxyTCP4Addr(conn net.Conn, serverAddr string, dstAddr string) error {
-	remote, err := net.Dial(`tcp4`, serverAddr)
+func ProxyTCPAddr(conn net.Conn, serverAddr string, dstAddr string) error {
+	remote, err := net.Dial(`tcp`, serverAddr)
 	if err != nil {
 		return fmt.Errorf(`连接SOCKS5服务器失败：%s: %w`, serverAddr, err)
 	}
-	return ProxyTCP4Conn(conn, remote, dstAddr)
+	return ProxyTCPConn(conn, remote, dstAddr)
 }
 
-func ProxyTCP4Conn(local, remote net.Conn, dstAddr string) error {
+// 目的地址可以是IPv4或IPv6。
+func ProxyTCPConn(local, remote net.Conn, dstAddr string) error {
 	defer local.Close()
 	defer remote.Close()
 
-	dst := netip.MustParseAddrPort(dstAddr)
+	if err := Connect(remote, dstAddr); err != nil {
+		return err
+	}
+
+	utils.Stream(local, remote)
+
+	return nil
+}
+
+// 经由SOCKS5服务器连接目的地址。
+//
+// 目的地址可以是域名，由服务器解析。
+func DialTCP(serverAddr string, dstAddr string) (net.Conn, error) {
+	remote, err := net.Dial(`tcp`, serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf(`连接SOCKS5服务器失败：%s: %w`, serverAddr, err)
+	}
+	if err := Connect(remote, dstAddr); err != nil {
+		remote.Close()
+		return nil, err
+	}
+	return remote, nil
+}
 
-	buf := [128]byte{}
+// 在已经建立的连接上完成握手，并请求连接目的地址。
+func Connect(remote net.Conn, dstAddr string) error {
+	buf := [512]byte{}
 
 	// 无密码问候。
 	if _, err := remote.Write([]byte{5, 1, 0}); err != nil {
@@ -43,31 +67,37 @@ func ProxyTCP4Conn(local, remote net.Conn, dstAddr string) error {
 	}
 
 	// 建立TCP连接。
-	buf[0] = 5
-	buf[1] = 1
-	buf[2] = 0
-	buf[3] = 1
-	copy(buf[4:], dst.Addr().AsSlice())
-	binary.BigEndian.PutUint16(buf[8:], dst.Port())
-	if _, err := remote.Write(buf[:10]); err != nil {
+	req, err := AppendHostPort(append(buf[:0], 5, 1, 0), dstAddr)
+	if err != nil {
+		return err
+	}
+	if _, err := remote.Write(req); err != nil {
 		return fmt.Errorf(`协议错误：%w`, err)
 	}
 
 	// 读连接状态。
-	if _, err := io.ReadFull(remote, buf[:10]); err != nil {
+	if _, err := io.ReadFull(remote, buf[:3]); err != nil {
 		return fmt.Errorf(`协议错误：%w`, err)
 	}
 	if !(buf[0] == 5 && buf[1] == 0 && buf[2] == 0) {
-		return fmt.Errorf(`服务器连接错误：%v`, buf[:10])
+		return fmt.Errorf(`服务器连接错误：%v`, buf[:3])
+	}
+	// 绑定地址，用不上。
+	if _, err := ReadAddr(remote); err != nil {
+		return fmt.Errorf(`协议错误：%w`, err)
 	}
-
-	utils.Stream(local, remote)
 
 	return nil
 }
 
-func ListenAndServeTProxy(port uint16, server string) {
-	tproxy.ListenAndServeTCP(port, func(conn net.Conn, addr string) {
-		ProxyTCP4Addr(conn, server, addr)
+// udp：服务器是否支持 UDP ASSOCIATE。
+func ListenAndServeTProxy(port uint16, server string, udp bool) {
+	if udp {
+		go tproxy.ListenAndServeUDP(port, func(src netip.AddrPort) (tproxy.PacketConn, error) {
+			return DialUDP(server)
+		})
+	}
+	tproxy.ListenAndServeTCP(port, func(conn net.Conn, dst tproxy.Destination) {
+		ProxyTCPAddr(conn, server, dst.String())
 	})
 }
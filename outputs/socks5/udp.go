@@ -0,0 +1,267 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+)
+
+// 把地址按 SOCKS5 的格式（ATYP DST.ADDR DST.PORT）追加到 buf 后面。
+//
+// Trojan 协议也使用相同的地址格式。
+func AppendAddr(buf []byte, addr netip.AddrPort) []byte {
+	ip := addr.Addr().Unmap()
+	if ip.Is4() {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 4)
+	}
+	buf = append(buf, ip.AsSlice()...)
+	return binary.BigEndian.AppendUint16(buf, addr.Port())
+}
+
+// 把 host:port 形式的地址按 SOCKS5 的格式追加到 buf 后面。
+//
+// host 可以是IP，也可以是域名（由服务器解析）。
+func AppendHostPort(buf []byte, addr string) ([]byte, error) {
+	if ap, err := netip.ParseAddrPort(addr); err == nil {
+		return AppendAddr(buf, ap), nil
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf(`端口不正确：%s`, addr)
+	}
+	if len(host) == 0 || len(host) > 255 {
+		return nil, fmt.Errorf(`域名长度不正确：%s`, addr)
+	}
+	buf = append(buf, 3, byte(len(host)))
+	buf = append(buf, host...)
+	return binary.BigEndian.AppendUint16(buf, uint16(port)), nil
+}
+
+// 读取 SOCKS5 格式的地址。
+//
+// 域名类型的地址会被解析成IP（一般只出现在服务器的回复中）。
+func ReadAddr(r io.Reader) (netip.AddrPort, error) {
+	return readAddr(r, lookupHost)
+}
+
+func readAddr(r io.Reader, lookup func(host string) (netip.Addr, error)) (netip.AddrPort, error) {
+	var buf [1 + 255 + 2]byte
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	var ip netip.Addr
+	switch buf[0] {
+	case 1:
+		if _, err := io.ReadFull(r, buf[:4]); err != nil {
+			return netip.AddrPort{}, err
+		}
+		ip = netip.AddrFrom4([4]byte(buf[:4]))
+	case 4:
+		if _, err := io.ReadFull(r, buf[:16]); err != nil {
+			return netip.AddrPort{}, err
+		}
+		ip = netip.AddrFrom16([16]byte(buf[:16]))
+	case 3:
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			return netip.AddrPort{}, err
+		}
+		n := int(buf[0])
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return netip.AddrPort{}, err
+		}
+		addr, err := lookup(string(buf[:n]))
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		ip = addr
+	default:
+		return netip.AddrPort{}, fmt.Errorf(`未知的地址类型：%d`, buf[0])
+	}
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(ip.Unmap(), binary.BigEndian.Uint16(buf[:2])), nil
+}
+
+func lookupHost(host string) (netip.Addr, error) {
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return netip.Addr{}, fmt.Errorf(`无法解析地址：%s: %w`, host, err)
+	}
+	ip, _ := netip.AddrFromSlice(ips[0])
+	return ip, nil
+}
+
+var errResolving = errors.New(`正在解析域名`)
+
+// 回复包中域名地址的解析结果。
+//
+// 解析在后台进行，不阻塞读循环，解析完成之前的包直接丢弃。
+type hostCache struct {
+	lock sync.Mutex
+	// 无效的地址表示正在解析。
+	ips map[string]netip.Addr
+}
+
+func (c *hostCache) lookup(host string) (netip.Addr, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if ip, ok := c.ips[host]; ok {
+		if !ip.IsValid() {
+			return netip.Addr{}, errResolving
+		}
+		return ip, nil
+	}
+
+	if c.ips == nil {
+		c.ips = map[string]netip.Addr{}
+	}
+	c.ips[host] = netip.Addr{}
+
+	go func() {
+		ip, err := lookupHost(host)
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if err != nil {
+			// 下一个包再重试。
+			delete(c.ips, host)
+			return
+		}
+		c.ips[host] = ip
+	}()
+
+	return netip.Addr{}, errResolving
+}
+
+// 基于 UDP ASSOCIATE 的UDP出口。
+//
+// 控制连接（TCP）断开时，UDP关联也随之失效。
+type PacketConn struct {
+	ctrl  net.Conn
+	relay *net.UDPConn
+
+	// 读缓冲区，只在 ReadFromUDPAddrPort 中使用。
+	buf   []byte
+	hosts hostCache
+}
+
+func DialUDP(serverAddr string) (*PacketConn, error) {
+	ctrl, err := net.Dial(`tcp`, serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf(`连接SOCKS5服务器失败：%s: %w`, serverAddr, err)
+	}
+
+	relayAddr, err := associate(ctrl)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	// 服务器可能返回 0.0.0.0，表示与控制连接相同的地址。
+	if relayAddr.Addr().IsUnspecified() {
+		server := ctrl.RemoteAddr().(*net.TCPAddr).AddrPort()
+		relayAddr = netip.AddrPortFrom(server.Addr().Unmap(), relayAddr.Port())
+	}
+
+	relay, err := net.DialUDP(`udp`, nil, net.UDPAddrFromAddrPort(relayAddr))
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf(`连接SOCKS5中继失败：%s: %w`, relayAddr, err)
+	}
+
+	p := &PacketConn{
+		ctrl:  ctrl,
+		relay: relay,
+		buf:   make([]byte, 64<<10),
+	}
+
+	// 控制连接上不会再有数据，读到结束说明关联失效了。
+	go func() {
+		io.Copy(io.Discard, ctrl)
+		p.Close()
+	}()
+
+	return p, nil
+}
+
+func associate(conn net.Conn) (netip.AddrPort, error) {
+	buf := [10]byte{}
+
+	// 无密码问候。
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		return netip.AddrPort{}, fmt.Errorf(`协议错误：%w`, err)
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return netip.AddrPort{}, fmt.Errorf(`协议错误：%w`, err)
+	}
+	if !(buf[0] == 5 && buf[1] == 0x00) {
+		return netip.AddrPort{}, fmt.Errorf(`服务器认证不支持。`)
+	}
+
+	// UDP ASSOCIATE，客户端地址未知，填零。
+	req := append([]byte{5, 3, 0}, AppendAddr(nil, netip.AddrPortFrom(netip.IPv4Unspecified(), 0))...)
+	if _, err := conn.Write(req); err != nil {
+		return netip.AddrPort{}, fmt.Errorf(`协议错误：%w`, err)
+	}
+
+	if _, err := io.ReadFull(conn, buf[:3]); err != nil {
+		return netip.AddrPort{}, fmt.Errorf(`协议错误：%w`, err)
+	}
+	if !(buf[0] == 5 && buf[1] == 0) {
+		return netip.AddrPort{}, fmt.Errorf(`服务器不支持UDP关联：%v`, buf[:3])
+	}
+	addr, err := ReadAddr(conn)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf(`协议错误：%w`, err)
+	}
+	return addr, nil
+}
+
+func (p *PacketConn) WriteToUDPAddrPort(b []byte, addr netip.AddrPort) (int, error) {
+	// RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA
+	buf := make([]byte, 0, 3+1+16+2+len(b))
+	buf = append(buf, 0, 0, 0)
+	buf = AppendAddr(buf, addr)
+	buf = append(buf, b...)
+	if _, err := p.relay.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (p *PacketConn) ReadFromUDPAddrPort(b []byte) (int, netip.AddrPort, error) {
+	buf := p.buf
+	for {
+		n, err := p.relay.Read(buf)
+		if err != nil {
+			return 0, netip.AddrPort{}, err
+		}
+		// 不支持分片，直接丢弃。
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		from, err := readAddr(r, p.hosts.lookup)
+		if err != nil {
+			continue
+		}
+		return copy(b, buf[n-r.Len():n]), from, nil
+	}
+}
+
+func (p *PacketConn) Close() error {
+	return errors.Join(p.relay.Close(), p.ctrl.Close())
+}
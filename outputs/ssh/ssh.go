@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"sync"
 
 	"github.com/movsb/gun/pkg/tproxy"
 	"github.com/movsb/gun/pkg/utils"
@@ -11,6 +12,10 @@ import (
 )
 
 type SSH struct {
+	addrPort string
+	config   *ssh.ClientConfig
+
+	lock   sync.Mutex
 	client *ssh.Client
 }
 
@@ -25,8 +30,47 @@ func New(username, password string, addrPort string, fingerprint string) *SSH {
 		Auth:            []ssh.AuthMethod{ssh.Password(password)},
 		HostKeyCallback: hostKeyCallback,
 	}
-	client := utils.Must1(ssh.Dial(`tcp4`, addrPort, &config))
-	return &SSH{client: client}
+	// 在第一次使用时才连接。
+	return &SSH{addrPort: addrPort, config: &config}
+}
+
+// 获取（必要时重新建立）到服务器的连接。
+func (s *SSH) getClient() (*ssh.Client, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+	client, err := ssh.Dial(`tcp`, s.addrPort, s.config)
+	if err != nil {
+		return nil, fmt.Errorf(`ssh: %w`, err)
+	}
+	s.client = client
+	// 连接断开后，下次使用时重新连接。
+	go func() {
+		client.Wait()
+		s.lock.Lock()
+		if s.client == client {
+			s.client = nil
+		}
+		s.lock.Unlock()
+	}()
+	return client, nil
+}
+
+// 经由服务器连接目的地址。
+//
+// addr 形如 host:port，host 可以是域名，由服务器解析。
+func (s *SSH) DialTCP(addr string) (net.Conn, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.Dial(`tcp`, addr)
+	if err != nil {
+		return nil, fmt.Errorf(`ssh: dial: %s: %w`, addr, err)
+	}
+	return conn, nil
 }
 
 func fingerprintHostKeyCallback(fingerprint string) ssh.HostKeyCallback {
@@ -42,9 +86,9 @@ func fingerprintHostKeyCallback(fingerprint string) ssh.HostKeyCallback {
 func (s *SSH) Serve(local net.Conn, dstAddr string) error {
 	defer local.Close()
 
-	remote, err := s.client.Dial(`tcp4`, dstAddr)
+	remote, err := s.DialTCP(dstAddr)
 	if err != nil {
-		return fmt.Errorf(`ssh: dial: %s: %w`, dstAddr, err)
+		return err
 	}
 	defer remote.Close()
 
@@ -54,8 +98,8 @@ func (s *SSH) Serve(local net.Conn, dstAddr string) error {
 }
 
 func (s *SSH) ListenAndServeTProxy(port uint16) {
-	tproxy.ListenAndServeTCP(port, func(conn net.Conn, addr string) {
-		if err := s.Serve(conn, addr); err != nil {
+	tproxy.ListenAndServeTCP(port, func(conn net.Conn, dst tproxy.Destination) {
+		if err := s.Serve(conn, dst.String()); err != nil {
 			log.Println(err)
 		}
 	})
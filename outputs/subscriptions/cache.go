@@ -0,0 +1,133 @@
+package subscriptions
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/goccy/go-yaml"
+	"github.com/movsb/gun/cmd/configs"
+	"github.com/movsb/gun/pkg/utils"
+)
+
+// 订阅的节点缓存在配置目录下的这个文件中。
+//
+// 由 `gun subscribe` 生成，启动的时候合并到库存列表。
+const CacheFileName = `subscriptions.ro.yaml`
+
+// 订阅名 -> 节点名 -> 节点配置。
+type Cache = configs.YamlMapSlice[string, configs.YamlMapSlice[string, configs.OutputConfig]]
+
+// 读取缓存的订阅节点。
+//
+// 文件不存在时返回空。
+func LoadCache(dir string) Cache {
+	data, err := os.ReadFile(filepath.Join(dir, CacheFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		log.Panicf(`读取订阅缓存时出错：%v`, err)
+	}
+	var cache Cache
+	if err := yaml.Unmarshal(data, &cache); err != nil {
+		log.Panicf(`解析订阅缓存时出错：%v`, err)
+	}
+	return cache
+}
+
+// 安全地保存订阅缓存：先写临时文件，再重命名。
+func SaveCache(dir string, cache Cache) error {
+	data, err := yaml.Marshal(cache)
+	if err != nil {
+		return err
+	}
+
+	return utils.WriteFileAtomic(filepath.Join(dir, CacheFileName), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// 更新所有的订阅并保存。
+//
+// 某个订阅更新失败的时候保留其上一次的缓存，不影响其它订阅。
+// 不再存在于配置中的订阅会被删除。
+func Update(ctx context.Context, dir string, subscriptions configs.YamlMapSlice[string, string]) error {
+	old := LoadCache(dir)
+	find := func(name string) (configs.YamlMapSlice[string, configs.OutputConfig], bool) {
+		for _, item := range old {
+			if item.Key == name {
+				return item.Value, true
+			}
+		}
+		return nil, false
+	}
+
+	cache := Cache{}
+	var failed int
+
+	for _, sub := range subscriptions {
+		outputs, err := ParseSubscription(ctx, sub.Value)
+		if err != nil {
+			failed++
+			log.Printf(`更新订阅失败：%s: %v`, sub.Key, err)
+			if prev, ok := find(sub.Key); ok {
+				cache = append(cache, configs.YamlMapItem[string, configs.YamlMapSlice[string, configs.OutputConfig]]{
+					Key:   sub.Key,
+					Value: prev,
+				})
+			}
+			continue
+		}
+		log.Printf(`已更新订阅：%s（%d 个节点）`, sub.Key, len(outputs))
+		cache = append(cache, configs.YamlMapItem[string, configs.YamlMapSlice[string, configs.OutputConfig]]{
+			Key:   sub.Key,
+			Value: outputs,
+		})
+	}
+
+	if err := SaveCache(dir, cache); err != nil {
+		return fmt.Errorf(`保存订阅缓存失败：%w`, err)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf(`%d 个订阅更新失败`, failed)
+	}
+
+	return nil
+}
+
+// 把缓存的订阅节点以 `订阅名/节点名` 的名字合并到库存列表中。
+//
+// 只合并仍然在配置中的订阅；与库存中已有名字重复的节点被忽略。
+func MergeStocks(outputs *configs.OutputsConfig, cache Cache) {
+	exists := map[string]bool{}
+	for _, item := range outputs.Stocks {
+		exists[item.Key] = true
+	}
+	subscribed := map[string]bool{}
+	for _, item := range outputs.Subscriptions {
+		subscribed[item.Key] = true
+	}
+
+	for _, sub := range cache {
+		if !subscribed[sub.Key] {
+			continue
+		}
+		for _, node := range sub.Value {
+			name := sub.Key + `/` + node.Key
+			if exists[name] {
+				continue
+			}
+			exists[name] = true
+			outputs.Stocks = append(outputs.Stocks, configs.YamlMapItem[string, configs.OutputConfig]{
+				Key:   name,
+				Value: node.Value,
+			})
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package subscriptions
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/goccy/go-yaml"
+	"github.com/movsb/gun/cmd/configs"
+)
+
+// Clash 配置中的单个代理。
+//
+// 只列出了用得到的字段，其它字段被忽略。
+//
+// [Proxies | Clash](https://clash.wiki/configuration/outbound.html)
+type clashProxy struct {
+	Name     string `yaml:"name"`
+	Type     string `yaml:"type"`
+	Server   string `yaml:"server"`
+	Port     int    `yaml:"port"`
+	Password string `yaml:"password"`
+	Username string `yaml:"username"`
+
+	// Shadowsocks
+	Cipher string `yaml:"cipher"`
+	Plugin string `yaml:"plugin"`
+
+	// TLS
+	TLS            bool   `yaml:"tls"`
+	SNI            string `yaml:"sni"`
+	SkipCertVerify bool   `yaml:"skip-cert-verify"`
+
+	// Hysteria 2
+	Obfs string `yaml:"obfs"`
+}
+
+// 简单判断一下是不是 Clash 的配置：有顶层的 proxies 键。
+func isClash(body []byte) bool {
+	return bytes.HasPrefix(body, []byte(`proxies:`)) || bytes.Contains(body, []byte("\nproxies:"))
+}
+
+func parseClash(body []byte) (configs.YamlMapSlice[string, configs.OutputConfig], error) {
+	var config struct {
+		Proxies []clashProxy `yaml:"proxies"`
+	}
+	if err := yaml.Unmarshal(body, &config); err != nil {
+		return nil, fmt.Errorf(`解析 Clash 配置失败：%w`, err)
+	}
+
+	outputs := configs.YamlMapSlice[string, configs.OutputConfig]{}
+	names := uniqueNames{}
+
+	for _, p := range config.Proxies {
+		output, err := p.toOutput()
+		if err != nil {
+			log.Printf(`跳过节点：%s: %v`, p.Name, err)
+			continue
+		}
+		name := p.Name
+		if name == `` {
+			name = hash(p.Type, p.Server, p.Port)
+		}
+		outputs = append(outputs, configs.YamlMapItem[string, configs.OutputConfig]{
+			Key:   names.add(name),
+			Value: output,
+		})
+	}
+
+	return outputs, nil
+}
+
+func (p *clashProxy) toOutput() (configs.OutputConfig, error) {
+	if p.Server == `` || p.Port <= 0 {
+		return configs.OutputConfig{}, fmt.Errorf(`服务器地址不正确：%s:%d`, p.Server, p.Port)
+	}
+	server := net.JoinHostPort(p.Server, strconv.Itoa(p.Port))
+
+	switch p.Type {
+	case `trojan`:
+		return configs.OutputConfig{Trojan: &configs.TrojanOutputConfig{
+			Server:   server,
+			Password: p.Password,
+			Insecure: p.SkipCertVerify,
+			SNI:      p.SNI,
+		}}, nil
+	case `ss`:
+		if p.Plugin != `` {
+			return configs.OutputConfig{}, fmt.Errorf(`%w的插件：%s`, errUnsupported, p.Plugin)
+		}
+		return configs.OutputConfig{Shadowsocks: &configs.ShadowsocksOutputConfig{
+			Server:   server,
+			Method:   p.Cipher,
+			Password: p.Password,
+		}}, nil
+	case `hysteria2`:
+		if p.SkipCertVerify {
+			return configs.OutputConfig{}, fmt.Errorf(`%w不安全的服务器`, errUnsupported)
+		}
+		if p.Obfs != `` {
+			return configs.OutputConfig{}, fmt.Errorf(`%w的混淆：%s`, errUnsupported, p.Obfs)
+		}
+		return configs.OutputConfig{Hysteria: &configs.HysteriaOutputConfig{
+			Server:   server,
+			Password: p.Password,
+		}}, nil
+	case `socks5`:
+		if p.Username != `` || p.TLS {
+			return configs.OutputConfig{}, fmt.Errorf(`%w带认证或TLS的SOCKS5服务器`, errUnsupported)
+		}
+		return configs.OutputConfig{Socks5: &configs.Socks5OutputConfig{
+			Server: server,
+		}}, nil
+	case `http`:
+		scheme := `http`
+		if p.TLS {
+			scheme = `https`
+		}
+		return configs.OutputConfig{NaiveProxy: &configs.NaiveProxyOutputConfig{
+			Server:   scheme + `://` + server,
+			Username: p.Username,
+			Password: p.Password,
+		}}, nil
+	default:
+		return configs.OutputConfig{}, fmt.Errorf(`%w的协议：%s`, errUnsupported, p.Type)
+	}
+}
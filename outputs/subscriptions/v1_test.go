@@ -0,0 +1,123 @@
+package subscriptions
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/goccy/go-yaml"
+)
+
+func TestParseLines(t *testing.T) {
+	lines := `trojan://password@example.com:443?sni=sni.example.com#trojan
+ss://YWVzLTEyOC1nY206cGFzc3dvcmQ@example.com:8388#ss
+ss://2022-blake3-aes-128-gcm:a2V5@example.com:8388#ss2022
+hysteria2://auth@example.com:443/?sni=example.com#hy2
+vmess://eyJ2IjoiMiJ9
+socks5://example.com:1080#socks5
+`
+	body := []byte(base64.StdEncoding.EncodeToString([]byte(lines)))
+	outputs, err := parseBody(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// vmess 应该被跳过。
+	names := []string{`trojan`, `ss`, `ss2022`, `hy2`, `socks5`}
+	if len(outputs) != len(names) {
+		t.Fatalf(`节点数量不正确：%v`, outputs)
+	}
+	for i, name := range names {
+		if outputs[i].Key != name {
+			t.Fatalf(`节点名字不正确：%s != %s`, outputs[i].Key, name)
+		}
+	}
+
+	if ss := outputs[1].Value.Shadowsocks; ss.Method != `aes-128-gcm` || ss.Password != `password` {
+		t.Fatalf(`ss 解析错误：%+v`, ss)
+	}
+	if ss := outputs[2].Value.Shadowsocks; ss.Method != `2022-blake3-aes-128-gcm` || ss.Password != `a2V5` {
+		t.Fatalf(`ss 解析错误：%+v`, ss)
+	}
+	if hy := outputs[3].Value.Hysteria; hy.Server != `example.com:443` || hy.Password != `auth` {
+		t.Fatalf(`hysteria2 解析错误：%+v`, hy)
+	}
+}
+
+func TestParseLegacyShadowsocks(t *testing.T) {
+	raw := `ss://` + base64.StdEncoding.EncodeToString([]byte(`aes-128-gcm:p@ss:word@example.com:8388`)) + `#legacy`
+	name, ss, err := parseLegacyShadowsocks(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != `legacy` || ss.Server != `example.com:8388` || ss.Method != `aes-128-gcm` || ss.Password != `p@ss:word` {
+		t.Fatalf(`ss 解析错误：%s %+v`, name, ss)
+	}
+}
+
+func TestParseClash(t *testing.T) {
+	body := []byte(`
+port: 7890
+proxies:
+  - name: tr
+    type: trojan
+    server: example.com
+    port: 443
+    password: password
+    sni: sni.example.com
+  - name: vmess
+    type: vmess
+    server: example.com
+    port: 443
+  - name: ss
+    type: ss
+    server: example.com
+    port: 8388
+    cipher: chacha20-ietf-poly1305
+    password: password
+`)
+	outputs, err := parseBody(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 2 {
+		t.Fatalf(`节点数量不正确：%v`, outputs)
+	}
+	if tr := outputs[0].Value.Trojan; tr.Server != `example.com:443` || tr.SNI != `sni.example.com` {
+		t.Fatalf(`trojan 解析错误：%+v`, tr)
+	}
+	if ss := outputs[1].Value.Shadowsocks; ss.Method != `chacha20-ietf-poly1305` {
+		t.Fatalf(`ss 解析错误：%+v`, ss)
+	}
+}
+
+func TestDuplicateNames(t *testing.T) {
+	lines := `socks5://a.example.com:1080#hk
+socks5://b.example.com:1080#hk
+socks5://c.example.com:1080#hk-2
+socks5://d.example.com:1080#hk
+`
+	outputs, err := parseBody([]byte(lines))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{`hk`, `hk-2`, `hk-2-2`, `hk-3`}
+	for i, name := range names {
+		if outputs[i].Key != name {
+			t.Fatalf(`节点名字不正确：%s != %s`, outputs[i].Key, name)
+		}
+	}
+
+	// 保存的缓存应该能被重新读取。
+	cache := Cache{{Key: `sub`, Value: outputs}}
+	data, err := yaml.Marshal(cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded Cache
+	if err := yaml.Unmarshal(data, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 1 || len(loaded[0].Value) != len(names) {
+		t.Fatalf(`读取的缓存不正确：%v`, loaded)
+	}
+}
@@ -4,14 +4,13 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"crypto/tls"
-	"encoding/binary"
 	"encoding/hex"
 	"fmt"
-	"log"
 	"net"
 	"net/netip"
 	"time"
 
+	"github.com/movsb/gun/outputs/socks5"
 	"github.com/movsb/gun/pkg/tproxy"
 	"github.com/movsb/gun/pkg/utils"
 )
@@ -44,46 +43,34 @@ func ListenAndServeTProxy(
 }
 
 func (t *Trojan) ListenAndServeTProxy(port uint16) {
-	tproxy.ListenAndServeTCP(port, func(conn net.Conn, addr string) {
-		t.ProxyTCP4(conn, netip.MustParseAddrPort(addr))
+	go tproxy.ListenAndServeUDP(port, func(src netip.AddrPort) (tproxy.PacketConn, error) {
+		return t.DialUDP()
+	})
+	tproxy.ListenAndServeTCP(port, func(conn net.Conn, dst tproxy.Destination) {
+		t.ProxyTCP(conn, dst.String())
 	})
 }
 
-func (t *Trojan) ProxyTCP4(local net.Conn, remote netip.AddrPort) error {
+// remote 形如 host:port，host 可以是域名，由服务器解析。
+func (t *Trojan) ProxyTCP(local net.Conn, remote string) error {
 	defer local.Close()
 
-	remoteConn, err := tls.Dial(`tcp4`, t.ServerAddrPort, &tls.Config{
-		InsecureSkipVerify: t.InsecureSkipVerify,
-		ServerName:         t.ServerName,
-	})
+	dst, err := socks5.AppendHostPort(nil, remote)
 	if err != nil {
 		return fmt.Errorf(`trojan: %w`, err)
 	}
+
+	remoteConn, err := t.dial()
+	if err != nil {
+		return err
+	}
 	defer remoteConn.Close()
 
 	back := [256]byte{}
 	buf := bytes.NewBuffer(back[:0])
 
-	// 写密码
-	pswSum := sha256.Sum224([]byte(t.Password))
-	buf.WriteString(hex.EncodeToString(pswSum[:]))
-	buf.WriteString("\r\n")
-
-	// 写请求
-	buf.WriteByte(1) // CONNECT
-	if remote.Addr().Is4() {
-		buf.WriteByte(1)
-		ip4 := remote.Addr().As4()
-		buf.Write(ip4[:])
-	} else if remote.Addr().Is6() {
-		buf.WriteByte(4)
-		ip6 := remote.Addr().As16()
-		buf.Write(ip6[:])
-	} else {
-		log.Panicln(`不支持的地址类型。`)
-	}
-	buf.Write(binary.BigEndian.AppendUint16(nil, remote.Port()))
-	buf.WriteString("\r\n")
+	// 写密码和请求
+	t.writeRequest(buf, cmdConnect, dst)
 
 	// 写首包数据。
 	// “This avoids length pattern detection and may reduce the number of packets to be sent.”
@@ -111,3 +98,55 @@ func (t *Trojan) ProxyTCP4(local net.Conn, remote netip.AddrPort) error {
 
 	return nil
 }
+
+const (
+	cmdConnect      = 1
+	cmdUDPAssociate = 3
+)
+
+func (t *Trojan) dial() (*tls.Conn, error) {
+	conn, err := tls.Dial(`tcp`, t.ServerAddrPort, &tls.Config{
+		InsecureSkipVerify: t.InsecureSkipVerify,
+		ServerName:         t.ServerName,
+	})
+	if err != nil {
+		return nil, fmt.Errorf(`trojan: %w`, err)
+	}
+	return conn, nil
+}
+
+// 写密码和请求头。
+//
+// dst 是已经编码好的 SOCKS5 格式的地址。
+func (t *Trojan) writeRequest(buf *bytes.Buffer, cmd byte, dst []byte) {
+	// 写密码
+	pswSum := sha256.Sum224([]byte(t.Password))
+	buf.WriteString(hex.EncodeToString(pswSum[:]))
+	buf.WriteString("\r\n")
+
+	// 写请求
+	buf.WriteByte(cmd)
+	buf.Write(dst)
+	buf.WriteString("\r\n")
+}
+
+// 经由服务器连接目的地址。
+//
+// addr 形如 host:port，host 可以是域名，由服务器解析。
+func (t *Trojan) DialTCP(addr string) (net.Conn, error) {
+	dst, err := socks5.AppendHostPort(nil, addr)
+	if err != nil {
+		return nil, fmt.Errorf(`trojan: %w`, err)
+	}
+	conn, err := t.dial()
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(nil)
+	t.writeRequest(buf, cmdConnect, dst)
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf(`trojan: 写请求时失败：%w`, err)
+	}
+	return conn, nil
+}
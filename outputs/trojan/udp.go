@@ -0,0 +1,93 @@
+package trojan
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+	"sync"
+
+	"github.com/movsb/gun/outputs/socks5"
+)
+
+// 基于 UDP ASSOCIATE 的UDP出口。
+//
+// 所有的UDP包都在同一条TLS连接上传输，每个包的格式为：
+//
+//	ATYP DST.ADDR DST.PORT Length CRLF Payload
+type PacketConn struct {
+	conn *tls.Conn
+	r    *bufio.Reader
+	lock sync.Mutex
+}
+
+func (t *Trojan) DialUDP() (*PacketConn, error) {
+	conn, err := t.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	// 请求中的地址没有实际用途，填零即可。
+	buf := bytes.NewBuffer(nil)
+	t.writeRequest(buf, cmdUDPAssociate, socks5.AppendAddr(nil, netip.AddrPortFrom(netip.IPv4Unspecified(), 0)))
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf(`trojan: 写请求时失败：%w`, err)
+	}
+
+	return &PacketConn{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+	}, nil
+}
+
+func (p *PacketConn) WriteToUDPAddrPort(b []byte, addr netip.AddrPort) (int, error) {
+	if len(b) > 0xFFFF {
+		return 0, fmt.Errorf(`trojan: 包太大：%d`, len(b))
+	}
+	buf := make([]byte, 0, 1+16+2+2+2+len(b))
+	buf = socks5.AppendAddr(buf, addr)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(b)))
+	buf = append(buf, '\r', '\n')
+	buf = append(buf, b...)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, err := p.conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (p *PacketConn) ReadFromUDPAddrPort(b []byte) (int, netip.AddrPort, error) {
+	from, err := socks5.ReadAddr(p.r)
+	if err != nil {
+		return 0, netip.AddrPort{}, err
+	}
+	var hdr [4]byte
+	if _, err := io.ReadFull(p.r, hdr[:]); err != nil {
+		return 0, netip.AddrPort{}, err
+	}
+	if hdr[2] != '\r' || hdr[3] != '\n' {
+		return 0, netip.AddrPort{}, fmt.Errorf(`trojan: 协议错误`)
+	}
+	length := int(binary.BigEndian.Uint16(hdr[:2]))
+	if length > len(b) {
+		// 缓冲区不够，丢弃此包。
+		if _, err := p.r.Discard(length); err != nil {
+			return 0, netip.AddrPort{}, err
+		}
+		return 0, from, nil
+	}
+	if _, err := io.ReadFull(p.r, b[:length]); err != nil {
+		return 0, netip.AddrPort{}, err
+	}
+	return length, from, nil
+}
+
+func (p *PacketConn) Close() error {
+	return p.conn.Close()
+}
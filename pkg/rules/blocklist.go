@@ -0,0 +1,145 @@
+package rules
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/movsb/gun/pkg/utils"
+)
+
+// hosts 文件中不是广告域名的条目。
+var hostsIgnored = map[string]bool{
+	`localhost`:             true,
+	`localhost.localdomain`: true,
+	`local`:                 true,
+	`broadcasthost`:         true,
+	`ip6-localhost`:         true,
+	`ip6-loopback`:          true,
+	`0.0.0.0`:               true,
+}
+
+// hosts 格式的屏蔽列表，转换成每行一个域名（后缀）。
+func transformHosts(w io.Writer, r io.Reader) error {
+	return eachUniqueLine(w, r, func(line string, emit func(string)) {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return
+		}
+		for _, host := range fields[1:] {
+			host = strings.ToLower(strings.TrimSuffix(host, `.`))
+			if !hostsIgnored[host] && hostRegexp.MatchString(host) {
+				emit(host)
+			}
+		}
+	})
+}
+
+// AdGuard/Adblock Plus 格式的屏蔽列表，转换成规则文件的语法。
+//
+// 只取能在DNS层面处理的规则：||domain^ 和 domain 作为后缀，|domain^ 作为完整域名，
+// /正则/ 匹配域名，@@ 开头的是例外规则。带路径的、带有只对部分请求生效的选项的，
+// 以及元素隐藏等其它规则都被忽略（按整个域名处理会误杀）。
+func transformAdblock(w io.Writer, r io.Reader) error {
+	return eachUniqueLine(w, r, func(line string, emit func(string)) {
+		if rule := adblockRule(line); rule != `` {
+			emit(rule)
+		}
+	})
+}
+
+func adblockRule(line string) string {
+	line = strings.TrimSpace(line)
+	switch {
+	case line == ``, line[0] == '!', line[0] == '#', line[0] == '[':
+		return ``
+	case strings.Contains(line, `##`), strings.Contains(line, `#@#`), strings.Contains(line, `#?#`), strings.Contains(line, `#$#`):
+		return ``
+	}
+
+	exception := strings.HasPrefix(line, `@@`)
+	line = strings.TrimPrefix(line, `@@`)
+
+	var rule string
+	switch {
+	case len(line) > 1 && line[0] == '/' && line[len(line)-1] == '/':
+		if _, err := regexp.Compile(line[1 : len(line)-1]); err == nil {
+			rule = `regexp:` + line[1:len(line)-1]
+		}
+	case strings.HasPrefix(line, `||`):
+		rule = adblockHost(line[2:])
+	case strings.HasPrefix(line, `|`):
+		line = strings.TrimPrefix(line[1:], `http://`)
+		line = strings.TrimPrefix(line, `https://`)
+		if host := adblockHost(line); host != `` {
+			rule = `full:` + host
+		}
+	default:
+		// 也可能是 hosts 格式的行。
+		if fields := strings.Fields(line); len(fields) >= 2 {
+			line = fields[1]
+		}
+		if host := adblockHost(line); !hostsIgnored[host] {
+			rule = host
+		}
+	}
+
+	if rule != `` && exception {
+		rule = `@@` + rule
+	}
+	return rule
+}
+
+// 在DNS层面有意义的选项。其它选项（如 $third-party、$script、$generichide）
+// 只对部分请求或者页面元素生效，带有这些选项的规则不能按整个域名处理。
+var adblockOptions = map[string]bool{
+	`important`: true,
+	`document`:  true,
+	`doc`:       true,
+	`all`:       true,
+}
+
+// 取出只匹配整个域名的规则中的域名：host、host^、host^|、host/，
+// 可以带 DNS 层面有意义的选项。带路径、端口、通配符或者其它选项的规则返回空。
+func adblockHost(s string) string {
+	s, opts, _ := strings.Cut(s, `$`)
+	if opts != `` {
+		for opt := range strings.SplitSeq(opts, `,`) {
+			if !adblockOptions[strings.TrimSpace(opt)] {
+				return ``
+			}
+		}
+	}
+	s = strings.TrimSuffix(s, `|`)
+	s = strings.TrimSuffix(s, `^`)
+	s = strings.TrimSuffix(s, `/`)
+	s = strings.TrimPrefix(s, `*.`)
+	s = strings.ToLower(strings.TrimSuffix(s, `.`))
+	if !hostRegexp.MatchString(s) {
+		return ``
+	}
+	return s
+}
+
+// 逐行转换，去掉重复的结果。
+func eachUniqueLine(w io.Writer, r io.Reader, convert func(line string, emit func(string))) error {
+	seen := map[string]struct{}{}
+	emit := func(s string) {
+		if _, ok := seen[s]; ok {
+			return
+		}
+		seen[s] = struct{}{}
+		utils.Must1(fmt.Fprintln(w, s))
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		convert(scanner.Text(), emit)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,77 @@
+package rules
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestBlockLists(t *testing.T) {
+	for _, tc := range []struct {
+		transform func(w *bytes.Buffer, r *strings.Reader) error
+		input     []string
+		want      []string
+	}{
+		{
+			func(w *bytes.Buffer, r *strings.Reader) error { return transformHosts(w, r) },
+			[]string{
+				`# comment`,
+				`127.0.0.1 localhost`,
+				`0.0.0.0 0.0.0.0`,
+				`0.0.0.0 Ads.example.com tracker.example.com # inline`,
+				`::1 ip6-localhost`,
+				`0.0.0.0 ads.example.com`,
+			},
+			[]string{`ads.example.com`, `tracker.example.com`},
+		},
+		{
+			func(w *bytes.Buffer, r *strings.Reader) error { return transformPlain(w, r) },
+			[]string{
+				`# comment`,
+				`ads.example.com`,
+				`@@good.example.com`,
+				`1.2.3.0/24`,
+				`bad rule`,
+				`regexp:[`,
+			},
+			[]string{`ads.example.com`, `@@good.example.com`, `1.2.3.0/24`},
+		},
+		{
+			func(w *bytes.Buffer, r *strings.Reader) error { return transformAdblock(w, r) },
+			[]string{
+				`! Title: test`,
+				`[Adblock Plus 2.0]`,
+				`||ads.example.com^`,
+				`||tracker.example.com^$important`,
+				`|exact.example.com^`,
+				`@@||good.example.com^`,
+				`/^ad\d+\.example\.net$/`,
+				`example.com##.banner`,
+				`0.0.0.0 hosts.example.com`,
+				`plain.example.com`,
+				`/banner/*/img^`,
+				`||youtube.com/api/stats/ads$xmlhttprequest`,
+				`||path.example.com^/ads`,
+				`||third.example.com^$third-party`,
+				`@@||example.com^$generichide`,
+				`@@||page.example.com^$document`,
+				`|https://url.example.com/`,
+				`plain.example.com/ads`,
+			},
+			[]string{
+				`ads.example.com`, `tracker.example.com`, `full:exact.example.com`,
+				`@@good.example.com`, `regexp:^ad\d+\.example\.net$`,
+				`hosts.example.com`, `plain.example.com`,
+				`@@page.example.com`, `full:url.example.com`,
+			},
+		},
+	} {
+		var b bytes.Buffer
+		if err := tc.transform(&b, strings.NewReader(strings.Join(tc.input, "\n"))); err != nil {
+			t.Fatal(err)
+		}
+		if want := strings.Join(tc.want, "\n") + "\n"; b.String() != want {
+			t.Errorf(`结果不正确：%q`, b.String())
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// 域名规则的类型。
+const (
+	// 域名本身及其子域名（默认）：domain:example.com 或者 example.com。
+	DomainSuffix = `domain`
+	// 只匹配子域名：*.example.com。
+	DomainWildcard = `wildcard`
+	// 只匹配域名本身：full:example.com。
+	DomainFull = `full`
+	// 域名包含关键字：keyword:google。
+	DomainKeyword = `keyword`
+	// 域名匹配正则表达式：regexp:^cdn\d+\.example\.com$。
+	DomainRegexp = `regexp`
+)
+
+// 一条域名规则。
+type Domain struct {
+	Type  string
+	Value string
+}
+
+// 解析规则文件中的一条域名规则。
+func ParseDomain(s string) (Domain, error) {
+	if v, ok := strings.CutPrefix(s, `*.`); ok {
+		return newDomain(DomainWildcard, v)
+	}
+	if typ, v, ok := strings.Cut(s, `:`); ok {
+		switch typ {
+		case DomainSuffix, DomainFull, DomainKeyword, DomainRegexp:
+			return newDomain(typ, v)
+		}
+		return Domain{}, fmt.Errorf(`不支持的域名规则：%s`, s)
+	}
+	return newDomain(DomainSuffix, s)
+}
+
+func newDomain(typ, value string) (Domain, error) {
+	if value == `` {
+		return Domain{}, errors.New(`域名规则为空`)
+	}
+	if typ == DomainRegexp {
+		if _, err := regexp.Compile(value); err != nil {
+			return Domain{}, fmt.Errorf(`正则表达式不正确：%w`, err)
+		}
+		return Domain{Type: typ, Value: value}, nil
+	}
+	value = strings.ToLower(strings.TrimSuffix(value, `.`))
+	if typ != DomainKeyword && strings.ContainsAny(value, "*/: \t") {
+		return Domain{}, fmt.Errorf(`域名不正确：%s`, value)
+	}
+	return Domain{Type: typ, Value: value}, nil
+}
+
+// 规则文件中的写法。
+func (d Domain) String() string {
+	switch d.Type {
+	case DomainSuffix:
+		return d.Value
+	case DomainWildcard:
+		return `*.` + d.Value
+	default:
+		return d.Type + `:` + d.Value
+	}
+}
+
+// 编译后的一组域名规则。
+//
+// 后缀、子域名、完整域名存放在按标签倒序的前缀树中，
+// 关键字和正则表达式逐个匹配。
+type DomainSet struct {
+	root     domainNode
+	keywords []string
+	regexps  []*regexp.Regexp
+}
+
+type domainNode struct {
+	children map[string]*domainNode
+	// 匹配到此节点为止的域名本身。
+	self bool
+	// 匹配此节点的子域名。
+	sub bool
+}
+
+func NewDomainSet(domains []Domain) (*DomainSet, error) {
+	s := &DomainSet{}
+	for _, d := range domains {
+		if err := s.Add(d); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *DomainSet) Add(d Domain) error {
+	switch d.Type {
+	case DomainKeyword:
+		s.keywords = append(s.keywords, d.Value)
+		return nil
+	case DomainRegexp:
+		// 待匹配的域名是小写的，正则表达式不区分大小写。
+		re, err := regexp.Compile(`(?i)` + d.Value)
+		if err != nil {
+			return err
+		}
+		s.regexps = append(s.regexps, re)
+		return nil
+	case DomainSuffix, DomainWildcard, DomainFull:
+	default:
+		return fmt.Errorf(`不支持的域名规则类型：%s`, d.Type)
+	}
+
+	node := &s.root
+	labels := strings.Split(d.Value, `.`)
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.children == nil {
+			node.children = map[string]*domainNode{}
+		}
+		child := node.children[labels[i]]
+		if child == nil {
+			child = &domainNode{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	node.self = node.self || d.Type != DomainWildcard
+	node.sub = node.sub || d.Type != DomainFull
+	return nil
+}
+
+// 匹配域名（可以带最后的 .，不区分大小写），返回匹配的优先级，0 表示不匹配。
+//
+// 越具体的规则优先级越高：域名本身 > 更长的后缀 > 关键字、正则表达式。
+// 用于在两组规则都匹配时决定使用哪一组。
+func (s *DomainSet) Match(name string) int {
+	name = strings.ToLower(strings.TrimSuffix(name, `.`))
+
+	best := 0
+	node := &s.root
+	rest := name
+	for node != nil && rest != `` {
+		i := strings.LastIndexByte(rest, '.')
+		node = node.children[rest[i+1:]]
+		if node == nil {
+			break
+		}
+		if i < 0 {
+			if node.self {
+				best = len(name) + 2
+			}
+			break
+		}
+		if node.sub {
+			best = len(name) - i
+		}
+		rest = rest[:i]
+	}
+	if best > 0 {
+		return best
+	}
+
+	for _, k := range s.keywords {
+		if strings.Contains(name, k) {
+			return 1
+		}
+	}
+	for _, re := range s.regexps {
+		if re.MatchString(name) {
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,54 @@
+package rules
+
+import "testing"
+
+func TestDomainSet(t *testing.T) {
+	var domains []Domain
+	for _, s := range []string{
+		`example.com`,
+		`*.wildcard.com`,
+		`full:Full.com`,
+		`domain:sub.full.com`,
+		`keyword:ads`,
+		`regexp:^cdn\d+\.`,
+		`regexp:^IMG\d+\.Example\.org$`,
+	} {
+		d, err := ParseDomain(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again, _ := ParseDomain(d.String()); again != d {
+			t.Errorf(`写法不一致：%s: %v != %v`, s, again, d)
+		}
+		domains = append(domains, d)
+	}
+	set, err := NewDomainSet(domains)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]int{
+		`example.com.`:     len(`example.com`) + 2,
+		`www.Example.com.`: len(`example.com`) + 1,
+		`notexample.com`:   0,
+		`wildcard.com`:     0,
+		`a.wildcard.com`:   len(`wildcard.com`) + 1,
+		`full.com`:         len(`full.com`) + 2,
+		`www.full.com`:     0,
+		`a.sub.full.com`:   len(`sub.full.com`) + 1,
+		`myads.net`:        1,
+		`cdn12.net`:        1,
+		`cdn.net`:          0,
+		`img1.example.org`: 1,
+	} {
+		if got := set.Match(name); got != want {
+			t.Errorf(`%s: want %d, got %d`, name, want, got)
+		}
+	}
+
+	for _, s := range []string{`unknown:x`, `regexp:(`, `full:`, `a/b.com`} {
+		if _, err := ParseDomain(s); err == nil {
+			t.Errorf(`应该报错：%s`, s)
+		}
+	}
+}
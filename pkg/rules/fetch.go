@@ -2,6 +2,7 @@ package rules
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"log"
 	"math"
 	"net/http"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -23,104 +25,234 @@ const (
 	chinaDomainsURL  = `https://raw.githubusercontent.com/felixonmars/dnsmasq-china-list/master/accelerated-domains.china.conf`
 	ChinaDomainsName = `china.domains.ro.txt`
 
-	gfwDomainsURL  = `https://raw.githubusercontent.com/pexcn/daily/gh-pages/gfwlist/gfwlist.txt`
+	// 原始的 gfwlist（base64 编码的 Adblock Plus 语法）。
+	gfwDomainsURL  = `https://raw.githubusercontent.com/gfwlist/gfwlist/master/gfwlist.txt`
 	GfwDomainsName = `banned.domains.ro.txt`
 
 	// 合并后的中国路由列表，含IPv4和IPv6。
 	chinaRoutesURL  = `https://ftp.apnic.net/stats/apnic/delegated-apnic-latest`
 	ChinaRoutesName = `china.routes.ro.txt`
 
+	// 屏蔽列表：blocked.<名字>.ro.txt。
+	BlockedListPattern = `blocked.*.ro.txt`
+
 	BannedUserTxt  = `banned.user.txt`
 	IgnoredUserTxt = `ignored.user.txt`
 	BlockedUserTxt = `blocked.user.txt`
 )
 
-func UpdateChinaDomains(ctx context.Context, dir string) {
-	_safelySaveURLAsFile(ctx, chinaDomainsURL, filepath.Join(dir, ChinaDomainsName), func(w io.Writer, r io.Reader) error {
-		scanner := bufio.NewScanner(r)
-		for scanner.Scan() {
-			// server=/qq.com/114.114.114.114
-			parts := strings.Split(scanner.Text(), `/`)
-			if len(parts) != 3 {
-				continue
-			}
-			utils.Must1(fmt.Fprintln(w, parts[1]))
+// 规则文件的格式。
+const (
+	// dnsmasq 配置：server=/qq.com/114.114.114.114。
+	FormatDnsmasq = `dnsmasq`
+	// 每行一个域名或者IP（段），原样保存（去掉空行和注释）。
+	FormatPlain = `plain`
+	// gfwlist（Adblock Plus 语法），转换成后缀、完整域名、正则和例外规则。
+	FormatGFWList = `gfwlist`
+	// base64 编码的 gfwlist。
+	FormatGFWListBase64 = `gfwlist-base64`
+	// APNIC 的分配记录（delegated-apnic-latest），只取中国的。
+	FormatAPNIC = `apnic`
+	// 每行一个IP或者IP段，会校验每一行。
+	FormatCIDR = `cidr`
+	// hosts 文件：0.0.0.0 ads.example.com，只取域名。
+	FormatHosts = `hosts`
+	// AdGuard/Adblock Plus 的DNS过滤规则：||ads.example.com^、@@||example.com^、/正则/。
+	FormatAdblock = `adblock`
+)
+
+// 规则文件的来源。
+type Source struct {
+	// 按顺序尝试的镜像，前一个失败（包括校验失败）时尝试下一个。
+	URLs []string
+	// 格式，见 Format* 常量。
+	Format string
+	// 可选的 SHA256 校验和：十六进制的值，或者校验和文件（sha256sum 的输出）的URL。
+	SHA256 string
+	// 可选的 minisign 公钥（base64，即 .pub 文件的第二行）。
+	// 签名从同一个镜像的 URL + .minisig 下载。
+	Minisign string
+	// 转换后的文件至少要有这么大（字节），以免异常情况（比如镜像返回了错误页面）
+	// 覆盖了正常的文件。为 0 表示不检查：用户配置的列表可能本来就很小。
+	MinSize int64
+}
+
+// 默认的来源的文件都有很多行，太小说明有问题。
+const defaultMinSize = 1 << 10
+
+// 默认的来源。
+var DefaultSources = map[string]Source{
+	ChinaDomainsName: {URLs: []string{chinaDomainsURL}, Format: FormatDnsmasq, MinSize: defaultMinSize},
+	GfwDomainsName:   {URLs: []string{gfwDomainsURL}, Format: FormatGFWListBase64, MinSize: defaultMinSize},
+	ChinaRoutesName:  {URLs: []string{chinaRoutesURL}, Format: FormatAPNIC, MinSize: defaultMinSize},
+}
+
+// 检查来源是否正确。
+func (s Source) Check() error {
+	if len(s.URLs) == 0 {
+		return errors.New(`没有指定URL`)
+	}
+	if _, ok := transforms[s.Format]; !ok {
+		return fmt.Errorf(`不支持的格式：%s`, s.Format)
+	}
+	if s.Minisign != `` {
+		if _, err := parseMinisignKey(s.Minisign); err != nil {
+			return err
 		}
-		return scanner.Err()
-	})
+	}
+	return nil
 }
 
-func UpdateGFWDomains(ctx context.Context, dir string) {
-	_safelySaveURLAsFile(ctx, gfwDomainsURL, filepath.Join(dir, GfwDomainsName), func(w io.Writer, r io.Reader) error {
-		_, err := io.Copy(w, r)
-		return err
-	})
+var transforms = map[string]func(w io.Writer, r io.Reader) error{
+	FormatDnsmasq:       transformDnsmasq,
+	FormatPlain:         transformPlain,
+	FormatGFWList:       transformGFWList,
+	FormatGFWListBase64: transformGFWListBase64,
+	FormatAPNIC:         transformAPNIC,
+	FormatCIDR:          transformCIDR,
+	FormatHosts:         transformHosts,
+	FormatAdblock:       transformAdblock,
 }
 
-func UpdateChinaRoutes(ctx context.Context, dir string) {
-	_safelySaveURLAsFile(ctx, chinaRoutesURL, filepath.Join(dir, ChinaRoutesName), func(w io.Writer, r io.Reader) error {
-		scanner := bufio.NewScanner(r)
-		for scanner.Scan() {
-			line := scanner.Text()
+// 名为 name 的屏蔽列表的文件名。
+func BlockedListName(name string) string {
+	return strings.Replace(BlockedListPattern, `*`, name, 1)
+}
 
-			if strings.Contains(line, `|CN|ipv4|`) {
-				parts := strings.Split(line, `|`)
-				if len(parts) < 5 {
-					continue
-				}
+func transformDnsmasq(w io.Writer, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// server=/qq.com/114.114.114.114
+		parts := strings.Split(scanner.Text(), `/`)
+		if len(parts) != 3 {
+			continue
+		}
+		utils.Must1(fmt.Fprintln(w, parts[1]))
+	}
+	return scanner.Err()
+}
+
+func transformPlain(w io.Writer, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == `` || line[0] == '#' {
+			continue
+		}
+		// 无效的行直接丢弃，不写入文件。
+		if !validLine(line) {
+			continue
+		}
+		utils.Must1(fmt.Fprintln(w, line))
+	}
+	return scanner.Err()
+}
+
+func transformCIDR(w io.Writer, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == `` || line[0] == '#' {
+			continue
+		}
+		var err error
+		if strings.Contains(line, `/`) {
+			_, err = netip.ParsePrefix(line)
+		} else {
+			_, err = netip.ParseAddr(line)
+		}
+		if err != nil {
+			return fmt.Errorf(`不是IP或者IP段：%s`, line)
+		}
+		utils.Must1(fmt.Fprintln(w, line))
+	}
+	return scanner.Err()
+}
 
-				start := parts[3]
-				count := utils.Must1(strconv.Atoi(parts[4]))
-				bits := 32 - int(math.Log2(float64(count)))
-				utils.Must1(fmt.Fprintf(w, "%s/%d\n", start, bits))
+func transformAPNIC(w io.Writer, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
 
+		if strings.Contains(line, `|CN|ipv4|`) {
+			parts := strings.Split(line, `|`)
+			if len(parts) < 5 {
 				continue
 			}
 
-			if strings.Contains(line, `|CN|ipv6|`) {
-				parts := strings.Split(line, `|`)
-				if len(parts) < 5 {
-					continue
-				}
+			start := parts[3]
+			count := utils.Must1(strconv.Atoi(parts[4]))
+			bits := 32 - int(math.Log2(float64(count)))
+			utils.Must1(fmt.Fprintf(w, "%s/%d\n", start, bits))
 
-				prefix := parts[3]
-				bits := utils.Must1(strconv.Atoi(parts[4]))
-				utils.Must1(fmt.Fprintf(w, "%s/%d\n", prefix, bits))
+			continue
+		}
 
+		if strings.Contains(line, `|CN|ipv6|`) {
+			parts := strings.Split(line, `|`)
+			if len(parts) < 5 {
 				continue
 			}
 
-			// ignored another lines.
+			prefix := parts[3]
+			bits := utils.Must1(strconv.Atoi(parts[4]))
+			utils.Must1(fmt.Fprintf(w, "%s/%d\n", prefix, bits))
+
+			continue
 		}
-		return scanner.Err()
-	})
+
+		// ignored another lines.
+	}
+	return scanner.Err()
 }
 
-const TmpPattern = `.gun.*.tmp`
+// 按来源更新规则文件 dir/name。全部镜像都失败时返回错误，原来的文件保持不变。
+//
+// client 为空时直接下载。
+func Update(ctx context.Context, client *http.Client, dir string, name string, src Source) error {
+	if err := src.Check(); err != nil {
+		return err
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	var errs []error
+	for _, url := range src.URLs {
+		err := _safelySaveURLAsFile(ctx, client, url, src, filepath.Join(dir, name), transforms[src.Format])
+		if err == nil {
+			return nil
+		}
+		log.Println(`下载失败：`, url, err)
+		errs = append(errs, err)
+	}
+	return fmt.Errorf(`全部镜像都下载失败：%s: %w`, name, errors.Join(errs...))
+}
 
 // 意外情况可能有残留，清理掉。
 func ClearTempFiles(dir string) {
-	paths, _ := filepath.Glob(filepath.Join(dir, TmpPattern))
+	paths, _ := filepath.Glob(filepath.Join(dir, utils.TmpPattern))
 	for _, path := range paths {
 		os.Remove(path)
 	}
 }
 
-// 安全下载URL到Path，通过 transform 函数拷贝。
+// 安全下载URL到Path，校验后通过 transform 函数拷贝。
 //
-// httpGet URL | transform > path.
+// httpGet URL | verify | transform > path.
 //
 //   - 但是并没有校验每一行数据是否合法。
 //   - 会校验文件修改时间，如果没有变化，不会重新下载。
-func _safelySaveURLAsFile(ctx context.Context, url string, path string, transform func(w io.Writer, r io.Reader) error) {
+func _safelySaveURLAsFile(ctx context.Context, client *http.Client, url string, src Source, path string, transform func(w io.Writer, r io.Reader) error) (outErr error) {
+	defer utils.CatchAsError(&outErr)
+
 	ctx, cancel := context.WithTimeout(ctx, time.Minute*10)
 	defer cancel()
 	req := utils.Must1(http.NewRequestWithContext(ctx, http.MethodGet, url, nil))
-	rsp := utils.Must1(http.DefaultClient.Do(req))
+	rsp := utils.Must1(client.Do(req))
+	defer rsp.Body.Close()
 	if rsp.StatusCode != 200 {
 		log.Panicln(`下载时失败：`, rsp.Status)
 	}
-	defer rsp.Body.Close()
 
 	var modTime time.Time
 	var eTag string
@@ -132,7 +264,7 @@ func _safelySaveURLAsFile(ctx context.Context, url string, path string, transfor
 			if tm, err := http.ParseTime(t); err == nil {
 				if tm.Equal(info.ModTime()) {
 					fmt.Println(`无需重新下载：`, path)
-					return
+					return nil
 				}
 				modTime = tm
 			}
@@ -144,41 +276,32 @@ func _safelySaveURLAsFile(ctx context.Context, url string, path string, transfor
 				buf = buf[:n]
 				if t == string(buf) {
 					fmt.Println(`无需重新下载：`, path)
-					return
+					return nil
 				}
 			}
 			eTag = t
 		}
 	}
 
-	// 直接在目标文件目录创建临时文件，以避免 os.Rename 的跨文件系统边界重命名文件时报错。
-	dir, _ := filepath.Split(path)
-	if dir == `` {
-		dir = `.`
-	}
-	tmpFile := utils.Must1(os.CreateTemp(dir, TmpPattern))
-	defer func() {
-		if tmpFile != nil {
-			tmpFile.Close()
-			os.Remove(tmpFile.Name())
-		}
-	}()
-
-	if err := transform(tmpFile, rsp.Body); err != nil {
-		log.Panicln(err)
-	}
+	// 规则文件不大，整个读到内存中再校验。
+	body := utils.Must1(io.ReadAll(rsp.Body))
+	utils.Must(verify(ctx, client, url, src, body))
 
-	if err := tmpFile.Close(); err != nil {
+	var buf bytes.Buffer
+	if err := transform(&buf, bytes.NewReader(body)); err != nil {
 		log.Panicln(err)
 	}
 
 	// 正常来说应该有很多行，异常情况可能是个小文件。
-	if info, err := os.Stat(tmpFile.Name()); err != nil || info.Size() <= 1<<10 {
-		log.Panicln(`数据文件有误：`, errors.Join(err, fmt.Errorf(`文件大小：%d`, info.Size())))
+	if int64(buf.Len()) < src.MinSize {
+		log.Panicln(`数据文件有误：`, fmt.Errorf(`文件大小：%d`, buf.Len()))
 	}
 
-	if err := os.Rename(tmpFile.Name(), path); err != nil {
-		log.Panicln(`重命名文件时出错：`, err)
+	if err := utils.WriteFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(buf.Bytes())
+		return err
+	}); err != nil {
+		log.Panicln(`写文件时出错：`, err)
 	}
 
 	switch {
@@ -190,5 +313,5 @@ func _safelySaveURLAsFile(ctx context.Context, url string, path string, transfor
 		unix.Setxattr(path, `user.gun.etag`, []byte(eTag), 0)
 	}
 
-	tmpFile = nil
+	return nil
 }
@@ -8,7 +8,9 @@ import (
 
 func TestFetch(t *testing.T) {
 	t.SkipNow()
-	rules.UpdateChinaDomains(t.Context(), `.`)
-	rules.UpdateGFWDomains(t.Context(), `.`)
-	rules.UpdateChinaRoutes(t.Context(), `.`)
+	for name, src := range rules.DefaultSources {
+		if err := rules.Update(t.Context(), nil, `.`, name, src); err != nil {
+			t.Fatal(err)
+		}
+	}
 }
@@ -3,6 +3,7 @@ package rules
 import (
 	"bufio"
 	"bytes"
+	"log"
 	"net/netip"
 	"os"
 	"strings"
@@ -24,20 +25,34 @@ var BlockedDefaultTxt []byte
 type File struct {
 	IPv4    []string
 	IPv6    []string
-	Domains []string
+	Domains []Domain
+
+	// 例外规则（以 @@ 开头），应该走与本文件相反的路径。
+	// 比如被墙列表中的例外规则会走国内的解析。
+	Exceptions *File
 }
 
 // 解析一个规则文件。
 //
-// 内容可以包含域名、IPv4、IPv6、CIDR。
+// 内容可以包含IPv4、IPv6、CIDR，以及域名规则：
+//
+//	example.com          域名本身及其子域名
+//	domain:example.com   同上
+//	*.example.com        只匹配子域名
+//	full:example.com     只匹配域名本身
+//	keyword:google       域名包含关键字
+//	regexp:^a\.com$      域名匹配正则表达式
+//	@@example.com        例外规则（可以接以上任一种）
 //
-// NOTE: 没有判断是合有效。
+// 无效的规则行被忽略。
+//
+// NOTE: 只校验域名规则，没有判断IP是否有效。
 func Parse(path string) *File {
 	f := &File{}
 	fp := utils.Must1(os.Open(path))
 	defer fp.Close()
 	scn := bufio.NewScanner(fp)
-	for scn.Scan() {
+	for n := 1; scn.Scan(); n++ {
 		line := strings.TrimSpace(scn.Text())
 		if len(line) <= 0 {
 			continue
@@ -46,31 +61,83 @@ func Parse(path string) *File {
 			continue
 		}
 
-		// 排除IPv6: 包含冒号的一定只可能是IPv6（含CIDR）
-		if strings.IndexByte(line, ':') >= 0 {
-			f.IPv6 = append(f.IPv6, line)
-			continue
+		if err := f.addLine(line); err != nil {
+			log.Printf(`忽略无效的规则：%s:%d: %v`, path, n, err)
 		}
+	}
+	if scn.Err() != nil {
+		panic(scn.Err())
+	}
+	return f
+}
 
-		// 包含/的一定是IPv4 CIDR
-		if strings.IndexByte(line, '/') >= 0 {
-			f.IPv4 = append(f.IPv4, line)
-			continue
+// 添加一行规则，可以是例外规则。
+func (f *File) addLine(line string) error {
+	if rest, ok := strings.CutPrefix(line, `@@`); ok {
+		if f.Exceptions == nil {
+			f.Exceptions = &File{}
 		}
+		return f.Exceptions.parseLine(rest)
+	}
+	return f.parseLine(line)
+}
+
+// 判断一行是否是有效的规则。
+func validLine(line string) bool {
+	return (&File{}).addLine(line) == nil
+}
 
-		// 其它：可能是IPv4，可能是域名。
-		// 大量数据时性能可能不太好，但是没关系，文件写起来方便就好。
-		_, err := netip.ParseAddr(line)
-		if err == nil {
-			f.IPv4 = append(f.IPv4, line)
-		} else {
-			f.Domains = append(f.Domains, line)
+// 域名规则的前缀。
+var domainPrefixes = []string{`*.`, DomainSuffix + `:`, DomainFull + `:`, DomainKeyword + `:`, DomainRegexp + `:`}
+
+func (f *File) parseLine(line string) error {
+	for _, prefix := range domainPrefixes {
+		if strings.HasPrefix(line, prefix) {
+			d, err := ParseDomain(line)
+			if err != nil {
+				return err
+			}
+			f.Domains = append(f.Domains, d)
+			return nil
 		}
 	}
-	if scn.Err() != nil {
-		panic(scn.Err())
+
+	// 排除IPv6: 包含冒号的一定只可能是IPv6（含CIDR）
+	if strings.IndexByte(line, ':') >= 0 {
+		f.IPv6 = append(f.IPv6, line)
+		return nil
 	}
-	return f
+
+	// 包含/的一定是IPv4 CIDR
+	if strings.IndexByte(line, '/') >= 0 {
+		f.IPv4 = append(f.IPv4, line)
+		return nil
+	}
+
+	// 其它：可能是IPv4，可能是域名。
+	// 大量数据时性能可能不太好，但是没关系，文件写起来方便就好。
+	_, err := netip.ParseAddr(line)
+	if err == nil {
+		f.IPv4 = append(f.IPv4, line)
+		return nil
+	}
+	d, err := ParseDomain(line)
+	if err != nil {
+		return err
+	}
+	f.Domains = append(f.Domains, d)
+	return nil
+}
+
+// 按规则文件的语法列出所有的域名规则（不含例外规则），用于传给DNS进程。
+func (f *File) DomainRules() (lines []string) {
+	if f == nil {
+		return nil
+	}
+	for _, d := range f.Domains {
+		lines = append(lines, d.String())
+	}
+	return
 }
 
 // 把自动生成的文件重新读出来。
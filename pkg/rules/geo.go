@@ -0,0 +1,355 @@
+package rules
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/movsb/gun/pkg/utils"
+	"go4.org/netipx"
+)
+
+// GeoIP/GeoSite 数据库。
+//
+//   - GeoIP：v2ray 的 geoip.dat，或者 MaxMind 的 .mmdb（按扩展名区分）；
+//   - GeoSite：v2ray 的 geosite.dat。
+//
+// 路径为空表示没有此数据库。
+type Geo struct {
+	GeoIP   string
+	GeoSite string
+}
+
+// geosite 中的一个类别。
+type GeoSite struct {
+	// 域名后缀。
+	Domains []string
+	// 完整域名。
+	Fulls []string
+	// 域名包含的关键字。
+	Keywords []string
+	// 匹配域名的正则表达式。
+	Regexps []string
+}
+
+// 解析 geoip:国家代码、geosite:类别 列表，合并成一个规则文件。
+//
+// geosite 中的各种类型的域名都会转换成对应的域名规则。
+func (g Geo) File(list []string) (*File, error) {
+	var codes, categories []string
+	for _, s := range list {
+		kind, name, _ := strings.Cut(s, `:`)
+		switch strings.ToLower(kind) {
+		case `geoip`:
+			codes = append(codes, name)
+		case `geosite`:
+			categories = append(categories, name)
+		default:
+			return nil, fmt.Errorf(`只支持 geoip:国家代码 或者 geosite:类别：%s`, s)
+		}
+	}
+
+	f := &File{}
+	if len(codes) > 0 {
+		ips, err := g.IPs(codes)
+		if err != nil {
+			return nil, err
+		}
+		for _, code := range codes {
+			for _, prefix := range ips[strings.ToUpper(code)] {
+				if prefix.Addr().Is4() {
+					f.IPv4 = append(f.IPv4, prefix.String())
+				} else {
+					f.IPv6 = append(f.IPv6, prefix.String())
+				}
+			}
+		}
+	}
+	if len(categories) > 0 {
+		sites, err := g.Sites(categories)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range categories {
+			site := sites[strings.ToUpper(c)]
+			for _, list := range []struct {
+				typ    string
+				values []string
+			}{
+				{DomainSuffix, site.Domains},
+				{DomainFull, site.Fulls},
+				{DomainKeyword, site.Keywords},
+				{DomainRegexp, site.Regexps},
+			} {
+				for _, v := range list.values {
+					f.Domains = append(f.Domains, Domain{Type: list.typ, Value: v})
+				}
+			}
+		}
+	}
+	return f, nil
+}
+
+// 读取国家代码对应的IP段（合并过的）。
+//
+// 返回的 map 的键是大写的国家代码，数据库中没有的国家代码会报错。
+func (g Geo) IPs(codes []string) (map[string][]netip.Prefix, error) {
+	if g.GeoIP == `` {
+		return nil, errors.New(`没有配置 GeoIP 数据库`)
+	}
+	data, err := os.ReadFile(g.GeoIP)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := map[string]*netipx.IPSetBuilder{}
+	for _, code := range codes {
+		wanted[strings.ToUpper(code)] = &netipx.IPSetBuilder{}
+	}
+
+	if strings.EqualFold(filepath.Ext(g.GeoIP), `.mmdb`) {
+		err = readMMDB(data, wanted)
+	} else {
+		err = readGeoIPDat(data, wanted)
+	}
+	if err != nil {
+		return nil, fmt.Errorf(`读取 GeoIP 数据库失败：%s: %w`, g.GeoIP, err)
+	}
+
+	ips := map[string][]netip.Prefix{}
+	for code, b := range wanted {
+		set, err := b.IPSet()
+		if err != nil {
+			return nil, err
+		}
+		if prefixes := set.Prefixes(); len(prefixes) > 0 {
+			ips[code] = prefixes
+		} else {
+			return nil, fmt.Errorf(`GeoIP 数据库中没有此国家代码：%s`, code)
+		}
+	}
+	return ips, nil
+}
+
+// 读取 geosite 类别。
+//
+// 类别可以带属性，比如 geolocation-!cn@cn，此时只包含有此属性的域名。
+// 返回的 map 的键是大写的类别名（包括属性），数据库中没有的类别会报错。
+func (g Geo) Sites(categories []string) (map[string]*GeoSite, error) {
+	if g.GeoSite == `` {
+		return nil, errors.New(`没有配置 GeoSite 数据库`)
+	}
+	data, err := os.ReadFile(g.GeoSite)
+	if err != nil {
+		return nil, err
+	}
+
+	// 类别名 -> 属性 -> 结果。
+	wanted := map[string]map[string]*GeoSite{}
+	for _, c := range categories {
+		name, attr, _ := strings.Cut(strings.ToUpper(c), `@`)
+		if wanted[name] == nil {
+			wanted[name] = map[string]*GeoSite{}
+		}
+		wanted[name][strings.ToLower(attr)] = &GeoSite{}
+	}
+	if err := readGeoSiteDat(data, wanted); err != nil {
+		return nil, fmt.Errorf(`读取 GeoSite 数据库失败：%s: %w`, g.GeoSite, err)
+	}
+
+	sites := map[string]*GeoSite{}
+	for _, c := range categories {
+		name, attr, _ := strings.Cut(strings.ToUpper(c), `@`)
+		site := wanted[name][strings.ToLower(attr)]
+		if len(site.Domains)+len(site.Fulls)+len(site.Keywords)+len(site.Regexps) == 0 {
+			return nil, fmt.Errorf(`GeoSite 数据库中没有此类别：%s`, c)
+		}
+		sites[strings.ToUpper(c)] = site
+	}
+	return sites, nil
+}
+
+// v2ray 的 geoip.dat：
+//
+//	message CIDR { bytes ip = 1; uint32 prefix = 2; }
+//	message GeoIP { string country_code = 1; repeated CIDR cidr = 2; bool reverse_match = 3; }
+//	message GeoIPList { repeated GeoIP entry = 1; }
+func readGeoIPDat(data []byte, wanted map[string]*netipx.IPSetBuilder) error {
+	return eachField(data, func(num int, entry []byte) error {
+		if num != 1 {
+			return nil
+		}
+		var (
+			code  string
+			cidrs [][]byte
+		)
+		err := eachField(entry, func(num int, value []byte) error {
+			switch num {
+			case 1:
+				code = strings.ToUpper(string(value))
+			case 2:
+				cidrs = append(cidrs, value)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		b, ok := wanted[code]
+		if !ok {
+			return nil
+		}
+		for _, cidr := range cidrs {
+			var (
+				ip   netip.Addr
+				bits int
+			)
+			err := eachField(cidr, func(num int, value []byte) error {
+				switch num {
+				case 1:
+					ip, _ = netip.AddrFromSlice(value)
+				case 2:
+					n, _ := binary.Uvarint(value)
+					bits = int(n)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			prefix, err := ip.Prefix(bits)
+			if err != nil {
+				return fmt.Errorf(`IP段不正确：%s/%d`, ip, bits)
+			}
+			b.AddPrefix(prefix)
+		}
+		return nil
+	})
+}
+
+// v2ray 的 geosite.dat：
+//
+//	message Domain {
+//		enum Type { Plain = 0; Regex = 1; Domain = 2; Full = 3; }
+//		Type type = 1; string value = 2;
+//		message Attribute { string key = 1; oneof typed_value { bool bool_value = 2; int64 int_value = 3; } }
+//		repeated Attribute attribute = 3;
+//	}
+//	message GeoSite { string country_code = 1; repeated Domain domain = 2; }
+//	message GeoSiteList { repeated GeoSite entry = 1; }
+func readGeoSiteDat(data []byte, wanted map[string]map[string]*GeoSite) error {
+	return eachField(data, func(num int, entry []byte) error {
+		if num != 1 {
+			return nil
+		}
+		var (
+			code    string
+			domains [][]byte
+		)
+		err := eachField(entry, func(num int, value []byte) error {
+			switch num {
+			case 1:
+				code = strings.ToUpper(string(value))
+			case 2:
+				domains = append(domains, value)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		attrs, ok := wanted[code]
+		if !ok {
+			return nil
+		}
+		for _, domain := range domains {
+			var (
+				typ   uint64
+				value string
+				keys  []string
+			)
+			err := eachField(domain, func(num int, v []byte) error {
+				switch num {
+				case 1:
+					typ, _ = binary.Uvarint(v)
+				case 2:
+					value = string(v)
+				case 3:
+					return eachField(v, func(num int, v []byte) error {
+						if num == 1 {
+							keys = append(keys, strings.ToLower(string(v)))
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for attr, site := range attrs {
+				if attr != `` && !slices.Contains(keys, attr) {
+					continue
+				}
+				switch typ {
+				case 0:
+					site.Keywords = append(site.Keywords, strings.ToLower(value))
+				case 1:
+					site.Regexps = append(site.Regexps, value)
+				case 2:
+					site.Domains = append(site.Domains, strings.ToLower(value))
+				case 3:
+					site.Fulls = append(site.Fulls, strings.ToLower(value))
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// 遍历 protobuf 消息的字段。
+//
+// 变长整数类型的字段的值是其原始编码，其它类型的值是原始字节。
+func eachField(data []byte, f func(num int, value []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New(`protobuf：字段不正确`)
+		}
+		data = data[n:]
+
+		var value []byte
+		switch key & 7 {
+		case 0:
+			_, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errors.New(`protobuf：整数不正确`)
+			}
+			value, data = data[:n], data[n:]
+		case 1, 5:
+			size := utils.IIF(key&7 == 1, 8, 4)
+			if len(data) < size {
+				return errors.New(`protobuf：数据不完整`)
+			}
+			value, data = data[:size], data[size:]
+		case 2:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return errors.New(`protobuf：数据不完整`)
+			}
+			value, data = data[n:n+int(size)], data[n+int(size):]
+		default:
+			return fmt.Errorf(`protobuf：不支持的类型：%d`, key&7)
+		}
+
+		if err := f(int(key>>3), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
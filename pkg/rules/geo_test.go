@@ -0,0 +1,130 @@
+package rules
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// 编码 protobuf 字段：值为 []byte 时是长度前缀类型，为 int 时是变长整数类型。
+func pbFields(fields ...any) []byte {
+	var b []byte
+	for i := 0; i < len(fields); i += 2 {
+		num := uint64(fields[i].(int))
+		switch v := fields[i+1].(type) {
+		case []byte:
+			b = binary.AppendUvarint(b, num<<3|2)
+			b = binary.AppendUvarint(b, uint64(len(v)))
+			b = append(b, v...)
+		case int:
+			b = binary.AppendUvarint(b, num<<3)
+			b = binary.AppendUvarint(b, uint64(v))
+		}
+	}
+	return b
+}
+
+func TestGeoDat(t *testing.T) {
+	dir := t.TempDir()
+
+	cidr := func(prefix string) []byte {
+		p := netip.MustParsePrefix(prefix)
+		return pbFields(1, p.Addr().AsSlice(), 2, p.Bits())
+	}
+	geoip := pbFields(
+		1, pbFields(1, []byte(`CN`), 2, cidr(`1.0.1.0/24`), 2, cidr(`1.0.2.0/24`)),
+		1, pbFields(1, []byte(`HK`), 2, cidr(`1.1.0.0/16`), 2, cidr(`2400:8500::/32`)),
+	)
+	domain := func(typ int, value string, attrs ...string) []byte {
+		b := pbFields(1, typ, 2, []byte(value))
+		for _, a := range attrs {
+			b = append(b, pbFields(3, pbFields(1, []byte(a), 2, 1))...)
+		}
+		return b
+	}
+	geosite := pbFields(
+		1, pbFields(1, []byte(`GOOGLE`),
+			2, domain(2, `google.com`),
+			2, domain(2, `google.cn`, `cn`),
+			2, domain(3, `www.Google.com`),
+			2, domain(0, `google`),
+			2, domain(1, `^g\d+\.com$`),
+		),
+	)
+	g := Geo{GeoIP: filepath.Join(dir, `geoip.dat`), GeoSite: filepath.Join(dir, `geosite.dat`)}
+	os.WriteFile(g.GeoIP, geoip, 0644)
+	os.WriteFile(g.GeoSite, geosite, 0644)
+
+	f, err := g.File([]string{`geoip:cn`, `geoip:HK`, `geosite:google@cn`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(f.IPv4, []string{`1.0.1.0/24`, `1.0.2.0/24`, `1.1.0.0/16`}) ||
+		!slices.Equal(f.IPv6, []string{`2400:8500::/32`}) ||
+		!slices.Equal(f.DomainRules(), []string{`google.cn`}) {
+		t.Fatalf(`结果不正确：%+v`, f)
+	}
+
+	sites, err := g.Sites([]string{`google`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := sites[`GOOGLE`]; len(s.Domains) != 2 || !slices.Equal(s.Fulls, []string{`www.google.com`}) ||
+		!slices.Equal(s.Keywords, []string{`google`}) || !slices.Equal(s.Regexps, []string{`^g\d+\.com$`}) {
+		t.Fatalf(`结果不正确：%+v`, s)
+	}
+
+	if _, err := g.File([]string{`geoip:jp`}); err == nil {
+		t.Fatal(`应该报错：没有此国家代码`)
+	}
+}
+
+func TestMMDB(t *testing.T) {
+	str := func(s string) []byte { return append([]byte{0x40 | byte(len(s))}, s...) }
+	country := func(key, code string) []byte {
+		b := append([]byte{0xE1}, str(key)...)
+		b = append(b, 0xE1)
+		b = append(b, str(`iso_code`)...)
+		return append(b, str(code)...)
+	}
+	cn := country(`country`, `CN`)
+	jp := country(`registered_country`, `JP`)
+
+	const nodeCount = 2
+	data := func(offset int) []byte {
+		v := nodeCount + 16 + offset
+		return []byte{byte(v >> 16), byte(v >> 8), byte(v)}
+	}
+	var file []byte
+	// 节点0：0.0.0.0/1 -> CN，128.0.0.0/1 -> 节点1。
+	file = append(file, data(0)...)
+	file = append(file, 0, 0, 1)
+	// 节点1：128.0.0.0/2 -> 空，192.0.0.0/2 -> JP。
+	file = append(file, 0, 0, nodeCount)
+	file = append(file, data(len(cn))...)
+	file = append(file, make([]byte, 16)...)
+	file = append(file, cn...)
+	file = append(file, jp...)
+	file = append(file, mmdbMetadataMarker...)
+	file = append(file, 0xE3)
+	file = append(file, str(`node_count`)...)
+	file = append(file, 0xC1, nodeCount)
+	file = append(file, str(`record_size`)...)
+	file = append(file, 0xA1, 24)
+	file = append(file, str(`ip_version`)...)
+	file = append(file, 0xA1, 4)
+
+	g := Geo{GeoIP: filepath.Join(t.TempDir(), `Country.mmdb`)}
+	os.WriteFile(g.GeoIP, file, 0644)
+	ips, err := g.IPs([]string{`cn`, `jp`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(ips[`CN`], []netip.Prefix{netip.MustParsePrefix(`0.0.0.0/1`)}) ||
+		!slices.Equal(ips[`JP`], []netip.Prefix{netip.MustParsePrefix(`192.0.0.0/2`)}) {
+		t.Fatalf(`结果不正确：%v`, ips)
+	}
+}
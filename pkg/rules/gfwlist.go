@@ -0,0 +1,153 @@
+package rules
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/movsb/gun/pkg/utils"
+)
+
+// base64 编码的 gfwlist（Adblock Plus 语法）。
+func transformGFWListBase64(w io.Writer, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(data), nil)))
+	if err != nil {
+		return fmt.Errorf(`gfwlist 不是 base64 编码的：%w`, err)
+	}
+	return transformGFWList(w, bytes.NewReader(decoded))
+}
+
+// 没有编码的 gfwlist（Adblock Plus 语法），转换成规则文件的语法，每行一条：
+//
+//	example.com         域名后缀
+//	full:example.com    完整域名
+//	regexp:^a\.com$     匹配域名的正则表达式
+//	@@<以上任一种>       例外规则
+func transformGFWList(w io.Writer, r io.Reader) error {
+	seen := map[string]struct{}{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		rule := gfwlistRule(scanner.Text())
+		if rule == `` {
+			continue
+		}
+		if _, ok := seen[rule]; ok {
+			continue
+		}
+		seen[rule] = struct{}{}
+		utils.Must1(fmt.Fprintln(w, rule))
+	}
+	return scanner.Err()
+}
+
+// 把一条 Adblock Plus 规则转换成规则文件中的一行。
+//
+// 注释、不能转换成域名的规则返回空。
+func gfwlistRule(line string) string {
+	line = strings.TrimSpace(line)
+	if line == `` || line[0] == '!' || line[0] == '[' {
+		return ``
+	}
+
+	exception := strings.HasPrefix(line, `@@`)
+	line = strings.TrimPrefix(line, `@@`)
+
+	var rule string
+	switch {
+	case len(line) > 1 && line[0] == '/' && line[len(line)-1] == '/':
+		if re := gfwlistRegexp(line[1 : len(line)-1]); re != `` {
+			rule = `regexp:` + re
+		}
+	case strings.HasPrefix(line, `||`):
+		if host := gfwlistHost(line[2:]); host != `` {
+			rule = host
+		}
+	case strings.HasPrefix(line, `|`):
+		// 匹配网址开头：只匹配这一个域名。
+		if host := gfwlistHost(line[1:]); host != `` {
+			rule = `full:` + host
+		}
+	default:
+		// 匹配网址中的任意部分：.example.com 和 example.com 都当作后缀。
+		if host := gfwlistHost(strings.TrimPrefix(line, `.`)); host != `` {
+			rule = host
+		}
+	}
+
+	if rule != `` && exception {
+		rule = `@@` + rule
+	}
+	return rule
+}
+
+var hostRegexp = regexp.MustCompile(`^[a-z0-9-]+(\.[a-z0-9-]+)+$`)
+
+// 取出规则中网址的域名部分。
+func gfwlistHost(s string) string {
+	if i := strings.IndexByte(s, '$'); i >= 0 {
+		s = s[:i]
+	}
+	s = strings.TrimPrefix(s, `http://`)
+	s = strings.TrimPrefix(s, `https://`)
+	s = strings.TrimPrefix(s, `*.`)
+	if i := strings.IndexAny(s, `/^:?`); i >= 0 {
+		s = s[:i]
+	}
+	s = strings.ToLower(strings.TrimSuffix(s, `.`))
+	if !hostRegexp.MatchString(s) {
+		return ``
+	}
+	return s
+}
+
+// gfwlist 中匹配网址的正则表达式，如：
+//
+//	^https?:\/\/([^\/]+\.)*google\.(ac|ad|ae)\/.*
+//
+// 去掉协议部分和域名之后的部分，转换成匹配域名的正则表达式。
+// 不以协议开头的不能确定哪部分是域名，返回空。
+func gfwlistRegexp(re string) string {
+	var ok bool
+	for _, scheme := range []string{`^https?:\/\/`, `^https?://`, `^http:\/\/`, `^https:\/\/`} {
+		if re, ok = strings.CutPrefix(re, scheme); ok {
+			break
+		}
+	}
+	if !ok {
+		return ``
+	}
+	// 域名在第一个不在 [] 中的 / 之前结束。
+	inClass := false
+loop:
+	for i := 0; i < len(re); i++ {
+		switch c := re[i]; {
+		case c == '\\' && i+1 < len(re):
+			if re[i+1] == '/' && !inClass {
+				re = re[:i]
+				break loop
+			}
+			i++
+		case c == '[':
+			inClass = true
+		case c == ']':
+			inClass = false
+		case c == '/' && !inClass:
+			re = re[:i]
+			break loop
+		}
+	}
+	re = `^` + strings.TrimSuffix(re, `$`) + `$`
+	if _, err := regexp.Compile(re); err != nil {
+		return ``
+	}
+	return re
+}
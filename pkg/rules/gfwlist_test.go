@@ -0,0 +1,60 @@
+package rules
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestGFWListBase64(t *testing.T) {
+	list := strings.Join([]string{
+		`[AutoProxy 0.2.9]`,
+		`! comment`,
+		`||google.com`,
+		`|https://www.example.com/path`,
+		`.twitter.com`,
+		`@@||baidu.com`,
+		`@@|http://cn.example.com`,
+		`/^https?:\/\/[^\/]+blogspot\.(.*)/`,
+		`/^https?:\/\/([^\/]+\.)*google\.(ac|ad)\/.*/`,
+		`/no-scheme/`,
+		`*.wildcard.com`,
+		`||google.com^`,
+		`||*.Facebook.com$third-party`,
+	}, "\n")
+	var b bytes.Buffer
+	if err := transformGFWListBase64(&b, strings.NewReader(base64.StdEncoding.EncodeToString([]byte(list)))); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		`google.com`,
+		`full:www.example.com`,
+		`twitter.com`,
+		`@@baidu.com`,
+		`@@full:cn.example.com`,
+		`regexp:^[^\/]+blogspot\.(.*)$`,
+		`regexp:^([^\/]+\.)*google\.(ac|ad)$`,
+		`wildcard.com`,
+		`facebook.com`,
+	}, "\n") + "\n"
+	if b.String() != want {
+		t.Fatalf(`结果不正确：%q`, b.String())
+	}
+
+	// 转换后的文件可以被解析。
+	path := filepath.Join(t.TempDir(), GfwDomainsName)
+	os.WriteFile(path, b.Bytes(), 0644)
+	f := Parse(path)
+	if !slices.Equal(f.DomainRules(), []string{
+		`google.com`, `full:www.example.com`, `twitter.com`,
+		`regexp:^[^\/]+blogspot\.(.*)$`, `regexp:^([^\/]+\.)*google\.(ac|ad)$`,
+		`wildcard.com`, `facebook.com`,
+	}) ||
+		!slices.Equal(f.Exceptions.DomainRules(), []string{`baidu.com`, `full:cn.example.com`}) {
+		t.Fatalf(`解析不正确：%+v %+v`, f, f.Exceptions)
+	}
+}
@@ -0,0 +1,280 @@
+package rules
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"strings"
+
+	"go4.org/netipx"
+)
+
+// MaxMind DB 文件格式：https://maxmind.github.io/MaxMind-DB/
+//
+// 只读取国家代码（country.iso_code，没有时用 registered_country.iso_code）。
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+type mmdbReader struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint64
+	recordSize uint64
+	ipVersion  uint64
+
+	// 数据偏移 -> 国家代码，大量的IP段共用同一个数据。
+	codes map[uint64]string
+}
+
+// 遍历整个搜索树，把需要的国家代码的IP段添加进去。
+func readMMDB(file []byte, wanted map[string]*netipx.IPSetBuilder) error {
+	i := bytes.LastIndex(file, mmdbMetadataMarker)
+	if i < 0 {
+		return errors.New(`没有找到元数据`)
+	}
+	meta, _, err := decodeMMDB(file[i+len(mmdbMetadataMarker):], 0)
+	if err != nil {
+		return fmt.Errorf(`元数据不正确：%w`, err)
+	}
+	m, _ := meta.(map[string]any)
+	r := &mmdbReader{codes: map[uint64]string{}}
+	r.nodeCount, _ = m[`node_count`].(uint64)
+	r.recordSize, _ = m[`record_size`].(uint64)
+	r.ipVersion, _ = m[`ip_version`].(uint64)
+	switch {
+	case r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32:
+		return fmt.Errorf(`不支持的记录大小：%d`, r.recordSize)
+	case r.ipVersion != 4 && r.ipVersion != 6:
+		return fmt.Errorf(`不支持的IP版本：%d`, r.ipVersion)
+	}
+	treeSize := r.recordSize * 2 / 8 * r.nodeCount
+	if treeSize+16 > uint64(i) {
+		return errors.New(`搜索树不完整`)
+	}
+	r.tree, r.data = file[:treeSize], file[treeSize+16:i]
+
+	return r.walk(0, [16]byte{}, 0, wanted)
+}
+
+// 深度优先遍历，ip 是到 node 为止的路径（前 depth 位）。
+func (r *mmdbReader) walk(node uint64, ip [16]byte, depth int, wanted map[string]*netipx.IPSetBuilder) error {
+	bits := int(32)
+	if r.ipVersion == 6 {
+		bits = 128
+	}
+	for bit := range uint64(2) {
+		child := r.record(node, bit)
+		path := ip
+		if bit == 1 {
+			path[depth/8] |= 0x80 >> (depth % 8)
+		}
+
+		switch {
+		case child == r.nodeCount:
+			// 空。
+		case child > r.nodeCount:
+			code, err := r.code(child - r.nodeCount - 16)
+			if err != nil {
+				return err
+			}
+			if b, ok := wanted[code]; ok {
+				b.AddPrefix(r.prefix(path, depth+1))
+			}
+		case depth+1 < bits:
+			// IPv6 数据库中 ::ffff:0:0/96 和 2002::/16 是 IPv4 的别名，跳过，只遍历 ::/96 中的。
+			if r.ipVersion == 6 && (depth+1 == 96 && path == [16]byte{10: 0xff, 11: 0xff} || depth+1 == 16 && path == [16]byte{0: 0x20, 1: 0x02}) {
+				continue
+			}
+			if err := r.walk(child, path, depth+1, wanted); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *mmdbReader) record(node uint64, bit uint64) uint64 {
+	switch r.recordSize {
+	case 24:
+		b := r.tree[node*6+bit*3:]
+		return uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+	case 28:
+		b := r.tree[node*7:]
+		if bit == 0 {
+			return uint64(b[3]>>4)<<24 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+		}
+		return uint64(b[3]&0x0f)<<24 | uint64(b[4])<<16 | uint64(b[5])<<8 | uint64(b[6])
+	default:
+		return uint64(binary.BigEndian.Uint32(r.tree[node*8+bit*4:]))
+	}
+}
+
+// IPv6 数据库中 ::/96 内的是 IPv4 地址。
+func (r *mmdbReader) prefix(ip [16]byte, bits int) netip.Prefix {
+	if r.ipVersion == 4 {
+		return netip.PrefixFrom(netip.AddrFrom4([4]byte(ip[:4])), bits)
+	}
+	if bits >= 96 && [12]byte(ip[:12]) == [12]byte{} {
+		return netip.PrefixFrom(netip.AddrFrom4([4]byte(ip[12:])), bits-96)
+	}
+	return netip.PrefixFrom(netip.AddrFrom16(ip), bits)
+}
+
+func (r *mmdbReader) code(offset uint64) (string, error) {
+	if code, ok := r.codes[offset]; ok {
+		return code, nil
+	}
+	v, _, err := decodeMMDB(r.data, offset)
+	if err != nil {
+		return ``, fmt.Errorf(`数据不正确：%w`, err)
+	}
+	var code string
+	m, _ := v.(map[string]any)
+	for _, key := range []string{`country`, `registered_country`} {
+		if country, ok := m[key].(map[string]any); ok {
+			if c, ok := country[`iso_code`].(string); ok && c != `` {
+				code = strings.ToUpper(c)
+				break
+			}
+		}
+	}
+	r.codes[offset] = code
+	return code, nil
+}
+
+// 解码 offset 处的值，返回值和下一个值的偏移。
+//
+// 字符串、map、数组、布尔、整数（都转换成 uint64 或者 int64）、浮点数。
+func decodeMMDB(data []byte, offset uint64) (any, uint64, error) {
+	errShort := errors.New(`数据不完整`)
+	next := func(n uint64) ([]byte, error) {
+		if offset+n > uint64(len(data)) {
+			return nil, errShort
+		}
+		b := data[offset : offset+n]
+		offset += n
+		return b, nil
+	}
+	number := func(b []byte) (n uint64) {
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return
+	}
+
+	b, err := next(1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	typ := ctrl >> 5
+
+	// 指针：指向数据段中的另一个值。
+	if typ == 1 {
+		ss, vvv := uint64(ctrl>>3&3), uint64(ctrl&7)
+		b, err := next(ss + 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		var p uint64
+		switch ss {
+		case 0:
+			p = vvv<<8 | number(b)
+		case 1:
+			p = (vvv<<16 | number(b)) + 2048
+		case 2:
+			p = (vvv<<24 | number(b)) + 526336
+		case 3:
+			p = number(b)
+		}
+		v, _, err := decodeMMDB(data, p)
+		return v, offset, err
+	}
+
+	if typ == 0 {
+		b, err := next(1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + b[0]
+	}
+
+	size := uint64(ctrl & 0x1f)
+	if size >= 29 {
+		b, err := next(size - 28)
+		if err != nil {
+			return nil, 0, err
+		}
+		size = []uint64{29, 285, 65821}[size-29] + number(b)
+	}
+
+	switch typ {
+	case 2, 4:
+		b, err := next(size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if typ == 2 {
+			return string(b), offset, nil
+		}
+		return bytes.Clone(b), offset, nil
+	case 3, 15:
+		b, err := next(size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if typ == 3 && size == 8 {
+			return math.Float64frombits(number(b)), offset, nil
+		}
+		if typ == 15 && size == 4 {
+			return float64(math.Float32frombits(uint32(number(b)))), offset, nil
+		}
+		return nil, 0, errors.New(`浮点数大小不正确`)
+	case 5, 6, 9, 10:
+		b, err := next(size)
+		if err != nil {
+			return nil, 0, err
+		}
+		// uint128 只保留低64位。
+		return number(b[max(0, len(b)-8):]), offset, nil
+	case 8:
+		b, err := next(size)
+		if err != nil {
+			return nil, 0, err
+		}
+		return int64(int32(uint32(number(b)))), offset, nil
+	case 7:
+		m := make(map[string]any, size)
+		for range size {
+			var k, v any
+			if k, offset, err = decodeMMDB(data, offset); err != nil {
+				return nil, 0, err
+			}
+			if v, offset, err = decodeMMDB(data, offset); err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New(`键不是字符串`)
+			}
+			m[key] = v
+		}
+		return m, offset, nil
+	case 11:
+		a := make([]any, 0, size)
+		for range size {
+			var v any
+			if v, offset, err = decodeMMDB(data, offset); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, offset, nil
+	case 14:
+		return size != 0, offset, nil
+	default:
+		return nil, 0, fmt.Errorf(`不支持的数据类型：%d`, typ)
+	}
+}
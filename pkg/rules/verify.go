@@ -0,0 +1,138 @@
+package rules
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// 按来源的配置校验下载的数据：SHA256 校验和、minisign 签名。
+func verify(ctx context.Context, client *http.Client, url string, src Source, body []byte) error {
+	if src.SHA256 != `` {
+		want := src.SHA256
+		if strings.HasPrefix(want, `http://`) || strings.HasPrefix(want, `https://`) {
+			sum, err := download(ctx, client, want)
+			if err != nil {
+				return fmt.Errorf(`下载校验和失败：%w`, err)
+			}
+			// sha256sum 的输出：校验和 文件名。
+			fields := strings.Fields(string(sum))
+			if len(fields) == 0 {
+				return errors.New(`校验和文件为空`)
+			}
+			want = fields[0]
+		}
+		got := sha256.Sum256(body)
+		if !strings.EqualFold(hex.EncodeToString(got[:]), want) {
+			return fmt.Errorf(`SHA256 校验和不正确：%x`, got)
+		}
+	}
+
+	if src.Minisign != `` {
+		key, err := parseMinisignKey(src.Minisign)
+		if err != nil {
+			return err
+		}
+		sig, err := download(ctx, client, url+`.minisig`)
+		if err != nil {
+			return fmt.Errorf(`下载签名失败：%w`, err)
+		}
+		if err := key.verify(body, sig); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func download(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != 200 {
+		return nil, fmt.Errorf(`下载时失败：%s`, rsp.Status)
+	}
+	return io.ReadAll(io.LimitReader(rsp.Body, 1<<20))
+}
+
+// minisign 公钥。
+//
+// https://jedisct1.github.io/minisign/
+type minisignKey struct {
+	id  [8]byte
+	key ed25519.PublicKey
+}
+
+// 公钥：base64(“Ed” + 8字节的编号 + 32字节的公钥)。
+func parseMinisignKey(s string) (*minisignKey, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(b) != 2+8+32 || string(b[:2]) != `Ed` {
+		return nil, errors.New(`minisign 公钥不正确`)
+	}
+	return &minisignKey{id: [8]byte(b[2:10]), key: ed25519.PublicKey(b[10:])}, nil
+}
+
+// 签名文件：
+//
+//	untrusted comment: <任意>
+//	base64(“Ed”或者“ED” + 8字节的公钥编号 + 64字节的签名)
+//	trusted comment: <可信注释>
+//	base64(对 签名 + 可信注释 的64字节的签名)
+//
+// “ED” 表示签名的是数据的 BLAKE2b-512 哈希。
+func (k *minisignKey) verify(data []byte, sigFile []byte) error {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(sigFile))
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimRight(scanner.Text(), "\r"))
+	}
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], `trusted comment: `) {
+		return errors.New(`minisign 签名文件格式不正确`)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(sig) != 2+8+64 {
+		return errors.New(`minisign 签名不正确`)
+	}
+	if [8]byte(sig[2:10]) != k.id {
+		return errors.New(`minisign 签名的公钥编号不匹配`)
+	}
+	switch string(sig[:2]) {
+	case `Ed`:
+	case `ED`:
+		sum := blake2b.Sum512(data)
+		data = sum[:]
+	default:
+		return errors.New(`不支持的 minisign 签名算法`)
+	}
+	if !ed25519.Verify(k.key, data, sig[10:]) {
+		return errors.New(`minisign 签名校验失败`)
+	}
+
+	global, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(global) != 64 {
+		return errors.New(`minisign 全局签名不正确`)
+	}
+	comment := strings.TrimPrefix(lines[2], `trusted comment: `)
+	if !ed25519.Verify(k.key, append(bytes.Clone(sig[10:]), comment...), global) {
+		return errors.New(`minisign 可信注释校验失败`)
+	}
+	return nil
+}
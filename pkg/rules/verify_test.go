@@ -0,0 +1,57 @@
+package rules
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+func TestVerify(t *testing.T) {
+	body := []byte("example.com\n")
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	id := []byte(`12345678`)
+
+	hashed := blake2b.Sum512(body)
+	sig := append(append([]byte(`ED`), id...), ed25519.Sign(priv, hashed[:])...)
+	comment := `timestamp:1`
+	global := ed25519.Sign(priv, append(bytes.Clone(sig[10:]), comment...))
+	sigFile := fmt.Sprintf("untrusted comment: test\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(sig), comment, base64.StdEncoding.EncodeToString(global))
+	sum := sha256.Sum256(body)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case `/list.txt.minisig`:
+			w.Write([]byte(sigFile))
+		case `/list.txt.sha256`:
+			fmt.Fprintf(w, "%x  list.txt\n", sum)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	key := base64.StdEncoding.EncodeToString(append(append([]byte(`Ed`), id...), pub...))
+	url := server.URL + `/list.txt`
+
+	for _, src := range []Source{
+		{SHA256: hex.EncodeToString(sum[:])},
+		{SHA256: url + `.sha256`},
+		{Minisign: key},
+	} {
+		if err := verify(t.Context(), http.DefaultClient, url, src, body); err != nil {
+			t.Fatalf(`应该校验成功：%+v: %v`, src, err)
+		}
+		if err := verify(t.Context(), http.DefaultClient, url, src, []byte(`changed`)); err == nil {
+			t.Fatalf(`应该校验失败：%+v`, src)
+		}
+	}
+}
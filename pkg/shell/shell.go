@@ -31,6 +31,10 @@ type _Command struct {
 	uid, gid uint32
 	detach   bool
 
+	// ctx 结束时发送的信号及强杀前的等待时间。
+	stopSignal os.Signal
+	stopWait   time.Duration
+
 	exitOnError    bool
 	ignoreErrors   bool
 	autoRestart    bool
@@ -193,6 +197,13 @@ func parseCmd(cmdline string, options ..._Option) *_Command {
 	c.cmd = exec.CommandContext(c.ctx, args[0], args[1:]...)
 	c.cmd.Args = append(c.cmd.Args, c.args...)
 
+	if c.stopSignal != nil {
+		c.cmd.Cancel = func() error {
+			return c.cmd.Process.Signal(c.stopSignal)
+		}
+		c.cmd.WaitDelay = c.stopWait
+	}
+
 	if c.dir != `` {
 		c.cmd.Dir = c.dir
 	}
@@ -410,6 +421,16 @@ func WithAutoRestart() _Option {
 	}
 }
 
+// ctx 结束时先发送 sig 让进程自行退出，等待 wait 后仍未退出再强杀。
+//
+// 默认直接强杀。
+func WithStopSignal(sig os.Signal, wait time.Duration) _Option {
+	return func(c *_Command) {
+		c.stopSignal = sig
+		c.stopWait = wait
+	}
+}
+
 // 忽略包含指定字符串的错误行。
 //
 // 错误可以来自：标准输出、标准错误输出、命令执行返回的错误（err）。
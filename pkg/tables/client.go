@@ -0,0 +1,190 @@
+package tables
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/movsb/gun/pkg/shell"
+	"github.com/movsb/gun/pkg/utils"
+)
+
+// 局域网客户端的策略。
+const (
+	// 不接管，全部直连。
+	CLIENT_DIRECT = `direct`
+	// 全部接管（忽略白名单），交给出口。
+	CLIENT_PROXY = `proxy`
+	// 禁止访问本机以外的地址。
+	CLIENT_BLOCK = `block`
+)
+
+// 按这个顺序匹配，同一个客户端出现在多个策略中时，前面的优先。
+var clientPolicies = []string{CLIENT_DIRECT, CLIENT_BLOCK, CLIENT_PROXY}
+
+// 按策略分组的局域网客户端：IP、IP段或者MAC地址。
+//
+// 策略 -> 客户端列表。
+type Clients map[string][]string
+
+// 客户端名单集的名字。kind：4、6 或者 mac。
+func clientSetName(policy string, kind string) string {
+	return fmt.Sprintf(`%sclient_%s_%s`, SET_NAME_PREFIX, policy, kind)
+}
+
+// 按类型分开的客户端。
+type clientAddrs struct {
+	ip4, ip6, macs []string
+}
+
+// 把客户端列表分成IPv4、IPv6和MAC地址。
+func splitClients(list []string) (clientAddrs, error) {
+	var c clientAddrs
+	for _, s := range list {
+		if mac, err := net.ParseMAC(s); err == nil {
+			if len(mac) != 6 {
+				return c, fmt.Errorf(`只支持以太网MAC地址：%s`, s)
+			}
+			c.macs = append(c.macs, mac.String())
+			continue
+		}
+		var (
+			prefix netip.Prefix
+			err    error
+		)
+		if strings.Contains(s, `/`) {
+			prefix, err = netip.ParsePrefix(s)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(s)
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			return c, fmt.Errorf(`客户端不是IP、IP段或者MAC地址：%s`, s)
+		}
+		ip := normalizeIP(prefix.Masked().String())
+		if prefix.Addr().Is4() {
+			c.ip4 = append(c.ip4, ip)
+		} else {
+			c.ip6 = append(c.ip6, ip)
+		}
+	}
+	return c, nil
+}
+
+// 检查客户端列表是否正确。
+func (c Clients) Check() error {
+	for policy, list := range c {
+		if !slices.Contains(clientPolicies, policy) {
+			return fmt.Errorf(`未知的客户端策略：%s`, policy)
+		}
+		if _, err := splitClients(list); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 遍历每个客户端名单集：名字、ipset 类型、nftables 类型、元素。
+func (c Clients) each(f func(name string, ipsetType string, nftType string, elements []string)) {
+	for _, policy := range clientPolicies {
+		a := utils.Must1(splitClients(c[policy]))
+		f(clientSetName(policy, `4`), `hash:net family inet`, `ipv4_addr`, a.ip4)
+		f(clientSetName(policy, `6`), `hash:net family inet6`, `ipv6_addr`, a.ip6)
+		f(clientSetName(policy, `mac`), `hash:mac`, `ether_addr`, a.macs)
+	}
+}
+
+// 创建客户端名单集。
+//
+// 即使没有客户端也会创建（空的），以便重新加载时直接更新。
+func CreateClientSets(clients Clients) {
+	clients.each(func(name, ipsetType, _ string, elements []string) {
+		values := shell.WithValues(`name`, name, `type`, ipsetType)
+		shell.Run(`ipset create ${name} ${type}`, values)
+		restoreClientSet(name, elements)
+	})
+}
+
+func restoreClientSet(name string, elements []string) {
+	buf := bytes.NewBuffer(nil)
+	for _, e := range elements {
+		fmt.Fprintln(buf, `add`, name, e)
+	}
+	shell.Run(`ipset -! restore`, shell.WithStdin(buf))
+}
+
+// 更新客户端名单集。
+//
+// 客户端名单集中没有运行时添加的元素，所以直接整体替换：
+// 先准备好临时集，再用 ipset swap 原子地替换。
+func UpdateClientSets(clients Clients) {
+	clients.each(func(name, ipsetType, _ string, elements []string) {
+		values := shell.WithValues(`name`, name, `tmp`, name+`_tmp`, `type`, ipsetType)
+		shell.Run(`ipset -! create ${tmp} ${type}`, values)
+		shell.Run(`ipset flush ${tmp}`, values)
+		restoreClientSet(name+`_tmp`, elements)
+		shell.Run(`ipset swap ${tmp} ${name}`, values)
+		shell.Run(`ipset destroy ${tmp}`, values)
+	})
+}
+
+// 更新 nftables 中的客户端名单集：在一个事务中清空后重新添加。
+func UpdateNFTClientSets(clients Clients) {
+	buf := bytes.NewBuffer(nil)
+	clients.each(func(name, _, _ string, elements []string) {
+		fmt.Fprintf(buf, "flush set inet %s %s\n", NFT_TABLE, name)
+		if len(elements) > 0 {
+			fmt.Fprintf(buf, "add element inet %s %s { %s }\n", NFT_TABLE, name, strings.Join(elements, `, `))
+		}
+	})
+	shell.Run(`nft -f -`, shell.WithStdin(buf))
+}
+
+// 按来源应用客户端策略。
+//
+// 需要在 DropQUIC、TProxy 之前调用，以便先于其它规则匹配：
+//   - direct：直接返回，不再经过其它规则；
+//   - block：丢弃发往本机以外的流量（所以仍然可以使用本机的DNS等服务）；
+//   - proxy：新连接直接打上标记，不再检查白名单，之后由 TProxy 接管。
+//     和其它主机一样不包括DNS请求。
+func ClientRules(cmd string, family Family) {
+	sh := shell.Bind(
+		chainNames,
+		tproxyValues,
+		shell.WithValues(`cmd`, cmd),
+	)
+
+	for _, policy := range clientPolicies {
+		for _, kind := range []string{utils.IIF(family == IPv4, `4`, `6`), `mac`} {
+			psh := sh.Bind(shell.WithValues(`set`, clientSetName(policy, kind)))
+			switch policy {
+			case CLIENT_DIRECT:
+				psh.Run(`${cmd} -t mangle -A ${prerouting} -m set --match-set ${set} src -j RETURN`)
+			case CLIENT_BLOCK:
+				psh.Run(`${cmd} -t mangle -A ${prerouting} \
+					-m set --match-set ${set} src \
+					-m addrtype ! --dst-type LOCAL \
+					-j DROP`,
+				)
+			case CLIENT_PROXY:
+				psh.Run(`${cmd} -t mangle -A ${prerouting} \
+					-p tcp -m tcp --syn ! --dport 53 \
+					-m set --match-set ${set} src \
+					-m addrtype ! --dst-type LOCAL \
+					-j CONNMARK --set-mark ${TPROXY_MARK}`,
+				)
+				psh.Run(`${cmd} -t mangle -A ${prerouting} \
+					-p udp -m udp ! --dport 53 \
+					-m conntrack --ctstate NEW,RELATED \
+					-m set --match-set ${set} src \
+					-m addrtype ! --dst-type LOCAL \
+					-j CONNMARK --set-mark ${TPROXY_MARK}`,
+				)
+			}
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package tables
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSplitClients(t *testing.T) {
+	c, err := splitClients([]string{`192.168.1.10`, `192.168.1.1/24`, `fd00::1`, `AA-BB-CC-DD-EE-FF`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(c.ip4, []string{`192.168.1.10`, `192.168.1.0/24`}) ||
+		!slices.Equal(c.ip6, []string{`fd00::1`}) ||
+		!slices.Equal(c.macs, []string{`aa:bb:cc:dd:ee:ff`}) {
+		t.Fatalf(`分类不正确：%+v`, c)
+	}
+
+	if err := (Clients{`unknown`: {`192.168.1.10`}}).Check(); err == nil {
+		t.Fatal(`应该报错：未知的策略`)
+	}
+	if err := (Clients{CLIENT_DIRECT: {`host`}}).Check(); err == nil {
+		t.Fatal(`应该报错：不正确的客户端`)
+	}
+}
+
+func TestNFTablesClients(t *testing.T) {
+	n := NFTables{Clients: Clients{CLIENT_DIRECT: {`aa:bb:cc:dd:ee:ff`}}}
+	ruleset := n.Ruleset()
+	for _, want := range []string{
+		"set gun_client_direct_mac {\n\t\ttype ether_addr\n\t\telements = { aa:bb:cc:dd:ee:ff }",
+		`ether saddr @gun_client_direct_mac return`,
+	} {
+		if !strings.Contains(ruleset, want) {
+			t.Fatalf("规则集中没有：%s\n%s", want, ruleset)
+		}
+	}
+}
@@ -14,6 +14,10 @@ const (
 	GUN_POSTROUTING = `GUN_POSTROUTING`
 	GUN_RULE        = `GUN_RULE`
 	GUN_QUIC        = `GUN_QUIC`
+
+	// nftables 中所有链都在同一张表，nat 的链需要换个名字。
+	GUN_NAT_PREROUTING = `GUN_NAT_PREROUTING`
+	GUN_NAT_OUTPUT     = `GUN_NAT_OUTPUT`
 )
 
 var (
@@ -0,0 +1,207 @@
+package tables
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/movsb/gun/pkg/shell"
+	"github.com/movsb/gun/pkg/utils"
+)
+
+// 停止时把DNS学习到的IP保存在配置目录下的这个文件中，启动时恢复。
+const LearnedFileName = `learned.ro.txt`
+
+// DNS进程运行时学习到的名单集元素。
+//
+// 与文件中的元素不同，它们都带有过期时间。
+type LearnedIP struct {
+	Set     string
+	IP      string
+	Expires time.Time
+}
+
+// 剩余的秒数，已过期时小于等于 0。
+func (l LearnedIP) timeout() int {
+	return int(time.Until(l.Expires).Seconds())
+}
+
+var learnedSetNames = []string{WHITE_SET_NAME_4, WHITE_SET_NAME_6, BLACK_SET_NAME_4, BLACK_SET_NAME_6}
+
+// 列出 ipset 名单集中学习到的IP。
+//
+// 名单集不存在时 found 为 false。
+func ListLearnedIPSet() (learned []LearnedIP, found bool) {
+	var b bytes.Buffer
+	shell.Run(`ipset save`, shell.WithStdout(&b), shell.WithIgnoreErrors())
+	return parseIPSetSave(b.String(), time.Now())
+}
+
+// 解析 `ipset save` 的输出：
+//
+//	create gun_white_4 hash:net family inet hashsize 1024 maxelem 65536 timeout 0
+//	add gun_white_4 1.0.1.0/24 timeout 0
+//	add gun_white_4 1.2.3.4 timeout 3542
+func parseIPSetSave(s string, now time.Time) (learned []LearnedIP, found bool) {
+	for line := range strings.SplitSeq(s, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !slices.Contains(learnedSetNames, fields[1]) {
+			continue
+		}
+		switch fields[0] {
+		case `create`:
+			found = true
+		case `add`:
+			if len(fields) < 5 || fields[3] != `timeout` {
+				continue
+			}
+			// timeout 0 表示不过期，是文件中的。
+			if seconds, _ := strconv.Atoi(fields[4]); seconds > 0 {
+				learned = append(learned, LearnedIP{
+					Set:     fields[1],
+					IP:      fields[2],
+					Expires: now.Add(time.Duration(seconds) * time.Second),
+				})
+			}
+		}
+	}
+	return
+}
+
+// 列出 nftables 命名集合中学习到的IP。
+//
+// 集合不存在时 found 为 false。
+func ListLearnedNFTSet() (learned []LearnedIP, found bool) {
+	now := time.Now()
+	for _, name := range learnedSetNames {
+		var b bytes.Buffer
+		var err error
+		func() {
+			defer utils.CatchAsError(&err)
+			shell.Run(`nft -j list set inet ${table} ${name}`,
+				shell.WithValues(`table`, NFT_TABLE, `name`, name),
+				shell.WithStdout(&b),
+			)
+		}()
+		if err != nil {
+			continue
+		}
+		l, err := parseNFTSetJSON(b.Bytes(), name, now)
+		if err != nil {
+			log.Println(`解析集合失败：`, name, err)
+			continue
+		}
+		learned = append(learned, l...)
+		found = true
+	}
+	return
+}
+
+// 解析 `nft -j list set` 的输出。
+//
+// 带过期时间的元素形如：{"elem": {"val": "1.2.3.4", "timeout": 3600, "expires": 3542}}，
+// 其它的（文件中的）元素是字符串或者 prefix 对象。
+func parseNFTSetJSON(data []byte, name string, now time.Time) ([]LearnedIP, error) {
+	var output struct {
+		Nftables []struct {
+			Set *struct {
+				Elem []json.RawMessage `json:"elem"`
+			} `json:"set"`
+		} `json:"nftables"`
+	}
+	if err := json.Unmarshal(data, &output); err != nil {
+		return nil, err
+	}
+
+	var learned []LearnedIP
+	for _, item := range output.Nftables {
+		if item.Set == nil {
+			continue
+		}
+		for _, raw := range item.Set.Elem {
+			var elem struct {
+				Elem *struct {
+					Val     any `json:"val"`
+					Expires int `json:"expires"`
+				} `json:"elem"`
+			}
+			if json.Unmarshal(raw, &elem) != nil || elem.Elem == nil {
+				continue
+			}
+			ip, ok := elem.Elem.Val.(string)
+			if !ok || elem.Elem.Expires <= 0 {
+				continue
+			}
+			learned = append(learned, LearnedIP{
+				Set:     name,
+				IP:      ip,
+				Expires: now.Add(time.Duration(elem.Elem.Expires) * time.Second),
+			})
+		}
+	}
+	return learned, nil
+}
+
+// 安全地保存：先写临时文件，再重命名。
+//
+// 每行一个：集合名 IP 过期时间。
+func SaveLearned(path string, learned []LearnedIP) error {
+	buf := bytes.NewBuffer(nil)
+	for _, l := range learned {
+		fmt.Fprintln(buf, l.Set, l.IP, l.Expires.Format(time.RFC3339))
+	}
+
+	return utils.WriteFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(buf.Bytes())
+		return err
+	})
+}
+
+// 读取上次保存的学习到的IP，已经过期的会被忽略。
+//
+// 文件不存在时返回空。
+func LoadLearned(path string) []LearnedIP {
+	fp, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		log.Panicf(`读取学习到的IP时出错：%v`, err)
+	}
+	defer fp.Close()
+
+	now := time.Now()
+	var learned []LearnedIP
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || !slices.Contains(learnedSetNames, fields[0]) {
+			continue
+		}
+		expires, err := time.Parse(time.RFC3339, fields[2])
+		if err != nil || !expires.After(now) {
+			continue
+		}
+		learned = append(learned, LearnedIP{Set: fields[0], IP: fields[1], Expires: expires})
+	}
+	return learned
+}
+
+// 按集合名过滤，并去掉已经过期的。
+func filterLearned(learned []LearnedIP, name string) []LearnedIP {
+	var filtered []LearnedIP
+	for _, l := range learned {
+		if l.Set == name && l.timeout() > 0 {
+			filtered = append(filtered, l)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,45 @@
+package tables
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseLearned(t *testing.T) {
+	now := time.Now()
+
+	learned, found := parseIPSetSave(`create gun_white_4 hash:net family inet hashsize 1024 maxelem 65536 timeout 0
+add gun_white_4 1.0.1.0/24 timeout 0
+add gun_white_4 1.2.3.4 timeout 3542
+create other hash:ip family inet hashsize 1024 maxelem 65536 timeout 0
+add other 5.6.7.8 timeout 100
+`, now)
+	if !found || len(learned) != 1 || learned[0].IP != `1.2.3.4` || !learned[0].Expires.Equal(now.Add(3542*time.Second)) {
+		t.Fatalf(`ipset 解析不正确：%v %v`, found, learned)
+	}
+
+	learned, err := parseNFTSetJSON([]byte(`{"nftables": [{"metainfo": {"json_schema_version": 1}}, {"set": {
+		"family": "inet", "name": "gun_black_4", "table": "gun", "type": "ipv4_addr",
+		"flags": ["interval", "timeout"],
+		"elem": [
+			{"prefix": {"addr": "8.8.8.0", "len": 24}},
+			"9.9.9.9",
+			{"elem": {"val": "1.2.3.4", "timeout": 3600, "expires": 3542}}
+		]
+	}}]}`), BLACK_SET_NAME_4, now)
+	if err != nil || len(learned) != 1 || learned[0].Set != BLACK_SET_NAME_4 || learned[0].IP != `1.2.3.4` {
+		t.Fatalf(`nft 解析不正确：%v %v`, err, learned)
+	}
+
+	path := filepath.Join(t.TempDir(), LearnedFileName)
+	if err := SaveLearned(path, []LearnedIP{
+		{Set: WHITE_SET_NAME_6, IP: `240e::1`, Expires: now.Add(time.Hour)},
+		{Set: WHITE_SET_NAME_4, IP: `1.1.1.1`, Expires: now.Add(-time.Hour)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if learned := LoadLearned(path); len(learned) != 1 || learned[0].IP != `240e::1` {
+		t.Fatalf(`过期的应该被忽略：%v`, learned)
+	}
+}
@@ -0,0 +1,263 @@
+package tables
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/movsb/gun/pkg/shell"
+	"github.com/movsb/gun/pkg/utils"
+)
+
+// 防火墙后端。
+type Backend string
+
+const (
+	// iptables/ip6tables + ipset。
+	BackendIPTables Backend = `iptables`
+	// nftables，整个规则集一次性原子应用。
+	BackendNFTables Backend = `nftables`
+)
+
+// nftables 下所有的链和集合都在这一张表里面，同时处理IPv4和IPv6。
+const NFT_TABLE = `gun`
+
+// nftables 规则集。
+//
+// 与 iptables 版本的 CreateChains/CreateIPSet/DropQUIC/ProxyDNS/TProxy 的逻辑一一对应，
+// 只是一次性生成整个规则集，然后用 `nft -f` 原子地应用。
+//
+// nftables 的 meta skgid 只认数字，所以这里需要的是用户组编号，而不是名字。
+type NFTables struct {
+	OutputsGroupID uint32
+	DNSGroupID     uint32
+	// 大于0时有效。
+	OriginalDNSServerGroupID uint32
+
+	White4, Black4 []string
+	White6, Black6 []string
+
+	// 上次停止时保存的DNS学习到的IP，按剩余的过期时间恢复。
+	Learned []LearnedIP
+
+	// 出口不支持UDP的时候，丢弃QUIC并放行mDNS、NTP。
+	DropQUIC bool
+
+	// 按策略分组的局域网客户端，见 ClientRules。
+	Clients Clients
+}
+
+// 应用规则集。
+//
+// 如果表已经存在，会被整体替换。
+func (n *NFTables) Apply() {
+	shell.Run(`nft -f -`, shell.WithStdin(strings.NewReader(n.Ruleset())))
+}
+
+// 删除整张表。
+//
+// 不存在不会报错。
+func DeleteNFTables() {
+	shell.Run(`nft delete table inet ${table}`,
+		shell.WithValues(`table`, NFT_TABLE),
+		shell.WithIgnoreErrors(`No such file or directory`),
+	)
+}
+
+// 生成 `nft -f` 可以读取的完整规则集。
+func (n *NFTables) Ruleset() string {
+	b := bytes.NewBuffer(nil)
+	p := func(format string, args ...any) {
+		fmt.Fprintf(b, format, args...)
+		b.WriteByte('\n')
+	}
+
+	// 先创建再删除，保证表不存在时也不会报错，整个文件在同一个事务中。
+	p(`add table inet %s`, NFT_TABLE)
+	p(`delete table inet %s`, NFT_TABLE)
+	p(``)
+	p(`table inet %s {`, NFT_TABLE)
+
+	// 黑白名单集。
+	// interval：支持CIDR；timeout：支持运行时（DNS）添加带过期时间的元素；
+	// auto-merge：文件中的网段可能会有重叠。
+	set := func(name string, typ string, elements []string) {
+		p(`	set %s {`, name)
+		p(`		type %s`, typ)
+		p(`		flags interval, timeout`)
+		p(`		auto-merge`)
+		elements = slices.Clip(elements)
+		for _, l := range filterLearned(n.Learned, name) {
+			elements = append(elements, fmt.Sprintf(`%s timeout %ds`, l.IP, l.timeout()))
+		}
+		if len(elements) > 0 {
+			p(`		elements = { %s }`, strings.Join(elements, `, `))
+		}
+		p(`	}`)
+	}
+	set(WHITE_SET_NAME_4, `ipv4_addr`, n.White4)
+	set(BLACK_SET_NAME_4, `ipv4_addr`, n.Black4)
+	set(WHITE_SET_NAME_6, `ipv6_addr`, n.White6)
+	set(BLACK_SET_NAME_6, `ipv6_addr`, n.Black6)
+
+	// 客户端名单集，没有运行时添加的元素。
+	n.Clients.each(func(name, _, typ string, elements []string) {
+		p(`	set %s {`, name)
+		p(`		type %s`, typ)
+		if typ != `ether_addr` {
+			p(`		flags interval`)
+			p(`		auto-merge`)
+		}
+		if len(elements) > 0 {
+			p(`		elements = { %s }`, strings.Join(elements, `, `))
+		}
+		p(`	}`)
+	})
+
+	// 放行流量：如果ip在白名单中且不在黑名单中。
+	// 否则打上标记，以便策略路由到本机。
+	whiteNotBlack := func() {
+		p(`		ip daddr @%s ip daddr != @%s return`, WHITE_SET_NAME_4, BLACK_SET_NAME_4)
+		p(`		ip6 daddr @%s ip6 daddr != @%s return`, WHITE_SET_NAME_6, BLACK_SET_NAME_6)
+	}
+
+	p(`	chain %s {`, GUN_RULE)
+	whiteNotBlack()
+	p(`		ct mark set %s`, TPROXY_MARK)
+	p(`	}`)
+
+	if n.DropQUIC {
+		p(`	chain %s {`, GUN_QUIC)
+		whiteNotBlack()
+		p(`		drop`)
+		p(`	}`)
+	}
+
+	// 与 AllowMDNS、AllowNTP 对应。
+	allowUDP := func() {
+		p(`		udp dport 5353 return`)
+		p(`		udp dport 123 return`)
+	}
+
+	const syn = `tcp flags & (fin|syn|rst|ack) == syn`
+
+	// mangle OUTPUT：接管本机传出的流量。
+	p(`	chain %s {`, GUN_OUTPUT)
+	p(`		type route hook output priority mangle; policy accept;`)
+	if n.DropQUIC {
+		p(`		udp dport 443 ct direction original fib daddr type != local meta skgid != %d jump %s`, n.OutputsGroupID, GUN_QUIC)
+		allowUDP()
+	}
+	// 放行发给本机进程的流量（以及回复流量）。
+	p(`		fib daddr type local return`)
+	p(`		ct direction reply return`)
+	// 放行本机代理进程传出的流量。
+	p(`		meta skgid %d return`, n.OutputsGroupID)
+	// 放行：除DNS进程外所有的DNS请求，交给后面的DNS重定向。
+	p(`		tcp dport 53 meta skgid != %d return`, n.DNSGroupID)
+	p(`		udp dport 53 meta skgid != %d return`, n.DNSGroupID)
+	p(`		%s jump %s`, syn, GUN_RULE)
+	p(`		meta l4proto udp ct state new,related jump %s`, GUN_RULE)
+	// 把 connmark 变成 skb mark，因为策略路由只看skb mark。
+	p(`		ct mark %s meta mark set %s`, TPROXY_MARK, TPROXY_MARK)
+	p(`	}`)
+
+	// mangle PREROUTING：接管内网主机传出的流量。
+	p(`	chain %s {`, GUN_PREROUTING)
+	p(`		type filter hook prerouting priority mangle; policy accept;`)
+	// 与 ClientRules 对应，先于其它规则匹配。
+	for _, policy := range clientPolicies {
+		for _, match := range []string{
+			fmt.Sprintf(`ip saddr @%s`, clientSetName(policy, `4`)),
+			fmt.Sprintf(`ip6 saddr @%s`, clientSetName(policy, `6`)),
+			fmt.Sprintf(`ether saddr @%s`, clientSetName(policy, `mac`)),
+		} {
+			switch policy {
+			case CLIENT_DIRECT:
+				p(`		%s return`, match)
+			case CLIENT_BLOCK:
+				p(`		%s fib daddr type != local drop`, match)
+			case CLIENT_PROXY:
+				p(`		%s %s tcp dport != 53 fib daddr type != local ct mark set %s`, match, syn, TPROXY_MARK)
+				p(`		%s udp dport != 53 ct state new,related fib daddr type != local ct mark set %s`, match, TPROXY_MARK)
+			}
+		}
+	}
+	if n.DropQUIC {
+		p(`		udp dport 443 ct direction original fib daddr type != local jump %s`, GUN_QUIC)
+		allowUDP()
+	}
+	p(`		fib daddr type local return`)
+	p(`		ct direction reply return`)
+	p(`		%s tcp dport != 53 fib saddr type != local jump %s`, syn, GUN_RULE)
+	p(`		udp dport != 53 ct state new,related fib saddr type != local jump %s`, GUN_RULE)
+	// 正式用 tproxy 接管。
+	for _, l4 := range []string{`tcp`, `udp`} {
+		p(`		meta nfproto ipv4 meta l4proto %s ct mark %s tproxy ip to %s:%d meta mark set %s accept`,
+			l4, TPROXY_MARK, TPROXY_SERVER_IP_4, TPROXY_SERVER_PORT, TPROXY_MARK)
+		p(`		meta nfproto ipv6 meta l4proto %s ct mark %s tproxy ip6 to [%s]:%d meta mark set %s accept`,
+			l4, TPROXY_MARK, TPROXY_SERVER_IP_6, TPROXY_SERVER_PORT, TPROXY_MARK)
+	}
+	p(`	}`)
+
+	// nat OUTPUT：本机其它进程发出的DNS请求转发到本DNS服务器。
+	p(`	chain %s {`, GUN_NAT_OUTPUT)
+	p(`		type nat hook output priority -100; policy accept;`)
+	if n.OriginalDNSServerGroupID > 0 {
+		p(`		meta skgid %d return`, n.OriginalDNSServerGroupID)
+	}
+	p(`		tcp dport 53 %s meta skgid != { %d, %d } redirect to :%d`, syn, n.OutputsGroupID, n.DNSGroupID, DNSPort)
+	p(`		udp dport 53 ct state new meta skgid != { %d, %d } redirect to :%d`, n.OutputsGroupID, n.DNSGroupID, DNSPort)
+	p(`	}`)
+
+	// nat PREROUTING：内网其它主机发来的DNS请求，转到DNS进程。
+	p(`	chain %s {`, GUN_NAT_PREROUTING)
+	p(`		type nat hook prerouting priority dstnat; policy accept;`)
+	p(`		tcp dport 53 %s fib saddr type != local redirect to :%d`, syn, DNSPort)
+	p(`		udp dport 53 ct state new fib saddr type != local redirect to :%d`, DNSPort)
+	p(`	}`)
+
+	// nat POSTROUTING：重定向到回环地址时，源地址也需要改为回环地址。
+	p(`	chain %s {`, GUN_POSTROUTING)
+	p(`		type nat hook postrouting priority srcnat; policy accept;`)
+	p(`		ip daddr %s ip saddr != %s snat ip to %s`, `127.0.0.1`, `127.0.0.1`, `127.0.0.1`)
+	p(`		ip6 daddr %s ip6 saddr != %s snat ip6 to %s`, `::1`, `::1`, `::1`)
+	p(`	}`)
+
+	p(`}`)
+
+	return b.String()
+}
+
+// 更新 nftables 的命名集合：old 中有而 new 中没有的删除，new 中新增的添加。
+// 其它元素（比如DNS进程运行时添加的IP）保持不变。
+//
+// 先在一个事务中添加，再删除，所以任何时刻都不会缺少应有的元素。
+// 因为 auto-merge 可能把相邻的网段合并，整体删除失败时逐个删除并忽略错误。
+func UpdateNFTSet(name string, old, new []string) {
+	removed, added := diffIPs(old, new)
+
+	element := func(op string, ips []string) string {
+		return fmt.Sprintf("%s element inet %s %s { %s }\n", op, NFT_TABLE, name, strings.Join(ips, `, `))
+	}
+
+	if len(added) > 0 {
+		shell.Run(`nft -f -`, shell.WithStdin(strings.NewReader(element(`add`, added))))
+	}
+	if len(removed) > 0 {
+		var err error
+		func() {
+			defer utils.CatchAsError(&err)
+			shell.Run(`nft -f -`, shell.WithStdin(strings.NewReader(element(`delete`, removed))))
+		}()
+		if err != nil {
+			for _, ip := range removed {
+				shell.Run(`nft -f -`,
+					shell.WithStdin(strings.NewReader(element(`delete`, []string{ip}))),
+					shell.WithIgnoreErrors(),
+				)
+			}
+		}
+	}
+}
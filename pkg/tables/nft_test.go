@@ -0,0 +1,59 @@
+package tables
+
+import (
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool(`update`, false, `更新 testdata 中的期望结果`)
+
+func testNFTables() *NFTables {
+	return &NFTables{
+		OutputsGroupID:           1001,
+		DNSGroupID:               1002,
+		OriginalDNSServerGroupID: 1003,
+		White4:                   []string{`1.0.1.0/24`, `1.0.2.0/23`},
+		Black4:                   []string{`8.8.8.8`},
+		White6:                   []string{`240e::/20`},
+		Black6:                   []string{`2001:4860:4860::8888`},
+		DropQUIC:                 true,
+		Clients: Clients{
+			CLIENT_DIRECT: {`192.168.1.10`, `aa:bb:cc:dd:ee:ff`},
+			CLIENT_PROXY:  {`192.168.1.0/28`, `fd00::/64`},
+		},
+	}
+}
+
+// 规则集的任何变化都应该是有意的：go test ./pkg/tables -run TestNFTablesRuleset -update
+func TestNFTablesRuleset(t *testing.T) {
+	ruleset := testNFTables().Ruleset()
+	path := filepath.Join(`testdata`, `ruleset.nft`)
+	if *update {
+		if err := os.WriteFile(path, []byte(ruleset), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ruleset != string(want) {
+		t.Fatalf("规则集与 %s 不一致：\n%s", path, ruleset)
+	}
+}
+
+// 用 nft 检查语法（不会应用），需要 nft 命令和 root 权限。
+func TestNFTablesRulesetCheck(t *testing.T) {
+	if _, err := exec.LookPath(`nft`); err != nil || os.Geteuid() != 0 {
+		t.Skip(`需要 nft 命令和 root 权限`)
+	}
+	cmd := exec.Command(`nft`, `-c`, `-f`, `-`)
+	cmd.Stdin = strings.NewReader(testNFTables().Ruleset())
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("nft 检查失败：%v\n%s", err, output)
+	}
+}
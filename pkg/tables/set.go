@@ -3,6 +3,8 @@ package tables
 import (
 	"bytes"
 	"fmt"
+	"net/netip"
+	"slices"
 	"strings"
 
 	"github.com/movsb/gun/pkg/shell"
@@ -20,11 +22,12 @@ const (
 // 创建黑白IP名单集。
 //
 // 应该包含文件中的和DNS服务器。
-func CreateIPSet(white4, black4, white6, black6 []string) {
-	_createIPSet(WHITE_SET_NAME_4, IPv4, white4)
-	_createIPSet(WHITE_SET_NAME_6, IPv6, white6)
-	_createIPSet(BLACK_SET_NAME_4, IPv4, black4)
-	_createIPSet(BLACK_SET_NAME_6, IPv6, black6)
+// learned 是上次停止时保存的DNS学习到的IP，按剩余的过期时间恢复。
+func CreateIPSet(white4, black4, white6, black6 []string, learned []LearnedIP) {
+	_createIPSet(WHITE_SET_NAME_4, IPv4, white4, learned)
+	_createIPSet(WHITE_SET_NAME_6, IPv6, white6, learned)
+	_createIPSet(BLACK_SET_NAME_4, IPv4, black4, learned)
+	_createIPSet(BLACK_SET_NAME_6, IPv6, black6, learned)
 }
 
 // 删除黑白IP名单集。
@@ -39,16 +42,109 @@ func DeleteIPSet() {
 	}
 }
 
-func _createIPSet(name string, family Family, ips []string) {
+// timeout 0：元素默认不过期（文件中的），但是允许DNS进程添加带过期时间的元素。
+func _createIPSet(name string, family Family, ips []string, learned []LearnedIP) {
 	values := shell.WithValues(
 		`name`, name,
 		`family`, utils.IIF(family == IPv4, `inet`, `inet6`),
 	)
-	shell.Run(`ipset create ${name} hash:net family ${family}`, values)
+	shell.Run(`ipset create ${name} hash:net family ${family} timeout 0`, values)
 
 	buf := bytes.NewBuffer(nil)
 	for _, ip := range ips {
 		fmt.Fprintln(buf, `add`, name, ip)
 	}
+	for _, l := range filterLearned(learned, name) {
+		fmt.Fprintln(buf, `add`, name, l.IP, `timeout`, l.timeout())
+	}
 	shell.Run(`ipset -! restore`, shell.WithStdin(buf))
 }
+
+// 更新名单集：old 中有而 new 中没有的删除，new 中新增的添加。
+// 其它元素（比如DNS进程运行时添加的IP）保持不变。
+//
+// 先在临时集中准备好完整的内容，再用 ipset swap 原子地替换，不会有中间状态。
+// 在读取和替换之间DNS进程新添加的IP可能会丢失，不过之后会被重新添加。
+// 已有元素的过期时间保持不变（有少许的误差）。
+func UpdateIPSet(name string, family Family, old, new []string) {
+	removed, added := diffIPs(old, new)
+	if len(removed) == 0 && len(added) == 0 {
+		return
+	}
+
+	var saved bytes.Buffer
+	shell.Run(`ipset save ${name}`, shell.WithValues(`name`, name), shell.WithStdout(&saved))
+
+	// IP -> 其它参数（比如 timeout 300）。
+	current := map[string]string{}
+	for line := range strings.SplitSeq(saved.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[0] == `add` {
+			current[normalizeIP(fields[2])] = strings.Join(fields[3:], ` `)
+		}
+	}
+	for _, ip := range removed {
+		delete(current, ip)
+	}
+	for _, ip := range added {
+		current[ip] = ``
+	}
+
+	tmp := name + `_tmp`
+	values := shell.WithValues(
+		`name`, name,
+		`tmp`, tmp,
+		`family`, utils.IIF(family == IPv4, `inet`, `inet6`),
+	)
+	shell.Run(`ipset -! create ${tmp} hash:net family ${family} timeout 0`, values)
+	shell.Run(`ipset flush ${tmp}`, values)
+
+	buf := bytes.NewBuffer(nil)
+	for ip, options := range current {
+		fmt.Fprintln(buf, `add`, tmp, ip, options)
+	}
+	shell.Run(`ipset -! restore`, shell.WithStdin(buf))
+	shell.Run(`ipset swap ${tmp} ${name}`, values)
+	shell.Run(`ipset destroy ${tmp}`, values)
+}
+
+// 比较两个IP/网段列表，返回需要删除的和需要添加的。
+//
+// 返回的都是规范化之后的形式。
+func diffIPs(old, new []string) (removed, added []string) {
+	oldSet := map[string]struct{}{}
+	for _, ip := range old {
+		oldSet[normalizeIP(ip)] = struct{}{}
+	}
+	newSet := map[string]struct{}{}
+	for _, ip := range new {
+		ip = normalizeIP(ip)
+		newSet[ip] = struct{}{}
+		if _, ok := oldSet[ip]; !ok {
+			added = append(added, ip)
+		}
+	}
+	for ip := range oldSet {
+		if _, ok := newSet[ip]; !ok {
+			removed = append(removed, ip)
+		}
+	}
+	slices.Sort(removed)
+	slices.Sort(added)
+	return
+}
+
+// 规范化成 ipset 列出元素时的形式：单个地址不带前缀长度，网段按掩码对齐。
+func normalizeIP(s string) string {
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		prefix = prefix.Masked()
+		if prefix.IsSingleIP() {
+			return prefix.Addr().String()
+		}
+		return prefix.String()
+	}
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr.String()
+	}
+	return s
+}
@@ -0,0 +1,19 @@
+package tables
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDiffIPs(t *testing.T) {
+	old := []string{`1.1.1.1`, `1.0.1.0/24`, `2.2.2.2/32`, `240e::/20`}
+	new := []string{`1.1.1.1/32`, `1.0.1.1/24`, `3.3.3.3`, `240e:0::/20`}
+
+	removed, added := diffIPs(old, new)
+	if want := []string{`2.2.2.2`}; !slices.Equal(removed, want) {
+		t.Fatalf(`删除的不正确：%v`, removed)
+	}
+	if want := []string{`3.3.3.3`}; !slices.Equal(added, want) {
+		t.Fatalf(`添加的不正确：%v`, added)
+	}
+}
@@ -0,0 +1,171 @@
+package tproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+const (
+	// 等待首包数据的时间，超时（比如服务器先说话的协议）则不再嗅探。
+	sniffTimeout = time.Millisecond * 100
+	// TLS 记录的最大长度（加上记录头）。
+	maxTLSRecord = 5 + 16384
+	// HTTP 请求头最多读取这么多。
+	maxHTTPHeader = 4096
+)
+
+// 嗅探连接的首包，取得 TLS ClientHello 中的 SNI 或者 HTTP 请求中的 Host。
+//
+// 读取到的数据会在返回的连接的 Read 中重新返回。没有嗅探到时域名为空。
+func sniff(conn net.Conn) (net.Conn, string) {
+	r := bufio.NewReaderSize(conn, maxTLSRecord)
+	sniffed := &sniffedConn{Conn: conn, r: r}
+
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	first, err := r.Peek(1)
+	if err != nil {
+		return sniffed, ``
+	}
+	switch {
+	case first[0] == 0x16:
+		header, err := r.Peek(5)
+		if err != nil {
+			return sniffed, ``
+		}
+		record, err := r.Peek(5 + min(int(binary.BigEndian.Uint16(header[3:5])), maxTLSRecord-5))
+		if err != nil {
+			return sniffed, ``
+		}
+		return sniffed, parseSNI(record)
+	case 'A' <= first[0] && first[0] <= 'Z':
+		var header []byte
+		for {
+			header, err = r.Peek(r.Buffered())
+			if err != nil || bytes.Contains(header, []byte("\r\n\r\n")) || len(header) >= maxHTTPHeader {
+				break
+			}
+			if _, err := r.Peek(r.Buffered() + 1); err != nil {
+				header, _ = r.Peek(r.Buffered())
+				break
+			}
+		}
+		return sniffed, parseHost(header)
+	}
+	return sniffed, ``
+}
+
+// 先返回嗅探时读取的数据。
+type sniffedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *sniffedConn) Read(p []byte) (int, error) {
+	if c.r.Buffered() > 0 {
+		return c.r.Read(p)
+	}
+	return c.Conn.Read(p)
+}
+
+// 读完缓存的数据后直接从原连接复制，以便 io.Copy 可以使用 splice。
+func (c *sniffedConn) WriteTo(w io.Writer) (int64, error) {
+	buffered, _ := c.r.Peek(c.r.Buffered())
+	n, err := w.Write(buffered)
+	c.r.Discard(n)
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := io.Copy(w, c.Conn)
+	return int64(n) + m, err
+}
+
+// 从完整的 TLS 握手记录中解析 ClientHello 的 server_name 扩展。
+//
+// [RFC 8446 - 4.1.2. Client Hello](https://www.rfc-editor.org/rfc/rfc8446#section-4.1.2)
+func parseSNI(record []byte) string {
+	// 记录头、握手类型（ClientHello）及长度、版本、随机数。
+	const fixed = 5 + 4 + 2 + 32
+	if len(record) < fixed || record[0] != 0x16 || record[5] != 0x01 {
+		return ``
+	}
+	b := record[fixed:]
+
+	// 会话编号、加密套件、压缩方法。
+	skip := func(lenSize int) bool {
+		if len(b) < lenSize {
+			return false
+		}
+		n := 0
+		for _, c := range b[:lenSize] {
+			n = n<<8 | int(c)
+		}
+		if len(b) < lenSize+n {
+			return false
+		}
+		b = b[lenSize+n:]
+		return true
+	}
+	if !skip(1) || !skip(2) || !skip(1) {
+		return ``
+	}
+
+	// 扩展列表。
+	if len(b) < 2 {
+		return ``
+	}
+	b = b[2:]
+	for len(b) >= 4 {
+		typ := binary.BigEndian.Uint16(b[0:2])
+		n := int(binary.BigEndian.Uint16(b[2:4]))
+		if len(b) < 4+n {
+			return ``
+		}
+		ext := b[4 : 4+n]
+		b = b[4+n:]
+		if typ != 0 {
+			continue
+		}
+		// server_name 列表：列表长度、名字类型（host_name）、名字长度、名字。
+		if len(ext) < 5 || ext[2] != 0 {
+			return ``
+		}
+		l := int(binary.BigEndian.Uint16(ext[3:5]))
+		if len(ext) < 5+l {
+			return ``
+		}
+		return string(ext[5 : 5+l])
+	}
+	return ``
+}
+
+// 从 HTTP 请求头中解析 Host（去掉端口）。
+func parseHost(header []byte) string {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(header)))
+	line, err := r.ReadLine()
+	if err != nil || !strings.HasSuffix(line, ` HTTP/1.1`) && !strings.HasSuffix(line, ` HTTP/1.0`) {
+		return ``
+	}
+	for {
+		line, err := r.ReadLine()
+		if err != nil || line == `` {
+			return ``
+		}
+		k, v, ok := strings.Cut(line, `:`)
+		if !ok || !strings.EqualFold(strings.TrimSpace(k), `Host`) {
+			continue
+		}
+		host := strings.TrimSpace(v)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return host
+	}
+}
@@ -0,0 +1,61 @@
+package tproxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSniff(t *testing.T) {
+	check := func(write func(c net.Conn), want string, wantData bool) {
+		t.Helper()
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+
+		written := make(chan []byte, 1)
+		go func() {
+			rec := &recordConn{Conn: client}
+			write(rec)
+			written <- rec.data
+		}()
+
+		conn, name := sniff(server)
+		if name != want {
+			t.Fatalf(`嗅探不正确：want %q, got %q`, want, name)
+		}
+		if !wantData {
+			return
+		}
+		// 嗅探时读取的数据需要重新返回。
+		data := <-written
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(conn, got); err != nil || string(got) != string(data) {
+			t.Fatalf(`数据不正确：%v`, err)
+		}
+	}
+
+	check(func(c net.Conn) {
+		tls.Client(c, &tls.Config{ServerName: `www.example.com`}).Handshake()
+	}, `www.example.com`, false)
+	check(func(c net.Conn) {
+		io.WriteString(c, "GET / HTTP/1.1\r\nUser-Agent: test\r\nhost: example.com:8080\r\n\r\n")
+	}, `example.com`, true)
+	check(func(c net.Conn) {
+		io.WriteString(c, "SSH-2.0-OpenSSH\r\n")
+	}, ``, true)
+	// 服务器先发送数据的协议。
+	check(func(c net.Conn) {}, ``, false)
+}
+
+// 记录写入的数据。
+type recordConn struct {
+	net.Conn
+	data []byte
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	c.data = append(c.data, p...)
+	return c.Conn.Write(p)
+}
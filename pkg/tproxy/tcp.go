@@ -1,10 +1,118 @@
 package tproxy
 
-import "net"
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// 连接的目的地址。
+type Destination struct {
+	// 本来要连接的远程地址（net.Conn.LocalAddr）。
+	Addr netip.AddrPort
+	// 嗅探到的或者通过虚假IP找回的域名，可能为空。
+	Domain string
+	// Addr 是虚假IP，只能按域名连接。
+	Fake bool
+}
+
+// 经由代理连接时使用的地址：有域名时为 域名:端口，由代理服务器解析；否则为 IP:端口。
+func (d Destination) String() string {
+	if d.Domain != `` {
+		return net.JoinHostPort(d.Domain, strconv.Itoa(int(d.Addr.Port())))
+	}
+	return d.Addr.String()
+}
+
+// 直接连接目的地址：总是使用原来的IP；虚假IP则使用向DNS进程查询到的域名的真实IP。
+func (d Destination) DialDirect() (net.Conn, error) {
+	if !d.Fake {
+		return net.Dial(`tcp`, d.Addr.String())
+	}
+	ips, err := fakeIP.resolve(d.Domain)
+	if err != nil {
+		return nil, fmt.Errorf(`查询真实IP失败：%s: %w`, d.Domain, err)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf(`域名没有真实IP：%s`, d.Domain)
+	}
+	var errs []error
+	for _, ip := range ips {
+		conn, err := net.Dial(`tcp`, netip.AddrPortFrom(ip, d.Addr.Port()).String())
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
 
-// net.Conn.LocalAddr 是本来要连接的远程地址。
-//
 // handler 是在独立的线程中被调用的。
-func ListenAndServeTCP(port uint16, handler func(conn net.Conn, remote string)) {
-	listenAndServeTCP(port, handler)
+//
+// 开启了嗅探（见 EnableSniffing）时，conn 会重新返回嗅探时读取的数据。
+func ListenAndServeTCP(port uint16, handler func(conn net.Conn, dst Destination)) {
+	listenAndServeTCP(port, func(conn net.Conn) {
+		dst := Destination{Addr: netip.MustParseAddrPort(conn.LocalAddr().String())}
+		dst.Addr = netip.AddrPortFrom(dst.Addr.Addr().Unmap(), dst.Addr.Port())
+
+		if fakeIP.lookup != nil && fakeIP.prefix.Contains(dst.Addr.Addr()) {
+			name, err := fakeIP.lookup(dst.Addr.Addr())
+			if err != nil {
+				log.Println(fmt.Errorf(`找回虚假IP的域名失败：%s: %w`, dst.Addr.Addr(), err))
+				conn.Close()
+				return
+			}
+			dst.Domain, dst.Fake = name, true
+		} else if sniffing {
+			var name string
+			conn, name = sniff(conn)
+			if _, err := netip.ParseAddr(name); err != nil && name != `` {
+				dst.Domain = name
+			}
+		}
+
+		if router != nil && router(conn, dst) {
+			return
+		}
+		handler(conn, dst)
+	})
+}
+
+var fakeIP struct {
+	prefix  netip.Prefix
+	lookup  func(ip netip.Addr) (string, error)
+	resolve func(name string) ([]netip.Addr, error)
+}
+
+// 设置DNS虚假IP模式的虚假IP段、找回域名的方法，以及查询域名真实IP的方法。
+//
+// 出口进程的DNS查询最终也会到达DNS进程，系统解析器得到的还是虚假IP，
+// 所以直连虚假IP对应的域名时，需要通过 resolve 查询真实IP。
+//
+// 需要在开始监听之前调用。
+func SetFakeIP(prefix netip.Prefix, lookup func(ip netip.Addr) (string, error), resolve func(name string) ([]netip.Addr, error)) {
+	fakeIP.prefix = prefix
+	fakeIP.lookup = lookup
+	fakeIP.resolve = resolve
+}
+
+var router func(conn net.Conn, dst Destination) bool
+
+// 设置路由：在交给出口之前先按规则处理连接，返回假表示交给出口处理。
+//
+// 需要在开始监听之前调用。
+func SetRouter(route func(conn net.Conn, dst Destination) bool) {
+	router = route
+}
+
+var sniffing bool
+
+// 开启嗅探：从 TLS ClientHello 的 SNI 或者 HTTP 请求的 Host 取得域名。
+//
+// 需要在开始监听之前调用。
+func EnableSniffing() {
+	sniffing = true
 }
@@ -4,20 +4,42 @@ package tproxy
 
 import (
 	"fmt"
+	"log"
 	"net"
 	"net/netip"
-	"syscall"
 
 	"github.com/movsb/gun/pkg/utils"
+	"golang.org/x/sys/unix"
 )
 
 // [kernel.org/doc/Documentation/networking/tproxy.txt](https://www.kernel.org/doc/Documentation/networking/tproxy.txt)
 // [KatelynHaworth/go-tproxy: Linux Transparent Proxy library for Golang](https://github.com/KatelynHaworth/go-tproxy)
 // [heiher/hev-socks5-tproxy: A lightweight, fast and reliable socks5 transparent proxy](https://github.com/heiher/hev-socks5-tproxy?tab=readme-ov-file#netfilter-and-routing)
 
-func listenTCPPort(port uint16) (net.Listener, error) {
-	addr := net.TCPAddrFromAddrPort(netip.MustParseAddrPort(fmt.Sprintf(`127.0.0.1:%d`, port)))
-	return listenTCPAddr(`tcp4`, addr)
+// 监听地址需要与 tables 中 TPROXY --on-ip 的地址一致。
+const (
+	listenIP4 = `127.0.0.1`
+	listenIP6 = `::1`
+)
+
+// 同时监听IPv4和IPv6。
+//
+// 如果系统没有开启IPv6（比如容器内），则只监听IPv4。
+func listenTCPPort(port uint16) ([]net.Listener, error) {
+	addr4 := net.TCPAddrFromAddrPort(netip.MustParseAddrPort(fmt.Sprintf(`%s:%d`, listenIP4, port)))
+	lis4, err := listenTCPAddr(`tcp4`, addr4)
+	if err != nil {
+		return nil, err
+	}
+
+	addr6 := net.TCPAddrFromAddrPort(netip.AddrPortFrom(netip.MustParseAddr(listenIP6), port))
+	lis6, err := listenTCPAddr(`tcp6`, addr6)
+	if err != nil {
+		log.Println(`tcp: 监听IPv6失败，只监听IPv4：`, err)
+		return []net.Listener{lis4}, nil
+	}
+
+	return []net.Listener{lis4, lis6}, nil
 }
 
 func listenTCPAddr(network string, local *net.TCPAddr) (net.Listener, error) {
@@ -27,23 +49,36 @@ func listenTCPAddr(network string, local *net.TCPAddr) (net.Listener, error) {
 	}
 	lfd, err := listener.File()
 	if err != nil {
+		listener.Close()
 		return nil, &net.OpError{Op: `listen`, Net: network, Source: nil, Addr: local, Err: err}
 	}
 	defer lfd.Close()
 
+	level, opt := unix.SOL_IP, unix.IP_TRANSPARENT
+	if network == `tcp6` {
+		level, opt = unix.SOL_IPV6, unix.IPV6_TRANSPARENT
+	}
+
 	// 虽然文档说的是要在bind之前设置，但是我在这里设置实际上也能成功。
-	if err := syscall.SetsockoptInt(int(lfd.Fd()), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
+	if err := unix.SetsockoptInt(int(lfd.Fd()), level, opt, 1); err != nil {
+		listener.Close()
 		return nil, &net.OpError{Op: `listen`, Net: network, Source: nil, Addr: local, Err: err}
 	}
 
 	return listener, nil
 }
 
-func listenAndServeTCP(port uint16, handler func(conn net.Conn, remote string)) {
-	lis := utils.Must1(listenTCPPort(port))
-	defer lis.Close()
-	for {
-		conn := utils.Must1(lis.Accept())
-		go handler(conn, conn.LocalAddr().String())
+func listenAndServeTCP(port uint16, handler func(conn net.Conn)) {
+	listeners := utils.Must1(listenTCPPort(port))
+	serve := func(lis net.Listener) {
+		defer lis.Close()
+		for {
+			conn := utils.Must1(lis.Accept())
+			go handler(conn)
+		}
+	}
+	for _, lis := range listeners[1:] {
+		go serve(lis)
 	}
+	serve(listeners[0])
 }
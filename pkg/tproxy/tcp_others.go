@@ -4,6 +4,6 @@ package tproxy
 
 import "net"
 
-func listenAndServeTCP(port uint16, handler func(conn net.Conn, remote string)) {
+func listenAndServeTCP(port uint16, handler func(conn net.Conn)) {
 	panic(`only for linux`)
 }
@@ -0,0 +1,182 @@
+package tproxy
+
+import (
+	"log"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 一个UDP会话的出口端。
+//
+// *net.UDPConn 天然实现了此接口，所以直连可以直接使用。
+type PacketConn interface {
+	// 读取一个回复包，以及回复包的来源地址（即要伪装的源地址）。
+	ReadFromUDPAddrPort(b []byte) (n int, addr netip.AddrPort, err error)
+	// 把包发往原始目的地址。
+	WriteToUDPAddrPort(b []byte, addr netip.AddrPort) (int, error)
+	Close() error
+}
+
+// 为来自 src 的UDP会话创建出口。
+//
+// 同一个源地址（内网主机的 ip:port）共用一个会话（即 Full Cone），
+// 发往不同目的地址的包都经由同一个出口发送。
+type DialUDP func(src netip.AddrPort) (PacketConn, error)
+
+// 会话多久没有收发数据就被认为是结束了。
+const udpSessionTimeout = time.Minute * 2
+
+// 每个会话最多缓存的待发送包数量，超过直接丢弃。
+const udpQueueSize = 64
+
+// 启动一个UDP透明代理。
+//
+// 回复包会以原始目的地址（或者真实的回复来源地址）作为源地址发回给内网主机。
+func ListenAndServeUDP(port uint16, dial DialUDP) {
+	listenAndServeUDP(port, dial)
+}
+
+type udpPacket struct {
+	data []byte
+	dst  netip.AddrPort
+}
+
+type udpSession struct {
+	src    netip.AddrPort
+	queue  chan udpPacket
+	active atomic.Int64
+}
+
+func (s *udpSession) touch() {
+	s.active.Store(time.Now().UnixNano())
+}
+
+func (s *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, s.active.Load()))
+}
+
+// 会话表，以源地址为键。
+type udpSessions struct {
+	lock     sync.Mutex
+	sessions map[netip.AddrPort]*udpSession
+
+	dial DialUDP
+	// 以指定的源地址发回复包。
+	reply func(from, to netip.AddrPort) (replier, error)
+	// 会话多久没有收发数据就被关闭。
+	timeout time.Duration
+}
+
+// 伪装了源地址的回复套接字。
+type replier interface {
+	Write(b []byte) (int, error)
+	Close() error
+}
+
+func newUDPSessions(dial DialUDP, reply func(from, to netip.AddrPort) (replier, error), timeout time.Duration) *udpSessions {
+	return &udpSessions{
+		sessions: map[netip.AddrPort]*udpSession{},
+		dial:     dial,
+		reply:    reply,
+		timeout:  timeout,
+	}
+}
+
+// 把包交给对应的会话，没有会话则创建。
+func (t *udpSessions) dispatch(src, dst netip.AddrPort, data []byte) {
+	t.lock.Lock()
+	s, ok := t.sessions[src]
+	if !ok {
+		s = &udpSession{
+			src:   src,
+			queue: make(chan udpPacket, udpQueueSize),
+		}
+		s.touch()
+		t.sessions[src] = s
+		go t.run(s)
+	}
+	t.lock.Unlock()
+
+	select {
+	case s.queue <- udpPacket{data: data, dst: dst}:
+	default:
+		// 出口太慢（或者还在握手），丢弃即可，UDP本来就不可靠。
+	}
+}
+
+func (t *udpSessions) remove(s *udpSession) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.sessions[s.src] == s {
+		delete(t.sessions, s.src)
+	}
+}
+
+func (t *udpSessions) run(s *udpSession) {
+	defer t.remove(s)
+
+	// 拨号可能很慢（比如TLS握手），所以不能在读循环里面做。
+	conn, err := t.dial(s.src)
+	if err != nil {
+		log.Println(`udp: 创建出口失败：`, s.src, err)
+		return
+	}
+	defer conn.Close()
+
+	go t.replyLoop(s, conn)
+
+	ticker := time.NewTicker(t.timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case p := <-s.queue:
+			if _, err := conn.WriteToUDPAddrPort(p.data, p.dst); err != nil {
+				log.Println(`udp: 发送失败：`, p.dst, err)
+				return
+			}
+			s.touch()
+		case <-ticker.C:
+			if s.idle() > t.timeout {
+				return
+			}
+		}
+	}
+}
+
+// 读出口的回复包，并以回复来源地址作为源地址发回给内网主机。
+//
+// 出口被关闭后退出。
+func (t *udpSessions) replyLoop(s *udpSession, conn PacketConn) {
+	repliers := map[netip.AddrPort]replier{}
+	defer func() {
+		for _, r := range repliers {
+			r.Close()
+		}
+	}()
+
+	buf := make([]byte, 64<<10)
+	for {
+		n, from, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		r, ok := repliers[from]
+		if !ok {
+			r, err = t.reply(from, s.src)
+			if err != nil {
+				log.Println(`udp: 创建回复套接字失败：`, from, err)
+				continue
+			}
+			repliers[from] = r
+		}
+		if _, err := r.Write(buf[:n]); err != nil {
+			log.Println(`udp: 回复失败：`, s.src, err)
+			continue
+		}
+		s.touch()
+	}
+}
@@ -0,0 +1,157 @@
+//go:build linux
+
+package tproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"syscall"
+
+	"github.com/movsb/gun/pkg/utils"
+	"golang.org/x/sys/unix"
+)
+
+// UDP 没有连接，拿不到 LocalAddr，原始目的地址需要通过 IP_RECVORIGDSTADDR 从控制消息中取得。
+// 回复的时候需要以原始目的地址作为源地址，所以需要用 IP_TRANSPARENT 绑定非本机地址。
+
+// 同时监听IPv4和IPv6，与TCP一样，没有IPv6的时候只监听IPv4。
+func listenUDPPort(port uint16) ([]*net.UDPConn, error) {
+	listen := func(network string, ip string) (*net.UDPConn, error) {
+		lc := net.ListenConfig{
+			Control: func(network, address string, c syscall.RawConn) error {
+				return controlTransparent(network, c, true)
+			},
+		}
+		addr := netip.AddrPortFrom(netip.MustParseAddr(ip), port)
+		conn, err := lc.ListenPacket(context.Background(), network, addr.String())
+		if err != nil {
+			return nil, err
+		}
+		return conn.(*net.UDPConn), nil
+	}
+
+	lis4, err := listen(`udp4`, listenIP4)
+	if err != nil {
+		return nil, err
+	}
+	lis6, err := listen(`udp6`, listenIP6)
+	if err != nil {
+		log.Println(`udp: 监听IPv6失败，只监听IPv4：`, err)
+		return []*net.UDPConn{lis4}, nil
+	}
+	return []*net.UDPConn{lis4, lis6}, nil
+}
+
+// 设置透明代理需要的套接字选项。
+//
+// recvOrigDst：是否需要接收原始目的地址。
+func controlTransparent(network string, c syscall.RawConn, recvOrigDst bool) error {
+	level, transparent, recv := unix.SOL_IP, unix.IP_TRANSPARENT, unix.IP_RECVORIGDSTADDR
+	if network == `udp6` {
+		level, transparent, recv = unix.SOL_IPV6, unix.IPV6_TRANSPARENT, unix.IPV6_RECVORIGDSTADDR
+	}
+
+	var err error
+	ctrlErr := c.Control(func(fd uintptr) {
+		if err = unix.SetsockoptInt(int(fd), level, transparent, 1); err != nil {
+			return
+		}
+		if err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+			return
+		}
+		if recvOrigDst {
+			err = unix.SetsockoptInt(int(fd), level, recv, 1)
+		}
+	})
+	if ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
+
+// 创建一个以 from 为源地址、发往 to 的回复套接字。
+func dialReplyUDP(from, to netip.AddrPort) (replier, error) {
+	network := utils.IIF(from.Addr().Is4(), `udp4`, `udp6`)
+	d := net.Dialer{
+		LocalAddr: net.UDPAddrFromAddrPort(from),
+		Control: func(network, address string, c syscall.RawConn) error {
+			return controlTransparent(network, c, false)
+		},
+	}
+	conn, err := d.Dial(network, to.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// 从控制消息中解析出原始目的地址。
+func parseOrigDst(oob []byte) (netip.AddrPort, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == unix.SOL_IP && msg.Header.Type == unix.IP_ORIGDSTADDR:
+			// struct sockaddr_in
+			if len(msg.Data) < unix.SizeofSockaddrInet4 {
+				continue
+			}
+			port := binary.BigEndian.Uint16(msg.Data[2:4])
+			addr := netip.AddrFrom4([4]byte(msg.Data[4:8]))
+			return netip.AddrPortFrom(addr, port), nil
+		case msg.Header.Level == unix.SOL_IPV6 && msg.Header.Type == unix.IPV6_ORIGDSTADDR:
+			// struct sockaddr_in6
+			if len(msg.Data) < unix.SizeofSockaddrInet6 {
+				continue
+			}
+			port := binary.BigEndian.Uint16(msg.Data[2:4])
+			addr := netip.AddrFrom16([16]byte(msg.Data[8:24]))
+			return netip.AddrPortFrom(addr.Unmap(), port), nil
+		}
+	}
+	return netip.AddrPort{}, fmt.Errorf(`没有找到原始目的地址`)
+}
+
+func listenAndServeUDP(port uint16, dial DialUDP) {
+	listeners := utils.Must1(listenUDPPort(port))
+
+	// 两个监听共用一个会话表：源地址本身就区分了协议族。
+	sessions := newUDPSessions(dial, dialReplyUDP, udpSessionTimeout)
+
+	serve := func(lis *net.UDPConn) {
+		defer lis.Close()
+
+		buf := make([]byte, 64<<10)
+		oob := make([]byte, 1024)
+
+		for {
+			n, oobn, _, src, err := lis.ReadMsgUDPAddrPort(buf, oob)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				log.Println(`udp: 读取失败：`, err)
+				continue
+			}
+			dst, err := parseOrigDst(oob[:oobn])
+			if err != nil {
+				log.Println(`udp:`, src, err)
+				continue
+			}
+			src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+			sessions.dispatch(src, dst, append([]byte(nil), buf[:n]...))
+		}
+	}
+
+	for _, lis := range listeners[1:] {
+		go serve(lis)
+	}
+	serve(listeners[0])
+}
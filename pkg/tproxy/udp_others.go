@@ -0,0 +1,7 @@
+//go:build !linux
+
+package tproxy
+
+func listenAndServeUDP(port uint16, dial DialUDP) {
+	panic(`only for linux`)
+}
@@ -0,0 +1,97 @@
+package tproxy
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 把写入的包原样作为回复返回的出口。
+type echoPacketConn struct {
+	replies chan netip.AddrPort
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (c *echoPacketConn) ReadFromUDPAddrPort(b []byte) (int, netip.AddrPort, error) {
+	select {
+	case from := <-c.replies:
+		return copy(b, `pong`), from, nil
+	case <-c.closed:
+		return 0, netip.AddrPort{}, net.ErrClosed
+	}
+}
+
+func (c *echoPacketConn) WriteToUDPAddrPort(b []byte, addr netip.AddrPort) (int, error) {
+	c.replies <- addr
+	return len(b), nil
+}
+
+func (c *echoPacketConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+type chanReplier struct {
+	from, to netip.AddrPort
+	ch       chan [2]netip.AddrPort
+}
+
+func (r *chanReplier) Write(b []byte) (int, error) {
+	r.ch <- [2]netip.AddrPort{r.from, r.to}
+	return len(b), nil
+}
+
+func (r *chanReplier) Close() error { return nil }
+
+func TestUDPSessions(t *testing.T) {
+	var dials atomic.Int32
+	replies := make(chan [2]netip.AddrPort, 10)
+
+	sessions := newUDPSessions(
+		func(src netip.AddrPort) (PacketConn, error) {
+			dials.Add(1)
+			return &echoPacketConn{
+				replies: make(chan netip.AddrPort, 10),
+				closed:  make(chan struct{}),
+			}, nil
+		},
+		func(from, to netip.AddrPort) (replier, error) {
+			return &chanReplier{from: from, to: to, ch: replies}, nil
+		},
+		time.Millisecond*200,
+	)
+
+	src := netip.MustParseAddrPort(`192.168.1.2:5000`)
+	dst1 := netip.MustParseAddrPort(`1.1.1.1:443`)
+	dst2 := netip.MustParseAddrPort(`8.8.8.8:443`)
+
+	sessions.dispatch(src, dst1, []byte(`ping`))
+	sessions.dispatch(src, dst2, []byte(`ping`))
+
+	for _, dst := range []netip.AddrPort{dst1, dst2} {
+		select {
+		case got := <-replies:
+			if got[0] != dst || got[1] != src {
+				t.Fatalf(`回复地址不正确：%v`, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatal(`没有收到回复`)
+		}
+	}
+
+	if n := dials.Load(); n != 1 {
+		t.Fatalf(`同一个源地址应该只拨号一次：%d`, n)
+	}
+
+	// 等待会话超时后，应该重新拨号。
+	time.Sleep(time.Millisecond * 500)
+	sessions.dispatch(src, dst1, []byte(`ping`))
+	<-replies
+	if n := dials.Load(); n != 2 {
+		t.Fatalf(`超时后应该重新拨号：%d`, n)
+	}
+}
@@ -57,6 +57,31 @@ func IIF[Any any](cond bool, first, second Any) Any {
 	return second
 }
 
+// 临时文件名的模式，意外情况下残留的临时文件可以据此清理。
+const TmpPattern = `.gun.*.tmp`
+
+// 安全地写文件：先由 write 写到临时文件，再重命名，以免写了一半的文件被读到。
+//
+// write 返回错误时不会修改目标文件。
+func WriteFileAtomic(path string, write func(w io.Writer) error) error {
+	// 直接在目标文件目录创建临时文件，以避免 os.Rename 的跨文件系统边界重命名文件时报错。
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), TmpPattern)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if err := write(tmpFile); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), path)
+}
+
 // 普通文件存在？
 func FileExists(path string) bool {
 	info, err := os.Stat(path)
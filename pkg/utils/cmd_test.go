@@ -6,6 +6,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"os"
 	"path/filepath"
 	"testing"
 	"time"
@@ -130,3 +131,28 @@ func waitUnixSocket(t *testing.T, socket string) {
 	}
 	t.Fatalf("timed out waiting for %s", socket)
 }
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, `file.txt`)
+
+	write := func(s string, err error) error {
+		return WriteFileAtomic(path, func(w io.Writer) error {
+			io.WriteString(w, s)
+			return err
+		})
+	}
+	if err := write(`one`, nil); err != nil {
+		t.Fatal(err)
+	}
+	// 写失败时不修改原来的文件。
+	if err := write(`two`, io.ErrUnexpectedEOF); err != io.ErrUnexpectedEOF {
+		t.Fatal(`应该返回写的错误：`, err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != `one` {
+		t.Fatalf(`文件内容不正确：%q`, data)
+	}
+	if paths, _ := filepath.Glob(filepath.Join(dir, TmpPattern)); len(paths) != 0 {
+		t.Fatal(`临时文件没有删除：`, paths)
+	}
+}
@@ -19,23 +19,23 @@ func Alpine(update bool) {
 		sh.Run(`apk add shadow`)
 	}
 
-	if !hasCommand(`sysctl`) {
+	if !HasCommand(`sysctl`) {
 		sh.Run(`apk add procps-ng`)
 	}
 
-	if !hasCommand(`setcap`) {
+	if !HasCommand(`setcap`) {
 		sh.Run(`apk add libcap-setcap`)
 	}
 
-	if !hasCommand(`ip`) {
+	if !HasCommand(`ip`) {
 		sh.Run(`apk add iproute2`)
 	}
 
-	if !hasCommand(`ipset`) {
+	if !HasCommand(`ipset`) {
 		sh.Run(`apk add ipset`)
 	}
 
-	if !hasCommand(`iptables`) {
+	if !HasCommand(`iptables`) {
 		sh.Run(`apk add iptables`)
 	}
 
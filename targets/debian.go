@@ -19,23 +19,23 @@ func Debian(update bool) {
 		sh.Run(`apt-get install -y passwd`)
 	}
 
-	if !hasCommand(`sysctl`) {
+	if !HasCommand(`sysctl`) {
 		sh.Run(`apt-get install -y procps`)
 	}
 
-	if !hasCommand(`setcap`) {
+	if !HasCommand(`setcap`) {
 		sh.Run(`apt-get install -y libcap2-bin`)
 	}
 
-	if !hasCommand(`ip`) {
+	if !HasCommand(`ip`) {
 		sh.Run(`apt-get install -y iproute2`)
 	}
 
-	if !hasCommand(`ipset`) {
+	if !HasCommand(`ipset`) {
 		sh.Run(`apt-get install -y ipset`)
 	}
 
-	if !hasCommand(`iptables`) {
+	if !HasCommand(`iptables`) {
 		sh.Run(`apt-get install -y iptables`)
 	}
 
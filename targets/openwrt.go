@@ -34,26 +34,33 @@ func run(install func(pkg string)) {
 		install(`shadow-groupadd`)
 	}
 
-	if !hasCommand(`sysctl`) {
+	if !HasCommand(`sysctl`) {
 		install(`procps-ng-sysctl`)
 	}
 
-	if !hasCommand(`setcap`) {
+	if !HasCommand(`setcap`) {
 		install(`libcap-bin`)
 	}
 
-	if !hasCommand(`ip`) {
+	if !HasCommand(`ip`) {
 		install(`ip-full`)
 	}
 
-	if !hasCommand(`ipset`) {
+	// fw4（22.03 及以后）是 nftables 原生的，默认使用 nftables 后端，
+	// 不再需要 iptables 和 ipset。
+	if HasCommand(`fw4`) {
+		install(`kmod-nft-tproxy`)
+		return
+	}
+
+	if !HasCommand(`ipset`) {
 		install(`ipset`)
 	}
 
-	if !hasCommand(`iptables`) {
+	if !HasCommand(`iptables`) {
 		install(`iptables-nft`)
 	}
-	if !hasCommand(`ip6tables`) {
+	if !HasCommand(`ip6tables`) {
 		install(`ip6tables-nft`)
 	}
 
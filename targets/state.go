@@ -14,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/movsb/gun/dns"
 	"github.com/movsb/gun/pkg/rules"
 	"github.com/movsb/gun/pkg/shell"
 	"github.com/movsb/gun/pkg/tables"
@@ -21,7 +22,11 @@ import (
 )
 
 type State struct {
+	// 防火墙后端。
+	Backend tables.Backend
+
 	// 具体的 iptables 命令名。
+	// 仅 iptables 后端有效。
 	// 因为可能是 legacy 版本的 iptables，被 ntf 取代后改名了。
 	Ip4tables string
 	Ip6tables string
@@ -37,8 +42,8 @@ type State struct {
 	// 大于0时有效，且此时使用127.0.0.1:53作为上游。
 	OriginalDNSServerGroupID uint32
 
-	ChinaDNS  string
-	BannedDNS string
+	ChinaDNS  []string
+	BannedDNS []string
 
 	chinaDomains   *rules.File
 	bannedDomains  *rules.File
@@ -46,9 +51,19 @@ type State struct {
 	bannedUserTxt  *rules.File
 	chinaRoutes    *rules.File
 	blockedDomains *rules.File
+	// gun update 下载的屏蔽列表（blocked.*.ro.txt）。
+	blockedLists []*rules.File
 
 	extraBannedIPs  *rules.File
 	extraIgnoredIPs *rules.File
+
+	// 通过 GeoIP/GeoSite 数据库添加的。
+	geoDirect *rules.File
+	geoProxy  *rules.File
+
+	// 路由规则中不直连的域名和IP，见 SetRuleTargets。
+	ruleTargets *rules.File
+	ruleDomains *rules.DomainSet
 }
 
 func (s *State) addIgnoredIPs(ips []string) {
@@ -72,22 +87,66 @@ func (s *State) addBannedIPs(ips []string) {
 	}
 }
 
-func (s *State) SetDNSUpstreams(china string, banned string) {
-	if china != `` {
+func (s *State) SetDNSUpstreams(china []string, banned []string) {
+	if len(china) > 0 {
 		s.ChinaDNS = china
 	} else if s.OriginalDNSServerGroupID > 0 {
-		s.ChinaDNS = `127.0.0.1`
+		s.ChinaDNS = []string{`127.0.0.1`}
 	} else {
-		s.ChinaDNS = `223.5.5.5`
+		s.ChinaDNS = []string{`223.5.5.5`}
+	}
+	// 上游（或者其引导IP）不经过代理。
+	for _, u := range s.ChinaDNS {
+		s.addIgnoredIPs(utils.Must1(dns.UpstreamIPs(u)))
 	}
-	s.addIgnoredIPs([]string{s.ChinaDNS})
 
-	if banned != `` {
+	if len(banned) > 0 {
 		s.BannedDNS = banned
 	} else {
-		s.BannedDNS = `8.8.8.8`
+		s.BannedDNS = []string{`8.8.8.8`}
+	}
+	// 上游（或者其引导IP）总是经过代理。
+	for _, u := range s.BannedDNS {
+		s.addBannedIPs(utils.Must1(dns.UpstreamIPs(u)))
+	}
+}
+
+// 虚假IP段整体经过代理（由出口找回域名），为空表示没有开启虚假IP模式。
+func (s *State) SetFakeIP(prefix string) {
+	if prefix != `` {
+		s.addBannedIPs([]string{prefix})
+	}
+}
+
+// 通过 GeoIP/GeoSite 数据库添加的直连和代理的IP、域名。
+func (s *State) SetGeo(direct, proxy *rules.File) {
+	s.geoDirect, s.geoProxy = direct, proxy
+}
+
+// 路由规则中不直连的域名和IP。
+//
+// 规则只作用于被接管的流量，所以这些域名被当作国外的（国内列表中被覆盖的规则被去掉，
+// 否则国内的优先），IP被添加到黑名单集，以便被接管后再交给规则。
+func (s *State) SetRuleTargets(f *rules.File) {
+	s.ruleTargets = f
+	s.ruleDomains = utils.Must1(rules.NewDomainSet(f.Domains))
+}
+
+// 国内的域名规则，去掉路由规则覆盖的（相同的或者更具体的）。
+func (s *State) chinaRules(f *rules.File) (lines []string) {
+	if f == nil {
+		return nil
+	}
+	for _, d := range f.Domains {
+		switch d.Type {
+		case rules.DomainSuffix, rules.DomainWildcard, rules.DomainFull:
+			if s.ruleDomains != nil && s.ruleDomains.Match(d.Value) > 0 {
+				continue
+			}
+		}
+		lines = append(lines, d.String())
 	}
-	s.addBannedIPs([]string{s.BannedDNS})
+	return
 }
 
 func (s *State) createTempFile(name string, write func(w io.Writer)) string {
@@ -97,61 +156,77 @@ func (s *State) createTempFile(name string, write func(w io.Writer)) string {
 	return tmp.Name()
 }
 
+// 国内的域名规则，包括被墙列表中的例外规则。
 func (s *State) ChinaDomainsFile() string {
 	return s.createTempFile(`china_domains.txt`, func(w io.Writer) {
-		if s.chinaDomains != nil {
-			for _, d := range s.chinaDomains.Domains {
-				utils.Must1(fmt.Fprintln(w, d))
-			}
+		for _, f := range []*rules.File{s.chinaDomains, s.ignoredUserTxt, s.geoDirect} {
+			writeLines(w, s.chinaRules(f))
 		}
-		if s.ignoredUserTxt != nil {
-			for _, d := range s.ignoredUserTxt.Domains {
-				utils.Must1(fmt.Fprintln(w, d))
+		for _, f := range []*rules.File{s.bannedDomains, s.bannedUserTxt, s.geoProxy} {
+			if f != nil {
+				writeLines(w, s.chinaRules(f.Exceptions))
 			}
 		}
 	})
 }
 
+// 国外的域名规则，包括国内列表中的例外规则。
 func (s *State) BannedDomainsFile() string {
 	return s.createTempFile(`banned_domains.txt`, func(w io.Writer) {
-		if s.bannedDomains != nil {
-			for _, d := range s.bannedDomains.Domains {
-				utils.Must1(fmt.Fprintln(w, d))
-			}
+		for _, f := range []*rules.File{s.bannedDomains, s.bannedUserTxt, s.geoProxy, s.ruleTargets} {
+			writeLines(w, f.DomainRules())
 		}
-		if s.bannedUserTxt != nil {
-			for _, d := range s.bannedUserTxt.Domains {
-				utils.Must1(fmt.Fprintln(w, d))
+		for _, f := range []*rules.File{s.chinaDomains, s.ignoredUserTxt, s.geoDirect} {
+			if f != nil {
+				writeLines(w, f.Exceptions.DomainRules())
 			}
 		}
 	})
 }
 
+func writeLines(w io.Writer, lines []string) {
+	for _, line := range lines {
+		utils.Must1(fmt.Fprintln(w, line))
+	}
+}
+
 func (s *State) White4() (ips []string) {
 	ips = append(ips, s.ignoredUserTxt.IPv4...)
 	ips = append(ips, s.chinaRoutes.IPv4...)
 	ips = append(ips, s.extraIgnoredIPs.IPv4...)
+	ips = append(ips, s.geoDirect.IPv4...)
 	return
 }
 func (s *State) White6() (ips []string) {
 	ips = append(ips, s.ignoredUserTxt.IPv6...)
 	ips = append(ips, s.chinaRoutes.IPv6...)
 	ips = append(ips, s.extraIgnoredIPs.IPv6...)
+	ips = append(ips, s.geoDirect.IPv6...)
 	return
 }
 func (s *State) Black4() (ips []string) {
 	ips = append(ips, s.bannedUserTxt.IPv4...)
 	ips = append(ips, s.extraBannedIPs.IPv4...)
+	ips = append(ips, s.geoProxy.IPv4...)
+	ips = append(ips, s.ruleTargets.IPv4...)
 	return
 }
 func (s *State) Black6() (ips []string) {
 	ips = append(ips, s.bannedUserTxt.IPv6...)
 	ips = append(ips, s.extraBannedIPs.IPv6...)
+	ips = append(ips, s.geoProxy.IPv6...)
+	ips = append(ips, s.ruleTargets.IPv6...)
 	return
 }
 func (s *State) BlockedDomainsFile() string {
 	return s.createTempFile(`blocked_domains.txt`, func(w io.Writer) {
-		utils.Must1(fmt.Fprintln(w, strings.Join(s.blockedDomains.Domains, "\n")))
+		// 例外规则以 @@ 开头，由DNS进程区分。
+		for _, f := range append([]*rules.File{s.blockedDomains}, s.blockedLists...) {
+			writeLines(w, f.DomainRules())
+			for _, line := range f.Exceptions.DomainRules() {
+				utils.Must1(fmt.Fprintln(w, `@@`+line))
+			}
+		}
 	})
 }
 func (s *State) ChinaRoutesFile() string {
@@ -163,13 +238,22 @@ func (s *State) ChinaRoutesFile() string {
 	})
 }
 
-func CheckCommands() {
+func CheckCommands(backend tables.Backend) {
+	for _, name := range []string{`sysctl`, `ip`} {
+		cmdMustExist(name)
+	}
+	cmdMustExist(`setcap`)
+
+	if backend == tables.BackendNFTables {
+		cmdMustExist(`nft`)
+		return
+	}
+
 	ip4 := findIPTables(true)
 	ip6 := findIPTables(false)
 
-	for _, name := range []string{`sysctl`, `ip`, `ipset`} {
-		cmdMustExist(name)
-	}
+	cmdMustExist(`ipset`)
+
 	for _, mod := range []string{`conntrack`, `addrtype`} {
 		if !hasIPTablesModule(ip4, mod) {
 			log.Panicf(`没有找到 iptables 模块：%s。`, mod)
@@ -186,28 +270,50 @@ func CheckCommands() {
 			log.Panicf(`没有找到 iptables 表：%s。`, table)
 		}
 	}
+}
 
-	cmdMustExist(`setcap`)
+// 确定使用哪个防火墙后端。
+//
+// 如果配置文件没有指定，则自动推断：
+//
+//   - 使用 fw4 的 OpenWRT（22.03 及以后）是 nftables 原生的；
+//   - 缺少 iptables 或 ipset 但有 nft 的系统（比如新版本的 Debian）。
+//
+// 其它情况仍然使用 iptables。
+func ResolveBackend(configured string) tables.Backend {
+	switch tables.Backend(configured) {
+	case tables.BackendIPTables, tables.BackendNFTables:
+		return tables.Backend(configured)
+	case ``:
+	default:
+		log.Panicf(`未知的防火墙后端：%s`, configured)
+	}
+
+	if !HasCommand(`nft`) {
+		return tables.BackendIPTables
+	}
+	if HasCommand(`fw4`) {
+		return tables.BackendNFTables
+	}
+	if !HasCommand(`iptables`) || !HasCommand(`ip6tables`) || !HasCommand(`ipset`) {
+		return tables.BackendNFTables
+	}
+	return tables.BackendIPTables
 }
 
-func LoadStates(configDir string) *State {
+func LoadStates(configDir string, backend tables.Backend) *State {
 	state := State{
-		Ip4tables: findIPTables(true),
-		Ip6tables: findIPTables(false),
+		Backend: backend,
+	}
+	state.loadRules(configDir)
 
-		chinaDomains:   rules.Parse(filepath.Join(configDir, rules.ChinaDomainsName)),
-		bannedDomains:  rules.Parse(filepath.Join(configDir, rules.GfwDomainsName)),
-		chinaRoutes:    rules.Parse(filepath.Join(configDir, rules.ChinaRoutesName)),
-		bannedUserTxt:  rules.Parse(filepath.Join(configDir, rules.BannedUserTxt)),
-		ignoredUserTxt: rules.Parse(filepath.Join(configDir, rules.IgnoredUserTxt)),
-		blockedDomains: rules.Parse(filepath.Join(configDir, rules.BlockedUserTxt)),
+	CheckCommands(backend)
 
-		extraBannedIPs:  &rules.File{},
-		extraIgnoredIPs: &rules.File{},
+	if backend == tables.BackendIPTables {
+		state.Ip4tables = findIPTables(true)
+		state.Ip6tables = findIPTables(false)
 	}
 
-	CheckCommands()
-
 	createGroups(tables.OutputsGroupName, tables.DNSGroupName)
 	state.OutputsGroupID = GetGroupID(tables.OutputsGroupName)
 	state.DNSGroupID = GetGroupID(tables.DNSGroupName)
@@ -221,6 +327,36 @@ func LoadStates(configDir string) *State {
 	return &state
 }
 
+// 读取配置目录下的规则文件。
+func (s *State) loadRules(configDir string) {
+	s.chinaDomains = rules.Parse(filepath.Join(configDir, rules.ChinaDomainsName))
+	s.bannedDomains = rules.Parse(filepath.Join(configDir, rules.GfwDomainsName))
+	s.chinaRoutes = rules.Parse(filepath.Join(configDir, rules.ChinaRoutesName))
+	s.bannedUserTxt = rules.Parse(filepath.Join(configDir, rules.BannedUserTxt))
+	s.ignoredUserTxt = rules.Parse(filepath.Join(configDir, rules.IgnoredUserTxt))
+	s.blockedDomains = rules.Parse(filepath.Join(configDir, rules.BlockedUserTxt))
+	s.blockedLists = nil
+	for _, path := range utils.Must1(filepath.Glob(filepath.Join(configDir, rules.BlockedListPattern))) {
+		s.blockedLists = append(s.blockedLists, rules.Parse(path))
+	}
+
+	s.extraBannedIPs = &rules.File{}
+	s.extraIgnoredIPs = &rules.File{}
+	s.geoDirect = &rules.File{}
+	s.geoProxy = &rules.File{}
+	s.ruleTargets = &rules.File{}
+	s.ruleDomains = nil
+}
+
+// 重新读取规则文件，返回新的状态。
+//
+// 命令、用户组等其它状态保持不变；DNS上游、GeoIP/GeoSite、路由规则需要重新设置。
+func (s *State) ReloadRules(configDir string) *State {
+	state := *s
+	state.loadRules(configDir)
+	return &state
+}
+
 // 自动添加用户组。
 //
 // groupadd 是 posix 标准命令；addgroup 是高层脚本封装。
@@ -265,7 +401,12 @@ func GetUserID(name string) (uint32, error) {
 }
 
 // 返回 iptables, ip6tables 的真正命令名。
+//
+// 如果不存在，返回空字符串。
 func FindIPTablesCommands() (string, string) {
+	if !HasCommand(`iptables`) || !HasCommand(`ip6tables`) {
+		return ``, ``
+	}
 	return findIPTables(true), findIPTables(false)
 }
 
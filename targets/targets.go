@@ -2,11 +2,12 @@ package targets
 
 import "os/exec"
 
-func hasCommand(cmd string) bool {
+// 命令是否存在。
+func HasCommand(cmd string) bool {
 	_, err := exec.LookPath(cmd)
 	return err == nil
 }
 
 func hasGroupAdd() bool {
-	return hasCommand(`groupadd`) || hasCommand(`addgroup`)
+	return HasCommand(`groupadd`) || HasCommand(`addgroup`)
 }